@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/0ranki/enervent-ctrl/client"
+)
+
+// Number of entries in the alarm log of the unit
+const alarmEntries = 20
+
+// Entry of the alarm log of the unit
+type alarmEntry struct {
+	Entry int        `json:"entry"` // 1 is the newest
+	Type  int        `json:"type"`
+	Name  string     `json:"name"`
+	State string     `json:"state"` // active, acknowledged or off
+	Time  *time.Time `json:"time"`  // In the time zone of the unit
+}
+
+// Alarms of the unit
+type alarmStatus struct {
+	ActiveA bool         `json:"active_a"` // Class A alarm active, the unit is stopped
+	ActiveB bool         `json:"active_b"`
+	Log     []alarmEntry `json:"log"`
+}
+
+// Names of the alarm states in the low byte of HREG_ALARMn_STATECLASS
+var alarmStates = []string{"off", "acknowledged", "active"}
+
+// Read the alarm coils and the alarm log entries in use
+func readAlarms(coils []client.Coil, registers []client.Register) (*alarmStatus, error) {
+	alarms := &alarmStatus{Log: []alarmEntry{}}
+	if coil, _ := findSymbol(coils, nil, "COIL_ALARM_A"); coil != nil {
+		alarms.ActiveA = coil.Value
+	}
+	if coil, _ := findSymbol(coils, nil, "COIL_ALARM_B"); coil != nil {
+		alarms.ActiveB = coil.Value
+	}
+	for n := 1; n <= alarmEntries; n++ {
+		regs := []*client.Register{}
+		for _, field := range []string{"ALMTYPE", "STATECLASS", "YY", "MM", "DD", "HH", "MI"} {
+			reg, err := findRegister(registers, fmt.Sprintf("HREG_ALARM%d_%s", n, field))
+			if err != nil {
+				return nil, fmt.Errorf("alarm log: %w", err)
+			}
+			regs = append(regs, reg)
+		}
+		if regs[0].Value == 0 {
+			continue
+		}
+		entry := alarmEntry{Entry: n, Type: regs[0].Value, Name: regs[0].Enum[regs[0].Value], State: strconv.Itoa(regs[1].Value & 0xff)}
+		if len(entry.Name) == 0 {
+			entry.Name = "Alarm " + strconv.Itoa(entry.Type)
+		}
+		if state := regs[1].Value & 0xff; state < len(alarmStates) {
+			entry.State = alarmStates[state]
+		}
+		if year := regs[2].Value; regs[3].Value >= 1 && regs[3].Value <= 12 {
+			if year < 100 {
+				year += 2000
+			}
+			t := time.Date(year, time.Month(regs[3].Value), regs[4].Value, regs[5].Value, regs[6].Value, 0, 0, time.Local)
+			entry.Time = &t
+		}
+		alarms.Log = append(alarms.Log, entry)
+	}
+	return alarms, nil
+}
+
+// true if an alarm is active
+func (a *alarmStatus) active() bool {
+	if a.ActiveA || a.ActiveB {
+		return true
+	}
+	for _, entry := range a.Log {
+		if entry.State == "active" {
+			return true
+		}
+	}
+	return false
+}
+
+// Print the alarm log. Exits with exitAlarm if an alarm is active
+func alarmsCommand(ctx context.Context, args []string) error {
+	flags, opts := cliFlagSet("alarms", "alarms [-json] [-active]")
+	activeonly := flags.Bool("active", false, "List only the active alarms")
+	parseCLIFlags(flags, args, 0, 0)
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	coils, err := b.Coils(ctx)
+	if err != nil {
+		return err
+	}
+	registers, err := b.Registers(ctx)
+	if err != nil {
+		return err
+	}
+	alarms, err := readAlarms(coils, registers)
+	if err != nil {
+		return err
+	}
+	if *activeonly {
+		entries := []alarmEntry{}
+		for _, entry := range alarms.Log {
+			if entry.State == "active" {
+				entries = append(entries, entry)
+			}
+		}
+		alarms.Log = entries
+	}
+	if opts.json {
+		err = printJSON(alarms)
+	} else {
+		if alarms.ActiveA {
+			fmt.Println("Class A alarm active")
+		}
+		if alarms.ActiveB {
+			fmt.Println("Class B alarm active")
+		}
+		tw := newTable()
+		fmt.Fprintln(tw, "ENTRY\tTIME\tALARM\tSTATE")
+		for _, entry := range alarms.Log {
+			t := "-"
+			if entry.Time != nil {
+				t = entry.Time.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", entry.Entry, t, entry.Name, entry.State)
+		}
+		err = tw.Flush()
+	}
+	if err == nil && alarms.active() {
+		return errAlarmActive
+	}
+	return err
+}
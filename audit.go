@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit log outcomes
+const (
+	auditOK        = "ok"
+	auditFailed    = "failed"    // Write failed or the read back value didn't match
+	auditRefused   = "refused"   // Read only mode
+	auditInvalid   = "invalid"   // Validation failed, nothing was written
+	auditForbidden = "forbidden" // Not allowed for the role of the user
+)
+
+// Entry in the audit log
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"` // Username, token:NAME, rule:NAME or system
+	Remote    string    `json:"remote,omitempty"`
+	Device    string    `json:"device,omitempty"` // Empty for the default device at /api/v1/
+	Action    string    `json:"action"`           // coil, register, temperature, batch, mode, override, fan, value, restore, baseline, revert, request
+	Target    string    `json:"target"`           // Coil/register symbol, mode or URL path
+	Old       any       `json:"old"`
+	Requested any       `json:"requested"`
+	Value     any       `json:"value"` // Value read back after the write
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	auditfile string
+	auditlock = &sync.Mutex{}
+)
+
+// Set the outcome and error of e from err
+func (e *auditEntry) setResult(err error) {
+	if err != nil {
+		e.Outcome = auditFailed
+		e.Error = err.Error()
+	} else if len(e.Outcome) == 0 {
+		e.Outcome = auditOK
+	}
+}
+
+// Write an audit log entry for a request, the user and remote
+// address are taken from r
+func auditRequest(r *http.Request, entry auditEntry) {
+	entry.User = "-"
+	if user := requestUser(r); user != nil {
+		entry.User = user.Username
+	}
+	entry.Remote = r.RemoteAddr
+	if len(entry.Device) == 0 {
+		entry.Device = requestDeviceId(r)
+	}
+	audit(entry)
+}
+
+// Append an entry to the audit log, rotating the log first if needed
+func audit(entry auditEntry) {
+	if len(auditfile) == 0 {
+		return
+	}
+	entry.Time = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("ERROR: audit:", err)
+		return
+	}
+	auditlock.Lock()
+	defer auditlock.Unlock()
+	if info, err := os.Stat(auditfile); err == nil && info.Size()+int64(len(data)) > int64(config.AuditMaxSize)*1024*1024 {
+		rotateAuditLog()
+	}
+	f, err := os.OpenFile(auditfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Println("ERROR: audit:", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Println("ERROR: audit:", err)
+	}
+}
+
+// Rename audit.log to audit.log.1, audit.log.1 to audit.log.2 and so on,
+// dropping the oldest. auditlock must be held by the caller
+func rotateAuditLog() {
+	for i := config.AuditKeep - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", auditfile, i), fmt.Sprintf("%s.%d", auditfile, i+1))
+	}
+	if config.AuditKeep > 0 {
+		_ = os.Rename(auditfile, auditfile+".1")
+	} else {
+		_ = os.Remove(auditfile)
+	}
+}
+
+// Filters for audit log queries, empty values match everything
+type auditFilter struct {
+	User    string
+	Action  string
+	Target  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (f auditFilter) match(e auditEntry) bool {
+	return (len(f.User) == 0 || e.User == f.User) &&
+		(len(f.Action) == 0 || e.Action == f.Action) &&
+		(len(f.Target) == 0 || strings.EqualFold(e.Target, f.Target)) &&
+		(len(f.Outcome) == 0 || e.Outcome == f.Outcome) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Read matching entries from the audit log and rotated logs, newest first
+func queryAudit(f auditFilter) ([]auditEntry, error) {
+	auditlock.Lock()
+	defer auditlock.Unlock()
+	entries := []auditEntry{}
+	files := []string{auditfile}
+	for i := 1; i <= config.AuditKeep; i++ {
+		files = append(files, fmt.Sprintf("%s.%d", auditfile, i))
+	}
+	for _, name := range files {
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		matched := []auditEntry{}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			e := auditEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			if f.match(e) {
+				matched = append(matched, e)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		slices.Reverse(matched)
+		entries = append(entries, matched...)
+		if len(entries) >= f.Limit {
+			return entries[:f.Limit], nil
+		}
+	}
+	return entries, nil
+}
+
+// /api/v1/audit endpoint, admin only. Query parameters user, action,
+// target, outcome, since and until (RFC 3339) and limit (default 100)
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if user := requestUser(r); user != nil && user.Role != roleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	f := auditFilter{
+		User:    query.Get("user"),
+		Action:  query.Get("action"),
+		Target:  query.Get("target"),
+		Outcome: query.Get("outcome"),
+		Limit:   100,
+	}
+	var err error
+	if s := query.Get("since"); len(s) > 0 {
+		if f.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("until"); len(s) > 0 {
+		if f.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("limit"); len(s) > 0 {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := queryAudit(f)
+	if err != nil {
+		log.Println("ERROR: audit:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditRotateAndQuery(t *testing.T) {
+	config = Conf{AuditMaxSize: 1, AuditKeep: 2}
+	auditfile = filepath.Join(t.TempDir(), "audit.log")
+	defer func() { auditfile = "" }()
+	// Fill the log past the size limit
+	padding := make([]byte, 200*1024)
+	for i := range padding {
+		padding[i] = 'x'
+	}
+	for i := 0; i < 12; i++ {
+		audit(auditEntry{User: "alice", Action: "coil", Target: fmt.Sprintf("COIL_%d", i), Outcome: auditOK, Error: string(padding)})
+	}
+	audit(auditEntry{User: "bob", Action: "mode", Target: "mode", Requested: "away", Outcome: auditRefused})
+	if _, err := os.Stat(auditfile + ".1"); err != nil {
+		t.Errorf("log not rotated: %s", err)
+	}
+	if _, err := os.Stat(auditfile + ".3"); !os.IsNotExist(err) {
+		t.Error("more than audit_keep rotated logs")
+	}
+	entries, err := queryAudit(auditFilter{User: "bob", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Outcome != auditRefused {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	entries, _ = queryAudit(auditFilter{Action: "coil", Limit: 3})
+	if len(entries) != 3 || entries[0].Target != "COIL_11" {
+		t.Errorf("expecting newest 3 coil entries, got %d, first %s", len(entries), entries[0].Target)
+	}
+}
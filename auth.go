@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// User roles, in order of increasing privileges
+const (
+	roleViewer   = "viewer"   // Read only access
+	roleOperator = "operator" // Operating modes, setpoint and fan speeds
+	roleAdmin    = "admin"    // Raw coil and register writes
+)
+
+var roles = []string{roleViewer, roleOperator, roleAdmin}
+
+// How long a verified username & password is remembered,
+// so that bcrypt isn't run on every request
+const authCacheTTL = 5 * time.Minute
+
+// User in the configuration file
+type userConf struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"` // bcrypt hash, see `enervent-ctrl user hash`
+	Role         string `yaml:"role"`
+}
+
+type authCacheEntry struct {
+	user    *userConf
+	expires time.Time
+}
+
+type ctxKey int
+
+const userCtxKey ctxKey = 0
+
+var (
+	users     []userConf
+	authcache = map[[32]byte]authCacheEntry{}
+	authlock  = &sync.Mutex{}
+	// Compared against when the username is unknown,
+	// so that the response time doesn't reveal valid usernames
+	dummyhash, _ = bcrypt.GenerateFromPassword([]byte("enervent-ctrl"), bcrypt.DefaultCost)
+)
+
+// Set up the users from the configuration. If no users are configured,
+// the username and password options are used as an admin user
+func initUsers() error {
+	users = nil
+	names := map[string]bool{}
+	for _, user := range config.Users {
+		if len(user.Username) == 0 {
+			return fmt.Errorf("user with empty username")
+		}
+		if names[user.Username] {
+			return fmt.Errorf("duplicate user %s", user.Username)
+		}
+		names[user.Username] = true
+		if !slices.Contains(roles, user.Role) {
+			return fmt.Errorf("user %s: invalid role %q, expecting one of %s", user.Username, user.Role, strings.Join(roles, " "))
+		}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return fmt.Errorf("user %s: invalid password hash: %s", user.Username, err)
+		}
+		users = append(users, user)
+	}
+	for _, cu := range config.CertUsers {
+		if !slices.Contains(roles, cu.Role) {
+			return fmt.Errorf("certificate user %s: invalid role %q, expecting one of %s", cu.CommonName, cu.Role, strings.Join(roles, " "))
+		}
+	}
+	if !slices.Contains([]string{"", "request", "require"}, config.ClientAuth) {
+		return fmt.Errorf("invalid client_auth %q, expecting request or require", config.ClientAuth)
+	}
+	if len(users) == 0 && !config.DisableAuth {
+		hash, err := bcrypt.GenerateFromPassword([]byte(config.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		users = append(users, userConf{Username: config.Username, PasswordHash: string(hash), Role: roleAdmin})
+		log.Println("No users configured, using username", config.Username, "as admin")
+	}
+	authlock.Lock()
+	authcache = map[[32]byte]authCacheEntry{}
+	authlock.Unlock()
+	return nil
+}
+
+// Check the username and password, returns nil if they don't match
+func authenticate(username, password string) *userConf {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	authlock.Lock()
+	entry, ok := authcache[key]
+	authlock.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.user
+	}
+	var user *userConf
+	for i := range users {
+		if users[i].Username == username {
+			user = &users[i]
+		}
+	}
+	if user == nil {
+		_ = bcrypt.CompareHashAndPassword(dummyhash, []byte(password))
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil
+	}
+	authlock.Lock()
+	defer authlock.Unlock()
+	for k, e := range authcache {
+		if time.Now().After(e.expires) {
+			delete(authcache, k)
+		}
+	}
+	authcache[key] = authCacheEntry{user, time.Now().Add(authCacheTTL)}
+	return user
+}
+
+// true if role has at least the privileges of required
+func hasRole(role, required string) bool {
+	return slices.Index(roles, role) >= slices.Index(roles, required)
+}
+
+// Role required for a request. GET requests only need the viewer role,
+// other methods require writerole
+func requiredRole(r *http.Request, writerole string) string {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return roleViewer
+	}
+	return writerole
+}
+
+// Authenticated user of the request, nil if authentication is disabled
+func requestUser(r *http.Request) *userConf {
+	user, _ := r.Context().Value(userCtxKey).(*userConf)
+	return user
+}
+
+// Client certificate, HTTP Basic Authentication and API token middleware for http.HandlerFunc
+// This is used for the API. Requests other than GET require writerole
+func authHandlerFunc(writerole string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.DisableAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user := certUser(r)
+		username, pass, ok := r.BasicAuth()
+		if user != nil {
+			username = user.Username
+		} else if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			username = "bearer token"
+			user = authenticateToken(bearer)
+		} else if ok {
+			user = authenticate(username, pass)
+		}
+		if user != nil {
+			if !hasRole(user.Role, requiredRole(r, writerole)) {
+				log.Println("Forbidden: IP:", r.RemoteAddr, "URI:", r.RequestURI, "username:", username, "role:", user.Role)
+				audit(auditEntry{User: user.Username, Remote: r.RemoteAddr, Action: "request", Target: r.Method + " " + r.URL.Path, Outcome: auditForbidden})
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userCtxKey, user)))
+			return
+		}
+		if len(username) == 0 {
+			username = "-"
+		}
+		log.Println("Authentication failed: IP:", r.RemoteAddr, "URI:", r.RequestURI, "username:", username)
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// Authentication middleware for http.Handler
+// Used for the HTML monitor views, any role is allowed
+func authHandler(next http.Handler) http.HandlerFunc {
+	return authHandlerFunc(roleViewer, next.ServeHTTP)
+}
+
+// `enervent-ctrl user` subcommand for managing the users in the configuration file
+func userCommand(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: enervent-ctrl user add [-role ROLE] [-password PASSWORD] USERNAME")
+		fmt.Fprintln(os.Stderr, "       enervent-ctrl user remove USERNAME")
+		fmt.Fprintln(os.Stderr, "       enervent-ctrl user list")
+		fmt.Fprintln(os.Stderr, "       enervent-ctrl user hash [-password PASSWORD]")
+		fmt.Fprintln(os.Stderr, "Roles:", strings.Join(roles, ", "))
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	flags := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	roleflag := flags.String("role", roleViewer, "Role of the user: "+strings.Join(roles, ", "))
+	passwflag := flags.String("password", "", "Password. Read from the terminal or stdin if not given")
+	_ = flags.Parse(args[1:])
+	parseConfigFile()
+	switch {
+	case args[0] == "add" && flags.NArg() == 1:
+		username := flags.Arg(0)
+		if !slices.Contains(roles, *roleflag) {
+			log.Fatalf("Invalid role %s, expecting one of %s", *roleflag, strings.Join(roles, ", "))
+		}
+		hash := hashPassword(*passwflag)
+		for i := range config.Users {
+			if config.Users[i].Username == username {
+				config.Users[i].PasswordHash = hash
+				config.Users[i].Role = *roleflag
+				writeConfigFile()
+				log.Println("Updated user", username)
+				return
+			}
+		}
+		config.Users = append(config.Users, userConf{Username: username, PasswordHash: hash, Role: *roleflag})
+		writeConfigFile()
+		log.Println("Added user", username, "with role", *roleflag)
+	case args[0] == "remove" && flags.NArg() == 1:
+		i := slices.IndexFunc(config.Users, func(u userConf) bool { return u.Username == flags.Arg(0) })
+		if i < 0 {
+			log.Fatal("User ", flags.Arg(0), " not found")
+		}
+		config.Users = slices.Delete(config.Users, i, i+1)
+		writeConfigFile()
+		log.Println("Removed user", flags.Arg(0))
+	case args[0] == "list" && flags.NArg() == 0:
+		for _, user := range config.Users {
+			fmt.Println(user.Username, user.Role)
+		}
+	case args[0] == "hash" && flags.NArg() == 0:
+		fmt.Println(hashPassword(*passwflag))
+	default:
+		usage()
+	}
+}
+
+// Hash password with bcrypt. If password is empty, it is read from the terminal
+// without echo, or from the first line of stdin if it isn't a terminal
+func hashPassword(password string) string {
+	if len(password) == 0 {
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			fmt.Fprint(os.Stderr, "Password: ")
+			data, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				log.Fatal("Failed to read password: ", err)
+			}
+			password = string(data)
+		} else {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && len(line) == 0 {
+				log.Fatal("Failed to read password: ", err)
+			}
+			password = strings.TrimRight(line, "\r\n")
+		}
+	}
+	if len(password) == 0 {
+		log.Fatal("Password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatal("Failed to hash password: ", err)
+	}
+	return string(hash)
+}
+
+// Write config back to the configuration file
+func writeConfigFile() {
+	confbytes, err := yaml.Marshal(&config)
+	if err != nil {
+		log.Fatal("Error encoding configuration:", err)
+	}
+	if err := os.WriteFile(confpath+"/configuration.yaml", confbytes, 0600); err != nil {
+		log.Fatal("Failed to write configuration:", err)
+	}
+}
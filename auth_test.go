@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthRoles(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	config = Conf{Users: []userConf{
+		{Username: "viewer", PasswordHash: string(hash), Role: roleViewer},
+		{Username: "operator", PasswordHash: string(hash), Role: roleOperator},
+		{Username: "admin", PasswordHash: string(hash), Role: roleAdmin},
+	}}
+	if err := initUsers(); err != nil {
+		t.Fatal(err)
+	}
+	handler := authHandlerFunc(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		if requestUser(r) == nil {
+			t.Error("user missing from request context")
+		}
+	})
+	tests := []struct {
+		user, pass, method string
+		want               int
+	}{
+		{"viewer", "secret", "GET", http.StatusOK},
+		{"viewer", "secret", "POST", http.StatusForbidden},
+		{"operator", "secret", "POST", http.StatusOK},
+		{"admin", "secret", "POST", http.StatusOK},
+		{"admin", "wrong", "GET", http.StatusUnauthorized},
+		{"nobody", "secret", "GET", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/api/v1/mode", nil)
+		r.SetBasicAuth(test.user, test.pass)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %s: status %d, expecting %d", test.user, test.method, w.Code, test.want)
+		}
+	}
+}
+
+func TestInitUsersValidation(t *testing.T) {
+	config = Conf{Users: []userConf{{Username: "a", PasswordHash: "plaintext", Role: roleAdmin}}}
+	if err := initUsers(); err == nil {
+		t.Error("expecting error for invalid password hash")
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	config = Conf{Users: []userConf{{Username: "a", PasswordHash: string(hash), Role: "root"}}}
+	if err := initUsers(); err == nil {
+		t.Error("expecting error for invalid role")
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/0ranki/enervent-ctrl/client"
+	"github.com/0ranki/enervent-ctrl/pingvin"
+	"gopkg.in/yaml.v3"
+)
+
+// Parse a backup document, JSON or YAML
+func parseBackup(data []byte, b any) error {
+	if json.Valid(data) {
+		return json.Unmarshal(data, b)
+	}
+	return yaml.Unmarshal(data, b)
+}
+
+// /api/v1/backup endpoint
+func backup(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := dev.Backup()
+	if err != nil {
+		log.Println("ERROR: Backup:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeBackup(w, r, b)
+}
+
+// Write a backup as JSON, or YAML with ?format=yaml or Accept: application/yaml
+func writeBackup(w http.ResponseWriter, r *http.Request, b *pingvin.Backup) {
+	if r.URL.Query().Get("format") == "yaml" || (len(r.URL.Query().Get("format")) == 0 && strings.Contains(r.Header.Get("Accept"), "yaml")) {
+		w.Header().Set("Content-Type", "application/yaml")
+		_ = yaml.NewEncoder(w).Encode(b)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(b)
+}
+
+// /api/v1/restore endpoint. Dry runs are allowed in read only mode
+func restore(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dryrun, confirm := r.URL.Query().Get("dry_run") == "true", r.URL.Query().Get("confirm") == "true"
+	if config.ReadOnly && !dryrun {
+		log.Println("WARNING: Read only mode, refusing to write to device")
+		auditRequest(r, auditEntry{Action: "restore", Target: "restore", Outcome: auditRefused})
+		http.Error(w, "Read only mode", http.StatusForbidden)
+		return
+	}
+	b := &pingvin.Backup{}
+	data, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = parseBackup(data, b)
+	}
+	if err != nil {
+		log.Println("ERROR: Could not parse backup:", err)
+		http.Error(w, "Invalid backup: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := dev.Restore(b, dryrun, confirm)
+	if !dryrun {
+		auditRestore(r, "restore", resp, err)
+	}
+	writeRestoreResponse(w, resp, err)
+}
+
+// Write the result of a restore, 400 if it was rejected
+func writeRestoreResponse(w http.ResponseWriter, resp *pingvin.RestoreResponse, err error) {
+	code := http.StatusOK
+	if errors.Is(err, pingvin.ErrValidation) {
+		code = http.StatusBadRequest
+	} else if err != nil {
+		code = http.StatusInternalServerError
+	}
+	if err != nil {
+		log.Println("ERROR: restore:", err)
+	}
+	// Errors of the whole backup, e.g. an unsupported version
+	if err != nil && len(resp.Changes) == 0 {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// Record a restore in the audit log, one entry per change
+func auditRestore(r *http.Request, action string, resp *pingvin.RestoreResponse, err error) {
+	if len(resp.Changes) == 0 && err != nil {
+		entry := auditEntry{Action: action, Target: action}
+		if errors.Is(err, pingvin.ErrValidation) {
+			entry.Outcome = auditInvalid
+		}
+		entry.setResult(err)
+		auditRequest(r, entry)
+	}
+	for _, change := range resp.Changes {
+		entry := auditEntry{Action: action, Target: change.Symbol, Old: change.Current, Requested: change.Backup, Value: change.Current, Outcome: auditOK, Error: change.Error}
+		if errors.Is(err, pingvin.ErrValidation) {
+			entry.Outcome = auditInvalid
+			if len(entry.Error) == 0 {
+				entry.Error = err.Error()
+			}
+		} else if !change.OK {
+			entry.Outcome = auditFailed
+		} else {
+			entry.Value = change.Backup
+		}
+		auditRequest(r, entry)
+	}
+}
+
+// Write the configuration backup of the unit to a file or stdout
+func backupCommand(ctx context.Context, args []string) error {
+	flags, opts := cliFlagSet("backup", "backup [-json] [FILE]", "The backup is written as YAML, or JSON with -json, to FILE or stdout")
+	parseCLIFlags(flags, args, 0, 1)
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	doc, err := b.Backup(ctx)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if opts.json {
+		data, err = json.MarshalIndent(doc, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(doc)
+	}
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 || flags.Arg(0) == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(flags.Arg(0), data, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d coils and %d registers to %s\n", len(doc.Coils), len(doc.Registers), flags.Arg(0))
+	return nil
+}
+
+// Restore the configuration of the unit from a backup file
+func restoreCommand(ctx context.Context, args []string) error {
+	flags, opts := cliFlagSet("restore", "restore [-json] [-dry-run] [-confirm] FILE",
+		"FILE is a backup in YAML or JSON, - for stdin. Only the values differing from the unit are written")
+	dryrun := flags.Bool("dry-run", false, "Only show the differences")
+	confirm := flags.Bool("confirm", false, "Confirm the writes of registers with the confirm write policy")
+	parseCLIFlags(flags, args, 1, 1)
+	var data []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	doc := &client.Backup{}
+	if err := parseBackup(data, doc); err != nil {
+		return fmt.Errorf("invalid backup %s: %w", flags.Arg(0), err)
+	}
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	resp, err := b.Restore(ctx, doc, *dryrun, *confirm)
+	if resp == nil || (err != nil && len(resp.Changes) == 0) {
+		return err
+	}
+	if opts.json {
+		if perr := printJSON(resp); err == nil {
+			err = perr
+		}
+		return err
+	}
+	for _, warning := range resp.Warnings {
+		fmt.Fprintln(os.Stderr, "WARNING:", warning)
+	}
+	if len(resp.Changes) > 0 {
+		tw := newTable()
+		fmt.Fprintln(tw, "SYMBOL\tCURRENT\tBACKUP\tRESULT")
+		for _, c := range resp.Changes {
+			result := "ok"
+			switch {
+			case len(c.Error) > 0:
+				result = c.Error
+			case resp.DryRun:
+				result = "would change"
+			case !c.OK:
+				result = "not written"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Symbol, restoreValue(c.Type, c.Current), restoreValue(c.Type, c.Backup), result)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if err != nil && (client.StatusCode(err) == http.StatusBadRequest || errors.Is(err, pingvin.ErrValidation)) {
+		return &cliError{"restore rejected, nothing was written", err}
+	} else if err != nil && resp.RolledBack {
+		return &cliError{"restore failed, the changes were rolled back", err}
+	} else if err != nil {
+		return &cliError{"restore failed", err}
+	}
+	if resp.DryRun {
+		fmt.Printf("%d values would change, %d unchanged\n", len(resp.Changes), resp.Unchanged)
+	} else {
+		fmt.Printf("Restored %d values, %d unchanged\n", len(resp.Changes), resp.Unchanged)
+	}
+	return nil
+}
+
+// Value of a restore change as text, on or off for coils
+func restoreValue(typ string, value float64) string {
+	if typ != "coil" {
+		return fmt.Sprintf("%g", value)
+	}
+	if value != 0 {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes
+const certReloadInterval = 30 * time.Second
+
+// Maps a client certificate common name to a role
+type certUserConf struct {
+	CommonName string `yaml:"common_name"`
+	Role       string `yaml:"role"`
+}
+
+// Keeps the server certificate and client CA pool up to date
+// with the files on disk
+type certReloader struct {
+	certfile, keyfile, cafile string
+	lock                      *sync.Mutex
+	cert                      *tls.Certificate
+	clientcas                 *x509.CertPool
+	modtimes                  map[string]time.Time
+}
+
+// Load the certificates and start watching them for changes
+func newCertReloader(certfile, keyfile, cafile string) (*certReloader, error) {
+	c := &certReloader{certfile: certfile, keyfile: keyfile, cafile: cafile, lock: &sync.Mutex{}, modtimes: map[string]time.Time{}}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			time.Sleep(certReloadInterval)
+			if reloaded, err := c.reload(); err != nil {
+				log.Println("ERROR: Failed to reload certificates:", err)
+			} else if reloaded {
+				log.Println("Reloaded TLS certificates")
+			}
+		}
+	}()
+	return c, nil
+}
+
+// Reload the files if any of them has changed.
+// Returns true if the files were reloaded
+func (c *certReloader) reload() (bool, error) {
+	changed := false
+	modtimes := map[string]time.Time{}
+	for _, name := range []string{c.certfile, c.keyfile, c.cafile} {
+		if len(name) == 0 {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return false, err
+		}
+		modtimes[name] = info.ModTime()
+		changed = changed || !info.ModTime().Equal(c.modtimes[name])
+	}
+	if !changed {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certfile, c.keyfile)
+	if err != nil {
+		return false, err
+	}
+	var pool *x509.CertPool
+	if len(c.cafile) > 0 {
+		data, err := os.ReadFile(c.cafile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return false, fmt.Errorf("no certificates found in %s", c.cafile)
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert, c.clientcas, c.modtimes = &cert, pool, modtimes
+	return true, nil
+}
+
+// TLS configuration for the server, using the latest certificates
+func (c *certReloader) tlsConfig(clientauth string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			conf := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+				ClientCAs:    c.clientcas,
+			}
+			if c.clientcas != nil {
+				conf.ClientAuth = tls.VerifyClientCertIfGiven
+				if clientauth == "require" {
+					conf.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return conf, nil
+		},
+	}
+}
+
+// User for a verified client certificate, nil if the request has none
+// or the common name isn't mapped to a role. Common names matching
+// a configured user get the role of the user
+func certUser(r *http.Request) *userConf {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for _, cu := range config.CertUsers {
+		if cu.CommonName == cn {
+			return &userConf{Username: "cert:" + cn, Role: cu.Role}
+		}
+	}
+	for i := range users {
+		if users[i].Username == cn {
+			return &userConf{Username: "cert:" + cn, Role: users[i].Role}
+		}
+	}
+	return nil
+}
+
+// Write a certificate and key as PEM files
+func writeCertificate(certfile, keyfile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// Read a certificate and key written by writeCertificate
+func readCertificate(certfile, keyfile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("CA key is not an ECDSA key")
+	}
+	return cert, key, nil
+}
+
+// Create a certificate signed by the CA, or a self-signed CA if ca is nil.
+// hosts are added as DNS or IP SANs
+func issueCertificate(cn string, hosts []string, validfor time.Duration, ca *x509.Certificate, cakey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"enervent-ctrl"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validfor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if len(host) > 0 {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if ca == nil {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		ca, cakey = template, key
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, cakey)
+	return der, key, err
+}
+
+// `enervent-ctrl cert` subcommand for generating a local CA and
+// server and client certificates signed by it
+func certCommand(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: enervent-ctrl cert ca")
+		fmt.Fprintln(os.Stderr, "       enervent-ctrl cert server [-hosts HOST,IP,...]")
+		fmt.Fprintln(os.Stderr, "       enervent-ctrl cert client NAME")
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	flags := flag.NewFlagSet("cert "+args[0], flag.ExitOnError)
+	hostsflag := flags.String("hosts", "", "Comma separated host names and IP addresses for the server certificate. Default is the hostname, enervent-ctrl.local, localhost and the IP addresses of the host")
+	validflag := flags.Duration("valid", 0, "Validity of the certificate. Default is 10 years for the CA, 2 years for others")
+	_ = flags.Parse(args[1:])
+	parseConfigFile()
+	cafile, cakeyfile := confpath+"/ca.pem", confpath+"/ca-key.pem"
+	valid := *validflag
+	if args[0] == "ca" && flags.NArg() == 0 {
+		if _, err := os.Stat(cafile); err == nil {
+			log.Fatal(cafile, " already exists, remove it first to create a new CA")
+		}
+		if valid == 0 {
+			valid = 10 * 365 * 24 * time.Hour
+		}
+		der, key, err := issueCertificate("enervent-ctrl CA", nil, valid, nil, nil, 0)
+		if err == nil {
+			err = writeCertificate(cafile, cakeyfile, der, key)
+		}
+		if err != nil {
+			log.Fatal("Failed to create CA: ", err)
+		}
+		log.Println("Wrote CA certificate", cafile, "and key", cakeyfile)
+		log.Println("Set client_ca:", cafile, "in the configuration to accept client certificates")
+		return
+	}
+	ca, cakey, err := readCertificate(cafile, cakeyfile)
+	if err != nil {
+		log.Fatal("Failed to read CA, create one with `enervent-ctrl cert ca`: ", err)
+	}
+	if valid == 0 {
+		valid = 2 * 365 * 24 * time.Hour
+	}
+	switch {
+	case args[0] == "server" && flags.NArg() == 0:
+		hosts := defaultHosts()
+		if len(*hostsflag) > 0 {
+			hosts = strings.Split(*hostsflag, ",")
+		}
+		der, key, err := issueCertificate(hosts[0], hosts, valid, ca, cakey, x509.ExtKeyUsageServerAuth)
+		if err == nil {
+			err = writeCertificate(config.SslCertificate, config.SslPrivatekey, der, key)
+		}
+		if err != nil {
+			log.Fatal("Failed to create server certificate: ", err)
+		}
+		log.Println("Wrote server certificate", config.SslCertificate, "for", strings.Join(hosts, ", "))
+	case args[0] == "client" && flags.NArg() == 1:
+		name := flags.Arg(0)
+		certfile, keyfile := confpath+"/client-"+name+".pem", confpath+"/client-"+name+"-key.pem"
+		der, key, err := issueCertificate(name, nil, valid, ca, cakey, x509.ExtKeyUsageClientAuth)
+		if err == nil {
+			err = writeCertificate(certfile, keyfile, der, key)
+		}
+		if err != nil {
+			log.Fatal("Failed to create client certificate: ", err)
+		}
+		log.Println("Wrote client certificate", certfile, "and key", keyfile)
+	default:
+		usage()
+	}
+}
+
+// Host names and IP addresses of this host for the server certificate
+func defaultHosts() []string {
+	hosts := []string{}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	hosts = append(hosts, "enervent-ctrl.local", "localhost")
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			hosts = append(hosts, ipnet.IP.String())
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	cafile, certfile, keyfile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	der, cakey, err := issueCertificate("test CA", nil, time.Hour, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCertificate(cafile, filepath.Join(dir, "ca-key.pem"), der, cakey); err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	issue := func() {
+		der, key, err := issueCertificate("localhost", []string{"localhost", "127.0.0.1"}, time.Hour, ca, cakey, x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeCertificate(certfile, keyfile, der, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	issue()
+	certs, err := newCertReloader(certfile, keyfile, cafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := certs.cert.Certificate[0]
+	leaf, _ := x509.ParseCertificate(first)
+	if len(leaf.IPAddresses) != 1 || len(leaf.DNSNames) != 1 {
+		t.Errorf("unexpected SANs %v %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+	if reloaded, _ := certs.reload(); reloaded {
+		t.Error("reloaded unchanged certificates")
+	}
+	issue()
+	later := time.Now().Add(time.Second)
+	_ = os.Chtimes(certfile, later, later)
+	if reloaded, err := certs.reload(); !reloaded || err != nil {
+		t.Fatalf("certificate not reloaded: %v", err)
+	}
+	if string(certs.cert.Certificate[0]) == string(first) {
+		t.Error("certificate unchanged after reload")
+	}
+	conf, _ := certs.tlsConfig("require").GetConfigForClient(nil)
+	if conf.ClientAuth != tls.RequireAndVerifyClientCert || conf.ClientCAs == nil {
+		t.Error("client certificates not required")
+	}
+}
+
+func TestCertUser(t *testing.T) {
+	config = Conf{CertUsers: []certUserConf{{CommonName: "homeassistant", Role: roleOperator}}}
+	users = []userConf{{Username: "alice", Role: roleAdmin}}
+	for cn, want := range map[string]string{"homeassistant": roleOperator, "alice": roleAdmin, "mallory": ""} {
+		r := httptest.NewRequest("GET", "/", nil)
+		cert := &x509.Certificate{}
+		cert.Subject.CommonName = cn
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		user := certUser(r)
+		if (user == nil && len(want) > 0) || (user != nil && user.Role != want) {
+			t.Errorf("%s: got %+v, expecting role %q", cn, user, want)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/0ranki/enervent-ctrl/client"
+	"github.com/0ranki/enervent-ctrl/pingvin"
+)
+
+// Exit codes of the command-line client
+const (
+	exitOK          = 0
+	exitFailure     = 1 // The command failed, e.g. a write was rejected
+	exitUsage       = 2 // Invalid arguments
+	exitUnavailable = 3 // The daemon or the unit could not be reached
+	exitAlarm       = 4 // alarms: an alarm is active
+	exitDenied      = 5 // Authentication failed, not permitted or read only mode
+)
+
+// Environment variable for the API token of the command-line client
+const tokenEnv = "ENERVENT_CTRL_TOKEN"
+
+var (
+	errReadOnly    = errors.New("read only mode, refusing to write to device")
+	errUnavailable = errors.New("unit not reachable")
+	errAlarmActive = errors.New("alarm active")
+)
+
+// Commands talking to the daemon, or directly to the unit if the
+// daemon isn't running
+var cliCommands = map[string]func(context.Context, []string) error{
+	"status":   statusCommand,
+	"get":      getCommand,
+	"set":      setCommand,
+	"mode":     modeCommand,
+	"temp":     tempCommand,
+	"alarms":   alarmsCommand,
+	"schedule": scheduleCommand,
+	"watch":    watchCommand,
+	"backup":   backupCommand,
+	"restore":  restoreCommand,
+}
+
+// Operations of the command-line client, implemented by *client.Client
+// for the daemon and unitBackend for the serial port
+type cliBackend interface {
+	Status(ctx context.Context) (*client.Status, error)
+	Coils(ctx context.Context) ([]client.Coil, error)
+	Registers(ctx context.Context) ([]client.Register, error)
+	Batch(ctx context.Context, req client.BatchRequest) (*client.BatchResponse, error)
+	Mode(ctx context.Context) (*client.ModeStatus, error)
+	SetMode(ctx context.Context, mode string) (*client.ModeStatus, error)
+	SetTemperature(ctx context.Context, value string) (*client.Register, error)
+	Backup(ctx context.Context) (*client.Backup, error)
+	Restore(ctx context.Context, b *client.Backup, dryRun, confirm bool) (*client.RestoreResponse, error)
+}
+
+// Options common to the command-line client commands
+type cliOptions struct {
+	url      string
+	token    string
+	username string
+	password string
+	device   string
+	lang     string
+	insecure bool
+	direct   bool
+	json     bool
+	verbose  bool
+}
+
+// Run a command-line client command, returns the exit code
+func runCLICommand(name string, args []string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := cliCommands[name](ctx, args)
+	if err != nil && !errors.Is(err, errAlarmActive) {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+	}
+	return exitCode(err)
+}
+
+// Exit code for the error of a command
+func exitCode(err error) int {
+	var urlerr *url.Error
+	switch code := client.StatusCode(err); {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errAlarmActive):
+		return exitAlarm
+	case errors.Is(err, errReadOnly), code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return exitDenied
+	case code > 0:
+		return exitFailure
+	case errors.Is(err, errUnavailable), errors.As(err, &urlerr):
+		return exitUnavailable
+	}
+	return exitFailure
+}
+
+// Flag set of a command with the common options. synopsis is the
+// usage of the command, e.g. "get [-json] SYMBOL...", with a line for
+// each form. The notes are printed after it
+func cliFlagSet(name, synopsis string, notes ...string) (*flag.FlagSet, *cliOptions) {
+	opts := &cliOptions{}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&opts.url, "url", "", "URL of the daemon, e.g. https://pingvin.lan:8888 or unix:/run/enervent-ctrl.sock. Default is the configured address")
+	flags.StringVar(&opts.token, "token", os.Getenv(tokenEnv), "API token. Default is $"+tokenEnv)
+	flags.StringVar(&opts.username, "username", "", "Username for HTTP Basic Authentication. Default is the configured username")
+	flags.StringVar(&opts.password, "password", "", "Password for HTTP Basic Authentication. Default is the configured password")
+	flags.StringVar(&opts.device, "device", "", "Id of the unit. Default is the default device")
+	flags.StringVar(&opts.lang, "lang", "", "Language of names and descriptions, e.g. fi")
+	flags.BoolVar(&opts.insecure, "insecure", false, "Don't verify the certificate of the daemon")
+	flags.BoolVar(&opts.direct, "direct", false, "Connect to the unit over the serial port instead of the daemon. Stop the daemon first")
+	flags.BoolVar(&opts.json, "json", false, "Write JSON instead of a table")
+	flags.BoolVar(&opts.verbose, "v", false, "Log to stderr")
+	flags.Usage = func() {
+		for i, form := range strings.Split(synopsis, "\n") {
+			prefix := "Usage:"
+			if i > 0 {
+				prefix = "      "
+			}
+			fmt.Fprintln(os.Stderr, prefix, "enervent-ctrl", form)
+		}
+		for _, note := range notes {
+			fmt.Fprintln(os.Stderr, note)
+		}
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "Exit status: 0 success, 1 failed, 2 invalid usage, 3 daemon or unit not reachable, 4 alarm active, 5 not permitted")
+	}
+	return flags, opts
+}
+
+// Parse the arguments of a command, exits if the number of
+// positional arguments isn't between min and max. max < 0 for no limit
+func parseCLIFlags(flags *flag.FlagSet, args []string, min, max int) {
+	_ = flags.Parse(args)
+	if flags.NArg() < min || (max >= 0 && flags.NArg() > max) {
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// Connect to the daemon, or to the unit if the daemon isn't running
+// and no URL was given. The returned function closes the connection
+func (o *cliOptions) connect(ctx context.Context) (cliBackend, func(), error) {
+	parseConfigFile()
+	if !o.verbose {
+		log.SetOutput(io.Discard)
+	}
+	if o.direct {
+		return o.connectUnit()
+	}
+	c, err := o.daemonClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(o.url) > 0 {
+		return c, func() {}, nil
+	}
+	probectx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	if err := c.Healthy(probectx); err != nil && client.StatusCode(err) == 0 {
+		fmt.Fprintln(os.Stderr, "Daemon not reachable, connecting to the unit directly:", err)
+		return o.connectUnit()
+	}
+	return c, func() {}, nil
+}
+
+// Client of the daemon at the given or configured address. Without
+// credentials, the configured username and password are used
+func (o *cliOptions) daemonClient() (*client.Client, error) {
+	base := o.url
+	if len(base) == 0 {
+		base = defaultDaemonURL()
+	}
+	c := client.New(base)
+	c.Token, c.Username, c.Password, c.Device, c.Language = o.token, o.username, o.password, o.device, o.lang
+	if len(c.Token) == 0 && len(c.Username) == 0 {
+		c.Username = config.Username
+	}
+	if len(c.Token) == 0 && len(c.Password) == 0 {
+		c.Password = config.Password
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s: %w", base, err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch u.Scheme {
+	case "unix":
+		path := u.Opaque + u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		}
+		c.BaseURL = "http://unix"
+	case "https":
+		transport.TLSClientConfig = daemonTLSConfig(u.Hostname(), o.insecure)
+	case "http":
+	default:
+		return nil, fmt.Errorf("invalid URL %s, expecting http, https or unix", base)
+	}
+	c.HTTPClient = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	return c, nil
+}
+
+// URL of the daemon from the configuration, the Unix socket if
+// there is one
+func defaultDaemonURL() string {
+	if info, err := os.Stat(config.UnixSocket); len(config.UnixSocket) > 0 && err == nil && info.Mode()&os.ModeSocket != 0 {
+		return "unix:" + config.UnixSocket
+	}
+	host := config.ListenAddress
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	port := config.Port
+	if port == 0 {
+		port = 8888
+	}
+	scheme := "https"
+	if config.DisableTLS {
+		scheme = "http"
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// TLS configuration for the daemon at host. The configured
+// certificate of the daemon is accepted as is, so that the generated
+// self-signed certificate works for any address of the daemon.
+// Other certificates are verified against the system roots
+func daemonTLSConfig(host string, insecure bool) *tls.Config {
+	if insecure {
+		return &tls.Config{InsecureSkipVerify: true}
+	}
+	pinned := []byte{}
+	if data, err := os.ReadFile(config.SslCertificate); err == nil {
+		if block, _ := pem.Decode(data); block != nil {
+			pinned = block.Bytes
+		}
+	}
+	return &tls.Config{
+		// Verified below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate from the daemon")
+			}
+			if len(pinned) > 0 && slices.Equal(rawCerts[0], pinned) {
+				return nil
+			}
+			certs := []*x509.Certificate{}
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+			return err
+		},
+	}
+}
+
+// Connect to the configured unit over the serial port
+func (o *cliOptions) connectUnit() (cliBackend, func(), error) {
+	confs, err := deviceConfs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid device configuration: %w", err)
+	}
+	conf := confs[0]
+	if len(o.device) > 0 {
+		i := slices.IndexFunc(confs, func(c deviceConf) bool { return c.Id == o.device })
+		if i < 0 {
+			return nil, nil, fmt.Errorf("unknown device %s", o.device)
+		}
+		conf = confs[i]
+	}
+	dev, err := pingvin.New(conf.Transport, config.Debug, pingvin.MapFiles{Map: conf.Map, Coils: conf.CoilMap, Registers: conf.RegisterMap, Profile: conf.MapProfile})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the coil and register maps: %w", err)
+	}
+	if err := dev.SetWritePolicies(conf.WritePolicy); err != nil {
+		dev.Quit()
+		return nil, nil, fmt.Errorf("invalid write policy configuration: %w", err)
+	}
+	u := &unitBackend{dev: dev, lang: o.lang, readOnly: config.ReadOnly}
+	return u, dev.Quit, nil
+}
+
+// Unit connected over the serial port, for the command-line client
+// when the daemon isn't running
+type unitBackend struct {
+	dev      *pingvin.Pingvin
+	lang     string
+	readOnly bool
+	updated  time.Time
+}
+
+// Read all coils and registers, unless they were just read
+func (u *unitBackend) update() error {
+	if time.Since(u.updated) < time.Second {
+		return nil
+	}
+	if err := u.dev.Update(); err != nil {
+		return fmt.Errorf("%w: %s", errUnavailable, err)
+	}
+	u.updated = time.Now()
+	return nil
+}
+
+// Convert a pingvin value to the client type with the same JSON
+func convert[T any](v any) (T, error) {
+	var out T
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(data, &out)
+	}
+	return out, err
+}
+
+func (u *unitBackend) Status(ctx context.Context) (*client.Status, error) {
+	if err := u.update(); err != nil {
+		return nil, err
+	}
+	return convert[*client.Status](u.dev.CurrentStatus())
+}
+
+func (u *unitBackend) Coils(ctx context.Context) ([]client.Coil, error) {
+	if err := u.update(); err != nil {
+		return nil, err
+	}
+	return convert[[]client.Coil](u.dev.LocalizedCoils(u.lang))
+}
+
+func (u *unitBackend) Registers(ctx context.Context) ([]client.Register, error) {
+	if err := u.update(); err != nil {
+		return nil, err
+	}
+	return convert[[]client.Register](u.dev.LocalizedRegisters(u.lang))
+}
+
+func (u *unitBackend) Batch(ctx context.Context, req client.BatchRequest) (*client.BatchResponse, error) {
+	if u.readOnly {
+		return nil, errReadOnly
+	}
+	writes, err := convert[[]pingvin.BatchWrite](req.Writes)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.dev.WriteBatch(writes, req.Atomic)
+	out, cerr := convert[*client.BatchResponse](resp)
+	if err == nil {
+		err = cerr
+	}
+	return out, err
+}
+
+func (u *unitBackend) Mode(ctx context.Context) (*client.ModeStatus, error) {
+	status, err := u.dev.Mode()
+	if err != nil {
+		return nil, err
+	}
+	return convert[*client.ModeStatus](status)
+}
+
+func (u *unitBackend) SetMode(ctx context.Context, mode string) (*client.ModeStatus, error) {
+	if u.readOnly {
+		return nil, errReadOnly
+	}
+	if !slices.Contains(pingvin.Modes, mode) {
+		return nil, fmt.Errorf("invalid mode %s, expecting one of %s", mode, strings.Join(pingvin.Modes, ", "))
+	}
+	status, err := u.dev.SetMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	return convert[*client.ModeStatus](status)
+}
+
+func (u *unitBackend) SetTemperature(ctx context.Context, value string) (*client.Register, error) {
+	if u.readOnly {
+		return nil, errReadOnly
+	}
+	if err := u.update(); err != nil {
+		return nil, err
+	}
+	if err := u.dev.Temperature(value); err != nil {
+		return nil, err
+	}
+	return convert[*client.Register](u.dev.Registers[135].Localize(u.lang))
+}
+
+func (u *unitBackend) Backup(ctx context.Context) (*client.Backup, error) {
+	if err := u.update(); err != nil {
+		return nil, err
+	}
+	b, err := u.dev.Backup()
+	if err != nil {
+		return nil, err
+	}
+	return convert[*client.Backup](b)
+}
+
+func (u *unitBackend) Restore(ctx context.Context, b *client.Backup, dryRun, confirm bool) (*client.RestoreResponse, error) {
+	if u.readOnly && !dryRun {
+		return nil, errReadOnly
+	}
+	if err := u.update(); err != nil {
+		return nil, err
+	}
+	backup, err := convert[*pingvin.Backup](b)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.dev.Restore(backup, dryRun, confirm)
+	out, cerr := convert[*client.RestoreResponse](resp)
+	if err == nil {
+		err = cerr
+	}
+	return out, err
+}
+
+// Write v as indented JSON to stdout
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/0ranki/enervent-ctrl/client"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := map[error]int{
+		nil:                               exitOK,
+		errors.New("unknown symbol"):      exitFailure,
+		&client.APIError{StatusCode: 400}: exitFailure,
+		&client.APIError{StatusCode: 401}: exitDenied,
+		&cliError{"setpoint", &client.APIError{StatusCode: 403}}: exitDenied,
+		fmt.Errorf("write: %w", errReadOnly):                     exitDenied,
+		&url.Error{Op: "Get", Err: errors.New("refused")}:        exitUnavailable,
+		&cliError{"stale", errUnavailable}:                       exitUnavailable,
+		errAlarmActive:                                           exitAlarm,
+	}
+	for err, expected := range tests {
+		if code := exitCode(err); code != expected {
+			t.Errorf("%v: expecting %d, got %d", err, expected, code)
+		}
+	}
+}
+
+func TestParseRegisterValue(t *testing.T) {
+	max := 500
+	setpoint := &client.Register{Symbol: "HREG_T_SETPOINT", Type: "int16", Multiplier: 10, Max: &max}
+	function := &client.Register{Symbol: "HREG_WC1", Type: "enumeration", Multiplier: 1, Enum: map[int]string{0: "Off", 2: "Away long"}}
+	days := &client.Register{Symbol: "HREG_DAY_WC1", Type: "bitfield", Multiplier: 1, Bits: []string{"Sunday", "Monday", "Tuesday"}}
+	tests := []struct {
+		reg      *client.Register
+		value    string
+		expected int
+	}{
+		{setpoint, "21.5", 215},
+		{setpoint, "-2", -20},
+		{function, "away long", 2},
+		{function, "2", 2},
+		{days, "monday,Sunday", 3},
+		{days, "4", 4},
+	}
+	for _, test := range tests {
+		if raw, err := parseRegisterValue(test.reg, test.value); err != nil || raw != test.expected {
+			t.Errorf("%s %s: expecting %d, got %d, %v", test.reg.Symbol, test.value, test.expected, raw, err)
+		}
+	}
+	for _, test := range []struct {
+		reg   *client.Register
+		value string
+	}{{setpoint, "4000"}, {setpoint, "warm"}, {function, "away"}, {days, "Friday"}, {days, "-1"}} {
+		if raw, err := parseRegisterValue(test.reg, test.value); err == nil {
+			t.Errorf("%s %s: expecting an error, got %d", test.reg.Symbol, test.value, raw)
+		}
+	}
+}
+
+func TestReadAlarms(t *testing.T) {
+	registers := []client.Register{}
+	for n := 1; n <= alarmEntries; n++ {
+		values := []int{0, 0, 0, 0, 0, 0, 0}
+		switch n {
+		case 1:
+			values = []int{16, 2, 26, 10, 18, 7, 5}
+		case 2:
+			values = []int{12, 1, 0, 0, 0, 0, 0}
+		case 3:
+			values = []int{99, 0, 2025, 12, 24, 18, 0}
+		}
+		for i, field := range []string{"ALMTYPE", "STATECLASS", "YY", "MM", "DD", "HH", "MI"} {
+			registers = append(registers, client.Register{Symbol: fmt.Sprintf("HREG_ALARM%d_%s", n, field), Value: values[i], Enum: map[int]string{16: "Supply filter high", 12: "Emergency stop"}})
+		}
+	}
+	alarms, err := readAlarms([]client.Coil{{Symbol: "COIL_ALARM_A"}, {Symbol: "COIL_ALARM_B"}}, registers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alarms.Log) != 3 || alarms.ActiveA || alarms.ActiveB || !alarms.active() {
+		t.Fatalf("unexpected alarms %+v", alarms)
+	}
+	first := alarms.Log[0]
+	if first.Name != "Supply filter high" || first.State != "active" || first.Time == nil || first.Time.Year() != 2026 || first.Time.Minute() != 5 {
+		t.Errorf("unexpected entry %+v", first)
+	}
+	if alarms.Log[1].State != "acknowledged" || alarms.Log[1].Time != nil {
+		t.Errorf("unexpected entry %+v", alarms.Log[1])
+	}
+	if alarms.Log[2].Name != "Alarm 99" || alarms.Log[2].State != "off" || alarms.Log[2].Time.Year() != 2025 {
+		t.Errorf("unexpected entry %+v", alarms.Log[2])
+	}
+	if _, err := readAlarms(nil, registers[:7]); err == nil {
+		t.Error("expecting an error without the alarm log registers")
+	}
+}
@@ -0,0 +1,372 @@
+// Package client is a typed Go client for the REST API of a running
+// enervent-ctrl daemon, as described by its OpenAPI document at
+// /api/v1/openapi.json.
+//
+//	c := client.New("https://pingvin.lan:8888")
+//	c.Token = os.Getenv("PINGVIN_TOKEN")
+//	status, err := c.Status(ctx)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client of one daemon. The fields may be changed before the first
+// request, a Client is safe for concurrent use after that
+type Client struct {
+	BaseURL    string // e.g. https://pingvin.lan:8888
+	Username   string // HTTP Basic Authentication
+	Password   string
+	Token      string       // API token, used instead of Username and Password
+	Device     string       // Id of the unit, empty for the default device
+	Language   string       // Language of names and descriptions, e.g. fi. Empty for the daemon's default
+	HTTPClient *http.Client // Default is http.DefaultClient
+}
+
+// Error response of the API
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Returns the status code of an *APIError in err, 0 for other errors
+func StatusCode(err error) int {
+	var apierr *APIError
+	if errors.As(err, &apierr) {
+		return apierr.StatusCode
+	}
+	return 0
+}
+
+// Client of the daemon at baseURL, e.g. https://pingvin.lan:8888
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Copy of c for the unit with the given id
+func (c *Client) WithDevice(id string) *Client {
+	d := *c
+	d.Device = id
+	return &d
+}
+
+// Path of an endpoint of the unit, e.g. status. The endpoints of other
+// units than the default one are under /api/v1/devices/ID/
+func (c *Client) devicePath(endpoint string) string {
+	if len(c.Device) > 0 {
+		return "/api/v1/devices/" + url.PathEscape(c.Device) + "/" + endpoint
+	}
+	return "/api/v1/" + endpoint
+}
+
+// Send a request with body encoded as JSON if not nil, and decode
+// the JSON response to out if not nil. Responses other than 2xx are
+// returned as *APIError, with the body also decoded to out if it is JSON
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	u := strings.TrimSuffix(c.BaseURL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reqbody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqbody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqbody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(c.Language) > 0 {
+		req.Header.Set("Accept-Language", c.Language)
+	}
+	if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if len(c.Username) > 0 {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	httpclient := c.HTTPClient
+	if httpclient == nil {
+		httpclient = http.DefaultClient
+	}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	isjson := strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json")
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Batch results are returned with the error
+		if out != nil && isjson && json.Valid(data) {
+			_ = json.Unmarshal(data, out)
+		}
+		return &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%s %s: invalid response: %w", method, path, err)
+	}
+	return nil
+}
+
+// Request decoding the response to T, the zero T on errors
+func call[T any](ctx context.Context, c *Client, method, path string, query url.Values, body any) (T, error) {
+	var out T
+	if err := c.do(ctx, method, path, query, body, &out); err != nil {
+		var zero T
+		return zero, err
+	}
+	return out, nil
+}
+
+// All coils of the unit from the latest update
+func (c *Client) Coils(ctx context.Context) ([]Coil, error) {
+	return call[[]Coil](ctx, c, "GET", c.devicePath("coils/"), nil, nil)
+}
+
+// Read a coil from the unit
+func (c *Client) Coil(ctx context.Context, address int) (*Coil, error) {
+	return call[*Coil](ctx, c, "GET", c.devicePath(fmt.Sprintf("coils/%d", address)), nil, nil)
+}
+
+// Write a coil, returns the coil read back. confirm is needed for
+// coils with the confirm write policy
+func (c *Client) WriteCoil(ctx context.Context, address int, value, confirm bool) (*Coil, error) {
+	query := url.Values{}
+	if confirm {
+		query.Set("confirm", "true")
+	}
+	return call[*Coil](ctx, c, "POST", c.devicePath(fmt.Sprintf("coils/%d/%t", address, value)), query, nil)
+}
+
+// Toggle a coil, returns the coil read back
+func (c *Client) ToggleCoil(ctx context.Context, address int) (*Coil, error) {
+	return call[*Coil](ctx, c, "POST", c.devicePath(fmt.Sprintf("coils/%d", address)), nil, nil)
+}
+
+// All holding registers of the unit from the latest update
+func (c *Client) Registers(ctx context.Context) ([]Register, error) {
+	return call[[]Register](ctx, c, "GET", c.devicePath("registers/"), nil, nil)
+}
+
+// Read a register from the unit
+func (c *Client) Register(ctx context.Context, address int) (*Register, error) {
+	return call[*Register](ctx, c, "GET", c.devicePath(fmt.Sprintf("registers/%d", address)), nil, nil)
+}
+
+// Write the raw value of a register, returns the register read back.
+// confirm is needed for registers with the confirm write policy
+func (c *Client) WriteRegister(ctx context.Context, address, value int, confirm bool) (*Register, error) {
+	query := url.Values{}
+	if confirm {
+		query.Set("confirm", "true")
+	}
+	return call[*Register](ctx, c, "POST", c.devicePath(fmt.Sprintf("registers/%d/%d", address, value)), query, nil)
+}
+
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	return call[*Status](ctx, c, "GET", c.devicePath("status"), nil, nil)
+}
+
+// Change the temperature setpoint. value is up, down, degrees, e.g.
+// 21 or 20.5, or the raw value, e.g. 205. Returns HREG_T_SETPOINT
+func (c *Client) SetTemperature(ctx context.Context, value string) (*Register, error) {
+	return call[*Register](ctx, c, "POST", c.devicePath("temperature/"+url.PathEscape(value)), nil, nil)
+}
+
+// Write several coils and registers. The response is also returned
+// with an *APIError when some of the writes failed or were rejected
+func (c *Client) Batch(ctx context.Context, req BatchRequest) (*BatchResponse, error) {
+	resp := &BatchResponse{}
+	return resp, c.do(ctx, "POST", c.devicePath("batch"), nil, req, resp)
+}
+
+func (c *Client) Mode(ctx context.Context) (*ModeStatus, error) {
+	return call[*ModeStatus](ctx, c, "GET", c.devicePath("mode"), nil, nil)
+}
+
+// Switch the operating mode, e.g. away
+func (c *Client) SetMode(ctx context.Context, mode string) (*ModeStatus, error) {
+	return call[*ModeStatus](ctx, c, "PUT", c.devicePath("mode"), nil, map[string]string{"mode": mode})
+}
+
+// Active temporary mode, nil if none
+func (c *Client) Override(ctx context.Context) (*Override, error) {
+	return call[*Override](ctx, c, "GET", c.devicePath("modes/"), nil, nil)
+}
+
+// Switch to mode for duration, then back. temperature is the setpoint
+// for the duration, see SetTemperature, or empty to keep the setpoint
+func (c *Client) StartOverride(ctx context.Context, mode string, duration time.Duration, temperature string) (*Override, error) {
+	query := url.Values{"duration": {duration.String()}}
+	if len(temperature) > 0 {
+		query.Set("temperature", temperature)
+	}
+	return call[*Override](ctx, c, "POST", c.devicePath("modes/"+url.PathEscape(mode)), query, nil)
+}
+
+// End the temporary mode, restoring the mode and setpoint from before
+func (c *Client) CancelOverride(ctx context.Context, mode string) error {
+	return c.do(ctx, "DELETE", c.devicePath("modes/"+url.PathEscape(mode)), nil, nil, nil)
+}
+
+func (c *Client) Fans(ctx context.Context) (*FanStatus, error) {
+	return call[*FanStatus](ctx, c, "GET", c.devicePath("fans"), nil, nil)
+}
+
+// Set the fan speed, %, of an operating mode, e.g. away
+func (c *Client) SetFanLevel(ctx context.Context, mode string, value int) (*FanLevel, error) {
+	return call[*FanLevel](ctx, c, "POST", c.devicePath(fmt.Sprintf("fans/%s/%d", url.PathEscape(mode), value)), nil, nil)
+}
+
+// Write policies of the coils and registers
+func (c *Client) Policy(ctx context.Context) ([]WritePolicy, error) {
+	return call[[]WritePolicy](ctx, c, "GET", c.devicePath("policy"), nil, nil)
+}
+
+// Configuration backup of the unit, read from the unit
+func (c *Client) Backup(ctx context.Context) (*Backup, error) {
+	return call[*Backup](ctx, c, "GET", c.devicePath("backup"), nil, nil)
+}
+
+// Restore a backup, writing the values differing from the unit. With
+// dryRun the differences are only validated. confirm is needed for
+// registers with the confirm write policy. The response is also
+// returned with an *APIError when the restore was rejected or failed
+func (c *Client) Restore(ctx context.Context, b *Backup, dryRun, confirm bool) (*RestoreResponse, error) {
+	query := url.Values{}
+	if dryRun {
+		query.Set("dry_run", "true")
+	}
+	if confirm {
+		query.Set("confirm", "true")
+	}
+	resp := &RestoreResponse{}
+	return resp, c.do(ctx, "POST", c.devicePath("restore"), query, b, resp)
+}
+
+// Configuration drift from the pinned baseline, as of the last check
+func (c *Client) Drift(ctx context.Context) (*DriftStatus, error) {
+	return call[*DriftStatus](ctx, c, "GET", c.devicePath("drift"), nil, nil)
+}
+
+// The pinned baseline
+func (c *Client) Baseline(ctx context.Context) (*Backup, error) {
+	return call[*Backup](ctx, c, "GET", c.devicePath("drift/baseline"), nil, nil)
+}
+
+// Pin b as the baseline, or the current configuration of the unit
+// if b is nil. Returns the drift from the new baseline
+func (c *Client) PinBaseline(ctx context.Context, b *Backup) (*DriftStatus, error) {
+	if b == nil {
+		return call[*DriftStatus](ctx, c, "POST", c.devicePath("drift/baseline"), nil, nil)
+	}
+	return call[*DriftStatus](ctx, c, "POST", c.devicePath("drift/baseline"), nil, b)
+}
+
+func (c *Client) UnpinBaseline(ctx context.Context) error {
+	return c.do(ctx, "DELETE", c.devicePath("drift/baseline"), nil, nil, nil)
+}
+
+// Write the baseline values of symbols, or of all drifted values if
+// symbols is empty. The response is also returned with an *APIError
+// when the revert was rejected or failed, see Restore
+func (c *Client) RevertDrift(ctx context.Context, symbols []string, confirm bool) (*RestoreResponse, error) {
+	query := url.Values{}
+	if confirm {
+		query.Set("confirm", "true")
+	}
+	resp := &RestoreResponse{}
+	return resp, c.do(ctx, "POST", c.devicePath("drift/revert"), query, map[string][]string{"symbols": symbols}, resp)
+}
+
+func (c *Client) Diagnostics(ctx context.Context) (*Diagnostics, error) {
+	return call[*Diagnostics](ctx, c, "GET", c.devicePath("diagnostics"), nil, nil)
+}
+
+// Units managed by the daemon
+func (c *Client) Devices(ctx context.Context) ([]Device, error) {
+	return call[[]Device](ctx, c, "GET", "/api/v1/devices", nil, nil)
+}
+
+func (c *Client) GetDevice(ctx context.Context, id string) (*Device, error) {
+	return call[*Device](ctx, c, "GET", "/api/v1/devices/"+url.PathEscape(id), nil, nil)
+}
+
+// Automation rules and their state
+func (c *Client) Rules(ctx context.Context) ([]Rule, error) {
+	return call[[]Rule](ctx, c, "GET", "/api/v1/rules", nil, nil)
+}
+
+func (c *Client) Rule(ctx context.Context, name string) (*Rule, error) {
+	return call[*Rule](ctx, c, "GET", "/api/v1/rules/"+url.PathEscape(name), nil, nil)
+}
+
+// Audit log entries matching q, newest first. Requires the admin role
+func (c *Client) Audit(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	query := url.Values{}
+	for k, v := range map[string]string{"user": q.User, "action": q.Action, "target": q.Target, "outcome": q.Outcome} {
+		if len(v) > 0 {
+			query.Set(k, v)
+		}
+	}
+	if !q.Since.IsZero() {
+		query.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		query.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return call[[]AuditEntry](ctx, c, "GET", "/api/v1/audit", query, nil)
+}
+
+// API tokens, without their secrets. Requires the admin role
+func (c *Client) Tokens(ctx context.Context) ([]Token, error) {
+	return call[[]Token](ctx, c, "GET", "/api/v1/tokens", nil, nil)
+}
+
+func (c *Client) CreateToken(ctx context.Context, req TokenRequest) (*CreatedToken, error) {
+	return call[*CreatedToken](ctx, c, "POST", "/api/v1/tokens", nil, req)
+}
+
+func (c *Client) RevokeToken(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", "/api/v1/tokens/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// Returns nil if the daemon is running
+func (c *Client) Healthy(ctx context.Context) error {
+	return c.do(ctx, "GET", "/healthz", nil, nil, nil)
+}
+
+// Returns nil if every unit has been read recently
+func (c *Client) Ready(ctx context.Context) error {
+	return c.do(ctx, "GET", "/readyz", nil, nil, nil)
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Responses of the daemon, recorded from a unit in normal mode
+const (
+	coilResponse     = `{"address":1,"symbol":"COIL_AWAY","value":true,"description":"Poissa-tila","reserved":false,"last_updated":"2026-10-19T10:43:55.782702517Z","stale":false}`
+	registerResponse = `{"address":135,"symbol":"HREG_T_SETPOINT","value":210,"bitfield":"0000000011010010","type":"int16","description":"The desired setpoint set by the user.","reserved":false,"multiplier":10,"min":0,"max":500,"name":"Supply air setpoint","unit":"°C","poll":"fast","last_updated":"2026-10-19T10:43:55.992356889Z","stale":false}`
+	statusResponse   = `{"heater_pct":0,"hrc_pct":80,"temp_setting":21,"fan_pct":0,"fan_pct_in":50,"fan_pct_ex":50,"measurements":{"room_temp1":21,"supply_heated":0,"supply_hrc":0,"supply_intake":-2.5,"supply_intake_24h":0,"supply_hum":0,"watertemp":0,"extract_intake":0,"extract_hrc":0,"extract_hum":0,"extract_hum_48h":0},"hrc_efficiency_in":0,"hrc_efficiency_ex":0,"op_mode":"Normal","uptime":"","system_time":"","snapshot_age":3.967,"stale":false,"override":null,"connection":{"state":"connected","device":"/dev/ttyUSB0","slave_id":1,"last_success":"2026-10-19T10:43:51.793834687Z","consecutive_failures":0,"reconnects":0},"coils":[` + coilResponse + `]}`
+	batchResponse    = `{"ok":false,"atomic":true,"rolled_back":false,"results":[{"type":"register","address":135,"symbol":"HREG_T_SETPOINT","requested":900,"previous":210,"value":210,"ok":false,"rolled_back":false,"error":"value 900 above the maximum 500"}]}`
+)
+
+// Test server recording the last request, responding with the
+// response and status of its path
+type testServer struct {
+	*httptest.Server
+	request *http.Request
+	body    []byte
+}
+
+func newTestServer(t *testing.T, responses map[string]string) *testServer {
+	t.Helper()
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.request = r
+		s.body, _ = io.ReadAll(r.Body)
+		if user, pass, ok := r.BasicAuth(); (!ok || user != "pingvin" || pass != "enervent") && r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch resp, ok := responses[r.Method+" "+r.URL.Path]; {
+		case !ok:
+			http.Error(w, "Not found", http.StatusNotFound)
+		case r.URL.Path == "/api/v1/batch":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, resp)
+		case len(resp) == 0:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, resp)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestClient(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"GET /api/v1/status":                      statusResponse,
+		"POST /api/v1/coils/1/true":               coilResponse,
+		"GET /api/v1/registers/135":               registerResponse,
+		"POST /api/v1/temperature/21.5":           registerResponse,
+		"PUT /api/v1/mode":                        `{"mode":"away","effective":"Away","flags":["Away"]}`,
+		"GET /api/v1/modes/":                      "null",
+		"POST /api/v1/modes/boost":                `{"mode":"boost","until":"2026-10-19T11:00:00Z","setpoint":0,"previous_mode":"normal","previous_setpoint":210,"remaining_seconds":1800}`,
+		"GET /api/v1/rules":                       "null",
+		"GET /api/v1/backup":                      `{"version":1,"created":"2026-10-19T10:43:55Z","sw_version":1.18,"coils":[],"registers":[{"symbol":"HREG_T_SETPOINT","address":135,"value":21.5,"unit":"°C"}]}`,
+		"POST /api/v1/drift/revert":               `{"ok":true,"dry_run":false,"rolled_back":false,"unchanged":0,"changes":[{"type":"register","address":135,"symbol":"HREG_T_SETPOINT","current":20,"backup":21.5,"ok":true}]}`,
+		"DELETE /api/v1/tokens/abc":               "",
+		"GET /api/v1/devices/sauna/fans":          `{"supply_pct":40,"extract_pct":45,"circulation_pct":0,"levels":[{"mode":"away","symbol":"HREG_AWAY_VENT_LEVEL","address":100,"value":30,"min":20,"max":100}]}`,
+		"POST /api/v1/devices/sauna/fans/away/35": `{"mode":"away","symbol":"HREG_AWAY_VENT_LEVEL","address":100,"value":35,"previous":30,"min":20,"max":100}`,
+	})
+	ctx := context.Background()
+	c := New(s.URL + "/")
+	c.Username, c.Password, c.Language = "pingvin", "enervent", "fi"
+
+	status, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Measurements.SupplyIntake != -2.5 || status.Connection.State != "connected" || status.Override != nil || len(status.Coils) != 1 || !status.Coils[0].Value {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if s.request.Header.Get("Accept-Language") != "fi" {
+		t.Error("expecting Accept-Language fi")
+	}
+	if coil, err := c.WriteCoil(ctx, 1, true, false); err != nil || coil.Symbol != "COIL_AWAY" || coil.LastUpdated == nil {
+		t.Errorf("unexpected coil %+v, %v", coil, err)
+	}
+	reg, err := c.Register(ctx, 135)
+	if err != nil || reg.Scaled() != 21 || *reg.Max != 500 || reg.Unit != "°C" {
+		t.Errorf("unexpected register %+v, %v", reg, err)
+	}
+	if _, err := c.SetTemperature(ctx, "21.5"); err != nil {
+		t.Error(err)
+	}
+	if mode, err := c.SetMode(ctx, "away"); err != nil || mode.Effective != "Away" {
+		t.Errorf("unexpected mode %+v, %v", mode, err)
+	}
+	if body := map[string]string{}; json.Unmarshal(s.body, &body) != nil || body["mode"] != "away" || s.request.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected mode request %s", s.body)
+	}
+	if override, err := c.Override(ctx); err != nil || override != nil {
+		t.Errorf("expecting no override, got %+v, %v", override, err)
+	}
+	override, err := c.StartOverride(ctx, "boost", 30*time.Minute, "")
+	if err != nil || override.PreviousMode != "normal" || override.Remaining != 1800 {
+		t.Errorf("unexpected override %+v, %v", override, err)
+	}
+	if s.request.URL.RawQuery != "duration=30m0s" {
+		t.Errorf("unexpected override query %s", s.request.URL.RawQuery)
+	}
+	if rules, err := c.Rules(ctx); err != nil || len(rules) != 0 {
+		t.Errorf("expecting no rules, got %v, %v", rules, err)
+	}
+	backup, err := c.Backup(ctx)
+	if err != nil || *backup.SwVersion != 1.18 || len(backup.Registers) != 1 || backup.Registers[0].Value != 21.5 {
+		t.Errorf("unexpected backup %+v, %v", backup, err)
+	}
+	revert, err := c.RevertDrift(ctx, []string{"HREG_T_SETPOINT"}, true)
+	if err != nil || !revert.OK || len(revert.Changes) != 1 || revert.Changes[0].Backup != 21.5 {
+		t.Errorf("unexpected revert %+v, %v", revert, err)
+	}
+	if string(s.body) != `{"symbols":["HREG_T_SETPOINT"]}` || s.request.URL.RawQuery != "confirm=true" {
+		t.Errorf("unexpected revert request %s?%s", s.body, s.request.URL.RawQuery)
+	}
+	if err := c.RevokeToken(ctx, "abc"); err != nil {
+		t.Error(err)
+	}
+
+	// Another unit with a token
+	sauna := c.WithDevice("sauna")
+	sauna.Token = "secret"
+	fans, err := sauna.Fans(ctx)
+	if err != nil || fans.Extract != 45 || len(fans.Levels) != 1 || *fans.Levels[0].Min != 20 {
+		t.Errorf("unexpected fans %+v, %v", fans, err)
+	}
+	if _, _, ok := s.request.BasicAuth(); ok {
+		t.Error("expecting the token instead of the password")
+	}
+	if level, err := sauna.SetFanLevel(ctx, "away", 35); err != nil || *level.Previous != 30 {
+		t.Errorf("unexpected fan level %+v, %v", level, err)
+	}
+	if len(c.Device) > 0 {
+		t.Error("WithDevice changed the original client")
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	s := newTestServer(t, map[string]string{"POST /api/v1/batch": batchResponse})
+	ctx := context.Background()
+	c := New(s.URL)
+	if _, err := c.Status(ctx); StatusCode(err) != http.StatusUnauthorized {
+		t.Errorf("expecting 401, got %v", err)
+	}
+	c.Token = "secret"
+	status, err := c.Status(ctx)
+	if StatusCode(err) != http.StatusNotFound || status != nil {
+		t.Errorf("expecting 404 without a status, got %v, %v", status, err)
+	}
+	if apierr, ok := err.(*APIError); !ok || apierr.Message != "Not found" {
+		t.Errorf("expecting the error message, got %v", err)
+	}
+	// Results of a rejected batch are returned with the error
+	resp, err := c.Batch(ctx, BatchRequest{Atomic: true, Writes: []BatchWrite{{Type: "register", Address: 135, Value: 900}}})
+	if StatusCode(err) != http.StatusBadRequest || resp == nil || len(resp.Results) != 1 || resp.Results[0].Error == "" {
+		t.Errorf("expecting 400 with the results, got %+v, %v", resp, err)
+	}
+	if !json.Valid(s.body) || string(s.body) != `{"atomic":true,"writes":[{"type":"register","address":135,"value":900}]}` {
+		t.Errorf("unexpected batch request %s", s.body)
+	}
+	s.Close()
+	if err := c.Healthy(ctx); err == nil || StatusCode(err) != 0 {
+		t.Errorf("expecting a connection error, got %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+package client
+
+import "time"
+
+// Single coil
+type Coil struct {
+	Address     int        `json:"address"`
+	Symbol      string     `json:"symbol"`
+	Value       bool       `json:"value"`
+	Description string     `json:"description"`
+	Reserved    bool       `json:"reserved"`
+	LastUpdated *time.Time `json:"last_updated"` // Time of the last successful read, nil if never read
+	Stale       bool       `json:"stale"`        // Not read within the stale window
+}
+
+// Single holding register. Value is the raw value, see Scaled
+type Register struct {
+	Address     int            `json:"address"`
+	Symbol      string         `json:"symbol"`
+	Value       int            `json:"value"`
+	Bitfield    string         `json:"bitfield"`
+	Type        string         `json:"type"` // int16, uint16, bitfield or enumeration
+	Description string         `json:"description"`
+	Reserved    bool           `json:"reserved"`
+	Multiplier  int            `json:"multiplier"`
+	Min         *int           `json:"min,omitempty"` // Lowest allowed raw value, if known
+	Max         *int           `json:"max,omitempty"` // Highest allowed raw value, if known
+	Name        string         `json:"name,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Enum        map[int]string `json:"enum,omitempty"` // Names of the values
+	Bits        []string       `json:"bits,omitempty"` // Names of the bits, LSB first
+	Poll        string         `json:"poll"`           // Polling tier: fast, slow or once
+	LastUpdated *time.Time     `json:"last_updated"`
+	Stale       bool           `json:"stale"`
+}
+
+// Value in Unit, the raw value divided by the multiplier
+func (r *Register) Scaled() float64 {
+	if r.Multiplier == 0 {
+		return float64(r.Value)
+	}
+	return float64(r.Value) / float64(r.Multiplier)
+}
+
+type Measurements struct {
+	Roomtemp1       float32 `json:"room_temp1"`        // Room temperature at panel 1
+	SupplyHeated    float32 `json:"supply_heated"`     // Supply air after heating
+	SupplyHrc       float32 `json:"supply_hrc"`        // Supply air after heat recovery
+	SupplyIntake    float32 `json:"supply_intake"`     // Outside air at the unit
+	SupplyIntake24h float32 `json:"supply_intake_24h"` // 24h average of the outside air
+	SupplyHum       float32 `json:"supply_hum"`        // Supply air humidity
+	Watertemp       float32 `json:"watertemp"`         // Heater return water
+	ExtractIntake   float32 `json:"extract_intake"`    // Extract air
+	ExtractHrc      float32 `json:"extract_hrc"`       // Extract air after heat recovery
+	ExtractHum      float32 `json:"extract_hum"`       // Extract air relative humidity
+	ExtractHum48h   float32 `json:"extract_hum_48h"`   // 48h average of the extract air humidity
+}
+
+// Modbus connection health
+type Connection struct {
+	State         string     `json:"state"` // connected, degraded or disconnected
+	Device        string     `json:"device"`
+	SlaveId       int        `json:"slave_id"`
+	LastSuccess   *time.Time `json:"last_success"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	Failures      int        `json:"consecutive_failures"`
+	Reconnects    int        `json:"reconnects"`
+}
+
+// Temporary operating mode
+type Override struct {
+	Mode             string    `json:"mode"`
+	Until            time.Time `json:"until"`
+	Setpoint         int       `json:"setpoint"`          // Raw setpoint during the override, 0 if unchanged
+	PreviousMode     string    `json:"previous_mode"`     // Mode to restore
+	PreviousSetpoint int       `json:"previous_setpoint"` // Setpoint to restore
+	Remaining        int       `json:"remaining_seconds"`
+}
+
+type Status struct {
+	HeaterPct    int          `json:"heater_pct"`
+	HrcPct       int          `json:"hrc_pct"`
+	TempSetting  float32      `json:"temp_setting"`
+	FanPct       int          `json:"fan_pct"`
+	FanPctIn     int          `json:"fan_pct_in"`
+	FanPctEx     int          `json:"fan_pct_ex"`
+	Measurements Measurements `json:"measurements"`
+	HrcEffIn     int          `json:"hrc_efficiency_in"`
+	HrcEffEx     int          `json:"hrc_efficiency_ex"`
+	OpMode       string       `json:"op_mode"`
+	Uptime       string       `json:"uptime"`
+	SystemTime   string       `json:"system_time"`
+	SnapshotAge  *float64     `json:"snapshot_age"` // Seconds since the last successful update, nil if none
+	Stale        bool         `json:"stale"`
+	Override     *Override    `json:"override"` // Active temporary mode, nil if none
+	Connection   Connection   `json:"connection"`
+	Coils        []Coil       `json:"coils"`
+}
+
+type ModeStatus struct {
+	Mode      string   `json:"mode"`      // Mode selected with the mode coils
+	Effective string   `json:"effective"` // Operating mode reported by the unit
+	Flags     []string `json:"flags"`     // Active bits of HREG_MODE
+}
+
+// Fan speed of an operating mode
+type FanLevel struct {
+	Mode     string `json:"mode"`
+	Symbol   string `json:"symbol"`
+	Address  int    `json:"address"`
+	Value    int    `json:"value"`
+	Previous *int   `json:"previous,omitempty"` // Set by SetFanLevel
+	Min      *int   `json:"min,omitempty"`
+	Max      *int   `json:"max,omitempty"`
+}
+
+type FanStatus struct {
+	Supply      int        `json:"supply_pct"`
+	Extract     int        `json:"extract_pct"`
+	Circulation int        `json:"circulation_pct"`
+	Levels      []FanLevel `json:"levels"`
+}
+
+// Single write of a batch. Value is 0 or 1 for coils
+type BatchWrite struct {
+	Type    string `json:"type"` // coil or register
+	Address int    `json:"address"`
+	Value   int    `json:"value"`
+	Confirm bool   `json:"confirm,omitempty"` // Required by the confirm write policy
+}
+
+type BatchRequest struct {
+	Atomic bool         `json:"atomic"` // Roll back all writes if one fails
+	Writes []BatchWrite `json:"writes"`
+}
+
+type BatchResult struct {
+	Type       string `json:"type"`
+	Address    int    `json:"address"`
+	Symbol     string `json:"symbol"`
+	Requested  int    `json:"requested"`
+	Previous   int    `json:"previous"`
+	Value      int    `json:"value"` // Read back value
+	OK         bool   `json:"ok"`
+	RolledBack bool   `json:"rolled_back"`
+	Error      string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	OK         bool          `json:"ok"`
+	Atomic     bool          `json:"atomic"`
+	RolledBack bool          `json:"rolled_back"`
+	Results    []BatchResult `json:"results"`
+}
+
+// Configuration of the unit: the coils and registers that aren't
+// volatile or read-only. The yaml tags are for saving it as YAML
+type Backup struct {
+	Version   int              `json:"version" yaml:"version"`
+	Created   time.Time        `json:"created" yaml:"created"`
+	Profile   string           `json:"profile,omitempty" yaml:"profile,omitempty"`       // Map profile of the unit
+	Family    *int             `json:"family,omitempty" yaml:"family,omitempty"`         // HREG_FAMILY_TYPE
+	SwVersion *float64         `json:"sw_version,omitempty" yaml:"sw_version,omitempty"` // HREG_SW_VERSION
+	Coils     []BackupCoil     `json:"coils" yaml:"coils"`
+	Registers []BackupRegister `json:"registers" yaml:"registers"`
+}
+
+type BackupCoil struct {
+	Symbol  string `json:"symbol" yaml:"symbol"`
+	Address int    `json:"address" yaml:"address"` // Informational, coils are restored by symbol
+	Value   bool   `json:"value" yaml:"value"`
+}
+
+type BackupRegister struct {
+	Symbol  string  `json:"symbol" yaml:"symbol"`
+	Address int     `json:"address" yaml:"address"` // Informational, registers are restored by symbol
+	Value   float64 `json:"value" yaml:"value"`     // Raw value divided by the multiplier
+	Unit    string  `json:"unit,omitempty" yaml:"unit,omitempty"`
+}
+
+// Difference between a backup and the unit. Coil values are 0 or 1
+type RestoreChange struct {
+	Type    string  `json:"type"`
+	Address int     `json:"address"`
+	Symbol  string  `json:"symbol"`
+	Current float64 `json:"current"` // Value of the unit before the restore
+	Backup  float64 `json:"backup"`
+	OK      bool    `json:"ok"` // Written and verified, or valid in a dry run
+	Error   string  `json:"error,omitempty"`
+}
+
+type RestoreResponse struct {
+	OK         bool            `json:"ok"`
+	DryRun     bool            `json:"dry_run"`
+	RolledBack bool            `json:"rolled_back"`
+	Unchanged  int             `json:"unchanged"` // Values already matching the backup
+	Warnings   []string        `json:"warnings,omitempty"`
+	Changes    []RestoreChange `json:"changes"`
+}
+
+// Configuration drift of the unit from the pinned baseline
+type DriftStatus struct {
+	Device    string       `json:"device"`
+	Pinned    *time.Time   `json:"pinned"`  // nil without a baseline
+	Created   *time.Time   `json:"created"` // When the baseline was read from the unit
+	LastCheck *time.Time   `json:"last_check"`
+	LastError string       `json:"last_error,omitempty"`
+	Drift     []DriftEntry `json:"drift"`
+}
+
+// Value differing from the baseline. Coil values are 0 or 1
+type DriftEntry struct {
+	Type     string    `json:"type"`
+	Address  int       `json:"address"`
+	Symbol   string    `json:"symbol"`
+	Baseline float64   `json:"baseline"`
+	Current  float64   `json:"current"`
+	Since    time.Time `json:"since"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type WritePolicy struct {
+	Symbol string `json:"symbol"`
+	Access string `json:"access"` // read, write or confirm
+	Min    *int   `json:"min,omitempty"`
+	Max    *int   `json:"max,omitempty"`
+	Step   int    `json:"step,omitempty"`
+}
+
+type OperationStats struct {
+	Requests      int        `json:"requests"`
+	Successes     int        `json:"successes"`
+	Failures      int        `json:"failures"`
+	Retries       int        `json:"retries"`
+	CRCErrors     int        `json:"crc_errors"`
+	Timeouts      int        `json:"timeouts"`
+	Exceptions    int        `json:"exceptions"`
+	OtherErrors   int        `json:"other_errors"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+type Diagnostics struct {
+	Operations         map[string]OperationStats `json:"operations"` // By Modbus operation, e.g. read_coils
+	LastError          string                    `json:"last_error,omitempty"`
+	LastErrorTime      *time.Time                `json:"last_error_time,omitempty"`
+	LastSuccessfulPoll *time.Time                `json:"last_successful_poll"`
+	Connection         Connection                `json:"connection"`
+}
+
+type Transport struct {
+	Serial   string `json:"serial_address"`
+	SlaveId  int    `json:"slave_id"`
+	BaudRate int    `json:"baud_rate"`
+	Parity   string `json:"parity"`
+}
+
+// Unit managed by the daemon
+type Device struct {
+	Id        string    `json:"id"`
+	Default   bool      `json:"default"`
+	Transport Transport `json:"transport"`
+	Profile   string    `json:"map_profile"`
+	State     string    `json:"state"`
+}
+
+type RuleCondition struct {
+	Value      string  `json:"value"`
+	Op         string  `json:"op"`
+	Threshold  float64 `json:"threshold"`
+	CompareTo  string  `json:"compare_to,omitempty"`
+	Hysteresis float64 `json:"hysteresis,omitempty"`
+	Device     string  `json:"device,omitempty"`
+}
+
+type RuleAction struct {
+	Write  string  `json:"write,omitempty"`
+	Value  float64 `json:"value"`
+	Mode   string  `json:"mode,omitempty"`
+	Device string  `json:"device,omitempty"`
+}
+
+type RuleConfig struct {
+	Name       string          `json:"name"`
+	DryRun     bool            `json:"dry_run"`
+	Conditions []RuleCondition `json:"conditions"`
+	Actions    []RuleAction    `json:"actions"`
+}
+
+type RuleLogEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Automation rule and its state
+type Rule struct {
+	Config    RuleConfig         `json:"config"`
+	For       string             `json:"for"`
+	Active    bool               `json:"active"`
+	Since     *time.Time         `json:"since"`
+	Fired     bool               `json:"fired"`
+	LastFired *time.Time         `json:"last_fired"`
+	LastError string             `json:"last_error,omitempty"`
+	Values    map[string]float64 `json:"values"`
+	Log       []RuleLogEntry     `json:"log"`
+}
+
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Remote    string    `json:"remote,omitempty"`
+	Device    string    `json:"device,omitempty"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Old       any       `json:"old"`
+	Requested any       `json:"requested"`
+	Value     any       `json:"value"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Filter of Audit, empty fields match everything
+type AuditQuery struct {
+	User    string
+	Action  string
+	Target  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int // Default 100
+}
+
+type Token struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scope    string     `json:"scope"` // read, control or admin
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires"`
+	LastUsed *time.Time `json:"last_used"`
+}
+
+type TokenRequest struct {
+	Name    string `json:"name"`
+	Scope   string `json:"scope"`
+	Expires string `json:"expires,omitempty"` // Duration, e.g. 720h. Empty for no expiry
+}
+
+// Token returned by CreateToken, with the secret that is only shown once
+type CreatedToken struct {
+	Token
+	Secret string `json:"token"`
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/0ranki/enervent-ctrl/client"
+	"github.com/0ranki/enervent-ctrl/pingvin"
+)
+
+// Error with a message for the user, keeping the original error for
+// the exit code
+type cliError struct {
+	msg string
+	err error
+}
+
+func (e *cliError) Error() string { return e.msg }
+func (e *cliError) Unwrap() error { return e.err }
+
+// Table writer for the command output
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+}
+
+// Coil or register by symbol, case insensitive. Reserved ones are skipped
+func findSymbol(coils []client.Coil, registers []client.Register, symbol string) (*client.Coil, *client.Register) {
+	for i := range coils {
+		if strings.EqualFold(coils[i].Symbol, symbol) && !coils[i].Reserved {
+			return &coils[i], nil
+		}
+	}
+	for i := range registers {
+		if strings.EqualFold(registers[i].Symbol, symbol) && !registers[i].Reserved {
+			return nil, &registers[i]
+		}
+	}
+	return nil, nil
+}
+
+// Register by symbol, error if not found
+func findRegister(registers []client.Register, symbol string) (*client.Register, error) {
+	if _, reg := findSymbol(nil, registers, symbol); reg != nil {
+		return reg, nil
+	}
+	return nil, fmt.Errorf("unknown symbol %s", symbol)
+}
+
+// Value of a register divided by the multiplier, e.g. 21.5
+func registerValue(r *client.Register) string {
+	return strconv.FormatFloat(r.Scaled(), 'f', -1, 64)
+}
+
+// Name of the value, the names of the set bits or the unit of a register
+func registerText(r *client.Register) string {
+	if name, ok := r.Enum[r.Value]; ok {
+		return name
+	}
+	if len(r.Bits) > 0 {
+		names := []string{}
+		for i, name := range r.Bits {
+			if r.Value>>i&0x1 == 1 {
+				names = append(names, name)
+			}
+		}
+		return strings.Join(names, ",")
+	}
+	return r.Unit
+}
+
+func coilValue(c *client.Coil) (string, string) {
+	if c.Value {
+		return "1", "on"
+	}
+	return "0", "off"
+}
+
+// Parse the raw value of a register from a value in the unit of the
+// register, e.g. 21.5, a name of the value or comma separated names
+// of the bits
+func parseRegisterValue(r *client.Register, s string) (int, error) {
+	for value, name := range r.Enum {
+		if strings.EqualFold(name, s) {
+			return value, nil
+		}
+	}
+	raw := 0
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		multiplier := r.Multiplier
+		if multiplier == 0 {
+			multiplier = 1
+		}
+		raw = int(math.Round(f * float64(multiplier)))
+	} else if len(r.Bits) > 0 {
+		for _, name := range strings.Split(s, ",") {
+			i := indexFold(r.Bits, strings.TrimSpace(name))
+			if i < 0 {
+				return 0, fmt.Errorf("%s: unknown bit %s, expecting one of %s", r.Symbol, name, strings.Join(r.Bits, ", "))
+			}
+			raw |= 1 << i
+		}
+	} else {
+		return 0, fmt.Errorf("%s: invalid value %s", r.Symbol, s)
+	}
+	if (r.Type == "int16" && (raw < math.MinInt16 || raw > math.MaxInt16)) || (r.Type != "int16" && (raw < 0 || raw > math.MaxUint16)) {
+		return 0, fmt.Errorf("%s: value %s out of range", r.Symbol, s)
+	}
+	return raw, nil
+}
+
+// Index of s in names, case insensitive. -1 if not found
+func indexFold(names []string, s string) int {
+	for i, name := range names {
+		if strings.EqualFold(name, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Parse the value of a coil, e.g. on or 1
+func parseCoilValue(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// Error of a failed batch write, with the message of the first failed write
+func batchError(resp *client.BatchResponse, err error) error {
+	if resp == nil {
+		return err
+	}
+	for _, res := range resp.Results {
+		if len(res.Error) > 0 && len(res.Symbol) > 0 {
+			return &cliError{fmt.Sprintf("%s: %s", res.Symbol, res.Error), err}
+		} else if len(res.Error) > 0 {
+			return &cliError{res.Error, err}
+		}
+	}
+	if client.StatusCode(err) > 0 {
+		return &cliError{"batch write failed", err}
+	}
+	return err
+}
+
+// Print the status of the unit. Exits with exitUnavailable if the
+// values are stale
+func statusCommand(ctx context.Context, args []string) error {
+	flags, opts := cliFlagSet("status", "status [-json]")
+	parseCLIFlags(flags, args, 0, 0)
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	status, err := b.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		err = printJSON(status)
+	} else {
+		printStatus(status)
+	}
+	if err == nil && (status.Stale || status.Connection.State == "disconnected") {
+		return &cliError{"the values are stale, connection " + status.Connection.State, errUnavailable}
+	}
+	return err
+}
+
+func printStatus(s *client.Status) {
+	m := s.Measurements
+	tw := newTable()
+	fmt.Fprintf(tw, "Mode\t%s\n", s.OpMode)
+	if o := s.Override; o != nil {
+		fmt.Fprintf(tw, "Override\t%s until %s, then %s\n", o.Mode, o.Until.Local().Format("15:04"), o.PreviousMode)
+	}
+	fmt.Fprintf(tw, "Setpoint\t%.1f °C\n", s.TempSetting)
+	fmt.Fprintf(tw, "Room\t%.1f °C\n", m.Roomtemp1)
+	fmt.Fprintf(tw, "Outside\t%.1f °C, 24h average %.1f °C\n", m.SupplyIntake, m.SupplyIntake24h)
+	fmt.Fprintf(tw, "Supply air\t%.1f °C, %.1f °C after heat recovery\n", m.SupplyHeated, m.SupplyHrc)
+	fmt.Fprintf(tw, "Extract air\t%.1f °C, %.1f °C after heat recovery\n", m.ExtractIntake, m.ExtractHrc)
+	fmt.Fprintf(tw, "Humidity\t%.0f %%, 48h average %.0f %%\n", m.ExtractHum, m.ExtractHum48h)
+	fmt.Fprintf(tw, "Fans\tsupply %d %%, extract %d %%\n", s.FanPctIn, s.FanPctEx)
+	fmt.Fprintf(tw, "Heat recovery\t%d %%, efficiency %d %%\n", s.HrcPct, s.HrcEffIn)
+	fmt.Fprintf(tw, "Heater\t%d %%\n", s.HeaterPct)
+	connection := s.Connection.State
+	if s.SnapshotAge != nil {
+		connection += fmt.Sprintf(", updated %s ago", time.Duration(*s.SnapshotAge*float64(time.Second)).Round(time.Second))
+	}
+	if s.Stale {
+		connection += ", stale"
+	}
+	fmt.Fprintf(tw, "Connection\t%s\n", connection)
+	_ = tw.Flush()
+}
+
+// Print the values of coils and registers by symbol
+func getCommand(ctx context.Context, args []string) error {
+	flags, opts := cliFlagSet("get", "get [-json] SYMBOL...")
+	parseCLIFlags(flags, args, 1, -1)
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	coils, err := b.Coils(ctx)
+	if err != nil {
+		return err
+	}
+	registers, err := b.Registers(ctx)
+	if err != nil {
+		return err
+	}
+	values := []any{}
+	tw := newTable()
+	for _, symbol := range flags.Args() {
+		coil, reg := findSymbol(coils, registers, symbol)
+		switch {
+		case coil != nil:
+			value, text := coilValue(coil)
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", coil.Symbol, value, text)
+			values = append(values, coil)
+		case reg != nil:
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", reg.Symbol, registerValue(reg), registerText(reg))
+			values = append(values, reg)
+		default:
+			return fmt.Errorf("unknown symbol %s", symbol)
+		}
+	}
+	if opts.json {
+		return printJSON(values)
+	}
+	return tw.Flush()
+}
+
+// Write a coil or register by symbol
+func setCommand(ctx context.Context, args []string) error {
+	flags, opts := cliFlagSet("set", "set [-confirm] SYMBOL VALUE")
+	confirm := flags.Bool("confirm", false, "Confirm the write of a register with the confirm write policy")
+	parseCLIFlags(flags, args, 2, 2)
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	coils, err := b.Coils(ctx)
+	if err != nil {
+		return err
+	}
+	registers, err := b.Registers(ctx)
+	if err != nil {
+		return err
+	}
+	symbol, arg := flags.Arg(0), flags.Arg(1)
+	write := client.BatchWrite{Confirm: *confirm}
+	coil, reg := findSymbol(coils, registers, symbol)
+	switch {
+	case coil != nil:
+		value, err := parseCoilValue(arg)
+		if err != nil {
+			return fmt.Errorf("%s: invalid value %s, expecting on or off", coil.Symbol, arg)
+		}
+		write.Type, write.Address = "coil", coil.Address
+		if value {
+			write.Value = 1
+		}
+	case reg != nil:
+		write.Type, write.Address = "register", reg.Address
+		if write.Value, err = parseRegisterValue(reg, arg); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown symbol %s", symbol)
+	}
+	resp, err := b.Batch(ctx, client.BatchRequest{Writes: []client.BatchWrite{write}})
+	if err != nil {
+		return batchError(resp, err)
+	}
+	res := resp.Results[0]
+	if opts.json {
+		return printJSON(res)
+	}
+	if coil != nil {
+		coil.Value = res.Value == 1
+		value, text := coilValue(coil)
+		fmt.Println(coil.Symbol, value, text)
+	} else {
+		reg.Value = res.Value
+		fmt.Println(strings.TrimSpace(reg.Symbol + " " + registerValue(reg) + " " + registerText(reg)))
+	}
+	return nil
+}
+
+// Print or switch the operating mode
+func modeCommand(ctx context.Context, args []string) error {
+	flags, opts := cliFlagSet("mode", "mode [-json] [MODE]", "Modes: "+strings.Join(pingvin.Modes, ", "))
+	parseCLIFlags(flags, args, 0, 1)
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	var mode *client.ModeStatus
+	if flags.NArg() == 1 {
+		mode, err = b.SetMode(ctx, flags.Arg(0))
+	} else {
+		mode, err = b.Mode(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(mode)
+	}
+	tw := newTable()
+	fmt.Fprintf(tw, "Mode\t%s\n", mode.Mode)
+	fmt.Fprintf(tw, "Effective\t%s\n", mode.Effective)
+	fmt.Fprintf(tw, "Flags\t%s\n", strings.Join(mode.Flags, ", "))
+	return tw.Flush()
+}
+
+// Change the temperature setpoint by a degree or to the given
+// temperature. The setpoint read back is checked
+func tempCommand(ctx context.Context, args []string) error {
+	flags, opts := cliFlagSet("temp", "temp [-json] up|down|DEGREES")
+	parseCLIFlags(flags, args, 1, 1)
+	arg := flags.Arg(0)
+	target, err := strconv.ParseFloat(arg, 64)
+	if err != nil && arg != "up" && arg != "down" {
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	// The status is only updated at the next poll after a write
+	registers, err := b.Registers(ctx)
+	if err != nil {
+		return err
+	}
+	setpoint, err := findRegister(registers, "HREG_T_SETPOINT")
+	if err != nil {
+		return err
+	}
+	previous := setpoint.Scaled()
+	switch arg {
+	case "up":
+		target = previous + 1
+	case "down":
+		target = previous - 1
+	}
+	reg, err := b.SetTemperature(ctx, strconv.FormatFloat(target, 'f', 1, 64))
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(reg)
+	}
+	fmt.Printf("Setpoint %.1f -> %.1f °C\n", previous, reg.Scaled())
+	return nil
+}
+
+// Print the status, or the values of the given coils and registers,
+// at intervals until interrupted
+func watchCommand(ctx context.Context, args []string) error {
+	flags, opts := cliFlagSet("watch", "watch [-json] [-interval DURATION] [-count N] [SYMBOL...]")
+	interval := flags.Duration("interval", 5*time.Second, "Interval of the updates")
+	count := flags.Int("count", 0, "Stop after N updates. Default is to run until interrupted")
+	parseCLIFlags(flags, args, 0, -1)
+	if *interval <= 0 {
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	symbols := flags.Args()
+	if !opts.json {
+		printWatchHeader(symbols)
+	}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for n := 1; ; n++ {
+		err = watchUpdate(ctx, b, symbols, opts.json)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+		}
+		if *count > 0 && n >= *count {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Width of a column of watch
+func watchWidth(symbol string) int {
+	return max(len(symbol), 8)
+}
+
+func printWatchHeader(symbols []string) {
+	if len(symbols) == 0 {
+		fmt.Printf("%-8s  %-12s  %8s  %8s  %8s  %8s  %8s  %6s  %7s  %7s  %6s\n", "TIME", "MODE", "SETPOINT", "ROOM", "OUTSIDE", "SUPPLY", "EXTRACT", "RH", "FAN IN", "FAN EX", "HRC")
+		return
+	}
+	fmt.Printf("%-8s", "TIME")
+	for _, symbol := range symbols {
+		fmt.Printf("  %*s", watchWidth(symbol), symbol)
+	}
+	fmt.Println()
+}
+
+// Print a line of watch
+func watchUpdate(ctx context.Context, b cliBackend, symbols []string, asjson bool) error {
+	now := time.Now()
+	if len(symbols) == 0 {
+		s, err := b.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if asjson {
+			return json.NewEncoder(os.Stdout).Encode(s)
+		}
+		m := s.Measurements
+		fmt.Printf("%-8s  %-12s  %8.1f  %8.1f  %8.1f  %8.1f  %8.1f  %6.0f  %7d  %7d  %6d\n", now.Format("15:04:05"), s.OpMode, s.TempSetting, m.Roomtemp1, m.SupplyIntake, m.SupplyHeated, m.ExtractIntake, m.ExtractHum, s.FanPctIn, s.FanPctEx, s.HrcPct)
+		return nil
+	}
+	coils, err := b.Coils(ctx)
+	if err != nil {
+		return err
+	}
+	registers, err := b.Registers(ctx)
+	if err != nil {
+		return err
+	}
+	values := map[string]float64{}
+	line := fmt.Sprintf("%-8s", now.Format("15:04:05"))
+	for _, symbol := range symbols {
+		coil, reg := findSymbol(coils, registers, symbol)
+		value := ""
+		switch {
+		case coil != nil:
+			value, _ = coilValue(coil)
+			values[coil.Symbol], _ = strconv.ParseFloat(value, 64)
+		case reg != nil:
+			value = registerValue(reg)
+			values[reg.Symbol] = reg.Scaled()
+		default:
+			return fmt.Errorf("unknown symbol %s", symbol)
+		}
+		line += fmt.Sprintf("  %*s", watchWidth(symbol), value)
+	}
+	if asjson {
+		return json.NewEncoder(os.Stdout).Encode(map[string]any{"time": now, "values": values})
+	}
+	fmt.Println(line)
+	return nil
+}
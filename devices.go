@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/0ranki/enervent-ctrl/pingvin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Unit managed by the daemon. Settings left empty are taken from the
+// top level of the configuration
+type deviceConf struct {
+	Id                string `yaml:"id"`
+	pingvin.Transport `yaml:",inline"`
+	Map               string                `yaml:"map,omitempty"`
+	MapProfile        string                `yaml:"map_profile,omitempty"`
+	CoilMap           string                `yaml:"coil_map,omitempty"`
+	RegisterMap       string                `yaml:"register_map,omitempty"`
+	Interval          int                   `yaml:"interval,omitempty"`
+	SlowInterval      int                   `yaml:"slow_interval,omitempty"`
+	StaleAfter        int                   `yaml:"stale_after,omitempty"`
+	Polling           []pingvin.PollTier    `yaml:"polling,omitempty"`
+	WritePolicy       []pingvin.WritePolicy `yaml:"write_policy,omitempty"` // Added to the top level write policy
+}
+
+// Unit and its configuration
+type managedDevice struct {
+	conf   deviceConf
+	device *pingvin.Pingvin
+	drift  *driftState
+}
+
+// Request context key of the device
+const deviceCtxKey ctxKey = 1
+
+// Id of the device configured at the top level
+const defaultDeviceId = "default"
+
+var (
+	devices       []*managedDevice // In configuration order, the first is the default device
+	deviceIdRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+// Endpoints available for each device under /api/v1/devices/ID/
+var deviceEndpoints = []string{"coils/", "registers/", "status", "temperature/", "batch", "mode", "modes/", "fans", "fans/", "policy", "diagnostics", "backup", "restore", "drift", "drift/"}
+
+// Device configurations with the defaults filled in from the top
+// level of the configuration. Without devices, the top level serial
+// device and map are used as the default device
+func deviceConfs() ([]deviceConf, error) {
+	confs := slices.Clone(config.Devices)
+	if len(confs) == 0 {
+		confs = []deviceConf{{Id: defaultDeviceId}}
+	}
+	ids := []string{}
+	for i := range confs {
+		conf := &confs[i]
+		if !deviceIdRegex.MatchString(conf.Id) {
+			return nil, fmt.Errorf("device %d: invalid id %q, expecting letters, digits, - and _", i+1, conf.Id)
+		}
+		if slices.Contains(ids, conf.Id) {
+			return nil, fmt.Errorf("device %s: duplicate id", conf.Id)
+		}
+		ids = append(ids, conf.Id)
+		if len(conf.Serial) == 0 {
+			conf.Serial = config.SerialAddress
+		}
+		if len(conf.Map) == 0 && len(conf.CoilMap) == 0 && len(conf.RegisterMap) == 0 {
+			conf.Map, conf.CoilMap, conf.RegisterMap = config.Map, config.CoilMap, config.RegisterMap
+		}
+		if len(conf.MapProfile) == 0 {
+			conf.MapProfile = config.MapProfile
+		}
+		if conf.Interval <= 0 {
+			conf.Interval = config.Interval
+		}
+		if conf.SlowInterval <= 0 {
+			conf.SlowInterval = config.SlowInterval
+		}
+		if conf.StaleAfter <= 0 {
+			conf.StaleAfter = config.StaleAfter
+		}
+		if len(conf.Polling) == 0 {
+			conf.Polling = config.Polling
+		}
+		conf.WritePolicy = append(slices.Clone(config.WritePolicy), conf.WritePolicy...)
+	}
+	return confs, nil
+}
+
+// Connect to the configured devices and set them up for polling. The
+// first one becomes the default device of /api/v1/
+func initDevices() error {
+	confs, err := deviceConfs()
+	if err != nil {
+		return err
+	}
+	for _, conf := range confs {
+		if len(confs) > 1 {
+			log.Println("Device", conf.Id)
+		}
+		dev, err := pingvin.New(conf.Transport, config.Debug, pingvin.MapFiles{Map: conf.Map, Coils: conf.CoilMap, Registers: conf.RegisterMap, Profile: conf.MapProfile})
+		if err != nil {
+			return fmt.Errorf("device %s: failed to load the coil and register maps: %w", conf.Id, err)
+		}
+		if err := dev.SetWritePolicies(conf.WritePolicy); err != nil {
+			return fmt.Errorf("device %s: invalid write policy configuration: %w", conf.Id, err)
+		}
+		if err := dev.SetPollTiers(conf.Polling); err != nil {
+			return fmt.Errorf("device %s: invalid polling configuration: %w", conf.Id, err)
+		}
+		dev.SetSlowInterval(time.Duration(conf.SlowInterval) * time.Second)
+		dev.SetStaleAfter(time.Duration(conf.StaleAfter) * time.Second)
+		if err := dev.SetMetrics(config.MetricsLayout, config.MetricsGroups); err != nil {
+			return fmt.Errorf("device %s: invalid metrics configuration: %w", conf.Id, err)
+		}
+		if config.EnableMetrics || len(config.MetricsAddress) > 0 {
+			prometheus.WrapRegistererWith(prometheus.Labels{"device": conf.Id}, prometheus.DefaultRegisterer).MustRegister(dev)
+		}
+		if err := dev.Update(); err != nil {
+			log.Println("ERROR: Initial update of", conf.Id, "failed:", err)
+		}
+		id := conf.Id
+		dev.OnOverrideExpired = func(mode, previousMode string, err error) {
+			entry := auditEntry{User: "system", Device: id, Action: "override", Target: mode, Old: mode, Requested: previousMode, Value: dev.CurrentMode()}
+			entry.setResult(err)
+			audit(entry)
+		}
+		if err := dev.RestoreOverride(overrideFile(conf.Id)); err != nil {
+			log.Println("ERROR: Failed to restore mode override of", conf.Id+":", err)
+		}
+		devices = append(devices, &managedDevice{conf: conf, device: dev})
+	}
+	device = devices[0].device
+	return nil
+}
+
+// Path of the persisted mode override of a device
+func overrideFile(id string) string {
+	if id == defaultDeviceId {
+		return confpath + "/override.json"
+	}
+	return confpath + "/override-" + id + ".json"
+}
+
+// Device by id, nil if not found
+func findDevice(id string) *managedDevice {
+	for _, d := range devices {
+		if d.conf.Id == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// The device of a /api/v1/devices/ID/ request, the default device for
+// the other requests
+func requestDevice(r *http.Request) *pingvin.Pingvin {
+	if d, ok := r.Context().Value(deviceCtxKey).(*managedDevice); ok {
+		return d.device
+	}
+	return device
+}
+
+// The managed device of a request, see requestDevice
+func requestManagedDevice(r *http.Request) *managedDevice {
+	if d, ok := r.Context().Value(deviceCtxKey).(*managedDevice); ok {
+		return d
+	}
+	return devices[0]
+}
+
+// Id of the device of a /api/v1/devices/ID/ request, empty for the
+// default device
+func requestDeviceId(r *http.Request) string {
+	if d, ok := r.Context().Value(deviceCtxKey).(*managedDevice); ok {
+		return d.conf.Id
+	}
+	return ""
+}
+
+// Summary of a device for /api/v1/devices
+type deviceInfo struct {
+	Id        string            `json:"id"`
+	Default   bool              `json:"default"`
+	Transport pingvin.Transport `json:"transport"`
+	Profile   string            `json:"map_profile"`
+	State     string            `json:"state"`
+}
+
+func (d *managedDevice) info() deviceInfo {
+	return deviceInfo{Id: d.conf.Id, Default: d.device == device, Transport: d.device.Transport(), Profile: d.device.Profile, State: d.device.Health().State}
+}
+
+// /api/v1/devices endpoint, the configured devices
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	infos := []deviceInfo{}
+	for _, d := range devices {
+		infos = append(infos, d.info())
+	}
+	_ = json.NewEncoder(w).Encode(infos)
+}
+
+// /api/v1/devices/ID/... requests are served by the /api/v1/...
+// handlers for the device ID, checking the role of the user again.
+// /api/v1/devices/ID describes the device
+func deviceRouter(w http.ResponseWriter, r *http.Request) {
+	id, endpoint, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/devices/"), "/")
+	d := findDevice(id)
+	if d == nil {
+		http.Error(w, "Unknown device "+id, http.StatusNotFound)
+		return
+	}
+	if len(endpoint) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(d.info())
+		return
+	}
+	// e.g. coils is served as coils/, instead of redirecting
+	// to the default device
+	if slices.Contains(deviceEndpoints, endpoint+"/") && !slices.Contains(deviceEndpoints, endpoint) {
+		endpoint += "/"
+	}
+	if !slices.ContainsFunc(deviceEndpoints, func(e string) bool {
+		return endpoint == e || (strings.HasSuffix(e, "/") && strings.HasPrefix(endpoint, e))
+	}) {
+		http.NotFound(w, r)
+		return
+	}
+	r2 := r.Clone(context.WithValue(r.Context(), deviceCtxKey, d))
+	r2.URL.Path = "/api/v1/" + endpoint
+	r2.URL.RawPath = ""
+	http.DefaultServeMux.ServeHTTP(w, r2)
+}
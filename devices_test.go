@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/0ranki/enervent-ctrl/pingvin"
+)
+
+func TestDeviceConfs(t *testing.T) {
+	policy := pingvin.WritePolicy{Symbol: "HREG_T_SETPOINT", Access: "write"}
+	config = Conf{SerialAddress: "/dev/ttyS0", Map: "map.yaml", Interval: 4, SlowInterval: 300, StaleAfter: 12, WritePolicy: []pingvin.WritePolicy{policy}}
+	confs, err := deviceConfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(confs) != 1 || confs[0].Id != defaultDeviceId || confs[0].Serial != "/dev/ttyS0" || confs[0].Map != "map.yaml" || confs[0].Interval != 4 || len(confs[0].WritePolicy) != 1 {
+		t.Errorf("unexpected default device %+v", confs)
+	}
+	config.Devices = []deviceConf{
+		{Id: "a", Transport: pingvin.Transport{Serial: "/dev/ttyUSB0", SlaveId: 2}, Interval: 10},
+		{Id: "b", CoilMap: "coils.csv", WritePolicy: []pingvin.WritePolicy{{Symbol: "HREG_T_SETPOINT", Access: "read"}}},
+	}
+	if confs, err = deviceConfs(); err != nil {
+		t.Fatal(err)
+	}
+	if a := confs[0]; a.Serial != "/dev/ttyUSB0" || a.SlaveId != 2 || a.Map != "map.yaml" || a.Interval != 10 || a.SlowInterval != 300 {
+		t.Errorf("unexpected device a %+v", a)
+	}
+	// The CSV coil map replaces the top level map, the device write policy comes last
+	if b := confs[1]; b.Serial != "/dev/ttyS0" || len(b.Map) > 0 || b.Interval != 4 || len(b.WritePolicy) != 2 || b.WritePolicy[1].Access != "read" {
+		t.Errorf("unexpected device b %+v", b)
+	}
+	for _, invalid := range [][]deviceConf{{{Id: "a"}, {Id: "a"}}, {{Id: ""}}, {{Id: "a/b"}}} {
+		config.Devices = invalid
+		if _, err := deviceConfs(); err == nil {
+			t.Errorf("expecting error for devices %+v", invalid)
+		}
+	}
+}
+
+func TestDeviceRouter(t *testing.T) {
+	devices = []*managedDevice{{conf: deviceConf{Id: "a"}, device: &pingvin.Pingvin{}}, {conf: deviceConf{Id: "b"}, device: &pingvin.Pingvin{}}}
+	device = devices[0].device
+	defer func() { devices, device = nil, &pingvin.Pingvin{} }()
+	http.HandleFunc("/api/v1/coils/", func(w http.ResponseWriter, r *http.Request) {
+		if requestDevice(r) != devices[1].device || requestDeviceId(r) != "b" {
+			t.Errorf("%s: expecting device b", r.URL.Path)
+		}
+		w.Write([]byte(r.URL.Path))
+	})
+	tests := map[string]int{
+		"/api/v1/devices/b/coils":    http.StatusOK,
+		"/api/v1/devices/b/coils/10": http.StatusOK,
+		"/api/v1/devices/c/coils":    http.StatusNotFound,
+		"/api/v1/devices/b/tokens":   http.StatusNotFound,
+	}
+	for path, code := range tests {
+		w := httptest.NewRecorder()
+		deviceRouter(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Errorf("%s: expecting status %d, got %d", path, code, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	deviceRouter(w, httptest.NewRequest("GET", "/api/v1/devices/b/coils", nil))
+	if w.Body.String() != "/api/v1/coils/" {
+		t.Errorf("expecting the request to be served as /api/v1/coils/, got %s", w.Body.String())
+	}
+}
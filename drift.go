@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0ranki/enervent-ctrl/pingvin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Drift detection configuration. The configuration of each unit with
+// a pinned baseline is compared against the baseline every interval
+type driftConf struct {
+	Interval int      `yaml:"interval"`           // Seconds between checks
+	Webhooks []string `yaml:"webhooks,omitempty"` // URLs receiving the drift status as a JSON POST when it changes
+}
+
+// Value of the unit differing from the baseline. Coil values are 0 or 1
+type driftEntry struct {
+	Type     string    `json:"type"`
+	Address  int       `json:"address"`
+	Symbol   string    `json:"symbol"`
+	Baseline float64   `json:"baseline"`
+	Current  float64   `json:"current"`
+	Since    time.Time `json:"since"`           // First check finding the current value
+	Error    string    `json:"error,omitempty"` // e.g. the symbol is no longer in the map
+}
+
+// Baseline as persisted in the baseline file
+type driftBaseline struct {
+	Pinned time.Time       `json:"pinned"`
+	Backup *pingvin.Backup `json:"backup"`
+}
+
+// Drift state of a device, returned by /api/v1/drift
+type driftState struct {
+	lock      *sync.Mutex
+	file      string
+	baseline  *pingvin.Backup
+	Device    string        `json:"device"`
+	Pinned    *time.Time    `json:"pinned"`  // nil without a baseline
+	Created   *time.Time    `json:"created"` // When the baseline was read from the unit
+	LastCheck *time.Time    `json:"last_check"`
+	LastError string        `json:"last_error,omitempty"`
+	Drift     []*driftEntry `json:"drift"`
+}
+
+var (
+	driftValuesDesc    = prometheus.NewDesc("pingvin_drift_values", "Coils and registers differing from the pinned baseline", nil, nil)
+	driftLastCheckDesc = prometheus.NewDesc("pingvin_drift_last_check_timestamp_seconds", "Time of the last successful drift check", nil, nil)
+	webhookClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Validate the drift configuration and load the pinned baselines
+func initDrift() error {
+	if config.Drift.Interval <= 0 {
+		config.Drift.Interval = 900
+	}
+	for _, hook := range config.Drift.Webhooks {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid webhook %q, expecting an http or https URL", hook)
+		}
+	}
+	for _, d := range devices {
+		d.drift = &driftState{lock: &sync.Mutex{}, file: baselineFile(d.conf.Id), Device: d.conf.Id, Drift: []*driftEntry{}}
+		if err := d.drift.load(); err != nil {
+			return err
+		}
+		if d.drift.baseline != nil {
+			log.Println("Loaded configuration baseline of", d.conf.Id, "pinned at", d.drift.Pinned.Format(time.RFC3339))
+		}
+		if config.EnableMetrics || len(config.MetricsAddress) > 0 {
+			prometheus.WrapRegistererWith(prometheus.Labels{"device": d.conf.Id}, prometheus.DefaultRegisterer).MustRegister(d.drift)
+		}
+	}
+	return nil
+}
+
+// Path of the pinned baseline of a device
+func baselineFile(id string) string {
+	if id == defaultDeviceId {
+		return confpath + "/baseline.json"
+	}
+	return confpath + "/baseline-" + id + ".json"
+}
+
+// Read the baseline from the baseline file if it exists
+func (s *driftState) load() error {
+	data, err := os.ReadFile(s.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	baseline := &driftBaseline{}
+	if err := json.Unmarshal(data, baseline); err != nil || baseline.Backup == nil {
+		return fmt.Errorf("%s: invalid baseline: %v", s.file, err)
+	}
+	s.baseline, s.Pinned, s.Created = baseline.Backup, &baseline.Pinned, &baseline.Backup.Created
+	return nil
+}
+
+// Pin b as the baseline, or remove the baseline if b is nil
+func (s *driftState) pin(b *pingvin.Backup) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if b == nil {
+		if err := os.Remove(s.file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.baseline, s.Pinned, s.Created = nil, nil, nil
+	} else {
+		baseline := &driftBaseline{Pinned: time.Now(), Backup: b}
+		data, err := json.MarshalIndent(baseline, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(s.file, data, 0600); err != nil {
+			return err
+		}
+		s.baseline, s.Pinned, s.Created = b, &baseline.Pinned, &b.Created
+	}
+	s.LastCheck, s.LastError, s.Drift = nil, "", []*driftEntry{}
+	return nil
+}
+
+// Compare the unit against the baseline. Invalid baseline entries,
+// e.g. symbols missing from the map after a firmware update, are
+// reported as drift and the rest of the baseline is checked
+func (d *managedDevice) checkDrift(now time.Time) {
+	d.drift.lock.Lock()
+	baseline := d.drift.baseline
+	d.drift.lock.Unlock()
+	if baseline == nil {
+		return
+	}
+	invalid := []*pingvin.RestoreChange{}
+	resp, err := d.device.Restore(baseline, true, true)
+	if errors.Is(err, pingvin.ErrValidation) && len(resp.Changes) > 0 {
+		valid := *baseline
+		valid.Coils = slices.DeleteFunc(slices.Clone(valid.Coils), func(c pingvin.BackupCoil) bool { return invalidChange(resp.Changes, c.Symbol) })
+		valid.Registers = slices.DeleteFunc(slices.Clone(valid.Registers), func(r pingvin.BackupRegister) bool { return invalidChange(resp.Changes, r.Symbol) })
+		for _, change := range resp.Changes {
+			if len(change.Error) > 0 {
+				invalid = append(invalid, change)
+			}
+		}
+		resp, err = d.device.Restore(&valid, true, true)
+	}
+	d.drift.lock.Lock()
+	defer d.drift.lock.Unlock()
+	// Pinned or unpinned during the check
+	if d.drift.baseline != baseline {
+		return
+	}
+	if err != nil {
+		log.Println("ERROR: Drift check of", d.conf.Id, "failed:", err)
+		d.drift.LastError = err.Error()
+		return
+	}
+	if d.drift.update(now, append(invalid, resp.Changes...)) {
+		status, err := json.Marshal(d.drift)
+		if err != nil {
+			log.Println("ERROR: drift:", err)
+			return
+		}
+		notifyDrift(status)
+	}
+}
+
+// Whether the change of symbol is invalid
+func invalidChange(changes []*pingvin.RestoreChange, symbol string) bool {
+	return slices.ContainsFunc(changes, func(c *pingvin.RestoreChange) bool {
+		return c.Symbol == symbol && len(c.Error) > 0
+	})
+}
+
+// Replace the drift with the differences found at now, keeping the
+// time values were first found. Returns whether the drift changed.
+// s.lock must be held by the caller
+func (s *driftState) update(now time.Time, changes []*pingvin.RestoreChange) bool {
+	drift := []*driftEntry{}
+	changed := len(changes) != len(s.Drift)
+	for _, c := range changes {
+		entry := &driftEntry{Type: c.Type, Address: c.Address, Symbol: c.Symbol, Baseline: c.Backup, Current: c.Current, Since: now, Error: c.Error}
+		i := slices.IndexFunc(s.Drift, func(e *driftEntry) bool { return e.Symbol == c.Symbol })
+		if i >= 0 && s.Drift[i].Current == c.Current && s.Drift[i].Baseline == c.Backup {
+			entry.Since = s.Drift[i].Since
+		} else {
+			changed = true
+			if len(c.Error) > 0 {
+				log.Printf("WARNING: Configuration drift on %s: %s: %s", s.Device, c.Symbol, c.Error)
+			} else {
+				log.Printf("WARNING: Configuration drift on %s: %s is %g, baseline %g", s.Device, c.Symbol, c.Current, c.Backup)
+			}
+		}
+		drift = append(drift, entry)
+	}
+	if changed && len(drift) == 0 {
+		log.Println("Configuration of", s.Device, "matches the baseline again")
+	}
+	s.Drift, s.LastCheck, s.LastError = drift, &now, ""
+	return changed
+}
+
+// POST the drift status to the configured webhooks
+func notifyDrift(status []byte) {
+	for _, hook := range config.Drift.Webhooks {
+		go func() {
+			resp, err := webhookClient.Post(hook, "application/json", bytes.NewReader(status))
+			if err != nil {
+				log.Println("ERROR: Drift webhook failed:", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				log.Println("ERROR: Drift webhook", hook, "returned", resp.Status)
+			}
+		}()
+	}
+}
+
+// Check the devices with a baseline on startup and every interval seconds
+func runDrift(ctx context.Context, interval int) {
+	for {
+		for _, d := range devices {
+			d.checkDrift(time.Now())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
+		}
+	}
+}
+
+// Implements prometheus.Describe()
+func (s *driftState) Describe(ch chan<- *prometheus.Desc) {
+	ch <- driftValuesDesc
+	ch <- driftLastCheckDesc
+}
+
+// Implements prometheus.Collect(). Nothing is exported without a baseline
+func (s *driftState) Collect(ch chan<- prometheus.Metric) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.baseline == nil || s.LastCheck == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(driftValuesDesc, prometheus.GaugeValue, float64(len(s.Drift)))
+	ch <- prometheus.MustNewConstMetric(driftLastCheckDesc, prometheus.GaugeValue, float64(s.LastCheck.Unix()))
+}
+
+// /api/v1/drift endpoint. /api/v1/drift/baseline pins a baseline and
+// /api/v1/drift/revert writes baseline values back to the unit
+func driftHandler(w http.ResponseWriter, r *http.Request) {
+	d := requestManagedDevice(r)
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/drift"), "/") {
+	case "":
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		d.drift.lock.Lock()
+		defer d.drift.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(d.drift)
+	case "baseline":
+		driftBaselineHandler(w, r, d)
+	case "revert":
+		driftRevert(w, r, d)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// /api/v1/drift/baseline endpoint. POST pins the backup in the body,
+// or the current configuration of the unit without a body
+func driftBaselineHandler(w http.ResponseWriter, r *http.Request, d *managedDevice) {
+	switch r.Method {
+	case "GET":
+		d.drift.lock.Lock()
+		baseline := d.drift.baseline
+		d.drift.lock.Unlock()
+		if baseline == nil {
+			http.Error(w, "No baseline pinned", http.StatusNotFound)
+			return
+		}
+		writeBackup(w, r, baseline)
+	case "POST":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b := &pingvin.Backup{}
+		if len(bytes.TrimSpace(data)) == 0 {
+			if b, err = d.device.Backup(); err != nil {
+				log.Println("ERROR: Backup:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if err := parseBackup(data, b); err != nil {
+			http.Error(w, "Invalid backup: "+err.Error(), http.StatusBadRequest)
+			return
+		} else if b.Version != pingvin.BackupVersion {
+			http.Error(w, fmt.Sprintf("Invalid backup: unsupported backup version %d", b.Version), http.StatusBadRequest)
+			return
+		}
+		err = d.drift.pin(b)
+		entry := auditEntry{Action: "baseline", Target: "pin", Requested: b.Created}
+		entry.setResult(err)
+		auditRequest(r, entry)
+		if err != nil {
+			log.Println("ERROR: Failed to pin the baseline:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Println("Pinned the configuration baseline of", d.conf.Id)
+		d.checkDrift(time.Now())
+		d.drift.lock.Lock()
+		defer d.drift.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(d.drift)
+	case "DELETE":
+		err := d.drift.pin(nil)
+		entry := auditEntry{Action: "baseline", Target: "unpin"}
+		entry.setResult(err)
+		auditRequest(r, entry)
+		if err != nil {
+			log.Println("ERROR: Failed to remove the baseline:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Println("Removed the configuration baseline of", d.conf.Id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// /api/v1/drift/revert endpoint. Writes the baseline values of the
+// symbols in the body, {"symbols": [...]}, or of all drifted values
+// without a body
+func driftRevert(w http.ResponseWriter, r *http.Request, d *managedDevice) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if config.ReadOnly {
+		log.Println("WARNING: Read only mode, refusing to write to device")
+		auditRequest(r, auditEntry{Action: "revert", Target: "revert", Outcome: auditRefused})
+		http.Error(w, "Read only mode", http.StatusForbidden)
+		return
+	}
+	req := struct {
+		Symbols []string `json:"symbols"`
+	}{}
+	data, err := io.ReadAll(r.Body)
+	if err == nil && len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, &req)
+	}
+	if err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.drift.lock.Lock()
+	baseline := d.drift.baseline
+	if len(req.Symbols) == 0 {
+		for _, entry := range d.drift.Drift {
+			if len(entry.Error) == 0 {
+				req.Symbols = append(req.Symbols, entry.Symbol)
+			}
+		}
+	}
+	d.drift.lock.Unlock()
+	if baseline == nil {
+		http.Error(w, "No baseline pinned", http.StatusConflict)
+		return
+	}
+	revert := *baseline
+	revert.Coils, revert.Registers = []pingvin.BackupCoil{}, []pingvin.BackupRegister{}
+	for _, symbol := range req.Symbols {
+		if i := slices.IndexFunc(baseline.Coils, func(c pingvin.BackupCoil) bool { return c.Symbol == symbol }); i >= 0 {
+			revert.Coils = append(revert.Coils, baseline.Coils[i])
+		} else if i := slices.IndexFunc(baseline.Registers, func(r pingvin.BackupRegister) bool { return r.Symbol == symbol }); i >= 0 {
+			revert.Registers = append(revert.Registers, baseline.Registers[i])
+		} else {
+			http.Error(w, symbol+" is not in the baseline", http.StatusBadRequest)
+			return
+		}
+	}
+	resp, err := d.device.Restore(&revert, false, r.URL.Query().Get("confirm") == "true")
+	auditRestore(r, "revert", resp, err)
+	d.checkDrift(time.Now())
+	writeRestoreResponse(w, resp, err)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0ranki/enervent-ctrl/pingvin"
+)
+
+func TestDriftUpdate(t *testing.T) {
+	s := &driftState{lock: &sync.Mutex{}, Device: "default", Drift: []*driftEntry{}}
+	start := time.Now()
+	setpoint := &pingvin.RestoreChange{Type: "register", Address: 135, Symbol: "HREG_T_SETPOINT", Current: 20, Backup: 21.5}
+	heating := &pingvin.RestoreChange{Type: "coil", Address: 54, Symbol: "COIL_HEATING_EN", Current: 1, Backup: 0}
+	if !s.update(start, []*pingvin.RestoreChange{setpoint}) || len(s.Drift) != 1 {
+		t.Fatalf("expecting drift, got %+v", s.Drift)
+	}
+	// The same drift is not a change and keeps the time it was found
+	if s.update(start.Add(time.Hour), []*pingvin.RestoreChange{setpoint}) {
+		t.Error("unchanged drift reported as changed")
+	}
+	if !s.Drift[0].Since.Equal(start) || !s.LastCheck.Equal(start.Add(time.Hour)) {
+		t.Errorf("unexpected since %s, last check %s", s.Drift[0].Since, s.LastCheck)
+	}
+	if !s.update(start.Add(2*time.Hour), []*pingvin.RestoreChange{setpoint, heating}) || !s.Drift[1].Since.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("new drift not reported, got %+v", s.Drift[1])
+	}
+	setpoint.Current = 19
+	if !s.update(start.Add(3*time.Hour), []*pingvin.RestoreChange{setpoint, heating}) || !s.Drift[0].Since.Equal(start.Add(3*time.Hour)) {
+		t.Errorf("changed value not reported, got %+v", s.Drift[0])
+	}
+	if !s.update(start.Add(4*time.Hour), nil) || len(s.Drift) != 0 {
+		t.Errorf("expecting no drift, got %+v", s.Drift)
+	}
+}
+
+func TestDriftHandler(t *testing.T) {
+	confpath = t.TempDir()
+	devices = []*managedDevice{{conf: deviceConf{Id: defaultDeviceId}, device: &pingvin.Pingvin{}}}
+	config = Conf{}
+	if err := initDrift(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/api/v1/drift", "", http.StatusOK},
+		{"GET", "/api/v1/drift/baseline", "", http.StatusNotFound},
+		{"POST", "/api/v1/drift/baseline", `{"version": 2}`, http.StatusBadRequest},
+		{"POST", "/api/v1/drift/baseline", `coils: [`, http.StatusBadRequest},
+		{"POST", "/api/v1/drift/revert", "", http.StatusConflict},
+		{"DELETE", "/api/v1/drift/baseline", "", http.StatusNoContent},
+		{"GET", "/api/v1/drift/other", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		driftHandler(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if w.Code != test.code {
+			t.Errorf("%s %s: got %d, expecting %d", test.method, test.path, w.Code, test.code)
+		}
+	}
+
+	// Baselines are persisted
+	b := &pingvin.Backup{Version: pingvin.BackupVersion, Created: time.Now().Truncate(time.Second), Registers: []pingvin.BackupRegister{{Symbol: "HREG_T_SETPOINT", Value: 21.5}}}
+	if err := devices[0].drift.pin(b); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &driftState{lock: &sync.Mutex{}, file: baselineFile(defaultDeviceId)}
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.baseline == nil || len(loaded.baseline.Registers) != 1 || !loaded.Created.Equal(b.Created) {
+		t.Errorf("unexpected baseline %+v", loaded.baseline)
+	}
+	w := httptest.NewRecorder()
+	driftHandler(w, httptest.NewRequest("POST", "/api/v1/drift/revert", strings.NewReader(`{"symbols": ["HREG_NOT_FOUND"]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("revert of a symbol not in the baseline: got %d, expecting 400", w.Code)
+	}
+
+	config.Drift.Webhooks = []string{"ftp://example.com"}
+	if err := initDrift(); err == nil {
+		t.Error("expecting error for a webhook that isn't http")
+	}
+}
@@ -5,8 +5,12 @@ go 1.22
 require (
 	github.com/0ranki/https-go v0.0.0-20230314073101-4eca22af948c
 	github.com/goburrow/modbus v0.1.0
+	github.com/goburrow/serial v0.1.0
 	github.com/gorilla/handlers v1.5.2
 	github.com/prometheus/client_golang v1.19.0
+	github.com/prometheus/client_model v0.6.0
+	golang.org/x/crypto v0.21.0
+	golang.org/x/term v0.18.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -14,9 +18,7 @@ require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/felixge/httpsnoop v1.0.4 // indirect
-	github.com/goburrow/serial v0.1.0 // indirect
-	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
-	github.com/prometheus/client_model v0.6.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
 	github.com/prometheus/common v0.50.0 // indirect
 	github.com/prometheus/procfs v0.13.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
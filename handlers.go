@@ -1,78 +1,28 @@
 package main
 
 import (
-	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
-)
+	"time"
 
-// HTTP Basic Authentication middleware for http.HandlerFunc
-// This is used for the API
-func authHandlerFunc(next http.HandlerFunc) http.HandlerFunc {
-	// Based on https://www.alexedwards.net/blog/basic-authentication-in-go
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if config.DisableAuth {
-			next.ServeHTTP(w, r)
-			return
-		}
-		user, pass, ok := r.BasicAuth()
-		if ok {
-			userHash := sha256.Sum256([]byte(user))
-			passHash := sha256.Sum256([]byte(pass))
-			usernameMatch := (subtle.ConstantTimeCompare(userHash[:], usernamehash[:]) == 1)
-			passwordMatch := (subtle.ConstantTimeCompare(passHash[:], passwordhash[:]) == 1)
-			if usernameMatch && passwordMatch {
-				next.ServeHTTP(w, r)
-				return
-			}
-		}
-		if len(user) == 0 {
-			user = "-"
-		}
-		log.Println("Authentication failed: IP:", r.RemoteAddr, "URI:", r.RequestURI, "username:", user)
-		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-	})
-}
-
-// HTTP Basic Authentication middleware for http.Handler
-// Used for the HTML monitor views
-func authHandler(next http.Handler) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if config.DisableAuth {
-			next.ServeHTTP(w, r)
-			return
-		}
-		user, pass, ok := r.BasicAuth()
-		if ok {
-			userHash := sha256.Sum256([]byte(user))
-			passHash := sha256.Sum256([]byte(pass))
-			usernameMatch := (subtle.ConstantTimeCompare(userHash[:], usernamehash[:]) == 1)
-			passwordMatch := (subtle.ConstantTimeCompare(passHash[:], passwordhash[:]) == 1)
-			if usernameMatch && passwordMatch {
-				next.ServeHTTP(w, r)
-				return
-			}
-		}
-		if len(user) == 0 {
-			user = "-"
-		}
-		log.Println("Authentication failed: IP:", r.RemoteAddr, "URI:", r.RequestURI, "username:", user)
-		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-	})
-}
+	"github.com/0ranki/enervent-ctrl/pingvin"
+)
 
 // /api/v1/coils endpoint
 func coils(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
 	w.Header().Set("Content-Type", "application/json")
+	lang := responseLanguage(w, r)
 	pathparams := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/coils/"), "/")
 	if len(pathparams[0]) == 0 {
-		_ = json.NewEncoder(w).Encode(device.Coils)
+		dev.MarkStale()
+		_ = json.NewEncoder(w).Encode(dev.LocalizedCoils(lang))
 	} else if len(pathparams[0]) > 0 && r.Method == "GET" && len(pathparams) < 2 { // && r.Method == "POST"
 		intaddr, err := strconv.Atoi(pathparams[0])
 		if err != nil {
@@ -80,11 +30,15 @@ func coils(w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 			return
 		}
-		err = device.ReadCoil(uint16(intaddr))
+		if intaddr < 0 || intaddr >= len(dev.Coils) {
+			http.Error(w, "Coil address out of range", http.StatusNotFound)
+			return
+		}
+		err = dev.ReadCoil(uint16(intaddr))
 		if err != nil {
 			log.Println("ERROR ReadCoil: client.ReadCoils: ", err)
 		}
-		_ = json.NewEncoder(w).Encode(device.Coils[intaddr])
+		_ = json.NewEncoder(w).Encode(dev.Coils[intaddr].Localize(lang))
 	} else if len(pathparams[0]) > 0 && r.Method == "POST" && len(pathparams) == 2 {
 		intaddr, err := strconv.Atoi(pathparams[0])
 		if err != nil {
@@ -98,12 +52,13 @@ func coils(w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 			return
 		}
-		if config.ReadOnly {
-			log.Println("WARNING: Read only mode, refusing to write to device")
-		} else {
-			device.WriteCoil(uint16(intaddr), boolval)
+		if intaddr < 0 || intaddr >= len(dev.Coils) {
+			http.Error(w, "Coil address out of range", http.StatusNotFound)
+			return
+		}
+		if writeCoil(w, r, intaddr, boolval) {
+			_ = json.NewEncoder(w).Encode(dev.Coils[intaddr].Localize(lang))
 		}
-		_ = json.NewEncoder(w).Encode(device.Coils[intaddr])
 	} else if len(pathparams[0]) > 0 && r.Method == "POST" && len(pathparams) == 1 {
 		intaddr, err := strconv.Atoi(pathparams[0])
 		if err != nil {
@@ -111,21 +66,25 @@ func coils(w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 			return
 		}
-		if config.ReadOnly {
-			log.Println("WARNING: Read only mode, refusing to write to device")
-		} else {
-			device.WriteCoil(uint16(intaddr), !device.Coils[intaddr].Value)
+		if intaddr < 0 || intaddr >= len(dev.Coils) {
+			http.Error(w, "Coil address out of range", http.StatusNotFound)
+			return
+		}
+		if writeCoil(w, r, intaddr, !dev.Coils[intaddr].Value) {
+			_ = json.NewEncoder(w).Encode(dev.Coils[intaddr].Localize(lang))
 		}
-		_ = json.NewEncoder(w).Encode(device.Coils[intaddr])
 	}
 }
 
 // /api/v1/registers endpoint
 func registers(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
 	w.Header().Set("Content-Type", "application/json")
+	lang := responseLanguage(w, r)
 	pathparams := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/registers/"), "/")
 	if len(pathparams[0]) == 0 {
-		_ = json.NewEncoder(w).Encode(device.Registers)
+		dev.MarkStale()
+		_ = json.NewEncoder(w).Encode(dev.LocalizedRegisters(lang))
 	} else if len(pathparams[0]) > 0 && r.Method == "GET" && len(pathparams) < 2 { // && r.Method == "POST"
 		intaddr, err := strconv.Atoi(pathparams[0])
 		if err != nil {
@@ -133,11 +92,15 @@ func registers(w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 			return
 		}
-		_, err = device.ReadRegister(uint16(intaddr))
+		if intaddr < 0 || intaddr >= len(dev.Registers) {
+			http.Error(w, "Register address out of range", http.StatusNotFound)
+			return
+		}
+		_, err = dev.ReadRegister(uint16(intaddr))
 		if err != nil {
 			log.Println("ERROR: ReadRegister:", err)
 		}
-		_ = json.NewEncoder(w).Encode(device.Registers[intaddr])
+		_ = json.NewEncoder(w).Encode(dev.Registers[intaddr].Localize(lang))
 	} else if len(pathparams[0]) > 0 && r.Method == "POST" && len(pathparams) == 2 {
 		intaddr, err := strconv.Atoi(pathparams[0])
 		if err != nil {
@@ -151,35 +114,446 @@ func registers(w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 			return
 		}
+		if intaddr < 0 || intaddr >= len(dev.Registers) {
+			http.Error(w, "Register address out of range", http.StatusNotFound)
+			return
+		}
+		entry := auditEntry{Action: "register", Target: dev.Registers[intaddr].Symbol, Old: dev.Registers[intaddr].Value, Requested: intval}
 		if config.ReadOnly {
 			log.Println("WARNING: Read only mode, refusing to write to device")
+			entry.Outcome = auditRefused
 		} else {
-			_, err = device.WriteRegister(uint16(intaddr), uint16(intval))
-			if err != nil {
-				log.Println(err)
+			// Signed values are accepted as two's complement for compatibility
+			if intval > 32767 && intval <= 65535 && dev.Registers[intaddr].Type == "int16" {
+				intval -= 65536
+			}
+			write := pingvin.BatchWrite{Type: "register", Address: intaddr, Value: pingvin.BatchValue(intval), Confirm: r.URL.Query().Get("confirm") == "true"}
+			_, err = dev.WriteBatch([]pingvin.BatchWrite{write}, false)
+			if errors.Is(err, pingvin.ErrValidation) {
+				log.Println("ERROR: registers:", err)
+				entry.Outcome, entry.Error = auditInvalid, err.Error()
+				auditRequest(r, entry)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				log.Println("ERROR: registers:", err)
 			}
+			entry.setResult(err)
 		}
-		_ = json.NewEncoder(w).Encode(device.Registers[intaddr])
+		entry.Value = dev.Registers[intaddr].Value
+		auditRequest(r, entry)
+		_ = json.NewEncoder(w).Encode(dev.Registers[intaddr].Localize(lang))
 	}
 }
 
 // /status endpoint
 func status(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(device.Status)
+	status := dev.CurrentStatus()
+	if lang := responseLanguage(w, r); len(status.Coils) > 0 {
+		status.Coils = dev.LocalizedCoils(lang)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// Choose the language of the names and descriptions in the response
+// and set the response headers accordingly. Empty for the texts of the
+// map itself
+func responseLanguage(w http.ResponseWriter, r *http.Request) string {
+	dev := requestDevice(r)
+	w.Header().Add("Vary", "Accept-Language")
+	lang := requestLanguage(r, dev.Languages())
+	if len(lang) > 0 {
+		w.Header().Set("Content-Language", lang)
+	}
+	return lang
+}
+
+// The lang query parameter, or the preferred language of the
+// Accept-Language header, if the map has labels in it
+func requestLanguage(r *http.Request, languages []string) string {
+	if lang := strings.ToLower(r.URL.Query().Get("lang")); len(lang) > 0 {
+		if slices.Contains(languages, lang) {
+			return lang
+		}
+		return ""
+	}
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	accepted := []weighted{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		// fi-FI is matched as fi
+		lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if q > 0 && slices.Contains(languages, lang) {
+			accepted = append(accepted, weighted{lang, q})
+		}
+	}
+	slices.SortStableFunc(accepted, func(a, b weighted) int {
+		if a.q > b.q {
+			return -1
+		} else if a.q < b.q {
+			return 1
+		}
+		return 0
+	})
+	if len(accepted) > 0 {
+		return accepted[0].lang
+	}
+	return ""
+}
+
+// /api/v1/diagnostics endpoint, Modbus request statistics
+func diagnostics(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(dev.Diagnostics())
+}
+
+// /healthz endpoint, the process is up and serving requests
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// /api/v1/openapi.json endpoint, the OpenAPI document of the API
+func openapi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openapiDoc)
+}
+
+// /readyz endpoint, all coils and registers of every device have been
+// read successfully within the last ready_intervals update intervals
+func readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	for _, d := range devices {
+		if err := ready(d.device.Health().LastSuccess, d.conf.Interval, time.Now()); err != nil {
+			if len(devices) > 1 {
+				err = fmt.Errorf("%s: %w", d.conf.Id, err)
+			}
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Returns an error if lastpoll is nil or too old at now
+func ready(lastpoll *time.Time, interval int, now time.Time) error {
+	if lastpoll == nil {
+		return fmt.Errorf("no successful poll yet")
+	}
+	maxage := time.Duration(config.ReadyIntervals*interval) * time.Second
+	if age := now.Sub(*lastpoll); age > maxage {
+		return fmt.Errorf("last successful poll %s ago", age.Round(time.Second))
+	}
+	return nil
 }
 
 // /api/v1/temperature endpoint
 func temperature(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
 	w.Header().Set("Content-Type", "application/json")
 	pathparams := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/temperature/"), "/")
 	if len(pathparams[0]) > 0 && r.Method == "POST" && len(pathparams) == 1 {
-		err := device.Temperature(pathparams[0])
+		entry := auditEntry{Action: "temperature", Target: dev.Registers[135].Symbol, Old: dev.Registers[135].Value, Requested: pathparams[0]}
+		if config.ReadOnly {
+			log.Println("WARNING: Read only mode, refusing to write to device")
+			entry.Outcome = auditRefused
+			auditRequest(r, entry)
+			http.Error(w, "Read only mode", http.StatusForbidden)
+			return
+		}
+		err := dev.Temperature(pathparams[0])
+		entry.Value = dev.Registers[135].Value
+		if errors.Is(err, pingvin.ErrValidation) {
+			entry.Outcome = auditInvalid
+		}
+		entry.setResult(err)
+		auditRequest(r, entry)
+		if errors.Is(err, pingvin.ErrValidation) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Println("ERROR: Temperature:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(dev.Registers[135].Localize(responseLanguage(w, r)))
+	} else {
+		return
+	}
+}
+
+// batch write request
+type batchRequest struct {
+	Atomic bool                 `json:"atomic"` // Roll back all writes if one fails
+	Writes []pingvin.BatchWrite `json:"writes"`
+}
+
+// /api/v1/batch endpoint
+func batch(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if config.ReadOnly {
+		log.Println("WARNING: Read only mode, refusing to write to device")
+		auditRequest(r, auditEntry{Action: "batch", Target: "batch", Outcome: auditRefused})
+		http.Error(w, "Read only mode", http.StatusForbidden)
+		return
+	}
+	req := batchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Println("ERROR: Could not parse batch request:", err)
+		http.Error(w, "Invalid batch request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := dev.WriteBatch(req.Writes, req.Atomic)
+	auditBatch(r, resp, err)
+	if errors.Is(err, pingvin.ErrValidation) {
+		log.Println("ERROR: batch:", err)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err != nil {
+		log.Println("ERROR: batch:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// /api/v1/modes endpoint for temporary mode overrides
+func modes(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
+	w.Header().Set("Content-Type", "application/json")
+	pathparams := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/modes/"), "/")
+	if len(pathparams[0]) == 0 && r.Method == "GET" {
+		_ = json.NewEncoder(w).Encode(dev.OverrideStatus())
+		return
+	}
+	if len(pathparams[0]) == 0 || len(pathparams) > 1 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	entry := auditEntry{Action: "override", Target: pathparams[0], Old: dev.CurrentMode()}
+	if config.ReadOnly && (r.Method == "POST" || r.Method == "DELETE") {
+		log.Println("WARNING: Read only mode, refusing to write to device")
+		entry.Outcome = auditRefused
+		auditRequest(r, entry)
+		http.Error(w, "Read only mode", http.StatusForbidden)
+		return
+	}
+	if r.Method == "POST" {
+		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
 		if err != nil {
-			log.Println("ERROR: ", err)
+			log.Println("ERROR: Could not parse override duration", r.URL.Query().Get("duration"))
+			http.Error(w, "Invalid duration: "+err.Error(), http.StatusBadRequest)
+			return
 		}
-		_ = json.NewEncoder(w).Encode(device.Registers[135])
+		override, err := dev.Override(pathparams[0], duration, r.URL.Query().Get("temperature"))
+		entry.Requested = r.URL.RawQuery
+		entry.Value = dev.CurrentMode()
+		entry.setResult(err)
+		auditRequest(r, entry)
+		if err != nil {
+			log.Println("ERROR: Override:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(override)
+	} else if r.Method == "DELETE" {
+		override := dev.OverrideStatus()
+		if override == nil || override.Mode != pathparams[0] {
+			http.Error(w, "No active "+pathparams[0]+" override", http.StatusNotFound)
+			return
+		}
+		err := dev.CancelOverride()
+		entry.Requested = "cancel"
+		entry.Value = dev.CurrentMode()
+		entry.setResult(err)
+		auditRequest(r, entry)
+		if err != nil {
+			log.Println("ERROR: CancelOverride:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(dev.OverrideStatus())
 	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// /api/v1/mode endpoint
+func mode(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "GET" {
+		status, err := dev.Mode()
+		if err != nil {
+			log.Println("ERROR: Mode:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(status)
+		return
+	}
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := struct {
+		Mode string `json:"mode"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid mode request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry := auditEntry{Action: "mode", Target: "mode", Old: dev.CurrentMode(), Requested: req.Mode}
+	if config.ReadOnly {
+		log.Println("WARNING: Read only mode, refusing to write to device")
+		entry.Outcome = auditRefused
+		auditRequest(r, entry)
+		http.Error(w, "Read only mode", http.StatusForbidden)
+		return
+	}
+	if !slices.Contains(pingvin.Modes, req.Mode) {
+		entry.Outcome = auditInvalid
+		auditRequest(r, entry)
+		http.Error(w, "Invalid mode "+req.Mode+", expecting one of "+strings.Join(pingvin.Modes, ", "), http.StatusBadRequest)
+		return
+	}
+	status, err := dev.SetMode(req.Mode)
+	entry.Value = dev.CurrentMode()
+	entry.setResult(err)
+	auditRequest(r, entry)
+	if err != nil {
+		log.Println("ERROR: SetMode:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// /api/v1/fans endpoint
+func fans(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
+	w.Header().Set("Content-Type", "application/json")
+	pathparams := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/fans"), "/"), "/")
+	if len(pathparams[0]) == 0 && r.Method == "GET" {
+		status, err := dev.Fans()
+		if err != nil {
+			log.Println("ERROR: Fans:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(status)
+	} else if len(pathparams) == 2 && r.Method == "POST" {
+		intval, err := strconv.Atoi(pathparams[1])
+		if err != nil {
+			log.Println("ERROR: Could not parse fan speed", pathparams[1])
+			http.Error(w, "Invalid fan speed "+pathparams[1], http.StatusBadRequest)
+			return
+		}
+		entry := auditEntry{Action: "fan", Target: pathparams[0], Requested: intval}
+		if config.ReadOnly {
+			log.Println("WARNING: Read only mode, refusing to write to device")
+			entry.Outcome = auditRefused
+			auditRequest(r, entry)
+			http.Error(w, "Read only mode", http.StatusForbidden)
+			return
+		}
+		level, err := dev.SetFanLevel(pathparams[0], intval)
+		if level != nil {
+			entry.Target, entry.Old, entry.Value = level.Symbol, level.Previous, level.Value
+		}
+		if errors.Is(err, pingvin.ErrValidation) {
+			entry.Outcome = auditInvalid
+		}
+		entry.setResult(err)
+		auditRequest(r, entry)
+		if errors.Is(err, pingvin.ErrValidation) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Println("ERROR: SetFanLevel:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(level)
+	} else {
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// Write a coil from the coils endpoint and record it in the audit log.
+// Writes rejected by the validation or write policy are answered with
+// 400 and failed writes with 500, returns false in those cases
+func writeCoil(w http.ResponseWriter, r *http.Request, addr int, value bool) bool {
+	dev := requestDevice(r)
+	coil := dev.Coils[addr]
+	entry := auditEntry{Action: "coil", Target: coil.Symbol, Old: coil.Value, Requested: value}
+	if config.ReadOnly {
+		log.Println("WARNING: Read only mode, refusing to write to device")
+		entry.Outcome = auditRefused
+	} else {
+		_, err := dev.WriteBatch(dev.CoilWrites(addr, value, r.URL.Query().Get("confirm") == "true"), false)
+		if errors.Is(err, pingvin.ErrValidation) {
+			log.Println("ERROR: coils:", err)
+			entry.Outcome, entry.Error = auditInvalid, err.Error()
+			auditRequest(r, entry)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		entry.Value = dev.Coils[addr].Value
+		entry.setResult(err)
+		if err != nil {
+			log.Println("ERROR: coils:", err)
+			auditRequest(r, entry)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+	}
+	entry.Value = dev.Coils[addr].Value
+	auditRequest(r, entry)
+	return true
+}
+
+// Record the results of a batch write in the audit log, one entry per write
+func auditBatch(r *http.Request, resp *pingvin.BatchResponse, err error) {
+	for _, res := range resp.Results {
+		entry := auditEntry{Action: "batch", Target: res.Symbol, Old: res.Previous, Requested: res.Requested, Value: res.Value, Outcome: auditOK, Error: res.Error}
+		if len(res.Symbol) == 0 {
+			entry.Target = fmt.Sprintf("%s %d", res.Type, res.Address)
+		}
+		if errors.Is(err, pingvin.ErrValidation) {
+			entry.Outcome = auditInvalid
+			if len(entry.Error) == 0 {
+				entry.Error = err.Error()
+			}
+		} else if !res.OK {
+			entry.Outcome = auditFailed
+		}
+		if res.RolledBack {
+			entry.Error = "rolled back"
+		}
+		auditRequest(r, entry)
+	}
+}
+
+// /api/v1/policy endpoint
+func policy(w http.ResponseWriter, r *http.Request) {
+	dev := requestDevice(r)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(dev.WritePolicies())
 }
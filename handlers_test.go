@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0ranki/enervent-ctrl/pingvin"
+)
+
+func TestReady(t *testing.T) {
+	config = Conf{Interval: 4, ReadyIntervals: 3}
+	now := time.Now()
+	if err := ready(nil, config.Interval, now); err == nil {
+		t.Error("ready before the first poll")
+	}
+	recent := now.Add(-10 * time.Second)
+	if err := ready(&recent, config.Interval, now); err != nil {
+		t.Errorf("not ready after a poll 10s ago: %s", err)
+	}
+	old := now.Add(-13 * time.Second)
+	if err := ready(&old, config.Interval, now); err == nil {
+		t.Error("ready after a poll 13s ago with a 12s limit")
+	}
+}
+
+func TestRequestLanguage(t *testing.T) {
+	languages := []string{"en", "fi"}
+	tests := map[string]string{
+		"/api/v1/registers?lang=fi": "fi",
+		"/api/v1/registers?lang=FI": "fi",
+		"/api/v1/registers?lang=sv": "",
+		"/api/v1/registers":         "en",
+	}
+	for url, expected := range tests {
+		r := httptest.NewRequest("GET", url, nil)
+		r.Header.Set("Accept-Language", "en")
+		if lang := requestLanguage(r, languages); lang != expected {
+			t.Errorf("%s: expecting %q, got %q", url, expected, lang)
+		}
+	}
+	headers := map[string]string{
+		"fi-FI,fi;q=0.9,en-US;q=0.8,en;q=0.7": "fi",
+		"sv-FI, en;q=0.5, fi;q=0.8":           "fi",
+		"sv, fi;q=0":                          "",
+		"*":                                   "",
+		"":                                    "",
+	}
+	for header, expected := range headers {
+		r := httptest.NewRequest("GET", "/api/v1/coils", nil)
+		r.Header.Set("Accept-Language", header)
+		if lang := requestLanguage(r, languages); lang != expected {
+			t.Errorf("Accept-Language %q: expecting %q, got %q", header, expected, lang)
+		}
+	}
+}
+
+// The OpenAPI document covers the endpoints of each device and its
+// references resolve
+func TestOpenAPI(t *testing.T) {
+	doc := struct {
+		Info struct {
+			Version string `json:"version"`
+		} `json:"info"`
+		Paths      map[string]map[string]any `json:"paths"`
+		Components map[string]map[string]any `json:"components"`
+	}{}
+	if err := json.Unmarshal(openapiDoc, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Info.Version != version {
+		t.Errorf("expecting version %s, got %s", version, doc.Info.Version)
+	}
+	for _, endpoint := range deviceEndpoints {
+		found := false
+		for path := range doc.Paths {
+			found = found || strings.HasPrefix(path+"/", "/api/v1/"+endpoint)
+		}
+		if !found {
+			t.Errorf("endpoint %s not documented", endpoint)
+		}
+	}
+	for _, ref := range regexp.MustCompile(`"\$ref": "#/components/(\w+)/(\w+)"`).FindAllStringSubmatch(string(openapiDoc), -1) {
+		if _, ok := doc.Components[ref[1]][ref[2]]; !ok {
+			t.Errorf("unresolved reference %s", ref[0])
+		}
+	}
+}
+
+func TestAddressOutOfRange(t *testing.T) {
+	device = &pingvin.Pingvin{}
+	tests := []struct{ method, path string }{
+		{"GET", "/api/v1/coils/9999"},
+		{"GET", "/api/v1/coils/-1"},
+		{"POST", "/api/v1/coils/9999/true"},
+		{"POST", "/api/v1/coils/-1"},
+		{"GET", "/api/v1/registers/9999"},
+		{"POST", "/api/v1/registers/-1/0"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if strings.HasPrefix(test.path, "/api/v1/coils/") {
+			coils(w, r)
+		} else {
+			registers(w, r)
+		}
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s %s: got %d, expecting 404", test.method, test.path, w.Code)
+		}
+	}
+}
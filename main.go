@@ -1,19 +1,23 @@
 package main
 
 import (
-	"crypto/sha256"
+	"context"
 	"embed"
 	"flag"
+	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/0ranki/enervent-ctrl/pingvin"
 	"github.com/0ranki/https-go"
 	"github.com/gorilla/handlers"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/yaml.v3"
 )
@@ -24,38 +28,96 @@ import (
 //go:embed static/html/*
 var static embed.FS
 
+// OpenAPI document of the REST API, keep info.version in sync with version
+//
+//go:embed openapi.json
+var openapiDoc []byte
+
+// How long in-flight requests are waited for on shutdown
+const shutdownTimeout = 10 * time.Second
+
 var (
-	version      = "0.2.0"
-	device       pingvin.Pingvin
-	config       Conf
-	usernamehash [32]byte
-	passwordhash [32]byte
+	version  = "0.2.0"
+	device   = &pingvin.Pingvin{} // The default device, set up by initDevices
+	config   Conf
+	confpath string
 )
 
 type Conf struct {
-	SerialAddress  string `yaml:"serial_address"`
-	Port           int    `yaml:"port"`
-	SslCertificate string `yaml:"ssl_certificate"`
-	SslPrivatekey  string `yaml:"ssl_privatekey"`
-	DisableAuth    bool   `yaml:"disable_auth"`
-	Username       string `yaml:"username"`
-	Password       string `yaml:"password"`
-	Interval       int    `yaml:"interval"`
-	EnableMetrics  bool   `yaml:"enable_metrics"`
-	LogFile        string `yaml:"log_file"`
-	LogAccess      bool   `yaml:"log_access"`
-	Debug          bool   `yaml:"debug"`
-	ReadOnly       bool   `yaml:"read_only"`
+	SerialAddress  string                `yaml:"serial_address"`
+	Map            string                `yaml:"map"`
+	MapProfile     string                `yaml:"map_profile"`
+	CoilMap        string                `yaml:"coil_map"`
+	RegisterMap    string                `yaml:"register_map"`
+	ListenAddress  string                `yaml:"listen_address"`
+	Port           int                   `yaml:"port"`
+	DisableTLS     bool                  `yaml:"disable_tls"`
+	UnixSocket     string                `yaml:"unix_socket"`
+	MetricsAddress string                `yaml:"metrics_address"`
+	SslCertificate string                `yaml:"ssl_certificate"`
+	SslPrivatekey  string                `yaml:"ssl_privatekey"`
+	ClientCA       string                `yaml:"client_ca"`
+	ClientAuth     string                `yaml:"client_auth"`
+	CertUsers      []certUserConf        `yaml:"cert_users,omitempty"`
+	DisableAuth    bool                  `yaml:"disable_auth"`
+	Username       string                `yaml:"username"`
+	Password       string                `yaml:"password"`
+	Interval       int                   `yaml:"interval"`
+	SlowInterval   int                   `yaml:"slow_interval"`
+	ReadyIntervals int                   `yaml:"ready_intervals"`
+	StaleAfter     int                   `yaml:"stale_after"`
+	EnableMetrics  bool                  `yaml:"enable_metrics"`
+	MetricsAuth    bool                  `yaml:"metrics_auth"`
+	MetricsLayout  string                `yaml:"metrics_layout"`           // legacy or labels
+	MetricsGroups  []string              `yaml:"metrics_groups,omitempty"` // Groups exported in the labels layout
+	LogFile        string                `yaml:"log_file"`
+	LogAccess      bool                  `yaml:"log_access"`
+	Debug          bool                  `yaml:"debug"`
+	ReadOnly       bool                  `yaml:"read_only"`
+	AuditLog       string                `yaml:"audit_log"`
+	AuditMaxSize   int                   `yaml:"audit_max_size"`
+	AuditKeep      int                   `yaml:"audit_keep"`
+	Users          []userConf            `yaml:"users,omitempty"`
+	WritePolicy    []pingvin.WritePolicy `yaml:"write_policy,omitempty"`
+	Polling        []pingvin.PollTier    `yaml:"polling,omitempty"`
+	Rules          []ruleConf            `yaml:"rules,omitempty"`
+	Drift          driftConf             `yaml:"drift"`
+	Devices        []deviceConf          `yaml:"devices,omitempty"` // Default is one device with the settings above
 }
 
-// Start the HTTP server
-func serve(cert, key *string) {
+// Start the HTTP servers and run them until ctx is cancelled.
+// In-flight requests are allowed to finish before returning
+func serve(ctx context.Context, cert, key *string) {
 	log.Println("Starting service")
-	http.HandleFunc("/api/v1/coils/", authHandlerFunc(coils))
-	http.HandleFunc("/api/v1/status", authHandlerFunc(status))
-	http.HandleFunc("/api/v1/registers/", authHandlerFunc(registers))
-	http.HandleFunc("/api/v1/temperature/", authHandlerFunc(temperature))
-	if config.EnableMetrics {
+	http.HandleFunc("/api/v1/coils/", authHandlerFunc(roleAdmin, coils))
+	http.HandleFunc("/api/v1/status", authHandlerFunc(roleViewer, status))
+	http.HandleFunc("/api/v1/registers/", authHandlerFunc(roleAdmin, registers))
+	http.HandleFunc("/api/v1/temperature/", authHandlerFunc(roleOperator, temperature))
+	http.HandleFunc("/api/v1/batch", authHandlerFunc(roleAdmin, batch))
+	http.HandleFunc("/api/v1/mode", authHandlerFunc(roleOperator, mode))
+	http.HandleFunc("/api/v1/fans", authHandlerFunc(roleOperator, fans))
+	http.HandleFunc("/api/v1/fans/", authHandlerFunc(roleOperator, fans))
+	http.HandleFunc("/api/v1/rules", authHandlerFunc(roleAdmin, rulesHandler))
+	http.HandleFunc("/api/v1/rules/", authHandlerFunc(roleAdmin, rulesHandler))
+	http.HandleFunc("/api/v1/modes/", authHandlerFunc(roleOperator, modes))
+	http.HandleFunc("/api/v1/tokens", authHandlerFunc(roleAdmin, tokensHandler))
+	http.HandleFunc("/api/v1/tokens/", authHandlerFunc(roleAdmin, tokensHandler))
+	http.HandleFunc("/api/v1/policy", authHandlerFunc(roleAdmin, policy))
+	http.HandleFunc("/api/v1/backup", authHandlerFunc(roleAdmin, backup))
+	http.HandleFunc("/api/v1/restore", authHandlerFunc(roleAdmin, restore))
+	http.HandleFunc("/api/v1/drift", authHandlerFunc(roleAdmin, driftHandler))
+	http.HandleFunc("/api/v1/drift/", authHandlerFunc(roleAdmin, driftHandler))
+	http.HandleFunc("/api/v1/audit", authHandlerFunc(roleAdmin, auditHandler))
+	http.HandleFunc("/api/v1/diagnostics", authHandlerFunc(roleViewer, diagnostics))
+	http.HandleFunc("/api/v1/devices", authHandlerFunc(roleViewer, devicesHandler))
+	http.HandleFunc("/api/v1/devices/", authHandlerFunc(roleViewer, deviceRouter))
+	// Probes for service managers and load balancers, no authentication
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/api/v1/openapi.json", openapi)
+	http.HandleFunc("/readyz", readyz)
+	if config.EnableMetrics && config.MetricsAuth {
+		http.HandleFunc("/metrics", authHandler(promhttp.Handler()))
+	} else if config.EnableMetrics {
 		http.Handle("/metrics", promhttp.Handler())
 	}
 	html, err := fs.Sub(static, "static/html")
@@ -74,12 +136,89 @@ func serve(cert, key *string) {
 		logdst = os.Stdout
 	}
 	handler := handlers.LoggingHandler(logdst, http.DefaultServeMux)
-	err = http.ListenAndServeTLS(":8888", *cert, *key, handler)
-	if err != nil {
+	errs := make(chan error, 3)
+	servers := []*http.Server{}
+	if len(config.UnixSocket) > 0 {
+		servers = append(servers, serveUnixSocket(config.UnixSocket, handler, errs))
+	}
+	if len(config.MetricsAddress) > 0 {
+		servers = append(servers, serveMetrics(config.MetricsAddress, logdst, errs))
+	}
+	addr := listenAddress()
+	server := &http.Server{Addr: addr, Handler: handler}
+	servers = append(servers, server)
+	if config.DisableTLS {
+		log.Println("Listening on http://" + addr)
+		go func() { errs <- server.ListenAndServe() }()
+	} else {
+		log.Println("Listening on https://" + addr)
+		certs, cerr := newCertReloader(*cert, *key, config.ClientCA)
+		if cerr != nil {
+			log.Fatal("Failed to load certificates: ", cerr)
+		}
+		server.TLSConfig = certs.tlsConfig(config.ClientAuth)
+		go func() { errs <- server.ListenAndServeTLS("", "") }()
+	}
+	select {
+	case err := <-errs:
 		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down")
+	shutdownctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownctx); err != nil {
+			log.Println("ERROR: Shutdown:", err)
+		}
 	}
 }
 
+// Address of the TCP listener, e.g. 127.0.0.1:8888 or [::1]:8888.
+// All interfaces if the listen address is empty
+func listenAddress() string {
+	return net.JoinHostPort(config.ListenAddress, strconv.Itoa(config.Port))
+}
+
+// true if addr is a loopback address or localhost
+func isLoopback(addr string) bool {
+	if addr == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Serve the API on a Unix domain socket, without TLS
+func serveUnixSocket(path string, handler http.Handler, errs chan<- error) *http.Server {
+	// Remove a socket left over from a previous run
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatal("Failed to listen on Unix socket: ", err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		log.Fatal("Failed to set Unix socket permissions: ", err)
+	}
+	log.Println("Listening on unix:" + path)
+	server := &http.Server{Handler: handler}
+	go func() { errs <- server.Serve(listener) }()
+	return server
+}
+
+// Serve /metrics without authentication on a separate address,
+// e.g. on a management interface
+func serveMetrics(addr string, logdst io.Writer, errs chan<- error) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Println("Serving metrics on http://" + addr + "/metrics")
+	server := &http.Server{Addr: addr, Handler: handlers.LoggingHandler(logdst, mux)}
+	go func() { errs <- server.ListenAndServe() }()
+	return server
+}
+
 // Generate self-signed SSL keypair
 func generateCertificate(cert, key string) {
 	opts := https.GenerateOptions{Host: "enervent-ctrl.local", RSABits: 4096, ValidFor: 10 * 365 * 24 * time.Hour}
@@ -107,7 +246,7 @@ func parseConfigFile() {
 	if err != nil {
 		log.Fatal("Could not determine user home directory")
 	}
-	confpath := homedir + "/.config/enervent-ctrl"
+	confpath = homedir + "/.config/enervent-ctrl"
 	if _, err := os.Stat(confpath); err != nil {
 		log.Println("Generating configuration directory", confpath)
 		if err := os.MkdirAll(confpath, 0700); err != nil {
@@ -141,11 +280,18 @@ func initDefaultConfig(confpath string) {
 		Username:       "pingvin",
 		Password:       "enervent",
 		Interval:       4,
+		SlowInterval:   300,
+		ReadyIntervals: 3,
 		EnableMetrics:  false,
+		MetricsLayout:  pingvin.LayoutLegacy,
 		LogAccess:      false,
 		LogFile:        "",
+		AuditLog:       confpath + "/audit.log",
+		AuditMaxSize:   10,
+		AuditKeep:      5,
 		Debug:          false,
 		ReadOnly:       false,
+		Drift:          driftConf{Interval: 900},
 	}
 	conffile := confpath + "/configuration.yaml"
 	confbytes, err := yaml.Marshal(&config)
@@ -165,31 +311,77 @@ func configure() {
 	intervalflag := flag.Int("interval", config.Interval, "Set the interval of background updates")
 	logaccflag := flag.Bool("httplog", config.LogAccess, "Enable HTTP access logging")
 	generatecert := flag.Bool("regenerate-certs", false, "Generate a new SSL certificate. A new one is generated on startup as `~/.config/enervent-ctrl/server.crt` if it doesn't exist.")
+	listenflag := flag.String("listen", config.ListenAddress, "Address to listen on. Default is empty string, all interfaces")
+	portflag := flag.Int("port", config.Port, "TCP port to listen on")
+	notlsflag := flag.Bool("disable-tls", config.DisableTLS, "Serve plain HTTP instead of HTTPS, e.g. behind a reverse proxy")
+	socketflag := flag.String("unix-socket", config.UnixSocket, "Also serve the API on a Unix domain socket at this path")
+	metricsaddrflag := flag.String("metrics-address", config.MetricsAddress, "Serve /metrics without authentication on a separate address, e.g. 10.0.0.2:9100")
 	certflag := flag.String("cert", config.SslCertificate, "Path to SSL public key to use for HTTPS")
 	keyflag := flag.String("key", config.SslPrivatekey, "Path to SSL private key to use for HTTPS")
 	noauthflag := flag.Bool("disable-auth", config.DisableAuth, "Disable HTTP basic authentication")
 	usernflag := flag.String("username", config.Username, "Username for HTTP Basic Authentication")
 	passwflag := flag.String("password", config.Password, "Password for HTTP Basic Authentication")
 	promflag := flag.Bool("enable-metrics", config.EnableMetrics, "Enable the built-in Prometheus exporter")
+	promauthflag := flag.Bool("metrics-auth", config.MetricsAuth, "Require authentication for /metrics")
+	layoutflag := flag.String("metrics-layout", config.MetricsLayout, "Layout of the Prometheus metrics: legacy, or labels for metric families with labels")
 	logflag := flag.String("logfile", config.LogFile, "Path to log file. Default is empty string, log to stdout")
 	serialflag := flag.String("serial", config.SerialAddress, "Path to serial console for RS-485 connection. Defaults to /dev/ttyS0")
 	readOnly := flag.Bool("read-only", config.ReadOnly, "Read only mode, no writes to device are allowed")
+	mapflag := flag.String("map", config.Map, "Path to a YAML or JSON coil and register map replacing the built-in map")
+	profileflag := flag.String("map-profile", config.MapProfile, "Map profile to use. Default is to detect it from the unit")
+	coilmapflag := flag.String("coil-map", config.CoilMap, "Path to a CSV coil map replacing the coils of the built-in map")
+	registermapflag := flag.String("register-map", config.RegisterMap, "Path to a CSV register map replacing the registers of the built-in map")
 	// TODO: log file flag
 	flag.Parse()
 	config.Debug = *debugflag
 	config.Interval = *intervalflag
 	config.LogAccess = *logaccflag
+	config.ListenAddress = *listenflag
+	config.Port = *portflag
+	config.DisableTLS = *notlsflag
+	config.UnixSocket = *socketflag
+	config.MetricsAddress = *metricsaddrflag
 	config.SslCertificate = *certflag
 	config.SslPrivatekey = *keyflag
 	config.DisableAuth = *noauthflag
 	config.Username = *usernflag
 	config.Password = *passwflag
 	config.EnableMetrics = *promflag
+	config.MetricsAuth = *promauthflag
+	config.MetricsLayout = *layoutflag
 	config.LogFile = *logflag
 	config.SerialAddress = *serialflag
+	config.Map = *mapflag
+	config.MapProfile = *profileflag
+	config.CoilMap = *coilmapflag
+	config.RegisterMap = *registermapflag
 	config.ReadOnly = *readOnly
-	usernamehash = sha256.Sum256([]byte(config.Username))
-	passwordhash = sha256.Sum256([]byte(config.Password))
+	if err := initUsers(); err != nil {
+		log.Fatal("Invalid user configuration: ", err)
+	}
+	tokenfile = confpath + "/tokens.json"
+	if len(config.AuditLog) == 0 {
+		config.AuditLog = confpath + "/audit.log"
+	}
+	if config.AuditMaxSize <= 0 {
+		config.AuditMaxSize = 10
+	}
+	if config.AuditKeep <= 0 {
+		config.AuditKeep = 5
+	}
+	if config.SlowInterval <= 0 {
+		config.SlowInterval = 300
+	}
+	if config.ReadyIntervals <= 0 {
+		config.ReadyIntervals = 3
+	}
+	if config.StaleAfter <= 0 {
+		config.StaleAfter = 3 * config.Interval
+	}
+	if config.AuditLog != "none" {
+		auditfile = config.AuditLog
+		log.Println("Audit log:", auditfile)
+	}
 	if len(config.LogFile) != 0 {
 		logfile, err := os.OpenFile(config.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
 		if err != nil {
@@ -198,8 +390,11 @@ func configure() {
 		log.SetOutput(logfile)
 		log.Println("Opened logfile")
 	}
+	if config.Port == 0 {
+		config.Port = 8888
+	}
 	// Check that certificate file exists, generate if needed
-	if _, err := os.Stat(config.SslCertificate); err != nil || *generatecert {
+	if _, err := os.Stat(config.SslCertificate); !config.DisableTLS && (err != nil || *generatecert) {
 		generateCertificate(config.SslCertificate, config.SslPrivatekey)
 	}
 	// Enable debug if configured
@@ -211,18 +406,60 @@ func configure() {
 		log.Println("HTTP Access logging enabled")
 	}
 	log.Println("Update interval set to", config.Interval, "seconds")
-	if config.EnableMetrics {
+	if config.EnableMetrics || len(config.MetricsAddress) > 0 {
 		log.Println("Prometheus exporter enabled (/metrics)")
-		prometheus.MustRegister(&device)
+	}
+	if config.DisableTLS && !isLoopback(config.ListenAddress) {
+		log.Println("WARNING: TLS disabled on a non-loopback address, credentials are sent in plain text")
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		userCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		certCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		tokenCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "convert-map" {
+		convertMapCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate-map" {
+		validateMapCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && cliCommands[os.Args[1]] != nil {
+		os.Exit(runCLICommand(os.Args[1], os.Args[2:]))
+	}
 	log.Println("enervent-ctrl version", version)
 	configure()
-	device = *pingvin.New(config.SerialAddress, config.Debug)
-	device.Update()
-	go device.Monitor(config.Interval)
-	serve(&config.SslCertificate, &config.SslPrivatekey)
-	device.Quit()
+	if err := initDevices(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initRules(); err != nil {
+		log.Fatal("Invalid rule configuration: ", err)
+	}
+	if err := initDrift(); err != nil {
+		log.Fatal("Invalid drift configuration: ", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for _, d := range devices {
+		go d.device.Monitor(ctx, d.conf.Interval)
+	}
+	if len(rules) > 0 {
+		go runRules(ctx, config.Interval)
+	}
+	go runDrift(ctx, config.Drift.Interval)
+	serve(ctx, &config.SslCertificate, &config.SslPrivatekey)
+	for _, d := range devices {
+		d.device.Quit()
+	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		listen string
+		port   int
+		want   string
+	}{
+		{"", 8888, ":8888"},
+		{"127.0.0.1", 8080, "127.0.0.1:8080"},
+		{"::1", 8888, "[::1]:8888"},
+		{"localhost", 443, "localhost:443"},
+	}
+	for _, test := range tests {
+		config = Conf{ListenAddress: test.listen, Port: test.port}
+		if got := listenAddress(); got != test.want {
+			t.Errorf("%q port %d: got %s, expecting %s", test.listen, test.port, got, test.want)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := map[string]bool{
+		"localhost": true,
+		"127.0.0.1": true,
+		"127.1.2.3": true,
+		"::1":       true,
+		"":          false,
+		"0.0.0.0":   false,
+		"10.0.0.1":  false,
+		"example":   false,
+	}
+	for addr, want := range tests {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("isLoopback(%q) is %t, expecting %t", addr, got, want)
+		}
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	// A socket left over from a previous run is replaced
+	old, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.(*net.UnixListener).SetUnlinkOnClose(false)
+	old.Close()
+	errs := make(chan error, 1)
+	server := serveUnixSocket(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}), errs)
+	defer server.Shutdown(context.Background())
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("socket permissions %o, expecting 660", info.Mode().Perm())
+	}
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}}
+	resp, err := client.Get("http://unix/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "ok" {
+		t.Errorf("unexpected response %q", body)
+	}
+}
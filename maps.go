@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+
+	"github.com/0ranki/enervent-ctrl/pingvin"
+	"gopkg.in/yaml.v3"
+)
+
+// Convert CSV coil and register maps to a YAML or JSON map
+// written to stdout
+func convertMapCommand(args []string) {
+	flags := flag.NewFlagSet("convert-map", flag.ExitOnError)
+	coilsflag := flags.String("coils", "", "Path to the CSV coil map, e.g. coils.csv")
+	registersflag := flags.String("registers", "", "Path to the CSV register map, e.g. registers.csv")
+	nameflag := flags.String("name", "", "Name of the map")
+	jsonflag := flags.Bool("json", false, "Write JSON instead of YAML")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: enervent-ctrl convert-map -coils FILE -registers FILE [-name NAME] [-json] > map.yaml")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if len(*coilsflag) == 0 || len(*registersflag) == 0 || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	m, err := pingvin.ConvertCsvMaps(*coilsflag, *registersflag)
+	if err != nil {
+		log.Fatal("Failed to convert the maps: ", err)
+	}
+	m.Name = *nameflag
+	if *jsonflag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(m)
+	} else {
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		err = enc.Encode(m)
+	}
+	if err != nil {
+		log.Fatal("Failed to write the map: ", err)
+	}
+}
+
+// Check the map of the default or given device, or the map given, and
+// print the problems found. With -live, all coils and registers are
+// also read from the unit. Exits with status 1 if errors are found
+func validateMapCommand(args []string) {
+	flags := flag.NewFlagSet("validate-map", flag.ExitOnError)
+	coilsflag := flags.String("coil-map", "", "Path to a CSV coil map. Default is the configured map")
+	registersflag := flags.String("register-map", "", "Path to a CSV register map. Default is the configured map")
+	profileflag := flags.String("map-profile", "", "Map profile to use with -live. Default is to detect it from the unit")
+	liveflag := flags.Bool("live", false, "Also read all coils and registers from the unit. Stop the daemon first")
+	serialflag := flags.String("serial", "", "Path to serial console for RS-485 connection. Default is the serial_address of the device")
+	deviceflag := flags.String("device", "", "Id of the configured device to check. Default is the default device")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: enervent-ctrl validate-map [-live] [MAP]")
+		fmt.Fprintln(os.Stderr, "       enervent-ctrl validate-map [-live] [-coil-map FILE] [-register-map FILE]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	parseConfigFile()
+	confs, err := deviceConfs()
+	if err != nil {
+		log.Fatal("Invalid device configuration: ", err)
+	}
+	conf := confs[0]
+	if len(*deviceflag) > 0 {
+		i := slices.IndexFunc(confs, func(c deviceConf) bool { return c.Id == *deviceflag })
+		if i < 0 {
+			log.Fatal("Unknown device ", *deviceflag)
+		}
+		conf = confs[i]
+	}
+	files := pingvin.MapFiles{Map: conf.Map, Coils: conf.CoilMap, Registers: conf.RegisterMap, Profile: conf.MapProfile}
+	if flags.NArg() == 1 || len(*coilsflag) > 0 || len(*registersflag) > 0 {
+		files = pingvin.MapFiles{Map: flags.Arg(0), Coils: *coilsflag, Registers: *registersflag}
+	}
+	if len(*profileflag) > 0 {
+		files.Profile = *profileflag
+	}
+	m, err := pingvin.DecodeMap(files)
+	if err != nil {
+		log.Fatal("Failed to read the map: ", err)
+	}
+	report := m.Check()
+	if *liveflag && len(report.Errors) == 0 {
+		transport := conf.Transport
+		if len(*serialflag) > 0 {
+			transport.Serial = *serialflag
+		}
+		dev, err := pingvin.New(transport, false, files)
+		if err != nil {
+			log.Fatal("Failed to load the map: ", err)
+		}
+		unit := dev.CheckUnit()
+		dev.Quit()
+		report.Errors = append(report.Errors, unit.Errors...)
+		report.Warnings = append(report.Warnings, unit.Warnings...)
+	}
+	for _, e := range report.Errors {
+		fmt.Println("ERROR:", e)
+	}
+	for _, w := range report.Warnings {
+		fmt.Println("WARNING:", w)
+	}
+	fmt.Printf("%d coils, %d registers, %d profiles: %d errors, %d warnings\n", len(m.Coils), len(m.Registers), len(m.Profiles), len(report.Errors), len(report.Warnings))
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,338 @@
+package pingvin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// Version of the backup document format
+const BackupVersion = 1
+
+// Coils left out of backups: the operating mode and
+// state reported by the unit
+var volatileCoils = []string{
+	"0-7",   // Operating mode
+	"10",    // Boost
+	"30",    // Heat recycler running
+	"32",    // After heater running
+	"37",    // Overtime input
+	"40",    // Eco mode
+	"41-43", // Alarms and active clock program
+}
+
+// Registers left out of backups: measurements, state and logs that
+// change on their own. Read-only registers are left out by the write policy
+var volatileRegisters = []string{
+	"0-49",    // Measurements, status and clock
+	"134",     // Outside temperature average
+	"332",     // Active time programs
+	"337",     // Active time programs
+	"343",     // Uptime
+	"385-524", // Alarm log
+	"581-586", // Number of alarms and the clock interface
+	"774",     // Circulation fan speed
+	"780-798", // Analog and digital I/O
+}
+
+// Configuration of a unit. Register values are scaled with the multipliers
+type Backup struct {
+	Version   int              `yaml:"version" json:"version"`
+	Created   time.Time        `yaml:"created" json:"created"`
+	Profile   string           `yaml:"profile,omitempty" json:"profile,omitempty"`       // Map profile in use
+	Family    *int             `yaml:"family,omitempty" json:"family,omitempty"`         // HREG_FAMILY_TYPE
+	SwVersion *float64         `yaml:"sw_version,omitempty" json:"sw_version,omitempty"` // HREG_SW_VERSION
+	Coils     []BackupCoil     `yaml:"coils" json:"coils"`
+	Registers []BackupRegister `yaml:"registers" json:"registers"`
+}
+
+// Coil in a backup. The address is informational, coils are restored by symbol
+type BackupCoil struct {
+	Symbol  string `yaml:"symbol" json:"symbol"`
+	Address int    `yaml:"address" json:"address"`
+	Value   bool   `yaml:"value" json:"value"`
+}
+
+// Register in a backup. The address is informational, registers are restored by symbol
+type BackupRegister struct {
+	Symbol  string  `yaml:"symbol" json:"symbol"`
+	Address int     `yaml:"address" json:"address"`
+	Value   float64 `yaml:"value" json:"value"` // Raw value divided by the multiplier
+	Unit    string  `yaml:"unit,omitempty" json:"unit,omitempty"`
+}
+
+// Difference between a backup and the unit. Coil values are 0 or 1
+type RestoreChange struct {
+	Type    string  `json:"type"`
+	Address int     `json:"address"`
+	Symbol  string  `json:"symbol"`
+	Current float64 `json:"current"` // Value of the unit before the restore
+	Backup  float64 `json:"backup"`
+	OK      bool    `json:"ok"` // Written and verified, or valid in a dry run
+	Error   string  `json:"error,omitempty"`
+}
+
+// Result of a restore
+type RestoreResponse struct {
+	OK         bool             `json:"ok"`
+	DryRun     bool             `json:"dry_run"`
+	RolledBack bool             `json:"rolled_back"`
+	Unchanged  int              `json:"unchanged"`          // Values already matching the backup
+	Warnings   []string         `json:"warnings,omitempty"` // e.g. the backup is from another software version
+	Changes    []*RestoreChange `json:"changes"`
+}
+
+// Whether addr is in one of ranges, e.g. "100-133"
+func inAddresses(ranges []string, addr int) bool {
+	for _, addresses := range ranges {
+		first, last, err := parseAddresses(addresses)
+		if err == nil && addr >= first && addr <= last {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a coil or register is part of a backup: not reserved,
+// volatile or read-only by the write policy
+func (p *Pingvin) backedUp(typ string, addr int) bool {
+	volatile := volatileRegisters
+	if typ == "coil" {
+		if addr < 0 || addr >= len(p.Coils) || p.Coils[addr].Reserved {
+			return false
+		}
+		volatile = volatileCoils
+	} else if addr < 0 || addr >= len(p.Registers) || p.Registers[addr].Reserved {
+		return false
+	}
+	return !inAddresses(volatile, addr) && p.policies[fmt.Sprintf("%s:%d", typ, addr)].Access != AccessRead
+}
+
+// Read all coils from the unit, updating p.Coils
+func (p *Pingvin) readCoils() error {
+	vals, err := p.readCoilRange(0, uint16(len(p.Coils)))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i, val := range vals {
+		p.Coils[i].Value, p.Coils[i].LastUpdated, p.Coils[i].Stale = val, &now, false
+	}
+	return nil
+}
+
+// Read the registers at the sorted addrs from the unit, updating p.Registers
+func (p *Pingvin) readRegisters(addrs []int) error {
+	for _, block := range planBlocks(addrs) {
+		if _, err := p.readRegisterRange(uint16(block.start), uint16(block.quantity)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the configuration of the unit
+func (p *Pingvin) Backup() (*Backup, error) {
+	addrs := []int{}
+	for _, reg := range p.Registers {
+		if p.backedUp("register", reg.Address) {
+			addrs = append(addrs, reg.Address)
+		}
+	}
+	if err := p.readCoils(); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	if err := p.readRegisters(addrs); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	b := &Backup{Version: BackupVersion, Created: time.Now(), Profile: p.Profile, Coils: []BackupCoil{}, Registers: []BackupRegister{}}
+	if reg := p.registerBySymbol("HREG_FAMILY_TYPE"); reg != nil && reg.LastUpdated != nil {
+		family := reg.Value
+		b.Family = &family
+	}
+	if reg := p.registerBySymbol("HREG_SW_VERSION"); reg != nil && reg.LastUpdated != nil {
+		sw := float64(reg.Value) / float64(reg.Multiplier)
+		b.SwVersion = &sw
+	}
+	for _, coil := range p.Coils {
+		if p.backedUp("coil", coil.Address) {
+			b.Coils = append(b.Coils, BackupCoil{Symbol: coil.Symbol, Address: coil.Address, Value: coil.Value})
+		}
+	}
+	for _, addr := range addrs {
+		reg := p.Registers[addr]
+		b.Registers = append(b.Registers, BackupRegister{Symbol: reg.Symbol, Address: addr, Value: float64(reg.Value) / float64(reg.Multiplier), Unit: reg.Unit})
+	}
+	return b, nil
+}
+
+// Differences between the unit and the backup that don't prevent a restore
+func (p *Pingvin) backupWarnings(b *Backup) []string {
+	warnings := []string{}
+	if b.Profile != p.Profile {
+		warnings = append(warnings, fmt.Sprintf("the backup is from map profile %q, the unit uses %q", b.Profile, p.Profile))
+	}
+	if reg := p.registerBySymbol("HREG_FAMILY_TYPE"); b.Family != nil && reg != nil && *b.Family != reg.Value {
+		warnings = append(warnings, fmt.Sprintf("the backup is from unit family %d, the unit is %d", *b.Family, reg.Value))
+	}
+	if reg := p.registerBySymbol("HREG_SW_VERSION"); b.SwVersion != nil && reg != nil {
+		if sw := float64(reg.Value) / float64(reg.Multiplier); *b.SwVersion != sw {
+			warnings = append(warnings, fmt.Sprintf("the backup is from software version %g, the unit has %g", *b.SwVersion, sw))
+		}
+	}
+	return warnings
+}
+
+// Order of the writes of a restore: registers first, then the coils
+// enabling functions using them, and registers with the confirm write
+// policy, e.g. the network configuration, last
+func (p *Pingvin) restoreOrder(w BatchWrite) int {
+	if w.Type == "coil" {
+		return 1
+	}
+	if p.policies[fmt.Sprintf("register:%d", w.Address)].Access == AccessConfirm {
+		return 2
+	}
+	return 0
+}
+
+// Restore the configuration from a backup. The values of the unit are
+// read and compared with the backup, and the differing values are
+// written as an atomic batch in a safe order, see restoreOrder. All
+// writes are validated against the write policies before anything is
+// written. confirm confirms writes with the confirm write policy. If
+// dryRun is true, the differences are validated but not written
+func (p *Pingvin) Restore(b *Backup, dryRun, confirm bool) (*RestoreResponse, error) {
+	resp := &RestoreResponse{DryRun: dryRun, Changes: []*RestoreChange{}}
+	if b.Version < 1 || b.Version > BackupVersion {
+		return resp, fmt.Errorf("%w: unsupported backup version %d", ErrValidation, b.Version)
+	}
+	resp.Warnings = p.backupWarnings(b)
+	var verr error
+	invalid := func(change *RestoreChange, msg string) {
+		change.Error = msg
+		resp.Changes = append(resp.Changes, change)
+		if verr == nil {
+			verr = fmt.Errorf("%w: %s", ErrValidation, msg)
+		}
+	}
+	// Backup values by "coil:N" / "register:N"
+	values := map[string]int{}
+	seen := map[string]bool{}
+	for _, c := range b.Coils {
+		change := &RestoreChange{Type: "coil", Symbol: c.Symbol}
+		coil := p.coilBySymbol(c.Symbol)
+		if c.Value {
+			change.Backup = 1
+		}
+		switch {
+		case coil == nil:
+			invalid(change, "unknown coil "+c.Symbol)
+		case seen[c.Symbol]:
+			invalid(change, "duplicate coil "+c.Symbol)
+		case !p.backedUp("coil", coil.Address):
+			change.Address = coil.Address
+			invalid(change, fmt.Sprintf("coil %d (%s) is not restored", coil.Address, c.Symbol))
+		default:
+			values[fmt.Sprintf("coil:%d", coil.Address)] = int(change.Backup)
+		}
+		seen[c.Symbol] = true
+	}
+	addrs := []int{}
+	for _, r := range b.Registers {
+		change := &RestoreChange{Type: "register", Symbol: r.Symbol, Backup: r.Value}
+		reg := p.registerBySymbol(r.Symbol)
+		switch {
+		case reg == nil:
+			invalid(change, "unknown register "+r.Symbol)
+		case seen[r.Symbol]:
+			invalid(change, "duplicate register "+r.Symbol)
+		case !p.backedUp("register", reg.Address):
+			change.Address = reg.Address
+			invalid(change, fmt.Sprintf("register %d (%s) is not restored", reg.Address, r.Symbol))
+		default:
+			values[fmt.Sprintf("register:%d", reg.Address)] = int(math.Round(r.Value * float64(reg.Multiplier)))
+			addrs = append(addrs, reg.Address)
+		}
+		seen[r.Symbol] = true
+	}
+	if verr != nil {
+		return resp, verr
+	}
+	slices.Sort(addrs)
+	if err := p.readCoils(); err != nil {
+		return resp, fmt.Errorf("restore: %w", err)
+	}
+	if err := p.readRegisters(addrs); err != nil {
+		return resp, fmt.Errorf("restore: %w", err)
+	}
+	writes := []BatchWrite{}
+	changes := map[string]*RestoreChange{}
+	for _, coil := range p.Coils {
+		val, ok := values[fmt.Sprintf("coil:%d", coil.Address)]
+		if !ok {
+			continue
+		}
+		current := 0
+		if coil.Value {
+			current = 1
+		}
+		if current == val {
+			resp.Unchanged++
+			continue
+		}
+		changes[fmt.Sprintf("coil:%d", coil.Address)] = &RestoreChange{Type: "coil", Address: coil.Address, Symbol: coil.Symbol, Current: float64(current), Backup: float64(val)}
+		writes = append(writes, BatchWrite{Type: "coil", Address: coil.Address, Value: BatchValue(val), Confirm: confirm})
+	}
+	for _, addr := range addrs {
+		reg, val := p.Registers[addr], values[fmt.Sprintf("register:%d", addr)]
+		if uint16(reg.Value) == uint16(val) {
+			resp.Unchanged++
+			continue
+		}
+		changes[fmt.Sprintf("register:%d", addr)] = &RestoreChange{Type: "register", Address: addr, Symbol: reg.Symbol,
+			Current: float64(reg.Value) / float64(reg.Multiplier), Backup: float64(val) / float64(reg.Multiplier)}
+		writes = append(writes, BatchWrite{Type: "register", Address: addr, Value: BatchValue(val), Confirm: confirm})
+	}
+	slices.SortStableFunc(writes, func(a, b BatchWrite) int {
+		return p.restoreOrder(a) - p.restoreOrder(b)
+	})
+	for _, w := range writes {
+		change := changes[fmt.Sprintf("%s:%d", w.Type, w.Address)]
+		resp.Changes = append(resp.Changes, change)
+		if err := p.validateBatchWrite(w); err != nil {
+			change.Error = err.Error()
+			if verr == nil && errors.Is(err, ErrValidation) {
+				verr = err
+			} else if verr == nil {
+				verr = fmt.Errorf("%w: %s", ErrValidation, err)
+			}
+		}
+	}
+	if verr != nil {
+		return resp, verr
+	}
+	if dryRun || len(writes) == 0 {
+		for _, change := range resp.Changes {
+			change.OK = true
+		}
+		resp.OK = true
+		return resp, nil
+	}
+	batch, err := p.WriteBatch(writes, true)
+	for _, res := range batch.Results {
+		change := changes[fmt.Sprintf("%s:%d", res.Type, res.Address)]
+		change.OK, change.Error = res.OK && !batch.RolledBack, res.Error
+		if res.OK && batch.RolledBack {
+			change.Error = "rolled back"
+		}
+	}
+	resp.RolledBack = batch.RolledBack
+	if err != nil {
+		return resp, fmt.Errorf("restore: %w", err)
+	}
+	resp.OK = true
+	return resp, nil
+}
@@ -0,0 +1,118 @@
+package pingvin
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	p, client := newTestPingvin(t)
+	client.registers[135] = 215
+	client.coils[54] = true
+	b, err := p.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols := []string{}
+	for _, reg := range b.Registers {
+		symbols = append(symbols, reg.Symbol)
+		if reg.Symbol == "HREG_T_SETPOINT" && reg.Value != 21.5 {
+			t.Errorf("HREG_T_SETPOINT is %g, expecting 21.5", reg.Value)
+		}
+	}
+	for _, coil := range b.Coils {
+		symbols = append(symbols, coil.Symbol)
+		if coil.Symbol == "COIL_HEATING_EN" && !coil.Value {
+			t.Error("COIL_HEATING_EN is false, expecting true")
+		}
+	}
+	for _, symbol := range []string{"HREG_T_SETPOINT", "HREG_DAY_WC1", "HREG_IPADDR_HIGH", "COIL_HEATING_EN"} {
+		if !slices.Contains(symbols, symbol) {
+			t.Errorf("%s missing from the backup", symbol)
+		}
+	}
+	// Measurements, logs, the mode and read-only registers are left out
+	for _, symbol := range []string{"HREG_T_FRS", "HREG_ALARM1_ALMTYPE", "HREG_MBADDR", "HREG_SW_VERSION", "COIL_AWAY", "COIL_ALARM_A"} {
+		if slices.Contains(symbols, symbol) {
+			t.Errorf("%s in the backup", symbol)
+		}
+	}
+	if b.Version != BackupVersion {
+		t.Errorf("version is %d, expecting %d", b.Version, BackupVersion)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	p, client := newTestPingvin(t)
+	client.registers[135], client.registers[654] = 215, 0xc0a8
+	b, err := p.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.registers[135], client.registers[654], client.coils[54] = 200, 0x0a00, true
+
+	// Dry run reports the differences without writing
+	client.requests = nil
+	resp, err := p.Restore(b, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Changes) != 3 || resp.Unchanged == 0 {
+		t.Fatalf("unexpected changes %+v", resp)
+	}
+	if c := resp.Changes[0]; c.Symbol != "HREG_T_SETPOINT" || c.Current != 20 || c.Backup != 21.5 || !c.OK {
+		t.Errorf("unexpected change %+v", c)
+	}
+	if slices.ContainsFunc(client.requests, func(req string) bool { return req != "ReadCoils" && req != "ReadHoldingRegisters" }) {
+		t.Errorf("dry run wrote to the unit: %v", client.requests)
+	}
+
+	// The network configuration requires confirmation
+	if _, err := p.Restore(b, false, false); !errors.Is(err, ErrPolicy) {
+		t.Errorf("expecting policy error, got %v", err)
+	}
+	if client.registers[135] != 200 {
+		t.Error("rejected restore wrote to the unit")
+	}
+
+	// Registers, then coils, then the network configuration
+	resp, err = p.Restore(b, false, true)
+	if err != nil || !resp.OK {
+		t.Fatalf("unexpected restore %+v, %v", resp, err)
+	}
+	order := []string{}
+	for _, c := range resp.Changes {
+		order = append(order, c.Symbol)
+	}
+	if !slices.Equal(order, []string{"HREG_T_SETPOINT", "COIL_HEATING_EN", "HREG_IPADDR_HIGH"}) {
+		t.Errorf("unexpected order %v", order)
+	}
+	if client.registers[135] != 215 || client.registers[654] != 0xc0a8 || client.coils[54] {
+		t.Error("backup not restored")
+	}
+	if resp, err := p.Restore(b, false, false); err != nil || len(resp.Changes) != 0 {
+		t.Errorf("expecting no changes, got %+v, %v", resp, err)
+	}
+}
+
+func TestRestoreValidation(t *testing.T) {
+	p, client := newTestPingvin(t)
+	tests := []*Backup{
+		{Version: BackupVersion + 1},
+		{Version: 1, Registers: []BackupRegister{{Symbol: "HREG_NOT_FOUND"}}},
+		{Version: 1, Registers: []BackupRegister{{Symbol: "HREG_MBADDR", Value: 2}}},                                      // read-only
+		{Version: 1, Coils: []BackupCoil{{Symbol: "COIL_AWAY", Value: true}}},                                             // volatile
+		{Version: 1, Registers: []BackupRegister{{Symbol: "HREG_T_SETPOINT"}, {Symbol: "HREG_T_SETPOINT"}}},               // duplicate
+		{Version: 1, Registers: []BackupRegister{{Symbol: "HREG_T_SETPOINT", Value: 90}}},                                 // above max
+		{Version: 1, Registers: []BackupRegister{{Symbol: "HREG_AI1_VL", Value: 5}, {Symbol: "HREG_AI2_VL", Value: 500}}}, // one invalid
+	}
+	for i, b := range tests {
+		if _, err := p.Restore(b, false, true); !errors.Is(err, ErrValidation) {
+			t.Errorf("test %d: expecting validation error, got %v", i, err)
+		}
+	}
+	if slices.ContainsFunc(client.requests, func(req string) bool { return req != "ReadCoils" && req != "ReadHoldingRegisters" }) {
+		t.Errorf("invalid restores wrote to the unit: %v", client.requests)
+	}
+}
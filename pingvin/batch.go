@@ -0,0 +1,425 @@
+package pingvin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Value of a single batch write. Accepts JSON booleans
+// for coils and integers for both coils and registers
+type BatchValue int
+
+// single write in a batch
+type BatchWrite struct {
+	Type    string     `json:"type"` // "coil" or "register"
+	Address int        `json:"address"`
+	Value   BatchValue `json:"value"`
+	Confirm bool       `json:"confirm,omitempty"` // Required for writes with the confirm write policy
+}
+
+// result of a single write in a batch
+type BatchResult struct {
+	Type       string `json:"type"`
+	Address    int    `json:"address"`
+	Symbol     string `json:"symbol"`
+	Requested  int    `json:"requested"`
+	Previous   int    `json:"previous"`
+	Value      int    `json:"value"` // Read back value
+	OK         bool   `json:"ok"`
+	RolledBack bool   `json:"rolled_back"`
+	Error      string `json:"error,omitempty"`
+}
+
+// result of a whole batch
+type BatchResponse struct {
+	OK         bool           `json:"ok"`
+	Atomic     bool           `json:"atomic"`
+	RolledBack bool           `json:"rolled_back"`
+	Results    []*BatchResult `json:"results"`
+}
+
+// Returned when a batch is rejected before anything is written
+var ErrValidation = errors.New("validation failed")
+
+// consecutive writes of the same type to adjacent addresses,
+// sent to the unit in a single request
+type batchRun struct {
+	typ     string
+	start   uint16
+	results []*BatchResult
+	written bool
+}
+
+func (v *BatchValue) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		*v = 0
+		if b {
+			*v = 1
+		}
+		return nil
+	}
+	i, err := strconv.Atoi(string(data))
+	if err != nil {
+		return fmt.Errorf("invalid value %s, expecting boolean or integer", string(data))
+	}
+	*v = BatchValue(i)
+	return nil
+}
+
+// Validate a single batch write against the coil and register data
+func (p *Pingvin) validateBatchWrite(w BatchWrite) error {
+	val := int(w.Value)
+	switch w.Type {
+	case "coil":
+		if w.Address < 0 || w.Address >= len(p.Coils) {
+			return fmt.Errorf("coil address %d out of range", w.Address)
+		}
+		if p.Coils[w.Address].Reserved {
+			return fmt.Errorf("coil %d is reserved", w.Address)
+		}
+		if val != 0 && val != 1 {
+			return fmt.Errorf("invalid coil value %d", val)
+		}
+	case "register":
+		if w.Address < 0 || w.Address >= len(p.Registers) {
+			return fmt.Errorf("register address %d out of range", w.Address)
+		}
+		reg := p.Registers[w.Address]
+		if reg.Reserved {
+			return fmt.Errorf("register %d is reserved", w.Address)
+		}
+		if val < -32768 || val > 65535 {
+			return fmt.Errorf("value %d does not fit in a 16-bit register", val)
+		}
+		if (reg.Type == "uint16" || reg.Type == "enumeration") && val < 0 {
+			return fmt.Errorf("register %d (%s) is unsigned", w.Address, reg.Symbol)
+		}
+		if reg.Type == "int16" && val > 32767 {
+			return fmt.Errorf("value %d out of range for signed register %d (%s)", val, w.Address, reg.Symbol)
+		}
+	default:
+		return fmt.Errorf("invalid type %q, expecting coil or register", w.Type)
+	}
+	return p.checkPolicy(w.Type, w.Address, val, w.Confirm)
+}
+
+// Split writes into runs of consecutive writes to adjacent
+// addresses of the same type. The request order is preserved
+func splitBatch(results []*BatchResult) []*batchRun {
+	runs := []*batchRun{}
+	var run *batchRun
+	for _, res := range results {
+		if run != nil && run.typ == res.Type && int(run.start)+len(run.results) == res.Address &&
+			(res.Type == "coil" || len(run.results) < 123) {
+			run.results = append(run.results, res)
+			continue
+		}
+		run = &batchRun{typ: res.Type, start: uint16(res.Address), results: []*BatchResult{res}}
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// Write a list of coils and registers. All writes are validated before
+// anything is sent to the unit. Consecutive writes to adjacent addresses
+// are combined into a single multi-write request. Each write is verified
+// by reading the value back. If atomic is true, values written before a
+// failure are restored to their previous values.
+func (p *Pingvin) WriteBatch(writes []BatchWrite, atomic bool) (*BatchResponse, error) {
+	resp := &BatchResponse{Atomic: atomic}
+	seen := map[string]bool{}
+	mutexwrites, mutexon := map[uint16]bool{}, false
+	var verr error
+	for _, w := range writes {
+		res := &BatchResult{Type: w.Type, Address: w.Address, Requested: int(w.Value)}
+		resp.Results = append(resp.Results, res)
+		if err := p.validateBatchWrite(w); err != nil {
+			res.Error = err.Error()
+			if verr == nil && errors.Is(err, ErrValidation) {
+				verr = err
+			} else if verr == nil {
+				verr = fmt.Errorf("%w: %s", ErrValidation, err)
+			}
+			continue
+		}
+		key := fmt.Sprintf("%s:%d", w.Type, w.Address)
+		if seen[key] {
+			res.Error = fmt.Sprintf("duplicate write to %s %d", w.Type, w.Address)
+			if verr == nil {
+				verr = fmt.Errorf("%w: %s", ErrValidation, res.Error)
+			}
+			continue
+		}
+		seen[key] = true
+		if w.Type == "coil" {
+			res.Symbol = p.Coils[w.Address].Symbol
+			if isMutexCoil(uint16(w.Address)) {
+				mutexwrites[uint16(w.Address)] = w.Value == 1
+				mutexon = mutexon || w.Value == 1
+			}
+		} else {
+			res.Symbol = p.Registers[w.Address].Symbol
+		}
+	}
+	if mutexon && p.mutexCoilsOn(mutexwrites) > 1 {
+		return resp, fmt.Errorf("%w: only one of the mutually exclusive mode coils %v can be enabled, turn the others off in the same batch", ErrValidation, mutexcoils)
+	}
+	if verr != nil {
+		return resp, verr
+	}
+	if len(writes) == 0 {
+		return resp, fmt.Errorf("%w: no writes given", ErrValidation)
+	}
+	p.writelock.Lock()
+	defer p.writelock.Unlock()
+	runs := splitBatch(resp.Results)
+	var failed error
+	for _, run := range runs {
+		if err := p.readRun(run, true); err != nil {
+			failed = err
+			break
+		}
+		run.written = true
+		if err := p.writeRun(run); err != nil {
+			failed = err
+			break
+		}
+		if err := p.readRun(run, false); err != nil {
+			failed = err
+			break
+		}
+		for _, res := range run.results {
+			if uint16(res.Value) == uint16(res.Requested) {
+				res.OK = true
+			} else {
+				res.Error = "read back value does not match"
+				failed = fmt.Errorf("verification failed for %s %d (%s)", res.Type, res.Address, res.Symbol)
+			}
+		}
+		if failed != nil {
+			break
+		}
+	}
+	if failed != nil {
+		for _, run := range runs {
+			for _, res := range run.results {
+				if !res.OK && len(res.Error) == 0 {
+					res.Error = failed.Error()
+				}
+			}
+		}
+		if atomic {
+			p.rollbackBatch(runs)
+			resp.RolledBack = true
+		}
+		return resp, failed
+	}
+	resp.OK = true
+	for _, res := range resp.Results {
+		log.Printf("Wrote %s %d to value %d (%s)", res.Type, res.Address, res.Value, res.Symbol)
+	}
+	return resp, nil
+}
+
+// Number of mutually exclusive mode coils enabled after writes,
+// the others keep their values in p.Coils
+func (p *Pingvin) mutexCoilsOn(writes map[uint16]bool) int {
+	on := 0
+	for _, n := range mutexcoils {
+		value, ok := writes[n]
+		if (ok && value) || (!ok && p.Coils[n].Value) {
+			on++
+		}
+	}
+	return on
+}
+
+// Restore previous values of written runs, last written first
+func (p *Pingvin) rollbackBatch(runs []*batchRun) {
+	for i := len(runs) - 1; i >= 0; i-- {
+		run := runs[i]
+		if !run.written {
+			continue
+		}
+		prev := &batchRun{typ: run.typ, start: run.start}
+		for _, res := range run.results {
+			prev.results = append(prev.results, &BatchResult{Type: res.Type, Address: res.Address, Requested: res.Previous})
+		}
+		if err := p.writeRun(prev); err != nil {
+			log.Printf("ERROR: rollbackBatch: %s %d-%d: %s", run.typ, run.start, int(run.start)+len(run.results)-1, err)
+			continue
+		}
+		if err := p.readRun(prev, false); err != nil {
+			log.Printf("ERROR: rollbackBatch: %s", err)
+		}
+		for j, res := range run.results {
+			res.OK = false
+			res.Value = prev.results[j].Value
+			res.RolledBack = uint16(prev.results[j].Value) == uint16(res.Previous)
+		}
+	}
+}
+
+// Send a single run to the unit, using multi-write function codes
+// if the run contains more than one address
+func (p *Pingvin) writeRun(run *batchRun) error {
+	var err error
+	quantity := uint16(len(run.results))
+	p.buslock.Lock()
+	defer p.buslock.Unlock()
+	if run.typ == "coil" {
+		if quantity == 1 {
+			var value uint16 = 0
+			if run.results[0].Requested == 1 {
+				value = 0xff00
+			}
+			_, err = p.modbusclient.WriteSingleCoil(run.start, value)
+		} else {
+			vals := make([]bool, quantity)
+			for i, res := range run.results {
+				vals[i] = res.Requested == 1
+			}
+			_, err = p.modbusclient.WriteMultipleCoils(run.start, quantity, coilBits(vals))
+		}
+	} else {
+		if quantity == 1 {
+			_, err = p.modbusclient.WriteSingleRegister(run.start, uint16(run.results[0].Requested))
+		} else {
+			data := make([]byte, 0, 2*quantity)
+			for _, res := range run.results {
+				data = append(data, byte(uint16(res.Requested)>>8), byte(uint16(res.Requested)))
+			}
+			_, err = p.modbusclient.WriteMultipleRegisters(run.start, quantity, data)
+		}
+	}
+	return err
+}
+
+// Read the current values of a run from the unit. If previous is true,
+// the values are stored as the previous values, otherwise as
+// read back values. The values in p.Coils / p.Registers are updated
+func (p *Pingvin) readRun(run *batchRun, previous bool) error {
+	quantity := uint16(len(run.results))
+	vals := make([]int, quantity)
+	if run.typ == "coil" {
+		coils, err := p.readCoilRange(run.start, quantity)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for i, c := range coils {
+			if c {
+				vals[i] = 1
+			}
+			coil := p.Coils[int(run.start)+i]
+			coil.Value, coil.LastUpdated, coil.Stale = c, &now, false
+		}
+	} else {
+		regs, err := p.readRegisterRange(run.start, quantity)
+		if err != nil {
+			return err
+		}
+		copy(vals, regs)
+	}
+	for i, res := range run.results {
+		if previous {
+			res.Previous = vals[i]
+		} else {
+			res.Value = vals[i]
+		}
+	}
+	return nil
+}
+
+// Read a range of coils, returns the coil values
+func (p *Pingvin) readCoilRange(addr, quantity uint16) ([]bool, error) {
+	var results []byte
+	var err error
+	for retries := 1; retries <= 3; retries++ {
+		p.buslock.Lock()
+		results, err = p.modbusclient.ReadCoils(addr, quantity)
+		p.buslock.Unlock()
+		if err == nil && len(results) >= (int(quantity)+7)/8 {
+			break
+		} else if retries == 3 {
+			return nil, fmt.Errorf("reading coils %d-%d failed: %v", addr, addr+quantity-1, err)
+		}
+		p.busstats.retry(opReadCoils)
+		time.Sleep(100 * time.Millisecond)
+	}
+	vals := make([]bool, quantity)
+	for i := range vals {
+		vals[i] = (results[i/8] >> (i % 8) & 0x1) == 1
+	}
+	return vals, nil
+}
+
+// Read a range of holding registers, returns the register values
+// and updates p.Registers
+func (p *Pingvin) readRegisterRange(addr, quantity uint16) ([]int, error) {
+	var results []byte
+	var err error
+	for retries := 1; retries <= 3; retries++ {
+		p.buslock.Lock()
+		results, err = p.modbusclient.ReadHoldingRegisters(addr, quantity)
+		p.buslock.Unlock()
+		if err == nil && len(results) >= 2*int(quantity) {
+			break
+		} else if retries == 3 {
+			return nil, fmt.Errorf("reading registers %d-%d failed: %v", addr, addr+quantity-1, err)
+		}
+		p.busstats.retry(opReadHoldingRegisters)
+		time.Sleep(200 * time.Millisecond)
+	}
+	vals := make([]int, quantity)
+	now := time.Now()
+	for i := range vals {
+		reg := p.Registers[int(addr)+i]
+		reg.LastUpdated, reg.Stale = &now, false
+		uvalue := uint16(results[2*i])<<8 | uint16(results[2*i+1])
+		if reg.Type == "int16" || reg.Type == "bitfield" {
+			reg.Value = int(int16(uvalue))
+		} else {
+			reg.Value = int(uvalue)
+		}
+		vals[i] = reg.Value
+	}
+	return vals, nil
+}
+
+// Convert a slice of booleans to the byte slice expected by
+// modbus.Client.WriteMultipleCoils
+func coilBits(vals []bool) []byte {
+	// modbus.NewClient.WriteMultipleCoils wants the individual
+	// bits in each byte "inverted", e.g. if you want to set 16 coils
+	// with values 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, the
+	// byte array needs to be [0x01,0x80] or [0b00000001, 0b10000000]
+	bits := make([]byte, (len(vals)+7)/8)
+	for i, val := range vals {
+		if val {
+			// i/8 integer division, returns 0 for 0-7 etc.
+			// i%8 loops through 0-7
+			// e.g. coil[19]:  (i/8 = 2, i%8 = 3)
+			// -> bits[2] = (bits[2] | 0b00000001 << 3)
+			// -> bits[2] = bits[2] | 0b00001000
+			// -> 4th least sign. bit is set to 1
+			bits[i/8] |= 0x01 << uint(i%8)
+		}
+	}
+	return bits
+}
+
+// Check if coil is one of the mutually exclusive coils
+func isMutexCoil(addr uint16) bool {
+	for _, mutexcoil := range mutexcoils {
+		if mutexcoil == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package pingvin
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestBatchValueUnmarshal(t *testing.T) {
+	writes := []BatchWrite{}
+	data := `[{"type":"coil","address":10,"value":true},{"type":"register","address":135,"value":-215}]`
+	if err := json.Unmarshal([]byte(data), &writes); err != nil {
+		t.Fatal(err)
+	}
+	if writes[0].Value != 1 {
+		t.Errorf("coil value is %d, expecting 1", writes[0].Value)
+	}
+	if writes[1].Value != -215 {
+		t.Errorf("register value is %d, expecting -215", writes[1].Value)
+	}
+	if err := json.Unmarshal([]byte(`[{"type":"coil","address":10,"value":"on"}]`), &writes); err == nil {
+		t.Error("expecting error for string value")
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	p, client := newTestPingvin(t)
+	writes := []BatchWrite{
+		{Type: "coil", Address: 18, Value: 1},
+		{Type: "coil", Address: 19, Value: 1},
+		{Type: "register", Address: 135, Value: 215},
+		{Type: "register", Address: 110, Value: 5},
+		{Type: "register", Address: 111, Value: 7},
+	}
+	resp, err := p.WriteBatch(writes, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.OK {
+		t.Error("resp.OK is false, expecting true")
+	}
+	if !client.coils[18] || !client.coils[19] {
+		t.Error("coils 18 and 19 not written")
+	}
+	if client.registers[135] != 215 || client.registers[110] != 5 || client.registers[111] != 7 {
+		t.Errorf("registers not written: %d %d %d", client.registers[135], client.registers[110], client.registers[111])
+	}
+	if p.Registers[135].Value != 215 || !p.Coils[19].Value {
+		t.Error("p.Registers / p.Coils not updated from read back")
+	}
+	// Adjacent addresses are written with the multi-write function codes
+	counts := map[string]int{}
+	for _, req := range client.requests {
+		counts[req]++
+	}
+	if counts["WriteMultipleCoils"] != 1 || counts["WriteMultipleRegisters"] != 1 || counts["WriteSingleRegister"] != 1 {
+		t.Errorf("unexpected requests: %v", counts)
+	}
+}
+
+func TestWriteBatchValidation(t *testing.T) {
+	p, client := newTestPingvin(t)
+	tests := [][]BatchWrite{
+		{{Type: "coil", Address: 13, Value: 1}},                                        // reserved
+		{{Type: "coil", Address: 100, Value: 1}},                                       // out of range
+		{{Type: "coil", Address: 10, Value: 2}},                                        // not a boolean
+		{{Type: "register", Address: 3, Value: -1}},                                    // unsigned
+		{{Type: "register", Address: 135, Value: 40000}},                               // signed
+		{{Type: "input", Address: 1, Value: 1}},                                        // type
+		{{Type: "coil", Address: 1, Value: 1}, {Type: "coil", Address: 10, Value: 1}},  // mutex coils
+		{{Type: "coil", Address: 18, Value: 1}, {Type: "coil", Address: 18, Value: 0}}, // duplicate
+		{},
+	}
+	for i, writes := range tests {
+		_, err := p.WriteBatch(writes, true)
+		if !errors.Is(err, ErrValidation) {
+			t.Errorf("test %d: expecting validation error, got %v", i, err)
+		}
+	}
+	if len(client.requests) != 0 {
+		t.Errorf("invalid batches sent requests to the unit: %v", client.requests)
+	}
+}
+
+func TestWriteBatchMutexCoils(t *testing.T) {
+	p, client := newTestPingvin(t)
+	client.coils[1], p.Coils[1].Value = true, true
+	// Away is already on
+	if _, err := p.WriteBatch([]BatchWrite{{Type: "coil", Address: 3, Value: 1}}, true); !errors.Is(err, ErrValidation) {
+		t.Errorf("expecting validation error, got %v", err)
+	}
+	if client.coils[3] {
+		t.Error("overpressure coil written")
+	}
+	// Turning away off in the same batch is fine
+	if _, err := p.WriteBatch([]BatchWrite{{Type: "coil", Address: 1, Value: 0}, {Type: "coil", Address: 3, Value: 1}}, true); err != nil {
+		t.Fatal(err)
+	}
+	if client.coils[1] || !client.coils[3] {
+		t.Errorf("unexpected coils away %t, overpressure %t", client.coils[1], client.coils[3])
+	}
+}
+
+func TestWriteBatchRollback(t *testing.T) {
+	p, client := newTestPingvin(t)
+	client.registers[135] = 210
+	writes := []BatchWrite{
+		{Type: "register", Address: 135, Value: 220},
+		{Type: "coil", Address: 18, Value: 1},
+	}
+	// Simulate a unit ignoring the coil write after the register is written
+	p.modbusclient = &failingCoilClient{client}
+	resp, err := p.WriteBatch(writes, true)
+	if err == nil {
+		t.Fatal("expecting error")
+	}
+	if !resp.RolledBack {
+		t.Error("resp.RolledBack is false, expecting true")
+	}
+	if client.registers[135] != 210 {
+		t.Errorf("register 135 is %d, expecting rollback to 210", client.registers[135])
+	}
+	if !resp.Results[0].RolledBack || resp.Results[0].Previous != 210 {
+		t.Errorf("unexpected result %+v", resp.Results[0])
+	}
+}
+
+// fakeClient that ignores coil writes
+type failingCoilClient struct {
+	*fakeClient
+}
+
+func (c *failingCoilClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	c.requests = append(c.requests, "WriteSingleCoil")
+	return []byte{byte(value >> 8), byte(value)}, nil
+}
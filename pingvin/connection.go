@@ -0,0 +1,163 @@
+package pingvin
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+)
+
+// Connection states
+const (
+	StateConnected    = "connected"
+	StateDegraded     = "degraded"     // Latest update failed
+	StateDisconnected = "disconnected" // Several updates failed or the serial device can't be opened
+)
+
+// Consecutive failed updates before the connection is considered down
+const disconnectedAfter = 3
+
+// Longest wait between reconnection attempts
+const maxBackoff = time.Minute
+
+// Modbus connection health
+type connectionHealth struct {
+	State         string     `json:"state"`
+	Device        string     `json:"device"`
+	SlaveId       int        `json:"slave_id"`
+	LastSuccess   *time.Time `json:"last_success"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	Failures      int        `json:"consecutive_failures"`
+	Reconnects    int        `json:"reconnects"`
+}
+
+// Open the serial device
+func (p *Pingvin) connect() error {
+	p.buslock.Lock()
+	defer p.buslock.Unlock()
+	return p.handler.Connect()
+}
+
+// Close and reopen the serial device, e.g. after a USB adapter
+// has been unplugged and plugged back in
+func (p *Pingvin) reconnect() error {
+	p.buslock.Lock()
+	defer p.buslock.Unlock()
+	_ = p.handler.Close()
+	err := p.handler.Connect()
+	p.healthlock.Lock()
+	defer p.healthlock.Unlock()
+	if err != nil {
+		p.health.State = StateDisconnected
+		p.health.LastError = err.Error()
+		now := time.Now()
+		p.health.LastErrorTime = &now
+		return err
+	}
+	p.health.Reconnects++
+	return nil
+}
+
+// Record the result of an update in the connection health
+func (p *Pingvin) updateHealth(err error) {
+	p.healthlock.Lock()
+	defer p.healthlock.Unlock()
+	now := time.Now()
+	if err == nil {
+		if p.health.State != StateConnected && p.health.LastSuccess != nil {
+			log.Println("Modbus connection restored")
+		}
+		p.health.State = StateConnected
+		p.health.LastSuccess = &now
+		p.health.Failures = 0
+		return
+	}
+	p.health.Failures++
+	p.health.LastError = err.Error()
+	p.health.LastErrorTime = &now
+	if p.health.Failures < disconnectedAfter {
+		p.health.State = StateDegraded
+	} else if p.health.State != StateDisconnected {
+		log.Println("ERROR: Modbus connection lost:", err)
+		p.health.State = StateDisconnected
+	}
+}
+
+// Current Modbus connection health
+func (p *Pingvin) Health() connectionHealth {
+	p.healthlock.Lock()
+	defer p.healthlock.Unlock()
+	return p.health
+}
+
+// true if err is a problem with the serial device rather than with
+// the unit, e.g. a timeout or an exception response. Joined errors
+// are port errors if any of them is
+func isPortError(err error) bool {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return slices.ContainsFunc(joined.Unwrap(), isPortError)
+	}
+	var merr *modbus.ModbusError
+	if err == nil || errors.As(err, &merr) || errors.Is(err, serial.ErrTimeout) {
+		return false
+	}
+	// Invalid CRC, length or slave ID of a response
+	return !strings.Contains(err.Error(), "modbus: response")
+}
+
+// Update the values every interval seconds until ctx is cancelled,
+// retrying failed updates with an increasing delay up to maxBackoff.
+// The serial device is reopened after port errors, or when none of
+// the units on it answer, so a unit that is powered off doesn't reset
+// the port for the other units on the bus
+func (p *Pingvin) Monitor(ctx context.Context, interval int) {
+	wait := time.Duration(interval) * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		err := p.poll()
+		busdown := setBusFailing(p.transport, err != nil)
+		if err == nil {
+			wait = time.Duration(interval) * time.Second
+			continue
+		}
+		if isPortError(err) || busdown {
+			if err := p.reconnect(); err != nil {
+				log.Println("ERROR: Failed to reopen", p.Health().Device+":", err)
+			}
+		}
+		wait = min(2*wait, maxBackoff)
+		log.Println("Retrying in", wait)
+	}
+}
+
+// Close the connection after in-flight writes have finished. The locks
+// are not released, so any later reads and writes block until exit.
+// The bus lock is released if other units still use the serial device,
+// the last one closes it. Pending override reverts are persisted and
+// resumed on the next start
+func (p *Pingvin) Quit() {
+	p.overridelock.Lock()
+	if p.reverttimer != nil {
+		p.reverttimer.Stop()
+	}
+	p.writelock.Lock()
+	p.buslock.Lock()
+	if !releaseBus(p.health.Device) {
+		p.buslock.Unlock()
+		return
+	}
+	if err := p.handler.Close(); err != nil {
+		log.Println("ERROR: Quit:", err)
+	}
+	log.Println("Closed Modbus connection")
+}
@@ -0,0 +1,60 @@
+package pingvin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+)
+
+func TestUpdateHealth(t *testing.T) {
+	p, _ := newTestPingvin(t)
+	p.updateHealth(nil)
+	if h := p.Health(); h.State != StateConnected || h.LastSuccess == nil {
+		t.Fatalf("expected connected after a successful update, got %+v", h)
+	}
+	failure := errors.New("timeout")
+	for i := 1; i <= disconnectedAfter; i++ {
+		p.updateHealth(failure)
+		h := p.Health()
+		if h.Failures != i || h.LastError != "timeout" {
+			t.Fatalf("failure %d: unexpected health %+v", i, h)
+		}
+		expected := StateDegraded
+		if i >= disconnectedAfter {
+			expected = StateDisconnected
+		}
+		if h.State != expected {
+			t.Errorf("failure %d: expected %s, got %s", i, expected, h.State)
+		}
+	}
+	p.updateHealth(nil)
+	if h := p.Health(); h.State != StateConnected || h.Failures != 0 {
+		t.Errorf("expected connected with no failures after recovery, got %+v", h)
+	}
+}
+
+func TestIsPortError(t *testing.T) {
+	exception := &modbus.ModbusError{FunctionCode: 3, ExceptionCode: modbus.ExceptionCodeServerDeviceFailure}
+	ioerror := &os.PathError{Op: "read", Path: "/dev/ttyUSB0", Err: syscall.EIO}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("updateRegisters: %w", serial.ErrTimeout), false},
+		{fmt.Errorf("updateCoils: %w", exception), false},
+		{fmt.Errorf("modbus: response crc '1' does not match expected '2'"), false},
+		{errors.Join(fmt.Errorf("updateCoils: %w", serial.ErrTimeout), exception), false},
+		{fmt.Errorf("updateCoils: %w", ioerror), true},
+		{errors.Join(serial.ErrTimeout, ioerror), true},
+	}
+	for _, test := range tests {
+		if got := isPortError(test.err); got != test.want {
+			t.Errorf("isPortError(%v) is %t, expecting %t", test.err, got, test.want)
+		}
+	}
+}
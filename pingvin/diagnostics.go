@@ -0,0 +1,229 @@
+package pingvin
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Modbus operations, used as the operation label of the bus metrics
+const (
+	opReadCoils              = "read_coils"
+	opReadHoldingRegisters   = "read_holding_registers"
+	opWriteSingleCoil        = "write_single_coil"
+	opWriteMultipleCoils     = "write_multiple_coils"
+	opWriteSingleRegister    = "write_single_register"
+	opWriteMultipleRegisters = "write_multiple_registers"
+)
+
+// Request and error counts of a Modbus operation
+type operationStats struct {
+	Requests      int        `json:"requests"`
+	Successes     int        `json:"successes"`
+	Failures      int        `json:"failures"`
+	Retries       int        `json:"retries"`
+	CRCErrors     int        `json:"crc_errors"`
+	Timeouts      int        `json:"timeouts"`
+	Exceptions    int        `json:"exceptions"` // Exception responses from the unit
+	OtherErrors   int        `json:"other_errors"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// Modbus bus diagnostics, returned by Diagnostics()
+type busDiagnostics struct {
+	Operations         map[string]operationStats `json:"operations"`
+	LastError          string                    `json:"last_error,omitempty"`
+	LastErrorTime      *time.Time                `json:"last_error_time,omitempty"`
+	LastSuccessfulPoll *time.Time                `json:"last_successful_poll"`
+	Connection         connectionHealth          `json:"connection"`
+}
+
+// Collects request statistics of the Modbus client
+type busStats struct {
+	lock          *sync.Mutex
+	operations    map[string]*operationStats
+	lastError     string
+	lastErrorTime *time.Time
+	duration      *prometheus.HistogramVec
+	requests      *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+	retries       *prometheus.CounterVec
+	lastPollDesc  *prometheus.Desc
+}
+
+func newBusStats() *busStats {
+	return &busStats{
+		lock:       &sync.Mutex{},
+		operations: map[string]*operationStats{},
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pingvin_modbus_request_duration_seconds",
+			Help:    "Duration of Modbus requests",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 1.5, 2.5},
+		}, []string{"operation"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pingvin_modbus_requests_total",
+			Help: "Modbus requests by operation and result (ok or error)",
+		}, []string{"operation", "result"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pingvin_modbus_errors_total",
+			Help: "Failed Modbus requests by operation and error type (crc, timeout, exception or other)",
+		}, []string{"operation", "type"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pingvin_modbus_retries_total",
+			Help: "Modbus requests retried after a failure",
+		}, []string{"operation"}),
+		lastPollDesc: prometheus.NewDesc("pingvin_modbus_last_successful_poll_timestamp_seconds",
+			"Time of the last successful read of all coils and registers", nil, nil),
+	}
+}
+
+// Type of a Modbus error for the error counters
+func errorType(err error) string {
+	var merr *modbus.ModbusError
+	var terr interface{ Timeout() bool }
+	switch {
+	case errors.As(err, &merr):
+		return "exception"
+	case errors.Is(err, serial.ErrTimeout), errors.As(err, &terr) && terr.Timeout():
+		return "timeout"
+	case strings.Contains(err.Error(), "crc"):
+		return "crc"
+	}
+	return "other"
+}
+
+// Record the result of a request
+func (s *busStats) record(op string, duration time.Duration, err error) {
+	s.duration.WithLabelValues(op).Observe(duration.Seconds())
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := s.stats(op)
+	stats.Requests++
+	if err == nil {
+		stats.Successes++
+		s.requests.WithLabelValues(op, "ok").Inc()
+		return
+	}
+	stats.Failures++
+	s.requests.WithLabelValues(op, "error").Inc()
+	typ := errorType(err)
+	s.errors.WithLabelValues(op, typ).Inc()
+	switch typ {
+	case "exception":
+		stats.Exceptions++
+	case "timeout":
+		stats.Timeouts++
+	case "crc":
+		stats.CRCErrors++
+	default:
+		stats.OtherErrors++
+	}
+	now := time.Now()
+	stats.LastError, stats.LastErrorTime = err.Error(), &now
+	s.lastError, s.lastErrorTime = err.Error(), &now
+}
+
+// Record a retry of a failed request
+func (s *busStats) retry(op string) {
+	s.retries.WithLabelValues(op).Inc()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats(op).Retries++
+}
+
+// Stats of op, the lock must be held
+func (s *busStats) stats(op string) *operationStats {
+	if _, ok := s.operations[op]; !ok {
+		s.operations[op] = &operationStats{}
+	}
+	return s.operations[op]
+}
+
+// Modbus request statistics and connection health
+func (p *Pingvin) Diagnostics() busDiagnostics {
+	health := p.Health()
+	diag := busDiagnostics{
+		Operations:         map[string]operationStats{},
+		LastSuccessfulPoll: health.LastSuccess,
+		Connection:         health,
+	}
+	p.busstats.lock.Lock()
+	defer p.busstats.lock.Unlock()
+	for op, stats := range p.busstats.operations {
+		diag.Operations[op] = *stats
+	}
+	diag.LastError, diag.LastErrorTime = p.busstats.lastError, p.busstats.lastErrorTime
+	return diag
+}
+
+func (s *busStats) describe(ch chan<- *prometheus.Desc) {
+	s.duration.Describe(ch)
+	s.requests.Describe(ch)
+	s.errors.Describe(ch)
+	s.retries.Describe(ch)
+	ch <- s.lastPollDesc
+}
+
+func (s *busStats) collect(ch chan<- prometheus.Metric, lastPoll *time.Time) {
+	s.duration.Collect(ch)
+	s.requests.Collect(ch)
+	s.errors.Collect(ch)
+	s.retries.Collect(ch)
+	if lastPoll != nil {
+		ch <- prometheus.MustNewConstMetric(s.lastPollDesc, prometheus.GaugeValue, float64(lastPoll.Unix()))
+	}
+}
+
+// modbus.Client recording the duration and result of each request
+type instrumentedClient struct {
+	modbus.Client
+	stats *busStats
+}
+
+func (c *instrumentedClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	start := time.Now()
+	results, err := c.Client.ReadCoils(address, quantity)
+	c.stats.record(opReadCoils, time.Since(start), err)
+	return results, err
+}
+
+func (c *instrumentedClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	start := time.Now()
+	results, err := c.Client.ReadHoldingRegisters(address, quantity)
+	c.stats.record(opReadHoldingRegisters, time.Since(start), err)
+	return results, err
+}
+
+func (c *instrumentedClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	start := time.Now()
+	results, err := c.Client.WriteSingleCoil(address, value)
+	c.stats.record(opWriteSingleCoil, time.Since(start), err)
+	return results, err
+}
+
+func (c *instrumentedClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	start := time.Now()
+	results, err := c.Client.WriteMultipleCoils(address, quantity, value)
+	c.stats.record(opWriteMultipleCoils, time.Since(start), err)
+	return results, err
+}
+
+func (c *instrumentedClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	start := time.Now()
+	results, err := c.Client.WriteSingleRegister(address, value)
+	c.stats.record(opWriteSingleRegister, time.Since(start), err)
+	return results, err
+}
+
+func (c *instrumentedClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	start := time.Now()
+	results, err := c.Client.WriteMultipleRegisters(address, quantity, value)
+	c.stats.record(opWriteMultipleRegisters, time.Since(start), err)
+	return results, err
+}
@@ -0,0 +1,51 @@
+package pingvin
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+)
+
+func TestErrorType(t *testing.T) {
+	tests := map[error]string{
+		&modbus.ModbusError{FunctionCode: 3, ExceptionCode: 2}: "exception",
+		serial.ErrTimeout: "timeout",
+		fmt.Errorf("read: %w", os.ErrDeadlineExceeded):                         "timeout",
+		fmt.Errorf("modbus: response crc '1' does not match expected '2'"):     "crc",
+		fmt.Errorf("modbus: response slave id '2' does not match request '1'"): "other",
+	}
+	for err, expected := range tests {
+		if typ := errorType(err); typ != expected {
+			t.Errorf("%v: expected %s, got %s", err, expected, typ)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	p, _ := newTestPingvin(t)
+	if err := p.Update(); err != nil {
+		t.Fatal(err)
+	}
+	// Out of range, the fake unit responds with an exception
+	if _, err := p.readRegisterRange(uint16(len(p.Registers)-1), 2); err == nil {
+		t.Fatal("expecting error")
+	}
+	diag := p.Diagnostics()
+	if diag.LastSuccessfulPoll == nil || diag.Connection.State != StateConnected {
+		t.Errorf("unexpected poll status %v, %s", diag.LastSuccessfulPoll, diag.Connection.State)
+	}
+	coils := diag.Operations[opReadCoils]
+	if coils.Requests != 1 || coils.Successes != 1 || coils.Failures != 0 {
+		t.Errorf("unexpected read_coils stats %+v", coils)
+	}
+	regs := diag.Operations[opReadHoldingRegisters]
+	if regs.Failures != 3 || regs.Exceptions != 3 || regs.Retries != 2 {
+		t.Errorf("unexpected read_holding_registers stats %+v", regs)
+	}
+	if regs.Requests != regs.Successes+regs.Failures || len(diag.LastError) == 0 {
+		t.Errorf("unexpected stats %+v, last error %q", regs, diag.LastError)
+	}
+}
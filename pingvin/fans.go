@@ -0,0 +1,109 @@
+package pingvin
+
+import (
+	"fmt"
+	"log"
+)
+
+// Fan speed setting register for an operating mode
+type fanSetting struct {
+	Mode   string
+	Symbol string
+}
+
+// Configured fan speed for an operating mode
+type fanLevel struct {
+	Mode     string `json:"mode"`
+	Symbol   string `json:"symbol"`
+	Address  int    `json:"address"`
+	Value    int    `json:"value"`              // Fan speed, %
+	Previous *int   `json:"previous,omitempty"` // Fan speed before SetFanLevel
+	Min      *int   `json:"min,omitempty"`
+	Max      *int   `json:"max,omitempty"`
+}
+
+// Current effective fan speeds and configured levels
+type fanStatus struct {
+	Supply      int         `json:"supply_pct"`      // HREG_EFFECTIVE_TF
+	Extract     int         `json:"extract_pct"`     // HREG_EFFECTIVE_PF
+	Circulation int         `json:"circulation_pct"` // HREG_EFFECTIVE_CIRCULATION
+	Levels      []*fanLevel `json:"levels"`
+}
+
+// Fan speed settings per operating mode. The registers are not in
+// the built-in map, the levels are listed only if a custom map has them.
+// The normal, boost and overpressure levels are not supported
+var fanSettings = []fanSetting{
+	{"away", "HREG_AWAY_VENT_LEVEL"},
+	{"away_long", "HREG_AWAYL_VENT_LEVEL"},
+}
+
+// Read the configured fan speed levels from the unit. The effective
+// speeds are the values from the latest update
+func (p *Pingvin) Fans() (*fanStatus, error) {
+	speeds := []int{}
+	for _, symbol := range []string{"HREG_EFFECTIVE_TF", "HREG_EFFECTIVE_PF", "HREG_EFFECTIVE_CIRCULATION"} {
+		reg := p.registerBySymbol(symbol)
+		if reg == nil {
+			return nil, fmt.Errorf("fan speed register %s is not in the register map", symbol)
+		}
+		speeds = append(speeds, reg.Value/reg.Multiplier)
+	}
+	status := &fanStatus{Supply: speeds[0], Extract: speeds[1], Circulation: speeds[2]}
+	for _, setting := range fanSettings {
+		reg := p.registerBySymbol(setting.Symbol)
+		if reg == nil {
+			continue
+		}
+		if _, err := p.ReadRegister(uint16(reg.Address)); err != nil {
+			return nil, err
+		}
+		level := &fanLevel{Mode: setting.Mode, Symbol: setting.Symbol}
+		level.fromRegister(reg)
+		status.Levels = append(status.Levels, level)
+	}
+	return status, nil
+}
+
+// Set the fan speed level of an operating mode. The value must be
+// within the limits of the register
+func (p *Pingvin) SetFanLevel(mode string, value int) (*fanLevel, error) {
+	for _, setting := range fanSettings {
+		if setting.Mode != mode {
+			continue
+		}
+		reg := p.registerBySymbol(setting.Symbol)
+		if reg == nil {
+			return nil, fmt.Errorf("%w: fan speed setting for %s mode (%s) is not in the register map", ErrValidation, mode, setting.Symbol)
+		}
+		previous := reg.Value / reg.Multiplier
+		raw := value * reg.Multiplier
+		if (reg.Min != nil && raw < *reg.Min) || (reg.Max != nil && raw > *reg.Max) {
+			return nil, fmt.Errorf("%w: fan speed %d%% out of range for %s mode", ErrValidation, value, mode)
+		}
+		if _, err := p.WriteBatch([]BatchWrite{{Type: "register", Address: reg.Address, Value: BatchValue(raw)}}, false); err != nil {
+			level := &fanLevel{Mode: mode, Symbol: setting.Symbol, Previous: &previous}
+			level.fromRegister(reg)
+			return level, err
+		}
+		log.Printf("Set %s mode fan speed to %d%%", mode, value)
+		level := &fanLevel{Mode: mode, Symbol: setting.Symbol, Previous: &previous}
+		level.fromRegister(reg)
+		return level, nil
+	}
+	return nil, fmt.Errorf("%w: no fan speed setting for mode %s", ErrValidation, mode)
+}
+
+// Fill in fanLevel from the register data
+func (level *fanLevel) fromRegister(reg *pingvinRegister) {
+	level.Address = reg.Address
+	level.Value = reg.Value / reg.Multiplier
+	if reg.Min != nil {
+		min := *reg.Min / reg.Multiplier
+		level.Min = &min
+	}
+	if reg.Max != nil {
+		max := *reg.Max / reg.Multiplier
+		level.Max = &max
+	}
+}
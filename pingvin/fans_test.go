@@ -0,0 +1,90 @@
+package pingvin
+
+import (
+	"errors"
+	"testing"
+)
+
+// Test Pingvin with the away fan level registers added to the map,
+// as in a custom map
+func newFanTestPingvin(t *testing.T) (*Pingvin, *fakeClient) {
+	t.Helper()
+	p, client := newTestPingvin(t)
+	m, err := ReadMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, max := 20, 100
+	m.Registers = append(m.Registers,
+		MapRegister{Address: 100, Symbol: "HREG_AWAY_VENT_LEVEL", Type: "uint16", Multiplier: 1, Min: &min, Max: &max},
+		MapRegister{Address: 102, Symbol: "HREG_AWAYL_VENT_LEVEL", Type: "uint16", Multiplier: 1, Min: &min, Max: &max},
+	)
+	if err := p.applyMap(m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetWritePolicies(nil); err != nil {
+		t.Fatal(err)
+	}
+	return p, client
+}
+
+func TestFans(t *testing.T) {
+	p, client := newFanTestPingvin(t)
+	client.registers[100] = 40
+	p.Registers[3].Value = 55
+	status, err := p.Fans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Supply != 55 {
+		t.Errorf("supply fan is %d, expecting 55", status.Supply)
+	}
+	// Levels not in the map are left out
+	if len(status.Levels) != 2 || status.Levels[0].Mode != "away" || status.Levels[1].Mode != "away_long" {
+		t.Fatalf("unexpected levels %+v", status.Levels)
+	}
+	if level := status.Levels[0]; level.Value != 40 || level.Min == nil || *level.Min != 20 || *level.Max != 100 {
+		t.Errorf("unexpected away level %+v", level)
+	}
+
+	// Map with a minimum but no maximum
+	p.Registers[100].Max = nil
+	status, err = p.Fans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level := status.Levels[0]; level.Min == nil || *level.Min != 20 || level.Max != nil {
+		t.Errorf("unexpected away level %+v", level)
+	}
+
+	// The built-in map has no fan levels
+	p, _ = newTestPingvin(t)
+	if status, err := p.Fans(); err != nil || len(status.Levels) != 0 {
+		t.Errorf("expecting no levels, got %+v, %v", status, err)
+	}
+	// Map without the fan speed registers
+	p.Registers = p.Registers[:4]
+	if _, err := p.Fans(); err == nil {
+		t.Error("expecting error for a map without HREG_EFFECTIVE_CIRCULATION")
+	}
+}
+
+func TestSetFanLevel(t *testing.T) {
+	p, client := newFanTestPingvin(t)
+	level, err := p.SetFanLevel("away_long", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.registers[102] != 30 || level.Value != 30 {
+		t.Errorf("away long fan level not written, register is %d", client.registers[102])
+	}
+	if _, err := p.SetFanLevel("away", 101); !errors.Is(err, ErrValidation) {
+		t.Errorf("expecting validation error for out of range value, got %v", err)
+	}
+	if _, err := p.SetFanLevel("normal", 50); !errors.Is(err, ErrValidation) {
+		t.Errorf("expecting validation error for a level not in the map, got %v", err)
+	}
+	if _, err := p.SetFanLevel("turbo", 50); !errors.Is(err, ErrValidation) {
+		t.Errorf("expecting validation error for unknown mode, got %v", err)
+	}
+}
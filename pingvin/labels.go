@@ -0,0 +1,77 @@
+package pingvin
+
+import "slices"
+
+// Languages of the labels in the map, sorted
+func (p *Pingvin) Languages() []string {
+	return p.languages
+}
+
+// Collect the languages of the coil and register labels
+func mapLanguages(coils []*pingvinCoil, registers []*pingvinRegister) []string {
+	languages := []string{}
+	add := func(labels map[string]MapLabel) {
+		for lang := range labels {
+			if !slices.Contains(languages, lang) {
+				languages = append(languages, lang)
+			}
+		}
+	}
+	for _, coil := range coils {
+		add(coil.Labels)
+	}
+	for _, reg := range registers {
+		add(reg.Labels)
+	}
+	slices.Sort(languages)
+	return languages
+}
+
+// Copy of the coil with the description in lang. The coil itself is
+// returned if it has no label in lang
+func (c *pingvinCoil) Localize(lang string) *pingvinCoil {
+	label, ok := c.Labels[lang]
+	if !ok {
+		return c
+	}
+	localized := *c
+	if len(label.Description) > 0 {
+		localized.Description = label.Description
+	}
+	return &localized
+}
+
+// Copy of the register with the name and description in lang. The
+// register itself is returned if it has no label in lang
+func (r *pingvinRegister) Localize(lang string) *pingvinRegister {
+	label, ok := r.Labels[lang]
+	if !ok {
+		return r
+	}
+	localized := *r
+	if len(label.Name) > 0 {
+		localized.Name = label.Name
+	}
+	if len(label.Description) > 0 {
+		localized.Description = label.Description
+	}
+	return &localized
+}
+
+// Coils with the descriptions in lang
+func (p *Pingvin) LocalizedCoils(lang string) []*pingvinCoil {
+	coils := make([]*pingvinCoil, len(p.Coils))
+	for i, coil := range p.Coils {
+		coils[i] = coil.Localize(lang)
+	}
+	return coils
+}
+
+// Registers with the names and descriptions in lang
+func (p *Pingvin) LocalizedRegisters(lang string) []*pingvinRegister {
+	registers := make([]*pingvinRegister, len(p.Registers))
+	for i, reg := range p.Registers {
+		registers[i] = reg.Localize(lang)
+	}
+	return registers
+}
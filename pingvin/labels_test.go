@@ -0,0 +1,31 @@
+package pingvin
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLocalize(t *testing.T) {
+	p, _ := newTestPingvin(t)
+	if languages := p.Languages(); !slices.Equal(languages, []string{"en", "fi"}) {
+		t.Errorf("expecting languages en and fi, got %v", languages)
+	}
+	reg := p.Registers[135].Localize("fi")
+	if reg.Name != "Asetettu lämpötila" || reg.Symbol != "HREG_T_SETPOINT" || p.Registers[135].Name != "Supply air setpoint" {
+		t.Errorf("unexpected localized register %v", reg)
+	}
+	// The English label only replaces the description
+	reg = p.Registers[1].Localize("en")
+	if reg != p.Registers[1] {
+		t.Error("expecting the register itself without a label")
+	}
+	if reg := p.Registers[3].Localize("en"); reg.Name != "Fan speed, supply air" || reg.Description != "Current supply air fan speed" {
+		t.Errorf("unexpected localized register %v", reg)
+	}
+	if coil := p.LocalizedCoils("fi")[6]; coil.Description != "Maksimilämmitys" || p.Coils[6].Description == coil.Description {
+		t.Errorf("unexpected localized coil %v", coil)
+	}
+	if coils := p.LocalizedCoils("sv"); coils[6] != p.Coils[6] {
+		t.Error("expecting the coils themselves for a language without labels")
+	}
+}
@@ -0,0 +1,527 @@
+package pingvin
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Built-in coil and register map
+//
+//go:embed enervent.yaml
+var defaultMap []byte
+
+// Version of the map format
+const mapVersion = 1
+
+// Register types
+var registerTypes = []string{"int16", "uint16", "bitfield", "enumeration"}
+
+// Map files replacing the built-in map. Map is a YAML or JSON map,
+// Coils and Registers are CSV maps in the format of the original
+// coils.csv and registers.csv
+type MapFiles struct {
+	Map       string
+	Coils     string
+	Registers string
+	Profile   string // Profile to use, detected from the unit if empty
+}
+
+// Coil and register map. Addresses missing from the map are reserved
+type Map struct {
+	Version   int           `yaml:"version" json:"version"`
+	Name      string        `yaml:"name,omitempty" json:"name,omitempty"`
+	Coils     []MapCoil     `yaml:"coils" json:"coils"`
+	Registers []MapRegister `yaml:"registers" json:"registers"`
+	Profiles  []MapProfile  `yaml:"profiles,omitempty" json:"profiles,omitempty"`
+}
+
+type MapCoil struct {
+	Address     int                 `yaml:"address" json:"address"`
+	Symbol      string              `yaml:"symbol,omitempty" json:"symbol,omitempty"`
+	Description string              `yaml:"description,omitempty" json:"description,omitempty"`
+	Labels      map[string]MapLabel `yaml:"labels,omitempty" json:"labels,omitempty"`     // Descriptions by language
+	Access      string              `yaml:"access,omitempty" json:"access,omitempty"`     // Default write policy: read, write or confirm
+	Reserved    bool                `yaml:"reserved,omitempty" json:"reserved,omitempty"` // Removes the coil in a profile
+}
+
+type MapRegister struct {
+	Address     int                 `yaml:"address" json:"address"`
+	Symbol      string              `yaml:"symbol,omitempty" json:"symbol,omitempty"`
+	Type        string              `yaml:"type,omitempty" json:"type,omitempty"`             // int16, uint16, bitfield or enumeration
+	Multiplier  int                 `yaml:"multiplier,omitempty" json:"multiplier,omitempty"` // Required, 1 for none
+	Unit        string              `yaml:"unit,omitempty" json:"unit,omitempty"`
+	Name        string              `yaml:"name,omitempty" json:"name,omitempty"` // Short name
+	Description string              `yaml:"description,omitempty" json:"description,omitempty"`
+	Labels      map[string]MapLabel `yaml:"labels,omitempty" json:"labels,omitempty"` // Names and descriptions by language
+	Notes       string              `yaml:"notes,omitempty" json:"notes,omitempty"`
+	Min         *int                `yaml:"min,omitempty" json:"min,omitempty"` // Lowest allowed raw value
+	Max         *int                `yaml:"max,omitempty" json:"max,omitempty"` // Highest allowed raw value
+	Access      string              `yaml:"access,omitempty" json:"access,omitempty"`
+	Enum        map[int]string      `yaml:"enum,omitempty" json:"enum,omitempty"`     // Names of the values
+	Bits        []string            `yaml:"bits,omitempty" json:"bits,omitempty"`     // Names of the bits, LSB first
+	Metric      *MapMetric          `yaml:"metric,omitempty" json:"metric,omitempty"` // Metric in the labelled metric layout
+	Reserved    bool                `yaml:"reserved,omitempty" json:"reserved,omitempty"`
+}
+
+// Metric family and labels of a register in the labelled metric layout,
+// e.g. name temperature_celsius with labels {sensor: TE20} is exported
+// as pingvin_temperature_celsius{sensor="TE20"}. Registers of a family
+// share the type, group and label names
+type MapMetric struct {
+	Name   string            `yaml:"name" json:"name"`                         // Without the pingvin_ prefix
+	Group  string            `yaml:"group" json:"group"`                       // For choosing the metrics to export
+	Type   string            `yaml:"type,omitempty" json:"type,omitempty"`     // gauge or counter, default gauge
+	Help   string            `yaml:"help,omitempty" json:"help,omitempty"`     // Given for one register of the family
+	Labels map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"` // Tell the registers of the family apart
+}
+
+// Name and description in a language, replacing the ones of the
+// coil or register. Coils have no name
+type MapLabel struct {
+	Name        string `yaml:"name,omitempty" json:"name,omitempty"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+}
+
+// Changes to the map for a unit family or software versions. A profile
+// is used if the unit matches all the conditions given. Coils and
+// registers replace the ones at the same address in the map
+type MapProfile struct {
+	Name         string        `yaml:"name" json:"name"`
+	Family       []int         `yaml:"family,omitempty" json:"family,omitempty"`                 // HREG_FAMILY_TYPE values
+	MinSwVersion *float64      `yaml:"min_sw_version,omitempty" json:"min_sw_version,omitempty"` // HREG_SW_VERSION, e.g. 1.18
+	MaxSwVersion *float64      `yaml:"max_sw_version,omitempty" json:"max_sw_version,omitempty"`
+	Coils        []MapCoil     `yaml:"coils,omitempty" json:"coils,omitempty"`
+	Registers    []MapRegister `yaml:"registers,omitempty" json:"registers,omitempty"`
+}
+
+// Read and validate a YAML or JSON map, the built-in map if file is
+// empty. Files ending in .json are read as JSON
+func ReadMap(file string) (*Map, error) {
+	return loadMap(MapFiles{Map: file})
+}
+
+// Read the map given in files without validating it. CSV maps replace
+// the coils or registers of the built-in map, its profiles are not
+// used with them
+func DecodeMap(files MapFiles) (*Map, error) {
+	if len(files.Map) > 0 && (len(files.Coils) > 0 || len(files.Registers) > 0) {
+		return nil, errors.New("a map can't be used together with CSV coil and register maps")
+	}
+	data := defaultMap
+	if len(files.Map) > 0 {
+		var err error
+		if data, err = os.ReadFile(files.Map); err != nil {
+			return nil, err
+		}
+	}
+	m := &Map{}
+	var err error
+	if strings.EqualFold(filepath.Ext(files.Map), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(m)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", mapName(files), err)
+	}
+	if len(files.Coils) > 0 || len(files.Registers) > 0 {
+		m.Profiles = nil
+	}
+	if len(files.Coils) > 0 {
+		if m.Coils, err = csvCoils(files.Coils); err != nil {
+			return nil, err
+		}
+	}
+	if len(files.Registers) > 0 {
+		if m.Registers, err = csvRegisters(files.Registers); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Read and validate the map given in files
+func loadMap(files MapFiles) (*Map, error) {
+	m, err := DecodeMap(files)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", mapName(files), err)
+	}
+	return m, nil
+}
+
+// Name of the map in files for error messages
+func mapName(files MapFiles) string {
+	csvs := slices.DeleteFunc([]string{files.Coils, files.Registers}, func(f string) bool { return len(f) == 0 })
+	if len(csvs) > 0 {
+		return strings.Join(csvs, ", ")
+	} else if len(files.Map) > 0 {
+		return files.Map
+	}
+	return "built-in map"
+}
+
+// Profile by name, nil if not found
+func (m *Map) profile(name string) *MapProfile {
+	for i := range m.Profiles {
+		if m.Profiles[i].Name == name {
+			return &m.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// First profile matching the unit family and software version,
+// nil if none matches
+func (m *Map) matchProfile(family int, swVersion float64) *MapProfile {
+	for i := range m.Profiles {
+		profile := &m.Profiles[i]
+		if len(profile.Family) > 0 && !slices.Contains(profile.Family, family) {
+			continue
+		}
+		if profile.MinSwVersion != nil && swVersion < *profile.MinSwVersion {
+			continue
+		}
+		if profile.MaxSwVersion != nil && swVersion > *profile.MaxSwVersion {
+			continue
+		}
+		return profile
+	}
+	return nil
+}
+
+// Coils with the changes of profile. Duplicate addresses in the
+// profile are returned as an error with the coils
+func (m *Map) profileCoils(profile *MapProfile) ([]MapCoil, error) {
+	coils := slices.Clone(m.Coils)
+	if profile == nil {
+		return coils, nil
+	}
+	errs := []error{}
+	seen := map[int]bool{}
+	for _, coil := range profile.Coils {
+		if seen[coil.Address] {
+			errs = append(errs, fmt.Errorf("coil %d: duplicate address", coil.Address))
+			continue
+		}
+		seen[coil.Address] = true
+		i := slices.IndexFunc(coils, func(c MapCoil) bool { return c.Address == coil.Address })
+		if i < 0 {
+			coils = append(coils, coil)
+		} else {
+			coils[i] = coil
+		}
+	}
+	return coils, errors.Join(errs...)
+}
+
+// Registers with the changes of profile. Duplicate addresses in the
+// profile are returned as an error with the registers
+func (m *Map) profileRegisters(profile *MapProfile) ([]MapRegister, error) {
+	registers := slices.Clone(m.Registers)
+	if profile == nil {
+		return registers, nil
+	}
+	errs := []error{}
+	seen := map[int]bool{}
+	for _, reg := range profile.Registers {
+		if seen[reg.Address] {
+			errs = append(errs, fmt.Errorf("register %d: duplicate address", reg.Address))
+			continue
+		}
+		seen[reg.Address] = true
+		i := slices.IndexFunc(registers, func(r MapRegister) bool { return r.Address == reg.Address })
+		if i < 0 {
+			registers = append(registers, reg)
+		} else {
+			registers[i] = reg
+		}
+	}
+	return registers, errors.Join(errs...)
+}
+
+// Set the coils, registers and map write policies from m with the
+// changes of profile, which may be nil
+func (p *Pingvin) applyMap(m *Map, profile *MapProfile) error {
+	coils, registers, policies, err := buildMap(m, profile)
+	if err != nil {
+		return err
+	}
+	p.Coils, p.Registers, p.mapPolicies = coils, registers, policies
+	p.languages = mapLanguages(coils, registers)
+	p.Profile = ""
+	if profile != nil {
+		p.Profile = profile.Name
+	}
+	return nil
+}
+
+// Build the coils, registers and map write policies of m with the
+// changes of profile. Coils and registers are indexed by address,
+// addresses missing from the map are reserved. Entries with problems
+// are left out, the problems are returned joined in the error
+func buildMap(m *Map, profile *MapProfile) ([]*pingvinCoil, []*pingvinRegister, []WritePolicy, error) {
+	mapcoils, coilerr := m.profileCoils(profile)
+	mapregisters, regerr := m.profileRegisters(profile)
+	errs := []error{coilerr, regerr}
+	policies := []WritePolicy{}
+	symbols := map[string]bool{}
+	metrics := map[string]string{} // Metric names and the coils or registers using them
+	coils := []*pingvinCoil{}
+	for _, c := range mapcoils {
+		if c.Address < 0 || c.Address > 0xffff {
+			errs = append(errs, fmt.Errorf("coil %d: invalid address", c.Address))
+			continue
+		}
+		for len(coils) <= c.Address {
+			coils = append(coils, newCoil(len(coils), "-", "-"))
+		}
+		if !coils[c.Address].Reserved {
+			errs = append(errs, fmt.Errorf("coil %d: duplicate address", c.Address))
+			continue
+		}
+		if c.Reserved {
+			continue
+		}
+		err := checkSymbol(c.Symbol, c.Access, symbols)
+		if err == nil {
+			err = checkLabels(c.Symbol, c.Labels, false)
+		}
+		if err == nil {
+			err = checkMetric(metricName(c.Symbol, c.Address, 2), fmt.Sprintf("coil %d", c.Address), metrics)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("coil %d: %w", c.Address, err))
+			continue
+		}
+		coils[c.Address] = newCoil(c.Address, c.Symbol, c.Description)
+		coils[c.Address].Labels = c.Labels
+		if len(c.Access) > 0 {
+			policies = append(policies, WritePolicy{Symbol: c.Symbol, Access: c.Access})
+		}
+	}
+	registers := []*pingvinRegister{}
+	for _, r := range mapregisters {
+		if r.Address < 0 || r.Address > 0xffff {
+			errs = append(errs, fmt.Errorf("register %d: invalid address", r.Address))
+			continue
+		}
+		for len(registers) <= r.Address {
+			registers = append(registers, newRegister(len(registers), "Reserved", "", 1, "Reserved"))
+		}
+		if !registers[r.Address].Reserved {
+			errs = append(errs, fmt.Errorf("register %d: duplicate address", r.Address))
+			continue
+		}
+		if r.Reserved {
+			continue
+		}
+		err := checkRegister(r, symbols)
+		if err == nil {
+			err = checkMetric(metricName(r.Symbol, r.Address, 3), fmt.Sprintf("register %d", r.Address), metrics)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("register %d: %w", r.Address, err))
+			continue
+		}
+		reg := newRegister(r.Address, r.Symbol, r.Type, r.Multiplier, r.Description)
+		reg.Name, reg.Unit, reg.Min, reg.Max, reg.Enum, reg.Bits = r.Name, r.Unit, r.Min, r.Max, r.Enum, r.Bits
+		reg.Labels, reg.Metric = r.Labels, r.Metric
+		registers[r.Address] = reg
+		if len(r.Access) > 0 {
+			policies = append(policies, WritePolicy{Symbol: r.Symbol, Access: r.Access})
+		}
+	}
+	errs = append(errs, checkMetricFamilies(registers)...)
+	return coils, registers, policies, errors.Join(errs...)
+}
+
+// Choose the profile of the map for the connected unit. A profile
+// given by name is used as is, otherwise the profile is matched
+// against the unit family and software version. Returns nil
+// for the base map
+func (p *Pingvin) detectProfile(m *Map, name string) (*MapProfile, error) {
+	if len(name) > 0 {
+		if profile := m.profile(name); profile != nil {
+			return profile, nil
+		}
+		return nil, fmt.Errorf("unknown map profile %s", name)
+	}
+	if len(m.Profiles) == 0 {
+		return nil, nil
+	}
+	familyreg, swreg := p.registerBySymbol("HREG_FAMILY_TYPE"), p.registerBySymbol("HREG_SW_VERSION")
+	if familyreg == nil || swreg == nil {
+		log.Println("WARNING: HREG_FAMILY_TYPE or HREG_SW_VERSION missing from the map, using the base map")
+		return nil, nil
+	}
+	family, err := p.ReadRegister(uint16(familyreg.Address))
+	if err == nil {
+		var sw int
+		sw, err = p.ReadRegister(uint16(swreg.Address))
+		swVersion := float64(sw) / float64(swreg.Multiplier)
+		if err == nil {
+			log.Printf("Unit family %d, software version %g", family, swVersion)
+			return m.matchProfile(family, swVersion), nil
+		}
+	}
+	log.Println("WARNING: Failed to read the unit family and software version, using the base map:", err)
+	return nil, nil
+}
+
+// Read the lines of a CSV map. The original CSVs are semicolon
+// separated and Windows-1252 encoded
+func readCsv(file string) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comma = ';'
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	lines := [][]string{}
+	for {
+		line, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for i := range line {
+			line[i] = strings.TrimSpace(decodeWindows1252(line[i]))
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// Characters of Windows-1252 that differ from Latin-1
+var windows1252 = map[byte]rune{
+	0x80: '€', 0x85: '…', 0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x96: '–', 0x97: '—',
+}
+
+// Decode s from Windows-1252, unless it's valid UTF-8
+func decodeWindows1252(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	runes := []rune{}
+	for _, b := range []byte(s) {
+		if r, ok := windows1252[b]; ok {
+			runes = append(runes, r)
+		} else {
+			runes = append(runes, rune(b))
+		}
+	}
+	return string(runes)
+}
+
+// Read coils from a CSV map with the columns address, symbol and
+// description. Reserved coils are left out
+func csvCoils(file string) ([]MapCoil, error) {
+	lines, err := readCsv(file)
+	if err != nil {
+		return nil, err
+	}
+	coils := []MapCoil{}
+	for i, line := range lines {
+		if len(line) < 3 {
+			return nil, fmt.Errorf("%s line %d: expecting 3 columns, got %d", file, i+1, len(line))
+		}
+		addr, err := strconv.Atoi(line[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid coil address %q", file, i+1, line[0])
+		}
+		if line[1] == "-" && line[2] == "-" {
+			continue
+		}
+		coils = append(coils, MapCoil{Address: addr, Symbol: line[1], Description: line[2]})
+	}
+	return coils, nil
+}
+
+// Read registers from a CSV map with the columns address, symbol, type,
+// multiplier, value range, name, description, UI name and description
+// and notes.
+// Reserved registers are left out
+func csvRegisters(file string) ([]MapRegister, error) {
+	lines, err := readCsv(file)
+	if err != nil {
+		return nil, err
+	}
+	registers := []MapRegister{}
+	for i, line := range lines {
+		if len(line) < 7 {
+			return nil, fmt.Errorf("%s line %d: expecting at least 7 columns, got %d", file, i+1, len(line))
+		}
+		addr, err := strconv.Atoi(line[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid register address %q", file, i+1, line[0])
+		}
+		if line[1] == "Reserved" && line[6] == "Reserved" {
+			continue
+		}
+		multiplier := 1
+		if len(line[3]) > 0 {
+			if multiplier, err = strconv.Atoi(line[3]); err != nil || multiplier <= 0 {
+				return nil, fmt.Errorf("%s line %d: invalid multiplier %q", file, i+1, line[3])
+			}
+		}
+		reg := MapRegister{Address: addr, Symbol: line[1], Type: line[2], Multiplier: multiplier, Name: line[5], Description: line[6]}
+		reg.Min, reg.Max = parseLimits(line[4])
+		// The UI texts are the English labels
+		if len(line) > 8 {
+			label := MapLabel{}
+			if line[7] != reg.Name {
+				label.Name = line[7]
+			}
+			if line[8] != reg.Description {
+				label.Description = line[8]
+			}
+			if label != (MapLabel{}) {
+				reg.Labels = map[string]MapLabel{"en": label}
+			}
+		}
+		if len(line) > 9 {
+			reg.Notes = line[9]
+		}
+		registers = append(registers, reg)
+	}
+	return registers, nil
+}
+
+// Convert the CSV coil and register maps to a map
+func ConvertCsvMaps(coilfile, registerfile string) (*Map, error) {
+	coils, err := csvCoils(coilfile)
+	if err != nil {
+		return nil, err
+	}
+	registers, err := csvRegisters(registerfile)
+	if err != nil {
+		return nil, err
+	}
+	m := &Map{Version: mapVersion, Coils: coils, Registers: registers}
+	return m, m.Validate()
+}
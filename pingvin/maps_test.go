@@ -0,0 +1,180 @@
+package pingvin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadDefaultMap(t *testing.T) {
+	m, err := ReadMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Pingvin{}
+	if err := p.applyMap(m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Coils) != 56 || len(p.Registers) != 799 {
+		t.Errorf("expecting 56 coils and 799 registers, got %d and %d", len(p.Coils), len(p.Registers))
+	}
+	if !p.Registers[0].Reserved || p.Registers[135].Unit != "°C" || len(p.Registers[44].Bits) != 16 {
+		t.Error("unexpected registers in the built-in map")
+	}
+}
+
+// The built-in map is converted from the original CSVs
+func TestConvertCsvMaps(t *testing.T) {
+	converted, err := ConvertCsvMaps("testdata/coils.csv", "testdata/registers.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(converted.Coils) != len(m.Coils) || len(converted.Registers) != len(m.Registers) {
+		t.Fatalf("expecting %d coils and %d registers, got %d and %d", len(m.Coils), len(m.Registers), len(converted.Coils), len(converted.Registers))
+	}
+	for i, coil := range converted.Coils {
+		if coil.Address != m.Coils[i].Address || coil.Symbol != m.Coils[i].Symbol || coil.Description != m.Coils[i].Description {
+			t.Errorf("expecting %v, got %v", m.Coils[i], coil)
+		}
+	}
+	for i, reg := range converted.Registers {
+		mreg := m.Registers[i]
+		if reg.Address != mreg.Address || reg.Symbol != mreg.Symbol || reg.Type != mreg.Type || reg.Multiplier != mreg.Multiplier || reg.Description != mreg.Description || reg.Labels["en"] != mreg.Labels["en"] {
+			t.Errorf("expecting %v, got %v", mreg, reg)
+		}
+	}
+	// A quoted UI text of register 137 contains a semicolon
+	if reg := converted.Registers[slices.IndexFunc(converted.Registers, func(r MapRegister) bool { return r.Address == 137 })]; len(reg.Notes) > 0 {
+		t.Errorf("quoted field split, got notes %q", reg.Notes)
+	}
+}
+
+func TestReadMapFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	// Coils and registers the daemon uses are missing, the map is read without validating it
+	m, err := DecodeMap(MapFiles{Map: write("map.json", `{"version": 1, "coils": [{"address": 1, "symbol": "COIL_AWAY"}],
+		"registers": [{"address": 2, "symbol": "HREG_MODE", "type": "bitfield", "multiplier": 1, "enum": {"0": "Normal"}}]}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coils, registers, _, err := buildMap(m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(coils) != 2 || !coils[0].Reserved || coils[1].Symbol != "COIL_AWAY" || len(registers) != 3 || registers[2].Enum[0] != "Normal" {
+		t.Errorf("unexpected map %v, %v", coils, registers)
+	}
+	register := "version: 1\ncoils: []\nregisters:\n  - {address: 1, symbol: HREG_T_OP1, type: int16, multiplier: 10}\n"
+	metric := register + "  - {address: 2, symbol: HREG_X, type: int16, multiplier: 1, metric: {name: x, group: x, labels: {side: a}}}\n"
+	tests := map[string]string{
+		"version: 2\ncoils: []\nregisters: []\n":                                                                                                 "unsupported map version 2",
+		register + "  - {address: 1, symbol: HREG_X}\n":                                                                                          "register 1: duplicate address",
+		register + "  - {address: 2, symbol: HREG_T_OP1}\n":                                                                                      "duplicate symbol HREG_T_OP1",
+		register + "  - {address: 2, symbol: HREG_X, type: int32, multiplier: 1}\n":                                                              "invalid type",
+		register + "  - {address: 2, symbol: HREG_X, type: int16}\n":                                                                             "multiplier must be positive",
+		register + "  - {address: 2, symbol: HREG_X, type: int16, multiplier: 1, min: 5, max: 1}\n":                                              "min is greater than max",
+		register + "  - {address: 2, symbol: HREG_X, type: int16, multiplier: 1, acces: read}\n":                                                 "field acces not found",
+		register + "  - {address: 2, symbol: HREG_X, type: int16, multiplier: 1, labels: {FI: {name: X}}}\n":                                     "invalid label language \"FI\"",
+		"version: 1\ncoils: [{address: 1, symbol: COIL_AWAY, labels: {fi: {name: Poissa}}}]\nregisters: []\n":                                    "fi label has a name",
+		register + "  - {address: 2, symbol: HREG_X, type: int16, multiplier: 1, metric: {name: coil, group: x}}\n":                              "metric name coil is used by the daemon",
+		register + "  - {address: 2, symbol: HREG_X, type: int16, multiplier: 1, metric: {name: x, group: mode}}\n":                              "group mode is used by the daemon",
+		register + "  - {address: 2, symbol: HREG_X, type: int16, multiplier: 1, metric: {name: x, group: x, type: summary}}\n":                  "invalid type \"summary\"",
+		register + "  - {address: 2, symbol: HREG_X, type: int16, multiplier: 1, metric: {name: x, group: x, labels: {device: a}}}\n":            "invalid label name \"device\"",
+		metric + "  - {address: 3, symbol: HREG_Y, type: int16, multiplier: 1, metric: {name: x, group: x, labels: {sensor: b}}}\n":              "label names differ from register 2",
+		metric + "  - {address: 3, symbol: HREG_Y, type: int16, multiplier: 1, metric: {name: x, group: x, labels: {side: a}}}\n":                "same labels as HREG_X",
+		metric + "  - {address: 3, symbol: HREG_Y, type: int16, multiplier: 1, metric: {name: x, group: x, type: counter, labels: {side: b}}}\n": "type and group differ",
+		register + "profiles:\n  - {name: x, registers: [{address: 3, symbol: HREG_T_OP1}]}\n":                                                   "profile x: register 3",
+	}
+	for content, expected := range tests {
+		if _, err := ReadMap(write("invalid.yaml", content)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expecting error %q, got %v", expected, err)
+		}
+	}
+	if _, err := ReadMap(filepath.Join(dir, "nonexistent.yaml")); err == nil {
+		t.Error("expecting error for a missing file")
+	}
+	// CSV maps replace the coils or registers of the built-in map
+	csv := "0;COIL_STOP;Stop the machine\r\n"
+	for addr := 1; addr <= 40; addr++ {
+		csv += fmt.Sprintf("%d;COIL_%d;Coil %d\r\n", addr, addr, addr)
+	}
+	csv += "41;-;-\r\n"
+	coilfile := write("coils.csv", csv)
+	if m, err = loadMap(MapFiles{Coils: coilfile}); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Coils) != 41 || len(m.Registers) < 400 || len(m.Profiles) != 0 {
+		t.Errorf("unexpected map with %d coils, %d registers and %d profiles", len(m.Coils), len(m.Registers), len(m.Profiles))
+	}
+	if _, err := loadMap(MapFiles{Map: "map.yaml", Coils: coilfile}); err == nil {
+		t.Error("expecting error for a map and a CSV map")
+	}
+	if _, err := loadMap(MapFiles{Registers: write("registers.csv", "0;HREG_T_OP1;int16;0;;;Temperature;;;\n")}); err == nil || !strings.Contains(err.Error(), "invalid multiplier") {
+		t.Errorf("expecting invalid multiplier error, got %v", err)
+	}
+}
+
+func TestMapProfile(t *testing.T) {
+	p, client := newTestPingvin(t)
+	m, err := ReadMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.registers[597], client.registers[599] = 1, 117
+	profile, err := p.detectProfile(m, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile == nil || profile.Name != "pingvin-sw-before-1.18" {
+		t.Fatalf("expecting profile pingvin-sw-before-1.18, got %v", profile)
+	}
+	if err := p.applyMap(m, profile); err != nil {
+		t.Fatal(err)
+	}
+	if p.Profile != profile.Name || !p.Registers[790].Reserved || p.Registers[774].Reserved {
+		t.Error("profile not applied")
+	}
+	// The profile removes the registers noted to be only on 1.18
+	// and above in the original register map
+	converted, err := ConvertCsvMaps("testdata/coils.csv", "testdata/registers.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reg := range converted.Registers {
+		if strings.Contains(reg.Notes, "Only on sw 1.18 and above") != p.Registers[reg.Address].Reserved {
+			t.Errorf("register %d: reserved is %t with notes %q", reg.Address, p.Registers[reg.Address].Reserved, reg.Notes)
+		}
+	}
+	client.registers[599] = 118
+	if profile, err := p.detectProfile(m, ""); err != nil || profile != nil {
+		t.Errorf("expecting the base map for software version 1.18, got %v, %v", profile, err)
+	}
+	if profile, err := p.detectProfile(m, "pingvin-sw-before-1.18"); err != nil || profile == nil {
+		t.Errorf("expecting the profile given, got %v, %v", profile, err)
+	}
+	if _, err := p.detectProfile(m, "ltr"); err == nil {
+		t.Error("expecting error for an unknown profile")
+	}
+	family := []int{3}
+	m.Profiles = append(m.Profiles, MapProfile{Name: "family3", Family: family})
+	if profile := m.matchProfile(3, 1.18); profile == nil || profile.Name != "family3" {
+		t.Errorf("expecting profile family3, got %v", profile)
+	}
+	if profile := m.matchProfile(2, 1.18); profile != nil {
+		t.Errorf("expecting no profile, got %v", profile)
+	}
+}
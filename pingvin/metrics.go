@@ -0,0 +1,189 @@
+package pingvin
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Layouts of the Prometheus metrics
+const (
+	LayoutLegacy = "legacy" // A gauge per coil and register, e.g. pingvin_hreg_135_t_setpoint
+	LayoutLabels = "labels" // Metric families with labels, e.g. pingvin_temperature_celsius{sensor="TE20"}
+)
+
+// Metric groups of the labelled layout not given in the map
+const (
+	GroupCoils     = "coils"     // pingvin_coil{symbol="COIL_AWAY"}
+	GroupMode      = "mode"      // pingvin_mode{mode="away"}, 1 for the current mode
+	GroupBus       = "bus"       // Modbus request metrics
+	GroupRegisters = "registers" // pingvin_register{symbol="HREG_T_OP1"} for every register, not exported by default
+)
+
+var builtinGroups = []string{GroupCoils, GroupMode, GroupBus, GroupRegisters}
+
+var (
+	coilDesc     = prometheus.NewDesc("pingvin_coil", "Value of the coil, 1 for on", []string{"symbol"}, nil)
+	modeDesc     = prometheus.NewDesc("pingvin_mode", "Operating mode selected with the mode coils, 1 for the current mode", []string{"mode"}, nil)
+	registerDesc = prometheus.NewDesc("pingvin_register", "Value of the register divided by its multiplier", []string{"symbol"}, nil)
+)
+
+// Metric names of the labelled layout not given in the map
+var builtinFamilies = []string{"pingvin_coil", "pingvin_mode", "pingvin_register"}
+
+// Metric family of registers in the labelled layout
+type metricFamily struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	labels    []string // Label names, sorted
+}
+
+// Choose the layout of the metrics and, for the labelled layout, the
+// groups to export. All groups except registers are exported if groups
+// is empty. Call before registering p
+func (p *Pingvin) SetMetrics(layout string, groups []string) error {
+	if len(layout) == 0 {
+		layout = LayoutLegacy
+	}
+	if layout != LayoutLegacy && layout != LayoutLabels {
+		return fmt.Errorf("metrics: invalid layout %q, expecting legacy or labels", layout)
+	}
+	if layout == LayoutLegacy && len(groups) > 0 {
+		return fmt.Errorf("metrics: groups can only be chosen with the labels layout")
+	}
+	available := p.MetricGroups()
+	if len(groups) == 0 {
+		groups = slices.DeleteFunc(slices.Clone(available), func(g string) bool { return g == GroupRegisters })
+	}
+	for _, group := range groups {
+		if !slices.Contains(available, group) {
+			return fmt.Errorf("metrics: unknown group %q, expecting one of %s", group, strings.Join(available, ", "))
+		}
+	}
+	p.metricsLayout, p.metricGroups = layout, groups
+	p.families = map[string]*metricFamily{}
+	help := map[string]string{}
+	for _, reg := range p.Registers {
+		if !reg.Reserved && reg.Metric != nil && len(reg.Metric.Help) > 0 {
+			help[reg.Metric.Name] = reg.Metric.Help
+		}
+	}
+	for _, reg := range p.Registers {
+		m := reg.Metric
+		if reg.Reserved || m == nil || !slices.Contains(groups, m.Group) || p.families[m.Name] != nil {
+			continue
+		}
+		family := &metricFamily{valueType: prometheus.GaugeValue, labels: sortedLabels(m.Labels)}
+		if m.Type == "counter" {
+			family.valueType = prometheus.CounterValue
+		}
+		if len(help[m.Name]) == 0 {
+			help[m.Name] = strings.ReplaceAll(m.Name, "_", " ")
+		}
+		family.desc = prometheus.NewDesc(prometheus.BuildFQName("", "pingvin", m.Name), help[m.Name], family.labels, nil)
+		p.families[m.Name] = family
+	}
+	return nil
+}
+
+// Metric groups of the labelled layout: the groups of the map followed
+// by the built-in groups
+func (p *Pingvin) MetricGroups() []string {
+	groups := []string{}
+	for _, reg := range p.Registers {
+		if !reg.Reserved && reg.Metric != nil && !slices.Contains(groups, reg.Metric.Group) {
+			groups = append(groups, reg.Metric.Group)
+		}
+	}
+	return append(groups, builtinGroups...)
+}
+
+func (p *Pingvin) metricGroup(group string) bool {
+	return slices.Contains(p.metricGroups, group)
+}
+
+func (p *Pingvin) describeLabels(ch chan<- *prometheus.Desc) {
+	if p.metricGroup(GroupBus) {
+		p.busstats.describe(ch)
+	}
+	for _, name := range sortedLabels(p.families) {
+		ch <- p.families[name].desc
+	}
+	if p.metricGroup(GroupRegisters) {
+		ch <- registerDesc
+	}
+	if p.metricGroup(GroupCoils) {
+		ch <- coilDesc
+	}
+	if p.metricGroup(GroupMode) {
+		ch <- modeDesc
+	}
+}
+
+// Stale values are left out like in the legacy layout
+func (p *Pingvin) collectLabels(ch chan<- prometheus.Metric) {
+	if p.metricGroup(GroupBus) {
+		p.busstats.collect(ch, p.Health().LastSuccess)
+	}
+	now := time.Now()
+	for _, reg := range p.Registers {
+		if reg.Reserved || p.isStale(reg.LastUpdated, reg.Poll, now) {
+			continue
+		}
+		value := float64(reg.Value) / float64(reg.Multiplier)
+		if reg.Metric != nil && p.families[reg.Metric.Name] != nil {
+			family := p.families[reg.Metric.Name]
+			ch <- prometheus.MustNewConstMetric(family.desc, family.valueType, value, labelValues(reg.Metric.Labels)...)
+		}
+		if p.metricGroup(GroupRegisters) {
+			ch <- prometheus.MustNewConstMetric(registerDesc, prometheus.GaugeValue, value, reg.Symbol)
+		}
+	}
+	modeStale := false
+	for _, coil := range p.Coils {
+		stale := p.isStale(coil.LastUpdated, TierFast, now)
+		if slices.Contains(mutexcoils, uint16(coil.Address)) {
+			modeStale = modeStale || stale
+		}
+		if coil.Reserved || stale || !p.metricGroup(GroupCoils) {
+			continue
+		}
+		val := 0.0
+		if coil.Value {
+			val = 1
+		}
+		ch <- prometheus.MustNewConstMetric(coilDesc, prometheus.GaugeValue, val, coil.Symbol)
+	}
+	if p.metricGroup(GroupMode) && !modeStale {
+		current := p.CurrentMode()
+		for _, mode := range Modes {
+			val := 0.0
+			if mode == current {
+				val = 1
+			}
+			ch <- prometheus.MustNewConstMetric(modeDesc, prometheus.GaugeValue, val, mode)
+		}
+	}
+}
+
+// Keys of labels in order
+func sortedLabels[V any](labels map[string]V) []string {
+	keys := []string{}
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Values of labels in the order of their keys
+func labelValues(labels map[string]string) []string {
+	values := []string{}
+	for _, k := range sortedLabels(labels) {
+		values = append(values, labels[k])
+	}
+	return values
+}
@@ -0,0 +1,106 @@
+package pingvin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Gather the metrics of p with the device label, by name
+func gatherMetrics(t *testing.T, p *Pingvin) map[string]*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	prometheus.WrapRegistererWith(prometheus.Labels{"device": "test"}, reg).MustRegister(p)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*dto.MetricFamily{}
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+	return byName
+}
+
+// Value of the metric of family with the label, -1 if not found
+func metricValue(f *dto.MetricFamily, label, value string) float64 {
+	for _, m := range f.GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() != label || l.GetValue() != value {
+				continue
+			}
+			if f.GetType() == dto.MetricType_COUNTER {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	return -1
+}
+
+func TestLabelledMetrics(t *testing.T) {
+	p, client := newTestPingvin(t)
+	client.registers[1], client.registers[3], client.registers[788] = 215, 60, 7
+	client.coils[1] = true
+	if err := p.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetMetrics(LayoutLabels, nil); err != nil {
+		t.Fatal(err)
+	}
+	families := gatherMetrics(t, p)
+	for _, name := range []string{"pingvin_temperature_celsius", "pingvin_fan_speed_percent", "pingvin_digital_input_pulses_total", "pingvin_coil", "pingvin_mode", "pingvin_modbus_requests_total"} {
+		if families[name] == nil {
+			t.Fatalf("missing metric %s", name)
+		}
+	}
+	if families["pingvin_register"] != nil || families["pingvin_hreg_001_t_op1"] != nil {
+		t.Error("expecting no raw registers or legacy metrics")
+	}
+	if v := metricValue(families["pingvin_temperature_celsius"], "sensor", "TE20"); v != 21.5 {
+		t.Errorf("expecting TE20 21.5, got %g", v)
+	}
+	if v := metricValue(families["pingvin_fan_speed_percent"], "fan", "supply"); v != 60 {
+		t.Errorf("expecting supply fan 60, got %g", v)
+	}
+	pulses := families["pingvin_digital_input_pulses_total"]
+	if pulses.GetType() != dto.MetricType_COUNTER || metricValue(pulses, "input", "DI9") != 7 {
+		t.Errorf("expecting counter DI9 7, got %v", pulses)
+	}
+	if metricValue(families["pingvin_coil"], "symbol", "COIL_AWAY") != 1 || metricValue(families["pingvin_temperature_celsius"], "device", "test") < 0 {
+		t.Error("expecting COIL_AWAY 1 with the device label")
+	}
+	mode := families["pingvin_mode"]
+	if len(mode.GetMetric()) != len(Modes) || metricValue(mode, "mode", "away") != 1 || metricValue(mode, "mode", "normal") != 0 {
+		t.Errorf("expecting mode away, got %v", mode)
+	}
+
+	if err := p.SetMetrics(LayoutLabels, []string{"fans", GroupRegisters}); err != nil {
+		t.Fatal(err)
+	}
+	families = gatherMetrics(t, p)
+	if len(families) != 2 || families["pingvin_fan_speed_percent"] == nil || metricValue(families["pingvin_register"], "symbol", "HREG_T_OP1") != 21.5 {
+		t.Errorf("expecting fans and registers, got %d families", len(families))
+	}
+
+	if err := p.SetMetrics("", nil); err != nil {
+		t.Fatal(err)
+	}
+	if families = gatherMetrics(t, p); families["pingvin_hreg_001_t_op1"] == nil || families["pingvin_temperature_celsius"] != nil {
+		t.Error("expecting the legacy layout")
+	}
+
+	tests := map[string][]string{
+		"invalid layout":      {"flat"},
+		"unknown group":       {LayoutLabels, "humidty"},
+		"labels layout":       {LayoutLegacy, "fans"},
+		"expecting one of te": {LayoutLabels, "x"},
+	}
+	for expected, args := range tests {
+		if err := p.SetMetrics(args[0], args[1:]); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expecting error %q, got %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package pingvin
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Requested and effective operating mode
+type modeStatus struct {
+	Mode      string   `json:"mode"`      // Mode requested with the mode coils
+	Effective string   `json:"effective"` // Operating mode reported by the unit (HREG_MODE)
+	Flags     []string `json:"flags"`     // All active bits of HREG_MODE
+}
+
+// Operating modes that can be selected. Apart from "normal",
+// each mode is enabled by one of the mutually exclusive coils
+var Modes = []string{"normal", "away", "away_long", "overpressure", "max_heat", "max_cool", "boost", "eco"}
+
+// Operating modes enabled by the mutually exclusive coils
+var modeCoils = map[string]uint16{
+	"away":         1,
+	"away_long":    2,
+	"overpressure": 3,
+	"max_heat":     6,
+	"max_cool":     7,
+	"boost":        10,
+	"eco":          40,
+}
+
+// Read the mutually exclusive coils from the unit, update p.Coils
+// and return the name of the enabled mode, "normal" if none are enabled
+func (p *Pingvin) readCoilMode() (string, error) {
+	last := uint16(0)
+	for _, n := range mutexcoils {
+		if n > last {
+			last = n
+		}
+	}
+	vals, err := p.readCoilRange(0, last+1)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	for i, val := range vals {
+		p.Coils[i].Value, p.Coils[i].LastUpdated, p.Coils[i].Stale = val, &now, false
+	}
+	return p.coilMode(), nil
+}
+
+// Mode selected with the mode coils, from the latest update
+func (p *Pingvin) CurrentMode() string {
+	return p.coilMode()
+}
+
+// Name of the mode enabled in p.Coils, "normal" if none are enabled
+func (p *Pingvin) coilMode() string {
+	for _, n := range mutexcoils {
+		if !p.Coils[n].Value {
+			continue
+		}
+		for mode, coil := range modeCoils {
+			if coil == n {
+				return mode
+			}
+		}
+	}
+	return "normal"
+}
+
+// Coil writes needed to switch to mode, based on the values in p.Coils.
+// All other enabled mutually exclusive coils are turned off
+func (p *Pingvin) modeWrites(mode string) ([]BatchWrite, error) {
+	target, ok := modeCoils[mode]
+	if !ok && mode != "normal" {
+		return nil, fmt.Errorf("unknown mode %s", mode)
+	}
+	writes := []BatchWrite{}
+	for _, n := range mutexcoils {
+		if p.Coils[n].Value && (!ok || n != target) {
+			writes = append(writes, BatchWrite{Type: "coil", Address: int(n), Value: 0})
+		}
+	}
+	if ok {
+		writes = append(writes, BatchWrite{Type: "coil", Address: int(target), Value: 1})
+	}
+	return writes, nil
+}
+
+// Read the requested and effective operating mode from the unit
+func (p *Pingvin) Mode() (*modeStatus, error) {
+	mode, err := p.readCoilMode()
+	if err != nil {
+		return nil, err
+	}
+	hregmode, err := p.ReadRegister(44)
+	if err != nil {
+		return nil, err
+	}
+	return &modeStatus{mode, parseStatus(hregmode), statusFlags(hregmode)}, nil
+}
+
+// Switch the operating mode. All mode coils are written in one
+// verified batch, and restored if any of the writes fail.
+// Discards an active override without reverting it
+func (p *Pingvin) SetMode(mode string) (*modeStatus, error) {
+	// Serialize with overrides, which also switch modes
+	p.overridelock.Lock()
+	defer p.overridelock.Unlock()
+	if _, err := p.readCoilMode(); err != nil {
+		return nil, err
+	}
+	writes, err := p.modeWrites(mode)
+	if err != nil {
+		return nil, err
+	}
+	if len(writes) > 0 {
+		if _, err := p.WriteBatch(writes, true); err != nil {
+			return nil, err
+		}
+	}
+	p.discardOverride()
+	log.Println("Switched operating mode to", mode)
+	return p.Mode()
+}
+
+// Names of all active bits in HREG_MODE
+func statusFlags(value int) []string {
+	flags := []string{}
+	for i, status := range pingvinStatuses {
+		if value>>i&0x1 == 1 {
+			flags = append(flags, status)
+		}
+	}
+	return flags
+}
@@ -0,0 +1,76 @@
+package pingvin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetMode(t *testing.T) {
+	p, client := newTestPingvin(t)
+	client.coils[1] = true  // away
+	client.coils[10] = true // boost
+	client.registers[44] = 1 << 9
+	status, err := p.SetMode("eco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range mutexcoils {
+		if client.coils[n] != (n == 40) {
+			t.Errorf("coil %d is %t after switching to eco", n, client.coils[n])
+		}
+		if p.Coils[n].Value != client.coils[n] {
+			t.Errorf("p.Coils[%d] not updated", n)
+		}
+	}
+	if status.Mode != "eco" {
+		t.Errorf("mode is %s, expecting eco", status.Mode)
+	}
+	// Coils read with the mode are fresh
+	p.MarkStale()
+	if p.Coils[0].LastUpdated == nil || p.Coils[0].Stale {
+		t.Errorf("coil 0 is stale after reading the mode, last updated %v", p.Coils[0].LastUpdated)
+	}
+	if status.Effective != "Manual boost" || len(status.Flags) != 1 {
+		t.Errorf("unexpected effective mode %s %v", status.Effective, status.Flags)
+	}
+	if _, err := p.SetMode("normal"); err != nil {
+		t.Fatal(err)
+	}
+	if client.coils[40] {
+		t.Error("eco coil still set after switching to normal")
+	}
+	if _, err := p.SetMode("turbo"); err == nil {
+		t.Error("expecting error for unknown mode")
+	}
+}
+
+func TestSetModeDiscardsOverride(t *testing.T) {
+	p, client := newTestPingvin(t)
+	if _, err := p.Override("boost", time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.SetMode("away"); err != nil {
+		t.Fatal(err)
+	}
+	if p.OverrideStatus() != nil {
+		t.Error("override still active after SetMode")
+	}
+	if !client.coils[1] || client.coils[10] {
+		t.Error("mode coils not switched")
+	}
+}
+
+func TestWriteCoilMutex(t *testing.T) {
+	p, client := newTestPingvin(t)
+	client.coils[3] = true
+	p.Coils[3].Value = true
+	if !p.WriteCoil(10, true) {
+		t.Fatal("WriteCoil failed")
+	}
+	if client.coils[3] || p.Coils[3].Value {
+		t.Error("overpressure coil not reset when enabling boost")
+	}
+	if !client.coils[10] || !p.Coils[10].Value {
+		t.Error("boost coil not set")
+	}
+}
@@ -0,0 +1,231 @@
+package pingvin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Temporary operating mode, reverted when it expires.
+// Persisted to disk so the revert survives a restart
+type pingvinOverride struct {
+	Mode             string    `json:"mode"`
+	Until            time.Time `json:"until"`
+	Setpoint         int       `json:"setpoint"`          // Setpoint during the override, 0 if unchanged
+	PreviousMode     string    `json:"previous_mode"`     // Mode to restore
+	PreviousSetpoint int       `json:"previous_setpoint"` // Setpoint to restore
+}
+
+// Active override as reported by the API and /status
+type overrideStatus struct {
+	pingvinOverride
+	Remaining int `json:"remaining_seconds"`
+}
+
+// Load a pending override from statefile and schedule the revert.
+// Overrides that expired while the daemon wasn't running are reverted
+// immediately. Overrides started later are persisted to statefile
+func (p *Pingvin) RestoreOverride(statefile string) error {
+	p.overridelock.Lock()
+	defer p.overridelock.Unlock()
+	p.overridefile = statefile
+	data, err := os.ReadFile(statefile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	override := &pingvinOverride{}
+	if err := json.Unmarshal(data, override); err != nil {
+		return fmt.Errorf("RestoreOverride: %s: %w", statefile, err)
+	}
+	p.override = override
+	remaining := time.Until(override.Until)
+	log.Printf("Restored %s override, reverting to %s in %s", override.Mode, override.PreviousMode, remaining.Round(time.Second))
+	p.scheduleRevert(remaining)
+	return nil
+}
+
+// Switch to mode for duration, then revert to the current mode.
+// If setpoint is not empty, the temperature setpoint is also changed
+// for the duration, see Temperature() for accepted values.
+// Starting an override while another one is active replaces it,
+// but the mode and setpoint from before the first override are restored
+func (p *Pingvin) Override(mode string, duration time.Duration, setpoint string) (*overrideStatus, error) {
+	if mode == "normal" {
+		return nil, fmt.Errorf("Override: mode must not be normal")
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("Override: duration must be positive")
+	}
+	p.overridelock.Lock()
+	defer p.overridelock.Unlock()
+	override := &pingvinOverride{Mode: mode, Until: time.Now().Add(duration)}
+	if len(setpoint) > 0 {
+		t, err := p.parseTemperature(setpoint)
+		if err != nil {
+			return nil, err
+		}
+		override.Setpoint = t
+	}
+	current, err := p.readCoilMode()
+	if err != nil {
+		return nil, err
+	}
+	if p.override != nil {
+		override.PreviousMode = p.override.PreviousMode
+		override.PreviousSetpoint = p.override.PreviousSetpoint
+	} else {
+		override.PreviousMode = current
+		override.PreviousSetpoint, err = p.ReadRegister(135)
+		if err != nil {
+			return nil, err
+		}
+	}
+	writes, err := p.modeWrites(mode)
+	if err != nil {
+		return nil, err
+	}
+	if override.Setpoint != 0 {
+		writes = append(writes, BatchWrite{Type: "register", Address: 135, Value: BatchValue(override.Setpoint)})
+	} else if p.override != nil && p.override.Setpoint != 0 {
+		// Previous override changed the setpoint, this one doesn't
+		writes = append(writes, BatchWrite{Type: "register", Address: 135, Value: BatchValue(override.PreviousSetpoint)})
+	}
+	if _, err := p.WriteBatch(writes, true); err != nil {
+		return nil, err
+	}
+	if p.reverttimer != nil {
+		p.reverttimer.Stop()
+	}
+	p.override = override
+	if err := p.saveOverride(); err != nil {
+		log.Println("ERROR: Override:", err)
+	}
+	p.scheduleRevert(duration)
+	log.Printf("Started %s override for %s, reverting to %s", mode, duration, override.PreviousMode)
+	return p.overrideStatus(), nil
+}
+
+// Revert an active override immediately
+func (p *Pingvin) CancelOverride() error {
+	p.overridelock.Lock()
+	defer p.overridelock.Unlock()
+	if p.override == nil {
+		return fmt.Errorf("CancelOverride: no active override")
+	}
+	if p.reverttimer != nil {
+		p.reverttimer.Stop()
+	}
+	return p.revertOverride()
+}
+
+// Forget an active override without reverting it.
+// p.overridelock must be held by the caller
+func (p *Pingvin) discardOverride() {
+	if p.override == nil {
+		return
+	}
+	if p.reverttimer != nil {
+		p.reverttimer.Stop()
+	}
+	log.Printf("Discarded %s override", p.override.Mode)
+	p.override = nil
+	p.reverttimer = nil
+	p.removeOverrideFile()
+}
+
+// Active override, nil if there is none
+func (p *Pingvin) OverrideStatus() *overrideStatus {
+	p.overridelock.Lock()
+	defer p.overridelock.Unlock()
+	return p.overrideStatus()
+}
+
+func (p *Pingvin) overrideStatus() *overrideStatus {
+	if p.override == nil {
+		return nil
+	}
+	remaining := int(time.Until(p.override.Until).Seconds())
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &overrideStatus{*p.override, remaining}
+}
+
+// Call expireOverride after d
+func (p *Pingvin) scheduleRevert(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	p.reverttimer = time.AfterFunc(d, p.expireOverride)
+}
+
+// Revert an expired override, retry in a minute on failure
+func (p *Pingvin) expireOverride() {
+	p.overridelock.Lock()
+	defer p.overridelock.Unlock()
+	if p.override == nil {
+		return
+	}
+	override := *p.override
+	err := p.revertOverride()
+	if err != nil {
+		log.Println("ERROR: Failed to revert override, retrying in 1 minute:", err)
+		p.scheduleRevert(time.Minute)
+	}
+	if p.OnOverrideExpired != nil {
+		p.OnOverrideExpired(override.Mode, override.PreviousMode, err)
+	}
+}
+
+// Restore the mode and setpoint from before the override.
+// p.overridelock must be held by the caller
+func (p *Pingvin) revertOverride() error {
+	override := p.override
+	if _, err := p.readCoilMode(); err != nil {
+		return err
+	}
+	writes, err := p.modeWrites(override.PreviousMode)
+	if err != nil {
+		return err
+	}
+	if override.Setpoint != 0 {
+		writes = append(writes, BatchWrite{Type: "register", Address: 135, Value: BatchValue(override.PreviousSetpoint)})
+	}
+	if len(writes) > 0 {
+		if _, err := p.WriteBatch(writes, true); err != nil {
+			return err
+		}
+	}
+	p.override = nil
+	p.reverttimer = nil
+	p.removeOverrideFile()
+	log.Printf("Reverted %s override to %s", override.Mode, override.PreviousMode)
+	return nil
+}
+
+// Write the active override to p.overridefile
+func (p *Pingvin) saveOverride() error {
+	if len(p.overridefile) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(p.override)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.overridefile, data, 0600)
+}
+
+// Remove p.overridefile after the override has ended
+func (p *Pingvin) removeOverrideFile() {
+	if len(p.overridefile) == 0 {
+		return
+	}
+	if err := os.Remove(p.overridefile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("ERROR: removeOverrideFile:", err)
+	}
+}
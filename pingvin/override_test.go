@@ -0,0 +1,73 @@
+package pingvin
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOverride(t *testing.T) {
+	p, client := newTestPingvin(t)
+	statefile := filepath.Join(t.TempDir(), "override.json")
+	if err := p.RestoreOverride(statefile); err != nil {
+		t.Fatal(err)
+	}
+	client.coils[1] = true // away
+	client.registers[135] = 210
+	status, err := p.Override("boost", 30*time.Minute, "23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.PreviousMode != "away" || status.PreviousSetpoint != 210 {
+		t.Errorf("unexpected override status %+v", status)
+	}
+	if status.Remaining < 1799 {
+		t.Errorf("remaining is %d, expecting 1800", status.Remaining)
+	}
+	if client.coils[1] || !client.coils[10] || client.registers[135] != 230 {
+		t.Error("boost mode and setpoint not written")
+	}
+	if _, err := os.Stat(statefile); err != nil {
+		t.Errorf("override not persisted: %s", err)
+	}
+	if err := p.CancelOverride(); err != nil {
+		t.Fatal(err)
+	}
+	if !client.coils[1] || client.coils[10] || client.registers[135] != 210 {
+		t.Error("previous mode and setpoint not restored")
+	}
+	if _, err := os.Stat(statefile); !os.IsNotExist(err) {
+		t.Error("state file not removed after revert")
+	}
+	if p.OverrideStatus() != nil {
+		t.Error("override still active after cancel")
+	}
+}
+
+func TestRestoreExpiredOverride(t *testing.T) {
+	p, client := newTestPingvin(t)
+	statefile := filepath.Join(t.TempDir(), "override.json")
+	client.coils[3] = true // overpressure
+	data, _ := json.Marshal(pingvinOverride{
+		Mode:         "overpressure",
+		Until:        time.Now().Add(-time.Minute),
+		PreviousMode: "normal",
+	})
+	if err := os.WriteFile(statefile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RestoreOverride(statefile); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50 && p.OverrideStatus() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.OverrideStatus() != nil {
+		t.Fatal("expired override not reverted")
+	}
+	if client.coils[3] {
+		t.Error("overpressure coil not reset")
+	}
+}
@@ -1,10 +1,12 @@
 package pingvin
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"math"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,37 +18,73 @@ import (
 
 // single coil data
 type pingvinCoil struct {
-	Address     int              `json:"address"`
-	Symbol      string           `json:"symbol"`
-	Value       bool             `json:"value"`
-	Description string           `json:"description"`
-	Reserved    bool             `json:"reserved"`
-	PromDesc    *prometheus.Desc `json:"-"`
+	Address     int                 `json:"address"`
+	Symbol      string              `json:"symbol"`
+	Value       bool                `json:"value"`
+	Description string              `json:"description"`
+	Reserved    bool                `json:"reserved"`
+	LastUpdated *time.Time          `json:"last_updated"` // Time of the last successful read
+	Stale       bool                `json:"stale"`        // Not read within the stale window
+	Labels      map[string]MapLabel `json:"-"`            // Descriptions by language
+	PromDesc    *prometheus.Desc    `json:"-"`
 }
 
 // unit modbus data
 type Pingvin struct {
 	Coils         []*pingvinCoil
 	Registers     []*pingvinRegister
+	Profile       string // Map profile in use, empty for the base map
 	Status        *pingvinStatus
-	buslock       *sync.Mutex
+	buslock       *busLock
+	writelock     *sync.Mutex
 	handler       *modbus.RTUClientHandler
+	transport     Transport
 	modbusclient  modbus.Client
 	firstReadDone bool
+	override      *pingvinOverride
+	overridefile  string
+	overridelock  *sync.Mutex
+	reverttimer   *time.Timer
+	policies      map[string]WritePolicy // Write policies by "coil:N" / "register:N"
+	mapPolicies   []WritePolicy          // Write policies from the map
+	languages     []string               // Languages of the map labels
+	health        connectionHealth
+	healthlock    *sync.Mutex
+	busstats      *busStats
+	staleAfter    time.Duration // Values not read within this are stale
+	slowInterval  time.Duration // How often the slow tier is read
+	lastSlowPoll  time.Time
+	oncePolled    bool // The once tier has been read
+	metricsLayout string
+	metricGroups  []string                 // Groups exported in the labels layout
+	families      map[string]*metricFamily // Metric families of the map by name
 	Debug         PingvinLogger
+	// Called after an expired override has been reverted, or the revert failed
+	OnOverrideExpired func(mode, previousMode string, err error)
 }
 
 // single register data
 type pingvinRegister struct {
-	Address     int              `json:"address"`
-	Symbol      string           `json:"symbol"`
-	Value       int              `json:"value"`
-	Bitfield    string           `json:"bitfield"`
-	Type        string           `json:"type"`
-	Description string           `json:"description"`
-	Reserved    bool             `json:"reserved"`
-	Multiplier  int              `json:"multiplier"`
-	PromDesc    *prometheus.Desc `json:"-"`
+	Address     int                 `json:"address"`
+	Symbol      string              `json:"symbol"`
+	Value       int                 `json:"value"`
+	Bitfield    string              `json:"bitfield"`
+	Type        string              `json:"type"`
+	Description string              `json:"description"`
+	Reserved    bool                `json:"reserved"`
+	Multiplier  int                 `json:"multiplier"`
+	Min         *int                `json:"min,omitempty"`  // Lowest allowed raw value, if known
+	Max         *int                `json:"max,omitempty"`  // Highest allowed raw value, if known
+	Name        string              `json:"name,omitempty"` // Short name
+	Unit        string              `json:"unit,omitempty"`
+	Enum        map[int]string      `json:"enum,omitempty"` // Names of the values
+	Bits        []string            `json:"bits,omitempty"` // Names of the bits, LSB first
+	Poll        string              `json:"poll"`           // Polling tier: fast, slow or once
+	LastUpdated *time.Time          `json:"last_updated"`   // Time of the last successful read
+	Stale       bool                `json:"stale"`          // Not read within the stale window
+	Labels      map[string]MapLabel `json:"-"`              // Names and descriptions by language
+	Metric      *MapMetric          `json:"-"`              // Metric in the labelled metric layout
+	PromDesc    *prometheus.Desc    `json:"-"`
 }
 
 type pingvinMeasurements struct {
@@ -76,6 +114,10 @@ type pingvinStatus struct {
 	OpMode       string              `json:"op_mode"`           // Current operating mode, text representation
 	Uptime       string              `json:"uptime"`            // Unit uptime
 	SystemTime   string              `json:"system_time"`       // Time and date in unit
+	SnapshotAge  *float64            `json:"snapshot_age"`      // Seconds since the last successful update, null if none
+	Stale        bool                `json:"stale"`             // Some values haven't been read within the stale window
+	Override     *overrideStatus     `json:"override"`          // Active temporary mode, null if none
+	Connection   connectionHealth    `json:"connection"`        // Modbus connection health
 	Coils        []*pingvinCoil      `json:"coils"`
 }
 
@@ -96,6 +138,29 @@ var (
 	// Only one of these should be enabled at a time
 
 	mutexcoils = []uint16{1, 2, 3, 6, 7, 10, 40}
+
+	// Value range column of the CSV register map
+	limitsRegexp = regexp.MustCompile(`^\s*(-?\d+)\s*-\s*(-?\d+)\s*$`)
+
+	// Bits of HREG_MODE, LSB first
+	pingvinStatuses = []string{
+		"Max cooling",
+		"Max heating",
+		"Stopped by alarm",
+		"Stopped by user",
+		"Away",
+		"reserved",
+		"Adaptive",
+		"CO2 boost",
+		"RH boost",
+		"Manual boost",
+		"Overpressure",
+		"Cooker hood mode",
+		"Central vac mode",
+		"Electric heater cooloff",
+		"Summer night cooling",
+		"HRC defrost",
+	}
 )
 
 func (logger *PingvinLogger) Println(msg ...any) {
@@ -104,46 +169,35 @@ func (logger *PingvinLogger) Println(msg ...any) {
 	}
 }
 
-func newCoil(address string, symbol string, description string) *pingvinCoil {
-	addr, err := strconv.Atoi(address)
-	if err != nil {
-		log.Fatal("newCoil: Atoi: ", err)
-	}
+// Prometheus metric name of a coil or register, the zero padded
+// address is inserted after the first part of the symbol,
+// e.g. pingvin_hreg_135_t_setpoint
+func metricName(symbol string, addr int, width int) string {
+	name := strings.ToLower(symbol)
+	zpadaddr := fmt.Sprintf("%0*d", width, addr)
+	name = strings.Replace(name, "_", "_"+zpadaddr+"_", 1)
+	return prometheus.BuildFQName("", "pingvin", name)
+}
+
+func newCoil(addr int, symbol string, description string) *pingvinCoil {
 	reserved := symbol == "-" && description == "-"
 	if !reserved {
-		promdesc := strings.ToLower(symbol)
-		zpadaddr := fmt.Sprintf("%02d", addr)
-		promdesc = strings.Replace(promdesc, "_", "_"+zpadaddr+"_", 1)
-		return &pingvinCoil{addr, symbol, false, description, reserved,
+		return &pingvinCoil{addr, symbol, false, description, reserved, nil, false, nil,
 			prometheus.NewDesc(
-				prometheus.BuildFQName("", "pingvin", promdesc),
+				metricName(symbol, addr, 2),
 				description,
 				nil,
 				nil,
 			),
 		}
 	}
-	return &pingvinCoil{addr, symbol, false, description, reserved, nil}
+	return &pingvinCoil{addr, symbol, false, description, reserved, nil, false, nil, nil}
 }
 
-func newRegister(address, symbol, typ, multiplier, description string) *pingvinRegister {
-	addr, err := strconv.Atoi(address)
-	if err != nil {
-		log.Fatal("newRegister: Atoi(address): ", err)
-	}
-	multipl := 1
-	if len(multiplier) > 0 {
-		multipl, err = strconv.Atoi(multiplier)
-		if err != nil {
-			log.Fatal("newRegister: Atoi(multiplier): ", err)
-		}
-	}
+func newRegister(addr int, symbol, typ string, multiplier int, description string) *pingvinRegister {
 	reserved := symbol == "Reserved" && description == "Reserved"
 
 	if !reserved {
-		promdesc := strings.ToLower(symbol)
-		zpadaddr := fmt.Sprintf("%03d", addr)
-		promdesc = strings.Replace(promdesc, "_", "_"+zpadaddr+"_", 1)
 		return &pingvinRegister{
 			addr,
 			symbol,
@@ -152,83 +206,134 @@ func newRegister(address, symbol, typ, multiplier, description string) *pingvinR
 			typ,
 			description,
 			reserved,
-			multipl,
+			multiplier,
+			nil,
+			nil,
+			"",
+			"",
+			nil,
+			nil,
+			TierSlow,
+			nil,
+			false,
+			nil,
+			nil,
 			prometheus.NewDesc(
-				prometheus.BuildFQName("", "pingvin", promdesc),
+				metricName(symbol, addr, 3),
 				description,
 				nil,
 				nil,
 			),
 		}
 	}
-	return &pingvinRegister{addr, symbol, 0, "0000000000000000", typ, description, reserved, multipl, nil}
+	return &pingvinRegister{addr, symbol, 0, "0000000000000000", typ, description, reserved, multiplier, nil, nil, "", "", nil, nil, TierSlow, nil, false, nil, nil, nil}
 }
 
-// read a CSV file containing data for coils or registers
-func readCsvLines(file string) [][]string {
-	delim := ";"
-	data := [][]string{}
-	csv, err := os.Open(file)
-	if err != nil {
-		log.Fatal(err)
+// Parse the value range column of the CSV register map, e.g. "0 - 500".
+// Returns nil for unknown limits
+func parseLimits(limits string) (*int, *int) {
+	match := limitsRegexp.FindStringSubmatch(limits)
+	if match == nil {
+		return nil, nil
 	}
-	defer csv.Close()
-	scanner := bufio.NewScanner(csv)
-	for scanner.Scan() {
-		elements := strings.Split(scanner.Text(), delim)
-		data = append(data, elements)
+	min, _ := strconv.Atoi(match[1])
+	max, _ := strconv.Atoi(match[2])
+	return &min, &max
+}
+
+// Find a coil by symbol, nil if not found or reserved
+func (p *Pingvin) coilBySymbol(symbol string) *pingvinCoil {
+	for _, coil := range p.Coils {
+		if coil.Symbol == symbol && !coil.Reserved {
+			return coil
+		}
 	}
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+	return nil
+}
+
+// Find a register by symbol, nil if not found or reserved
+func (p *Pingvin) registerBySymbol(symbol string) *pingvinRegister {
+	for _, reg := range p.Registers {
+		if reg.Symbol == symbol && !reg.Reserved {
+			return reg
+		}
 	}
-	return data
+	return nil
 }
 
-// Create modbus.Handler, store it in p.handler,
-// connect the handler and create p.modbusclient (modbus.Client)
-func (p *Pingvin) createModbusClient(serial string) {
-	// TODO: read configuration from file, mostly hardcoded for now
-	log.Println("Connecting to serial console on", serial)
-	p.handler = modbus.NewRTUClientHandler(serial)
-	p.handler.BaudRate = 19200
-	p.handler.DataBits = 8
-	p.handler.Parity = "N"
-	p.handler.StopBits = 1
-	p.handler.SlaveId = 1
-	p.handler.Timeout = 1500 * time.Millisecond
-	err := p.handler.Connect()
-	if err != nil {
-		log.Fatal("createModbusClient: p.handler.Connect: ", err)
+// Current value of a coil or register by symbol. Register values
+// are divided by the multiplier, coil values are 0 or 1
+func (p *Pingvin) Value(symbol string) (float64, error) {
+	if coil := p.coilBySymbol(symbol); coil != nil {
+		if coil.Value {
+			return 1, nil
+		}
+		return 0, nil
 	}
-	p.Debug.Println("Handler connected")
-	p.modbusclient = modbus.NewClient(p.handler)
+	if reg := p.registerBySymbol(symbol); reg != nil {
+		return float64(reg.Value) / float64(reg.Multiplier), nil
+	}
+	return 0, fmt.Errorf("unknown symbol %s", symbol)
 }
 
-func (p *Pingvin) Quit() {
-	err := p.handler.Close()
+// Write a coil or register by symbol. Register values are multiplied
+// by the multiplier, any non-zero value enables a coil.
+// Enabling one of the mutually exclusive mode coils turns the others
+// off in the same batch. The value is verified by reading it back
+func (p *Pingvin) WriteValue(symbol string, value float64) error {
+	writes := []BatchWrite{}
+	if coil := p.coilBySymbol(symbol); coil != nil {
+		writes = p.CoilWrites(coil.Address, value != 0, false)
+	} else if reg := p.registerBySymbol(symbol); reg != nil {
+		writes = []BatchWrite{{Type: "register", Address: reg.Address, Value: BatchValue(math.Round(value * float64(reg.Multiplier)))}}
+	} else {
+		return fmt.Errorf("%w: unknown symbol %s", ErrValidation, symbol)
+	}
+	_, err := p.WriteBatch(writes, false)
+	return err
+}
+
+// Create modbus.Handler, store it in p.handler,
+// connect the handler and create p.modbusclient (modbus.Client)
+func (p *Pingvin) createModbusClient(transport Transport) error {
+	bus, err := openBus(transport)
 	if err != nil {
-		log.Println("ERROR: Quit:", err)
+		return err
+	}
+	log.Println("Connecting to serial console on", transport.Serial, "slave ID", transport.SlaveId)
+	p.handler, p.buslock, p.transport = bus.handler, bus.lock, transport
+	p.health.Device, p.health.SlaveId = transport.Serial, transport.SlaveId
+	p.modbusclient = &instrumentedClient{Client: newSlaveClient(p.handler, transport.SlaveId), stats: p.busstats}
+	if err := p.connect(); err != nil {
+		// Monitor keeps trying to reconnect
+		log.Println("ERROR: createModbusClient: p.handler.Connect:", err)
+		p.health.State = StateDisconnected
+		p.health.LastError = err.Error()
+		return nil
 	}
+	p.Debug.Println("Handler connected")
+	return nil
 }
 
 // Update all coil values
-func (p *Pingvin) updateCoils() {
+func (p *Pingvin) updateCoils() error {
 	var results []byte
 	var err error
 	for retries := 1; retries <= 5; retries++ {
 		p.Debug.Println("Reading coils, attempt", retries)
-		p.buslock.Lock()
+		p.buslock.LockBackground()
 		results, err = p.modbusclient.ReadCoils(0, uint16(len(p.Coils)))
 		p.buslock.Unlock()
 		if len(results) > 0 {
 			break
 		} else if retries == 4 {
 			log.Println("ERROR: updateCoils: client.Readcoils: ", err)
-			return
+			return fmt.Errorf("updateCoils: %w", err)
 		}
 		if err != nil {
 			log.Printf("WARNING updateCoils: client.ReadCoils attempt %d: %s\n", retries, err)
 		}
+		p.busstats.retry(opReadCoils)
 		time.Sleep(100 * time.Millisecond)
 	}
 	// modbus.ReadCoils returns a byte array, with the first byte's bits representing coil values 0-7,
@@ -237,6 +342,7 @@ func (p *Pingvin) updateCoils() {
 	// e.g. reading the first 8 coils might return a byte array of length 1, with the following:
 	// [4], which is 00000100, meaning all other coils are 0 except coil #2 (3rd coil)
 	//
+	now := time.Now()
 	k := 0                              // pingvinCoil index
 	for i := 0; i < len(results); i++ { // loop through the byte array
 		for j := 0; j < 8; j++ {
@@ -244,34 +350,41 @@ func (p *Pingvin) updateCoils() {
 			// and checking if the LSB after the shift is 1 with a bitwise AND
 			// A coil value of 1 means on/true/yes, so == 1 returns the bool value
 			// for each coil
+			if k >= len(p.Coils) {
+				break
+			}
 			p.Coils[k].Value = (results[i] >> j & 0x1) == 1
+			p.Coils[k].LastUpdated, p.Coils[k].Stale = &now, false
 			k++
 		}
 	}
+	return nil
 }
 
 // Read a single holding register, stores value in p.Registers
 // Returns integer value of register
 func (p *Pingvin) ReadRegister(addr uint16) (int, error) {
-	p.buslock.Lock()
-	results, err := p.modbusclient.ReadHoldingRegisters(addr, 1)
-	p.buslock.Unlock()
+	if int(addr) >= len(p.Registers) {
+		return 0, fmt.Errorf("ReadRegister: address %d out of range", addr)
+	}
+	results, err := p.readRegisterRange(addr, 1)
 	if err != nil {
-		//log.Println("ERROR: ReadRegister:", err)
 		return p.Registers[addr].Value, err
 	}
-	if p.Registers[addr].Type == "uint16" {
-		p.Registers[addr].Value = int(uint16(results[0]) << 8)
-		p.Registers[addr].Value += int(uint16(results[1]))
-	} else if p.Registers[addr].Type == "int16" {
-		p.Registers[addr].Value = int(int16(results[0]) << 8)
-		p.Registers[addr].Value += int(int16(results[1]))
-	}
-	return p.Registers[addr].Value, nil
+	return results[0], nil
 }
 
 // Update a single holding register
 func (p *Pingvin) WriteRegister(addr uint16, value uint16) (uint16, error) {
+	if int(addr) >= len(p.Registers) {
+		return 0, fmt.Errorf("WriteRegister: address %d out of range", addr)
+	}
+	if err := p.checkPolicy("register", int(addr), int(value), false); err != nil {
+		log.Println("ERROR: WriteRegister:", err)
+		return 0, err
+	}
+	p.writelock.Lock()
+	defer p.writelock.Unlock()
 	p.buslock.Lock()
 	_, err := p.modbusclient.WriteSingleRegister(addr, value)
 	p.buslock.Unlock()
@@ -291,23 +404,18 @@ func (p *Pingvin) WriteRegister(addr uint16, value uint16) (uint16, error) {
 	return 0, fmt.Errorf("Failed to write register")
 }
 
-// Update all holding register values
-func (p *Pingvin) updateRegisters() {
+// Update the holding registers in tiers
+func (p *Pingvin) updateRegisters(tiers ...string) error {
 	var err error
-	regs := len(p.Registers)
-	k := 0
-	// modbus.ReadHoldingRegisters can read 125 regs at a time, so first we loop
-	// until all the values are fethed, increasing the value of k for each register
-	// When there are less than 125 registers to go, it's the last pass
-	for k < regs {
-		r := 125
-		if regs-k < 125 {
-			r = regs - k
-		}
+	// modbus.ReadHoldingRegisters can read 125 regs at a time. Reserved
+	// registers and registers of other tiers are skipped, the blocks are
+	// split at long gaps between the registers to read
+	for _, block := range planBlocks(p.pollAddresses(tiers)) {
+		k, r := block.start, block.quantity
 		var results []byte
 		for retries := 1; retries <= 5; retries++ {
 			p.Debug.Println("Reading registers, attempt", retries, "k:", k)
-			p.buslock.Lock()
+			p.buslock.LockBackground()
 			results, err = p.modbusclient.ReadHoldingRegisters(uint16(k), uint16(r))
 			p.buslock.Unlock()
 			if len(results) > 0 {
@@ -316,15 +424,20 @@ func (p *Pingvin) updateRegisters() {
 				log.Printf("ERROR: updateRegisters: max retries reached, giving up. client.ReadHoldingRegisters: %v", err)
 				log.Printf("ERROR: error occurred when reading registers %d - %d", k, k+r-1)
 				if !p.firstReadDone {
-					panic("FATAL: Error on initial read")
+					log.Println("ERROR: Initial read failed, retrying in the background")
 				}
-				return
+				return fmt.Errorf("updateRegisters: %w", err)
 			} else if err != nil {
 				log.Printf("WARNING: updateRegisters: client.ReadHoldingRegisters attempt %d: %s", retries, err)
 			}
+			p.busstats.retry(opReadHoldingRegisters)
 			time.Sleep(200 * time.Millisecond)
 		}
 		p.firstReadDone = true
+		now := time.Now()
+		for _, reg := range p.Registers[k : k+r] {
+			reg.LastUpdated, reg.Stale = &now, false
+		}
 		// The values represent 16 bit integers, but modbus works with bytes
 		// Each even byte of the returned []byte is the 8 MSBs of a new 16-bit
 		// value, so for each even byte in the reponse slice we bitshift the byte
@@ -362,14 +475,38 @@ func (p *Pingvin) updateRegisters() {
 			msb = !msb
 		}
 	}
+	return nil
+}
+
+// Wrapper function for updating coils, registers of all tiers and
+// populating p.Status for Home Assistant. The result is recorded in
+// the connection health
+func (p *Pingvin) Update() error {
+	return p.update(TierFast, TierSlow, TierOnce)
+}
+
+// Update the coils and the registers of the tiers due
+func (p *Pingvin) poll() error {
+	return p.update(p.dueTiers(time.Now())...)
 }
 
-// Wrapper function for updating coils, registers and populating
-// p.Status for Home Assistant
-func (p *Pingvin) Update() {
-	p.updateCoils()
-	p.updateRegisters()
+func (p *Pingvin) update(tiers ...string) error {
+	p.Debug.Println("Updating coils and registers, tiers", tiers)
+	// The registers are read even if the coils failed, so one failed
+	// read doesn't leave every value stale
+	coilerr := p.updateCoils()
+	regerr := p.updateRegisters(tiers...)
+	if regerr == nil && slices.Contains(tiers, TierSlow) {
+		p.lastSlowPoll = time.Now()
+	}
+	if regerr == nil && slices.Contains(tiers, TierOnce) {
+		p.oncePolled = true
+	}
+	err := errors.Join(coilerr, regerr)
+	p.updateHealth(err)
+	p.MarkStale()
 	p.populateStatus()
+	return err
 }
 
 // Read single coil
@@ -387,109 +524,77 @@ func (p *Pingvin) ReadCoil(n uint16) (err error) {
 		} else if err != nil {
 			log.Printf("WARNING: ReadCoil: client.ReadCoils attempt %d: %s", retries, err)
 		}
+		p.busstats.retry(opReadCoils)
 		time.Sleep(100 * time.Millisecond)
 	}
 	p.Coils[n].Value = results[0] == 1
+	now := time.Now()
+	p.Coils[n].LastUpdated, p.Coils[n].Stale = &now, false
 	return
 }
 
-// Force a single coil
+// Force a single coil. Enabling one of the mutually exclusive mode
+// coils turns the others off. The writes are verified and p.Coils updated
 func (p *Pingvin) WriteCoil(n uint16, val bool) bool {
-	if val {
-		_ = p.checkMutexCoils(n) //, p.handler)
-	}
-	var value uint16 = 0
-	if val {
-		value = 0xff00
-	}
-	p.buslock.Lock()
-	results, err := p.modbusclient.WriteSingleCoil(n, value)
-	p.buslock.Unlock()
-	if err != nil {
-		log.Println("ERROR: WriteCoil: ", err)
-	}
-	if (val && results[0] != 255) && (!val && results[0] != 0) {
-		log.Println("ERROR: WriteCoil: failed to write coil")
+	if _, err := p.WriteBatch(p.CoilWrites(int(n), val, false), false); err != nil {
+		log.Println("ERROR: WriteCoil:", err)
 		return false
 	}
-	err = p.ReadCoil(n)
-	if err != nil {
-		log.Printf("ERROR WriteCoil: p.ReadCoil: %s", err)
-	}
-	log.Printf("Wrote coil %d to value %v (%s: %s)", n, p.Coils[n].Value, p.Coils[n].Symbol, p.Coils[n].Description)
 	return true
 }
 
-// Force multiple coils
-func (p *Pingvin) WriteCoils(startaddr uint16, quantity uint16, vals []bool) error {
-	p.updateCoils()
-	coilslice := p.Coils[startaddr:(startaddr + quantity)]
-	if len(coilslice) != len(vals) {
-		return fmt.Errorf("ERROR: WriteCoils: vals ([]bool) is not the correct length")
-	}
-	// Convert slice of booleans to byte slice
-	// representing individual bits
-	// modbus.NewClient.WriteMultipleCoils wants the individual
-	// bits in each byte "inverted", e.g. if you want to set 16 coils
-	// with values 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, the
-	// byte array needs to be [0x01,0x80] or [0b00000001, 0b10000000]
-	bits := make([]byte, (len(coilslice)+7)/8)
-	for i, coil := range coilslice {
-		if coil.Value || vals[i] {
-			// i/8 integer division, returns 0 for 0-7 etc.
-			// i%8 loops through 0-7
-			// If coil.Value or vals[i] is true, set i%8 + 1 least significant bit
-			// to 1 in bits[i/8]
-			// e.g. coil[19]:  (i/8 = 2, i%8 = 3)
-			// -> bits[2] = (bits[2] | 0b00000001 << 3)
-			// -> bits[2] = bits[2] | 0b00001000
-			// -> 4th least sign. bit is set to 1
-			bits[i/8] |= 0x01 << uint(i%8)
-		}
-		if !vals[i] {
-			// bits contains the current values. If vals[i] is false,
-			// the bit should be set to 0
-			// ^(1 << 3) = ^0b00001000 = 0b11110111
-			// 0b10101010 &| ^(1 << 3)
-			//     0b10101010
-			// AND 0b11110111
-			// ->  0b10100010
-			bits[i/8] &= ^(1 << uint(i%8))
+// Force multiple coils. confirm confirms the writes to coils with the
+// confirm write policy. The writes are verified and p.Coils updated
+func (p *Pingvin) WriteCoils(startaddr uint16, quantity uint16, vals []bool, confirm bool) error {
+	if int(startaddr)+int(quantity) > len(p.Coils) {
+		return fmt.Errorf("WriteCoils: coils %d-%d out of range", startaddr, int(startaddr)+int(quantity)-1)
+	}
+	if int(quantity) != len(vals) {
+		return fmt.Errorf("WriteCoils: vals ([]bool) is not the correct length")
+	}
+	writes := []BatchWrite{}
+	for i, val := range vals {
+		write := BatchWrite{Type: "coil", Address: int(startaddr) + i, Confirm: confirm}
+		if val {
+			write.Value = 1
 		}
-		p.Debug.Println("index:", i/8, "value:", bits[i/8], "shift:", i%8)
+		writes = append(writes, write)
 	}
-	p.Debug.Println(bits)
-	p.buslock.Lock()
-	results, err := p.modbusclient.WriteMultipleCoils(startaddr, quantity, bits)
-	p.buslock.Unlock()
-	if err != nil {
-		log.Println("ERROR: WriteCoils: ", err)
+	if _, err := p.WriteBatch(writes, false); err != nil {
+		log.Println("ERROR: WriteCoils:", err)
 		return err
 	}
-	log.Println(results)
 	return nil
 }
 
 // Some of the coils are mutually exclusive, and can only be 1 one at a time.
-// Check if coil is one of them and force all of them to 0 if so
-func (p *Pingvin) checkMutexCoils(addr uint16) error { //, handler *modbus.RTUClientHandler) error {
-	for _, mutexcoil := range mutexcoils {
-		if mutexcoil == addr {
-			for _, n := range mutexcoils {
-				if p.Coils[n].Value {
-					p.buslock.Lock()
-					_, err := p.modbusclient.WriteSingleCoil(n, 0)
-					p.buslock.Unlock()
-					if err != nil {
-						log.Println("ERROR: checkMutexCoils:", err)
-						return err
-					}
-				}
-			}
-			return nil
+// Writes turning off the mutually exclusive coils other than addr
+// that are on in p.Coils, none if addr isn't one of them
+func (p *Pingvin) mutexOffWrites(addr uint16) []BatchWrite {
+	writes := []BatchWrite{}
+	if !isMutexCoil(addr) {
+		return writes
+	}
+	for _, n := range mutexcoils {
+		if n != addr && p.Coils[n].Value {
+			writes = append(writes, BatchWrite{Type: "coil", Address: int(n), Value: 0})
 		}
 	}
-	return nil
+	return writes
+}
+
+// Batch writes setting a single coil. Enabling one of the mutually
+// exclusive mode coils also turns the others off
+func (p *Pingvin) CoilWrites(addr int, val, confirm bool) []BatchWrite {
+	write := BatchWrite{Type: "coil", Address: addr, Confirm: confirm}
+	if !val {
+		return []BatchWrite{write}
+	}
+	write.Value = 1
+	if addr < 0 || addr >= len(p.Coils) {
+		return []BatchWrite{write}
+	}
+	return append(p.mutexOffWrites(uint16(addr)), write)
 }
 
 // populate p.Status struct for Home Assistant
@@ -521,6 +626,8 @@ func (p *Pingvin) populateStatus() {
 	p.Status.HrcEffIn = p.Registers[29].Value / p.Registers[29].Multiplier
 	p.Status.HrcEffEx = p.Registers[30].Value / p.Registers[30].Multiplier
 	p.Status.OpMode = parseStatus(p.Registers[44].Value)
+	p.Status.Override = p.OverrideStatus()
+	p.Status.Connection = p.Health()
 	// TODO: Alarms, n of alarms
 	// TODO: Uptime & date in separate functions
 	p.Status.Coils = p.Coils
@@ -529,24 +636,6 @@ func (p *Pingvin) populateStatus() {
 // Parse readable status from integer (bitfield) value
 func parseStatus(value int) string {
 	val := int16(value)
-	pingvinStatuses := []string{
-		"Max cooling",
-		"Max heating",
-		"Stopped by alarm",
-		"Stopped by user",
-		"Away",
-		"reserved",
-		"Adaptive",
-		"CO2 boost",
-		"RH boost",
-		"Manual boost",
-		"Overpressure",
-		"Cooker hood mode",
-		"Central vac mode",
-		"Electric heater cooloff",
-		"Summer night cooling",
-		"HRC defrost",
-	}
 	for i := 0; i < 15; i++ {
 		if val>>i&0x1 == 1 {
 			return pingvinStatuses[i]
@@ -563,6 +652,21 @@ func parseStatus(value int) string {
 // Temperature must be between 20 and 30 deg Celsius, otherwise
 // returns an error
 func (p *Pingvin) Temperature(action string) error {
+	temperature, err := p.parseTemperature(action)
+	if err != nil {
+		return err
+	}
+	p.Debug.Println("Writing register 135 to", temperature)
+	res, err := p.WriteRegister(135, uint16(temperature))
+	if err != nil {
+		return err
+	}
+	p.Debug.Println("Temperature changed to", res)
+	return nil
+}
+
+// Parse the raw setpoint register value from a Temperature action
+func (p *Pingvin) parseTemperature(action string) (int, error) {
 	temperature := 0
 	if action == "up" {
 		temperature = p.Registers[135].Value + 1*p.Registers[135].Multiplier
@@ -577,7 +681,7 @@ func (p *Pingvin) Temperature(action string) error {
 			tfloat, err := strconv.ParseFloat(action, 32)
 			if err != nil {
 				p.Debug.Println(err)
-				return err
+				return 0, fmt.Errorf("%w: invalid temperature %s", ErrValidation, action)
 			}
 			t = int(tfloat * float64(p.Registers[135].Multiplier))
 		}
@@ -589,27 +693,18 @@ func (p *Pingvin) Temperature(action string) error {
 		p.Debug.Println("Setting temperature to", temperature)
 	}
 	if temperature > 300 || temperature < 200 {
-		return fmt.Errorf("Temperature setpoint must be between 200 and 300")
-	}
-	p.Debug.Println("Writing register 135 to", temperature)
-	res, err := p.WriteRegister(135, uint16(temperature))
-	if err != nil {
-		return err
-	}
-	p.Debug.Println("Temperature changed to", res)
-	return nil
-}
-
-func (p *Pingvin) Monitor(interval int) {
-	for {
-		time.Sleep(time.Duration(interval) * time.Second)
-		p.Debug.Println("Updating values")
-		p.Update()
+		return 0, fmt.Errorf("%w: temperature setpoint must be between 200 and 300", ErrValidation)
 	}
+	return temperature, nil
 }
 
 // Implements prometheus.Describe()
 func (p *Pingvin) Describe(ch chan<- *prometheus.Desc) {
+	if p.metricsLayout == LayoutLabels {
+		p.describeLabels(ch)
+		return
+	}
+	p.busstats.describe(ch)
 	for _, hreg := range p.Registers {
 		if !hreg.Reserved {
 			ch <- hreg.PromDesc
@@ -624,8 +719,16 @@ func (p *Pingvin) Describe(ch chan<- *prometheus.Desc) {
 
 // Implements prometheus.Collect()
 func (p *Pingvin) Collect(ch chan<- prometheus.Metric) {
+	if p.metricsLayout == LayoutLabels {
+		p.collectLabels(ch)
+		return
+	}
+	p.busstats.collect(ch, p.Health().LastSuccess)
+	now := time.Now()
+	// Stale values are left out, so they show as missing instead of
+	// repeating the last value read
 	for _, hreg := range p.Registers {
-		if !hreg.Reserved {
+		if !hreg.Reserved && !p.isStale(hreg.LastUpdated, hreg.Poll, now) {
 			ch <- prometheus.MustNewConstMetric(
 				hreg.PromDesc,
 				prometheus.GaugeValue,
@@ -638,7 +741,7 @@ func (p *Pingvin) Collect(ch chan<- prometheus.Metric) {
 		if coil.Value {
 			val = 1
 		}
-		if !coil.Reserved {
+		if !coil.Reserved && !p.isStale(coil.LastUpdated, TierFast, now) {
 			ch <- prometheus.MustNewConstMetric(
 				coil.PromDesc,
 				prometheus.GaugeValue,
@@ -648,24 +751,48 @@ func (p *Pingvin) Collect(ch chan<- prometheus.Metric) {
 	}
 }
 
-// create a Pingvin struct, read coils and registers from CSVs
-func New(serial string, debug bool) *Pingvin {
+// create a Pingvin struct, read coils and registers from the map and
+// choose the map profile for the connected unit
+func New(transport Transport, debug bool, maps MapFiles) (*Pingvin, error) {
+	if err := transport.validate(); err != nil {
+		return nil, err
+	}
 	pingvin := Pingvin{}
 	pingvin.Debug.dbg = debug
-	pingvin.buslock = &sync.Mutex{}
-	pingvin.createModbusClient(serial)
-	log.Println("Parsing coil data...")
-	coilData := readCsvLines("coils.csv")
-	for i := 0; i < len(coilData); i++ {
-		pingvin.Coils = append(pingvin.Coils, newCoil(coilData[i][0], coilData[i][1], coilData[i][2]))
-	}
-	log.Println("Parsed", len(pingvin.Coils), "coils")
-	log.Println("Parsing register data...")
-	registerData := readCsvLines("registers.csv")
-	for i := 0; i < len(registerData); i++ {
-		pingvin.Registers = append(pingvin.Registers,
-			newRegister(registerData[i][0], registerData[i][1], registerData[i][2], registerData[i][3], registerData[i][6]))
-	}
-	log.Println("Parsed", len(pingvin.Registers), "registers")
-	return &pingvin
+	pingvin.writelock = &sync.Mutex{}
+	pingvin.overridelock = &sync.Mutex{}
+	pingvin.healthlock = &sync.Mutex{}
+	pingvin.busstats = newBusStats()
+	pingvin.staleAfter = defaultStaleAfter
+	pingvin.slowInterval = defaultSlowInterval
+	log.Println("Parsing coil and register map...")
+	m, err := loadMap(maps)
+	if err != nil {
+		return nil, err
+	}
+	if err := pingvin.applyMap(m, nil); err != nil {
+		return nil, err
+	}
+	if err := pingvin.createModbusClient(transport); err != nil {
+		return nil, err
+	}
+	// The profile is chosen before anything depends on the map
+	profile, err := pingvin.detectProfile(m, maps.Profile)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		log.Println("Using map profile", profile.Name)
+		if err := pingvin.applyMap(m, profile); err != nil {
+			return nil, err
+		}
+	}
+	log.Println("Parsed", len(pingvin.Coils), "coils and", len(pingvin.Registers), "registers")
+	if err := pingvin.SetWritePolicies(nil); err != nil {
+		return nil, err
+	}
+	if err := pingvin.SetPollTiers(nil); err != nil {
+		return nil, err
+	}
+	return &pingvin, nil
 }
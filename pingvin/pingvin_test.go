@@ -2,34 +2,38 @@ package pingvin
 
 import (
 	"fmt"
-	"strconv"
+	"sync"
 	"testing"
+
+	"github.com/goburrow/modbus"
 )
 
 func TestNewCoil(t *testing.T) {
-	data := readCsvLines("../coils.csv")
-	addr := data[1][0]
-	symbol := data[1][1]
-	description := data[1][2]
+	m, err := ReadMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := m.Coils[1].Address
+	symbol := m.Coils[1].Symbol
+	description := m.Coils[1].Description
 
 	coil := newCoil(addr, symbol, description)
 	typ := fmt.Sprintf("%T", coil)
-	// Assert newCoil returns pingvinKL.pingvinCoil
-	if typ != "pingvinKL.pingvinCoil" {
-		t.Errorf("newCoil returned %s, expecting pingvinKL.pingvinCoil", typ)
+	// Assert newCoil returns *pingvin.pingvinCoil
+	if typ != "*pingvin.pingvinCoil" {
+		t.Errorf("newCoil returned %s, expecting *pingvin.pingvinCoil", typ)
 	}
 
-	// Assert Address is int and matches CSV
+	// Assert Address is int and matches the map
 	addrtype := fmt.Sprintf("%T", coil.Address)
 	if addrtype != "int" {
 		t.Errorf("newCoil.Address is of type %s, expecting int", addrtype)
 	}
-	iaddr, _ := strconv.Atoi(addr)
-	if coil.Address != iaddr {
-		t.Errorf("coil.Address is %d, expecting %d", coil.Address, iaddr)
+	if coil.Address != addr {
+		t.Errorf("coil.Address is %d, expecting %d", coil.Address, addr)
 	}
 
-	// Assert Symbol is string and matches CSV
+	// Assert Symbol is string and matches the map
 	symboltype := fmt.Sprintf("%T", coil.Symbol)
 	if symboltype != "string" {
 		t.Errorf("coil.Symbol is of type %s, expecting string", symboltype)
@@ -38,7 +42,7 @@ func TestNewCoil(t *testing.T) {
 		t.Errorf("coil.Symbol is %s, expecting %s", coil.Symbol, symbol)
 	}
 
-	// Assert Description is string and matches CSV
+	// Assert Description is string and matches the map
 	descriptiontype := fmt.Sprintf("%T", coil.Description)
 	if descriptiontype != "string" {
 		t.Errorf("coil.Description is of type %s, expecting string", descriptiontype)
@@ -67,12 +71,16 @@ func TestNewCoil(t *testing.T) {
 }
 
 func TestNewReservedCoil(t *testing.T) {
-	data := readCsvLines("../coils.csv")
-	addr := data[3][0]
-	symbol := data[3][1]
-	description := data[3][2]
-
-	coil := newCoil(addr, symbol, description)
+	m, err := ReadMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Coil 13 is missing from the map
+	p := &Pingvin{}
+	if err := p.applyMap(m, nil); err != nil {
+		t.Fatal(err)
+	}
+	coil := p.Coils[13]
 	// Assert Reserved is bool and true
 	typ := fmt.Sprintf("%T", coil.Reserved)
 	if typ != "bool" {
@@ -84,31 +92,37 @@ func TestNewReservedCoil(t *testing.T) {
 }
 
 func TestNewRegister(t *testing.T) {
-	data := readCsvLines("../registers.csv")
-	addr := data[4][0]
-	symbol := data[4][1]
-	regtype := data[4][2]
-	description := data[4][6]
+	m, err := ReadMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := m.Registers[3].Address
+	symbol := m.Registers[3].Symbol
+	regtype := m.Registers[3].Type
+	multiplier := m.Registers[3].Multiplier
+	description := m.Registers[3].Description
 
-	hreg := newRegister(addr, symbol, regtype, description)
+	hreg := newRegister(addr, symbol, regtype, multiplier, description)
 
-	// Assert newRegister returns pingvinKL.pingvinRegister
+	// Assert newRegister returns *pingvin.pingvinRegister
 	typ := fmt.Sprintf("%T", hreg)
-	if typ != "pingvinKL.pingvinRegister" {
-		t.Errorf("newRegister returned %s, expecting pingvinKL.pingvinRegister", typ)
+	if typ != "*pingvin.pingvinRegister" {
+		t.Errorf("newRegister returned %s, expecting *pingvin.pingvinRegister", typ)
 	}
 
-	// Assert Address is int and matches CSV
+	// Assert Address is int and matches the map
 	addrtype := fmt.Sprintf("%T", hreg.Address)
 	if addrtype != "int" {
 		t.Errorf("hreg.Address is of type %s, expecting int", addrtype)
 	}
-	iaddr, _ := strconv.Atoi(addr)
-	if hreg.Address != iaddr {
-		t.Errorf("hreg.Address is %d, expecting %d", hreg.Address, iaddr)
+	if hreg.Address != addr {
+		t.Errorf("hreg.Address is %d, expecting %d", hreg.Address, addr)
+	}
+	if hreg.Multiplier != multiplier {
+		t.Errorf("hreg.Multiplier is %d, expecting %d", hreg.Multiplier, multiplier)
 	}
 
-	// Assert Symbol is string and matches CSV
+	// Assert Symbol is string and matches the map
 	symboltype := fmt.Sprintf("%T", hreg.Symbol)
 	if symboltype != "string" {
 		t.Errorf("hreg.Symbol is of type %s, expecting string", symboltype)
@@ -117,7 +131,7 @@ func TestNewRegister(t *testing.T) {
 		t.Errorf("hreg.Symbol is %s, expecting %s", hreg.Symbol, symbol)
 	}
 
-	// Assert Description is string and matches CSV
+	// Assert Description is string and matches the map
 	descriptiontype := fmt.Sprintf("%T", hreg.Description)
 	if descriptiontype != "string" {
 		t.Errorf("hreg.Description is of type %s, expecting string", descriptiontype)
@@ -144,7 +158,7 @@ func TestNewRegister(t *testing.T) {
 		t.Errorf("hreg.Reserved is %t, expecting false", hreg.Reserved)
 	}
 
-	// Assert Type is string and matches CSV
+	// Assert Type is string and matches the map
 	hregtype := fmt.Sprintf("%T", hreg.Type)
 	if hregtype != "string" {
 		t.Errorf("hreg.Type is of type %s, expecting string", hregtype)
@@ -153,3 +167,107 @@ func TestNewRegister(t *testing.T) {
 		t.Errorf("hreg.Type is %s, expecting %s", hreg.Type, regtype)
 	}
 }
+
+// In-memory modbus.Client simulating a unit for tests
+type fakeClient struct {
+	coils     []bool
+	registers []uint16
+	requests  []string // Function names of requests received
+}
+
+func (c *fakeClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	c.requests = append(c.requests, "ReadCoils")
+	if int(address)+int(quantity) > len(c.coils) {
+		return nil, &modbus.ModbusError{FunctionCode: 1, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}
+	}
+	vals := c.coils[address : address+quantity]
+	results := make([]byte, (len(vals)+7)/8)
+	for i, val := range vals {
+		if val {
+			results[i/8] |= 0x01 << uint(i%8)
+		}
+	}
+	return results, nil
+}
+
+func (c *fakeClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	c.requests = append(c.requests, "WriteSingleCoil")
+	c.coils[address] = value == 0xff00
+	return []byte{byte(value >> 8), byte(value)}, nil
+}
+
+func (c *fakeClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	c.requests = append(c.requests, "WriteMultipleCoils")
+	for i := 0; i < int(quantity); i++ {
+		c.coils[int(address)+i] = (value[i/8] >> (i % 8) & 0x1) == 1
+	}
+	return []byte{byte(quantity >> 8), byte(quantity)}, nil
+}
+
+func (c *fakeClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	c.requests = append(c.requests, "ReadHoldingRegisters")
+	if int(address)+int(quantity) > len(c.registers) {
+		return nil, &modbus.ModbusError{FunctionCode: 3, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}
+	}
+	results := []byte{}
+	for _, val := range c.registers[address : address+quantity] {
+		results = append(results, byte(val>>8), byte(val))
+	}
+	return results, nil
+}
+
+func (c *fakeClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	c.requests = append(c.requests, "WriteSingleRegister")
+	c.registers[address] = value
+	return []byte{byte(value >> 8), byte(value)}, nil
+}
+
+func (c *fakeClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	c.requests = append(c.requests, "WriteMultipleRegisters")
+	for i := 0; i < int(quantity); i++ {
+		c.registers[int(address)+i] = uint16(value[2*i])<<8 | uint16(value[2*i+1])
+	}
+	return []byte{byte(quantity >> 8), byte(quantity)}, nil
+}
+
+func (c *fakeClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeClient) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeClient) ReadFIFOQueue(address uint16) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// Create a Pingvin connected to a fakeClient, using the built-in maps
+func newTestPingvin(t *testing.T) (*Pingvin, *fakeClient) {
+	t.Helper()
+	p := &Pingvin{buslock: newBusLock(), writelock: &sync.Mutex{}, overridelock: &sync.Mutex{}, healthlock: &sync.Mutex{}, busstats: newBusStats(), staleAfter: defaultStaleAfter, slowInterval: defaultSlowInterval}
+	m, err := ReadMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.applyMap(m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetWritePolicies(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetPollTiers(nil); err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{coils: make([]bool, len(p.Coils)), registers: make([]uint16, len(p.Registers))}
+	p.modbusclient = &instrumentedClient{Client: client, stats: p.busstats}
+	return p, client
+}
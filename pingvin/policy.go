@@ -0,0 +1,165 @@
+package pingvin
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Write access of a coil or register
+const (
+	AccessRead    = "read"    // Writes are rejected
+	AccessWrite   = "write"   // Writable within the limits
+	AccessConfirm = "confirm" // Writable within the limits, each write must be confirmed
+)
+
+// Write policy of a coil or register. Min, Max and Step are raw
+// register values, they replace the limits from the register map
+type WritePolicy struct {
+	Symbol string `yaml:"symbol" json:"symbol"`
+	Access string `yaml:"access" json:"access"`
+	Min    *int   `yaml:"min,omitempty" json:"min,omitempty"`
+	Max    *int   `yaml:"max,omitempty" json:"max,omitempty"`
+	Step   int    `yaml:"step,omitempty" json:"step,omitempty"` // Value - min must be divisible by step
+}
+
+// Returned when a write is rejected by the write policy
+var ErrPolicy = fmt.Errorf("%w: write policy", ErrValidation)
+
+// Built-in policies for registers that can break the Modbus link or
+// the network configuration, and registers that only report information.
+// Policies from the configuration override these
+var defaultPolicies = []WritePolicy{
+	{Symbol: "HREG_MBADDR", Access: AccessRead},
+	{Symbol: "HREG_MODBUS_SPEED", Access: AccessRead},
+	{Symbol: "HREG_MODBUS_PARITY", Access: AccessRead},
+	{Symbol: "HREG_IPADDR_HIGH", Access: AccessConfirm},
+	{Symbol: "HREG_IPADDR_LOW", Access: AccessConfirm},
+	{Symbol: "HREG_GWIPADDR_HIGH", Access: AccessConfirm},
+	{Symbol: "HREG_GWIPADDR_LOW", Access: AccessConfirm},
+	{Symbol: "HREG_NETMASK_HIGH", Access: AccessConfirm},
+	{Symbol: "HREG_NETMASK_LOW", Access: AccessConfirm},
+	{Symbol: "HREG_DNSIP_ADDR_HIGH", Access: AccessConfirm},
+	{Symbol: "HREG_DNSIP_ADDR_LOW", Access: AccessConfirm},
+	{Symbol: "HREG_DHCP_CONTROL", Access: AccessConfirm},
+	{Symbol: "HREG_UPTIME", Access: AccessRead},
+	{Symbol: "HREG_BOOTLOADER_VERSION", Access: AccessRead},
+	{Symbol: "HREG_FAMILY_TYPE", Access: AccessRead},
+	{Symbol: "HREG_HW_VERSION", Access: AccessRead},
+	{Symbol: "HREG_SW_VERSION", Access: AccessRead},
+}
+
+// Set the write policies. policies are applied on top of the built-in
+// policies and the policies from the map, an error is returned for unknown symbols and invalid values
+func (p *Pingvin) SetWritePolicies(policies []WritePolicy) error {
+	p.policies = map[string]WritePolicy{}
+	for _, policy := range defaultPolicies {
+		// The register may be missing from a custom register map
+		if key := p.policyKey(policy.Symbol); len(key) > 0 {
+			p.policies[key] = policy
+		}
+	}
+	for _, policy := range p.mapPolicies {
+		p.policies[p.policyKey(policy.Symbol)] = policy
+	}
+	for _, policy := range policies {
+		key := p.policyKey(policy.Symbol)
+		if len(key) == 0 {
+			return fmt.Errorf("write policy: unknown symbol %s", policy.Symbol)
+		}
+		if !slices.Contains([]string{AccessRead, AccessWrite, AccessConfirm}, policy.Access) {
+			return fmt.Errorf("write policy: %s: invalid access %q, expecting read, write or confirm", policy.Symbol, policy.Access)
+		}
+		if policy.Min != nil && policy.Max != nil && *policy.Min > *policy.Max {
+			return fmt.Errorf("write policy: %s: min is greater than max", policy.Symbol)
+		}
+		if policy.Step < 0 {
+			return fmt.Errorf("write policy: %s: step must not be negative", policy.Symbol)
+		}
+		p.policies[key] = policy
+	}
+	return nil
+}
+
+// Write policies with the register map limits filled in
+func (p *Pingvin) WritePolicies() []WritePolicy {
+	policies := []WritePolicy{}
+	for _, reg := range p.Registers {
+		if policy, ok := p.policies[fmt.Sprintf("register:%d", reg.Address)]; ok {
+			if policy.Min == nil && policy.Max == nil {
+				policy.Min, policy.Max = reg.Min, reg.Max
+			}
+			policies = append(policies, policy)
+		}
+	}
+	for _, coil := range p.Coils {
+		if policy, ok := p.policies[fmt.Sprintf("coil:%d", coil.Address)]; ok {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+// Key of the coil or register with symbol in p.policies,
+// empty if the symbol isn't found
+func (p *Pingvin) policyKey(symbol string) string {
+	if coil := p.coilBySymbol(symbol); coil != nil {
+		return fmt.Sprintf("coil:%d", coil.Address)
+	}
+	if reg := p.registerBySymbol(symbol); reg != nil {
+		return fmt.Sprintf("register:%d", reg.Address)
+	}
+	return ""
+}
+
+// Check a write against the write policy of the coil or register.
+// Registers without a policy are writable within the limits from
+// the register map. The address must be valid
+func (p *Pingvin) checkPolicy(typ string, addr int, val int, confirm bool) error {
+	policy, ok := p.policies[fmt.Sprintf("%s:%d", typ, addr)]
+	if !ok {
+		policy = WritePolicy{Access: AccessWrite}
+	}
+	symbol := ""
+	if typ == "register" {
+		symbol = p.Registers[addr].Symbol
+		if policy.Min == nil && policy.Max == nil {
+			policy.Min, policy.Max = p.Registers[addr].Min, p.Registers[addr].Max
+		}
+	} else {
+		symbol = p.Coils[addr].Symbol
+	}
+	if policy.Access == AccessRead {
+		return fmt.Errorf("%w: %s %d (%s) is read-only", ErrPolicy, typ, addr, symbol)
+	}
+	if policy.Access == AccessConfirm && !confirm {
+		return fmt.Errorf("%w: writing %s %d (%s) requires confirmation", ErrPolicy, typ, addr, symbol)
+	}
+	if typ == "coil" {
+		return nil
+	}
+	if (policy.Min != nil && val < *policy.Min) || (policy.Max != nil && val > *policy.Max) {
+		return fmt.Errorf("%w: value %d out of range %s for register %d (%s)", ErrPolicy, val, policy.limits(), addr, symbol)
+	}
+	if policy.Step > 1 {
+		base := 0
+		if policy.Min != nil {
+			base = *policy.Min
+		}
+		if (val-base)%policy.Step != 0 {
+			return fmt.Errorf("%w: value %d for register %d (%s) is not a multiple of step %d", ErrPolicy, val, addr, symbol, policy.Step)
+		}
+	}
+	return nil
+}
+
+// Limits as text for error messages, e.g. "0 - 500"
+func (policy WritePolicy) limits() string {
+	min, max := "", ""
+	if policy.Min != nil {
+		min = fmt.Sprint(*policy.Min)
+	}
+	if policy.Max != nil {
+		max = fmt.Sprint(*policy.Max)
+	}
+	return min + " - " + max
+}
@@ -0,0 +1,138 @@
+package pingvin
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWritePolicy(t *testing.T) {
+	p, client := newTestPingvin(t)
+	min, max := 200, 250
+	err := p.SetWritePolicies([]WritePolicy{
+		{Symbol: "HREG_T_SETPOINT", Access: AccessWrite, Min: &min, Max: &max, Step: 5},
+		{Symbol: "COIL_HEATING_EN", Access: AccessConfirm},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		write BatchWrite
+		ok    bool
+	}{
+		{BatchWrite{Type: "register", Address: 640, Value: 2}, false},               // HREG_MBADDR, built-in read-only
+		{BatchWrite{Type: "register", Address: 654, Value: 1}, false},               // HREG_IPADDR_HIGH, not confirmed
+		{BatchWrite{Type: "register", Address: 654, Value: 1, Confirm: true}, true}, // confirmed
+		{BatchWrite{Type: "register", Address: 135, Value: 260}, false},             // above policy max
+		{BatchWrite{Type: "register", Address: 135, Value: 212}, false},             // not a multiple of step
+		{BatchWrite{Type: "register", Address: 135, Value: 215}, true},              // within policy
+		{BatchWrite{Type: "register", Address: 110, Value: 101}, false},             // above register map max
+		{BatchWrite{Type: "coil", Address: 54, Value: 1}, false},                    // COIL_HEATING_EN, not confirmed
+		{BatchWrite{Type: "coil", Address: 54, Value: 1, Confirm: true}, true},      // confirmed
+	}
+	for i, test := range tests {
+		_, err := p.WriteBatch([]BatchWrite{test.write}, false)
+		if test.ok && err != nil {
+			t.Errorf("test %d: unexpected error %s", i, err)
+		} else if !test.ok && !errors.Is(err, ErrPolicy) {
+			t.Errorf("test %d: expecting policy error, got %v", i, err)
+		}
+	}
+	if client.registers[640] != 0 {
+		t.Error("read-only register written")
+	}
+	if _, err := p.WriteRegister(640, 2); !errors.Is(err, ErrValidation) {
+		t.Errorf("WriteRegister: expecting policy error, got %v", err)
+	}
+	if p.WriteCoil(54, true) {
+		t.Error("WriteCoil wrote a coil requiring confirmation")
+	}
+	client.coils[54] = false
+	if err := p.WriteCoils(53, 2, []bool{false, true}, false); !errors.Is(err, ErrPolicy) {
+		t.Errorf("WriteCoils: expecting policy error, got %v", err)
+	}
+	if client.coils[54] {
+		t.Error("coil requiring confirmation written")
+	}
+	if err := p.WriteCoils(53, 2, []bool{false, true}, true); err != nil || !client.coils[54] {
+		t.Errorf("WriteCoils: confirmed write failed: %v", err)
+	}
+	client.coils[54] = false
+	if _, err := p.WriteBatch(p.CoilWrites(54, true, true), false); err != nil || !client.coils[54] {
+		t.Errorf("confirmed coil write failed: %v", err)
+	}
+}
+
+func TestCoilWrites(t *testing.T) {
+	p, _ := newTestPingvin(t)
+	p.Coils[1].Value = true
+	writes := p.CoilWrites(3, true, false)
+	if len(writes) != 2 || writes[0] != (BatchWrite{Type: "coil", Address: 1, Value: 0}) || writes[1] != (BatchWrite{Type: "coil", Address: 3, Value: 1}) {
+		t.Errorf("unexpected writes %+v", writes)
+	}
+	if writes := p.CoilWrites(3, false, false); len(writes) != 1 {
+		t.Errorf("unexpected writes %+v", writes)
+	}
+}
+
+func TestSetWritePoliciesValidation(t *testing.T) {
+	p, _ := newTestPingvin(t)
+	min, max := 10, 5
+	tests := [][]WritePolicy{
+		{{Symbol: "HREG_NOT_FOUND", Access: AccessRead}},
+		{{Symbol: "HREG_T_SETPOINT", Access: "never"}},
+		{{Symbol: "HREG_T_SETPOINT", Access: AccessWrite, Min: &min, Max: &max}},
+		{{Symbol: "HREG_T_SETPOINT", Access: AccessWrite, Step: -1}},
+	}
+	for i, policies := range tests {
+		if err := p.SetWritePolicies(policies); err == nil {
+			t.Errorf("test %d: expecting error", i)
+		}
+	}
+	// Built-in policies can be overridden
+	if err := p.SetWritePolicies([]WritePolicy{{Symbol: "HREG_MBADDR", Access: AccessConfirm}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkPolicy("register", 640, 2, true); err != nil {
+		t.Error(err)
+	}
+}
+
+// The other mode coils are not turned off if the mode coil can't be written
+func TestWriteValueMutexCoils(t *testing.T) {
+	p, client := newTestPingvin(t)
+	if err := p.SetWritePolicies([]WritePolicy{{Symbol: p.Coils[2].Symbol, Access: AccessRead}}); err != nil {
+		t.Fatal(err)
+	}
+	client.coils[1], p.Coils[1].Value = true, true
+	if err := p.WriteValue(p.Coils[2].Symbol, 1); !errors.Is(err, ErrPolicy) {
+		t.Errorf("expecting policy error, got %v", err)
+	}
+	if !client.coils[1] || client.coils[2] {
+		t.Error("mode coils written although the write was rejected")
+	}
+	if err := p.WriteValue(p.Coils[3].Symbol, 1); err != nil {
+		t.Fatal(err)
+	}
+	if client.coils[1] || !client.coils[3] {
+		t.Errorf("expecting only coil 3 on, got %v", client.coils[:4])
+	}
+}
+
+func TestTemperatureValidation(t *testing.T) {
+	p, client := newTestPingvin(t)
+	for _, action := range []string{"warm", "35.5", "4000"} {
+		if err := p.Temperature(action); !errors.Is(err, ErrValidation) {
+			t.Errorf("%s: expecting validation error, got %v", action, err)
+		}
+	}
+	min, max := 200, 220
+	if err := p.SetWritePolicies([]WritePolicy{{Symbol: "HREG_T_SETPOINT", Access: AccessWrite, Min: &min, Max: &max}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Temperature("23"); !errors.Is(err, ErrPolicy) {
+		t.Errorf("expecting policy error, got %v", err)
+	}
+	if err := p.Temperature("21.5"); err != nil || client.registers[135] != 215 {
+		t.Errorf("setpoint not written: %v", err)
+	}
+}
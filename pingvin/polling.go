@@ -0,0 +1,207 @@
+package pingvin
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Polling tiers of registers
+const (
+	TierFast = "fast" // Read every update interval
+	TierSlow = "slow" // Read every slow interval
+	TierOnce = "once" // Read at startup only
+)
+
+// Registers are read in blocks of at most 125 registers. A block is
+// split where more than maxBlockGap registers in a row are skipped,
+// reading them would take longer than a new request
+const (
+	maxBlockSize = 125
+	maxBlockGap  = 16
+)
+
+const defaultSlowInterval = 5 * time.Minute
+
+// Polling tier of a register or a range of registers. Addresses
+// is a single address or a range, e.g. "100-133"
+type PollTier struct {
+	Symbol    string `yaml:"symbol,omitempty" json:"symbol,omitempty"`
+	Addresses string `yaml:"addresses,omitempty" json:"addresses,omitempty"`
+	Tier      string `yaml:"tier" json:"tier"`
+}
+
+// Built-in tiers. Registers not listed here are read in the slow tier
+var defaultTiers = []PollTier{
+	{Addresses: "0-49", Tier: TierFast},    // Measurements, status and clock
+	{Addresses: "134-135", Tier: TierFast}, // Outside temperature average and setpoint
+	{Addresses: "774", Tier: TierFast},     // Circulation fan speed
+	{Addresses: "780-798", Tier: TierFast}, // Analog and digital I/O
+	{Symbol: "HREG_BOOTLOADER_VERSION", Tier: TierOnce},
+	{Addresses: "597-599", Tier: TierOnce}, // Unit type and versions
+	{Addresses: "640", Tier: TierOnce},     // Modbus address
+	{Addresses: "654-667", Tier: TierOnce}, // Network configuration
+	{Addresses: "733-734", Tier: TierOnce}, // Modbus speed and parity
+}
+
+// A range of registers read with one request
+type registerBlock struct {
+	start, quantity int
+}
+
+// Set the polling tiers of the registers. tiers are applied on top of
+// the built-in tiers, an error is returned for unknown symbols and
+// invalid addresses or tiers
+func (p *Pingvin) SetPollTiers(tiers []PollTier) error {
+	for _, reg := range p.Registers {
+		reg.Poll = TierSlow
+	}
+	for i, tier := range slices.Concat(defaultTiers, tiers) {
+		if !slices.Contains([]string{TierFast, TierSlow, TierOnce}, tier.Tier) {
+			return fmt.Errorf("polling: invalid tier %q, expecting fast, slow or once", tier.Tier)
+		}
+		if len(tier.Symbol) > 0 {
+			reg := p.registerBySymbol(tier.Symbol)
+			// The register may be missing from a custom register map
+			if reg == nil && i < len(defaultTiers) {
+				continue
+			} else if reg == nil {
+				return fmt.Errorf("polling: unknown register %s", tier.Symbol)
+			}
+			reg.Poll = tier.Tier
+			continue
+		}
+		first, last, err := parseAddresses(tier.Addresses)
+		if err != nil {
+			return fmt.Errorf("polling: %w", err)
+		}
+		// The map may have fewer registers than the built-in tiers cover
+		for addr := first; addr <= last && addr < len(p.Registers); addr++ {
+			p.Registers[addr].Poll = tier.Tier
+		}
+	}
+	return nil
+}
+
+// Set how often the slow tier is read
+func (p *Pingvin) SetSlowInterval(d time.Duration) {
+	p.slowInterval = d
+}
+
+// Parse a single address or a range of addresses, e.g. "100-133"
+func parseAddresses(addresses string) (int, int, error) {
+	firststr, laststr, isrange := strings.Cut(addresses, "-")
+	first, err := strconv.Atoi(strings.TrimSpace(firststr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid address %q", addresses)
+	}
+	last := first
+	if isrange {
+		if last, err = strconv.Atoi(strings.TrimSpace(laststr)); err != nil || last < first {
+			return 0, 0, fmt.Errorf("invalid address range %q", addresses)
+		}
+	}
+	if first < 0 {
+		return 0, 0, fmt.Errorf("invalid address %q", addresses)
+	}
+	return first, last, nil
+}
+
+// Addresses of the registers in tiers, reserved registers are skipped
+func (p *Pingvin) pollAddresses(tiers []string) []int {
+	addrs := []int{}
+	for _, reg := range p.Registers {
+		if !reg.Reserved && slices.Contains(tiers, reg.Poll) {
+			addrs = append(addrs, reg.Address)
+		}
+	}
+	return addrs
+}
+
+// Group sorted addresses into blocks read with one request
+func planBlocks(addrs []int) []registerBlock {
+	blocks := []registerBlock{}
+	for _, addr := range addrs {
+		if len(blocks) > 0 {
+			b := &blocks[len(blocks)-1]
+			end := b.start + b.quantity
+			if addr-end <= maxBlockGap && addr-b.start < maxBlockSize {
+				b.quantity = addr - b.start + 1
+				continue
+			}
+		}
+		blocks = append(blocks, registerBlock{start: addr, quantity: 1})
+	}
+	return blocks
+}
+
+// Tiers due for a background poll
+func (p *Pingvin) dueTiers(now time.Time) []string {
+	tiers := []string{TierFast}
+	if now.Sub(p.lastSlowPoll) >= p.slowInterval {
+		tiers = append(tiers, TierSlow)
+	}
+	if !p.oncePolled {
+		tiers = append(tiers, TierOnce)
+	}
+	return tiers
+}
+
+// How long a value of tier is fresh after it has been read
+func (p *Pingvin) freshFor(tier string) time.Duration {
+	switch tier {
+	case TierSlow:
+		return p.slowInterval + p.staleAfter
+	case TierOnce:
+		return time.Duration(1<<63 - 1)
+	}
+	return p.staleAfter
+}
+
+// Mutex for the Modbus bus, giving requests from users priority
+// over background polling
+type busLock struct {
+	lock    *sync.Mutex
+	cond    *sync.Cond
+	locked  bool
+	waiting int // Users waiting for the lock
+}
+
+func newBusLock() *busLock {
+	l := &busLock{lock: &sync.Mutex{}}
+	l.cond = sync.NewCond(l.lock)
+	return l
+}
+
+// Lock the bus for a user request
+func (l *busLock) Lock() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.waiting++
+	for l.locked {
+		l.cond.Wait()
+	}
+	l.waiting--
+	l.locked = true
+}
+
+// Lock the bus for background polling, waits until no user
+// requests are waiting
+func (l *busLock) LockBackground() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for l.locked || l.waiting > 0 {
+		l.cond.Wait()
+	}
+	l.locked = true
+}
+
+func (l *busLock) Unlock() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.locked = false
+	l.cond.Broadcast()
+}
@@ -0,0 +1,99 @@
+package pingvin
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPlanBlocks(t *testing.T) {
+	addrs := []int{1, 2, 3, 10, 40, 41}
+	for i := 200; i < 400; i++ {
+		addrs = append(addrs, i)
+	}
+	expected := []registerBlock{{1, 10}, {40, 2}, {200, 125}, {325, 75}}
+	if blocks := planBlocks(addrs); !slices.Equal(blocks, expected) {
+		t.Errorf("expected %v, got %v", expected, blocks)
+	}
+	if blocks := planBlocks(nil); len(blocks) != 0 {
+		t.Errorf("expected no blocks, got %v", blocks)
+	}
+}
+
+func TestSetPollTiers(t *testing.T) {
+	p, _ := newTestPingvin(t)
+	if p.Registers[1].Poll != TierFast || p.Registers[640].Poll != TierOnce || p.Registers[215].Poll != TierSlow {
+		t.Error("built-in tiers not applied")
+	}
+	err := p.SetPollTiers([]PollTier{{Symbol: "HREG_WC1", Tier: TierFast}, {Addresses: "1-2", Tier: TierSlow}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Registers[215].Poll != TierFast || p.Registers[2].Poll != TierSlow || p.Registers[3].Poll != TierFast {
+		t.Error("configured tiers not applied")
+	}
+	for _, tiers := range [][]PollTier{
+		{{Symbol: "HREG_NONEXISTENT", Tier: TierFast}},
+		{{Addresses: "10-5", Tier: TierFast}},
+		{{Addresses: "x", Tier: TierFast}},
+		{{Addresses: "10", Tier: "sometimes"}},
+	} {
+		if err := p.SetPollTiers(tiers); err == nil {
+			t.Errorf("%v: expecting error", tiers)
+		}
+	}
+	// Reserved registers are never read
+	for _, addr := range p.pollAddresses([]string{TierFast, TierSlow, TierOnce}) {
+		if p.Registers[addr].Reserved {
+			t.Errorf("reserved register %d in poll addresses", addr)
+		}
+	}
+}
+
+func TestDueTiers(t *testing.T) {
+	p, client := newTestPingvin(t)
+	now := time.Now()
+	if tiers := p.dueTiers(now); !slices.Equal(tiers, []string{TierFast, TierSlow, TierOnce}) {
+		t.Errorf("expecting all tiers before the first update, got %v", tiers)
+	}
+	if err := p.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if tiers := p.dueTiers(time.Now()); !slices.Equal(tiers, []string{TierFast}) {
+		t.Errorf("expecting fast tier after an update, got %v", tiers)
+	}
+	if tiers := p.dueTiers(time.Now().Add(defaultSlowInterval)); !slices.Equal(tiers, []string{TierFast, TierSlow}) {
+		t.Errorf("expecting fast and slow tiers after the slow interval, got %v", tiers)
+	}
+	// Only blocks with fast registers are read
+	client.requests = nil
+	if err := p.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.requests) != 4 {
+		t.Errorf("expecting 4 requests, got %v", client.requests)
+	}
+}
+
+func TestBusLockPriority(t *testing.T) {
+	l := newBusLock()
+	l.Lock()
+	order := make(chan string, 2)
+	go func() {
+		l.LockBackground()
+		order <- "background"
+		l.Unlock()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		l.Lock()
+		order <- "user"
+		l.Unlock()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.Unlock()
+	if first := <-order; first != "user" {
+		t.Errorf("expecting the user request first, got %s", first)
+	}
+	<-order
+}
@@ -0,0 +1,71 @@
+package pingvin
+
+import (
+	"fmt"
+	"time"
+)
+
+// Three times the default update interval
+const defaultStaleAfter = 12 * time.Second
+
+// Set how long values are considered fresh after they have been read.
+// Stale values are flagged in the API and not exported to Prometheus
+func (p *Pingvin) SetStaleAfter(d time.Duration) {
+	p.staleAfter = d
+}
+
+// How long values are considered fresh after they have been read
+func (p *Pingvin) StaleAfter() time.Duration {
+	return p.staleAfter
+}
+
+// true if a value of tier read at lastUpdated is stale at now
+func (p *Pingvin) isStale(lastUpdated *time.Time, tier string, now time.Time) bool {
+	return lastUpdated == nil || now.Sub(*lastUpdated) > p.freshFor(tier)
+}
+
+// Current value of a coil or register by symbol like Value,
+// but an error if the value is stale
+func (p *Pingvin) FreshValue(symbol string) (float64, error) {
+	now := time.Now()
+	if coil := p.coilBySymbol(symbol); coil != nil && p.isStale(coil.LastUpdated, TierFast, now) {
+		return 0, fmt.Errorf("%s is stale", symbol)
+	}
+	if reg := p.registerBySymbol(symbol); reg != nil && p.isStale(reg.LastUpdated, reg.Poll, now) {
+		return 0, fmt.Errorf("%s is stale", symbol)
+	}
+	return p.Value(symbol)
+}
+
+// Update the stale flags of coils and registers. Returns true
+// if any of them is stale
+func (p *Pingvin) MarkStale() bool {
+	now := time.Now()
+	stale := false
+	for _, coil := range p.Coils {
+		coil.Stale = p.isStale(coil.LastUpdated, TierFast, now)
+		stale = stale || (coil.Stale && !coil.Reserved)
+	}
+	for _, reg := range p.Registers {
+		reg.Stale = p.isStale(reg.LastUpdated, reg.Poll, now)
+		stale = stale || (reg.Stale && !reg.Reserved)
+	}
+	return stale
+}
+
+// Copy of p.Status with the stale flag and snapshot age
+// as of now
+func (p *Pingvin) CurrentStatus() pingvinStatus {
+	status := pingvinStatus{}
+	if p.Status != nil {
+		status = *p.Status
+	}
+	status.Stale = p.MarkStale()
+	status.Override = p.OverrideStatus()
+	status.Connection = p.Health()
+	if last := status.Connection.LastSuccess; last != nil {
+		age := time.Since(*last).Round(time.Millisecond).Seconds()
+		status.SnapshotAge = &age
+	}
+	return status
+}
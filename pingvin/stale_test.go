@@ -0,0 +1,124 @@
+package pingvin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Fails reading holding registers 200-699
+type failingBlockClient struct {
+	*fakeClient
+}
+
+func (c *failingBlockClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	if address >= 200 && address < 700 {
+		return nil, &modbus.ModbusError{FunctionCode: 3, ExceptionCode: modbus.ExceptionCodeServerDeviceFailure}
+	}
+	return c.fakeClient.ReadHoldingRegisters(address, quantity)
+}
+
+func TestStalePartialUpdate(t *testing.T) {
+	p, client := newTestPingvin(t)
+	p.modbusclient = &failingBlockClient{client}
+	if err := p.Update(); err == nil {
+		t.Fatal("expecting error")
+	}
+	if p.Registers[1].Stale || p.Registers[1].LastUpdated == nil {
+		t.Errorf("register 1 in the first block is stale")
+	}
+	if !p.Registers[343].Stale || p.Registers[343].LastUpdated != nil {
+		t.Errorf("register 343 in a failed block is not stale")
+	}
+	if p.Coils[1].Stale {
+		t.Errorf("coil 1 is stale")
+	}
+	status := p.CurrentStatus()
+	if !status.Stale || status.SnapshotAge != nil {
+		t.Errorf("expecting stale status without a snapshot age, got %v, %v", status.Stale, status.SnapshotAge)
+	}
+	// The fast tier doesn't include the failing block
+	if err := p.update(TierFast); err != nil {
+		t.Fatal(err)
+	}
+	if status := p.CurrentStatus(); status.SnapshotAge == nil {
+		t.Error("no snapshot age after a successful update")
+	}
+}
+
+func TestStaleAfter(t *testing.T) {
+	p, _ := newTestPingvin(t)
+	if err := p.Update(); err != nil {
+		t.Fatal(err)
+	}
+	status := p.CurrentStatus()
+	if status.Stale || status.SnapshotAge == nil {
+		t.Fatalf("expecting fresh status with a snapshot age, got %v, %v", status.Stale, status.SnapshotAge)
+	}
+	// Age the values past the stale window
+	old := time.Now().Add(-time.Minute)
+	p.Registers[135].LastUpdated = &old
+	status = p.CurrentStatus()
+	if !status.Stale {
+		t.Error("expecting stale status")
+	}
+	if !p.Registers[135].Stale || p.Registers[136].Stale {
+		t.Error("expecting only register 135 to be stale")
+	}
+	ch := make(chan prometheus.Metric, 2000)
+	p.Collect(ch)
+	close(ch)
+	for m := range ch {
+		if m.Desc() == p.Registers[135].PromDesc {
+			t.Error("stale register exported to Prometheus")
+		}
+	}
+}
+
+// Fails reading the coils
+type failingReadCoilClient struct {
+	*fakeClient
+}
+
+func (c *failingReadCoilClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return nil, &modbus.ModbusError{FunctionCode: 1, ExceptionCode: modbus.ExceptionCodeServerDeviceFailure}
+}
+
+func TestStaleCoilsFailed(t *testing.T) {
+	p, client := newTestPingvin(t)
+	p.modbusclient = &failingReadCoilClient{client}
+	if err := p.Update(); err == nil {
+		t.Fatal("expecting error")
+	}
+	if !p.Coils[1].Stale {
+		t.Error("coil 1 is not stale after a failed read")
+	}
+	if p.Registers[1].Stale || p.Registers[1].LastUpdated == nil {
+		t.Error("registers not updated after a failed coil read")
+	}
+}
+
+func TestFreshValue(t *testing.T) {
+	p, _ := newTestPingvin(t)
+	if _, err := p.FreshValue("HREG_T_SETPOINT"); err == nil {
+		t.Error("expecting error for a value that hasn't been read")
+	}
+	if err := p.Update(); err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range []string{"HREG_T_SETPOINT", "COIL_HEATING_EN"} {
+		if _, err := p.FreshValue(symbol); err != nil {
+			t.Error(err)
+		}
+	}
+	old := time.Now().Add(-time.Minute)
+	p.Registers[135].LastUpdated = &old
+	if _, err := p.FreshValue(p.Registers[135].Symbol); err == nil {
+		t.Error("expecting error for a stale register")
+	}
+	if _, err := p.FreshValue("HREG_NOT_FOUND"); err == nil {
+		t.Error("expecting error for an unknown symbol")
+	}
+}
@@ -0,0 +1,173 @@
+package pingvin
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// Serial line defaults of the Pingvin units
+const (
+	defaultSlaveId  = 1
+	defaultBaudRate = 19200
+	defaultParity   = "N"
+)
+
+// RS-485 serial device and Modbus slave ID of a unit. Units with
+// different slave IDs can share a serial device, the requests
+// to them are then made in turn
+type Transport struct {
+	Serial   string `yaml:"serial_address" json:"serial_address"`
+	SlaveId  int    `yaml:"slave_id,omitempty" json:"slave_id"`   // Default 1
+	BaudRate int    `yaml:"baud_rate,omitempty" json:"baud_rate"` // Default 19200
+	Parity   string `yaml:"parity,omitempty" json:"parity"`       // N, E or O, default N
+}
+
+// Serial device shared by the units on the same RS-485 bus
+type sharedBus struct {
+	handler *modbus.RTUClientHandler
+	lock    *busLock
+	users   int
+	failing map[int]bool // Slave IDs whose latest update failed
+}
+
+var (
+	buses     = map[string]*sharedBus{} // By serial device
+	buseslock = &sync.Mutex{}
+)
+
+// Serial device and slave ID of the unit, with the defaults filled in
+func (p *Pingvin) Transport() Transport {
+	return p.transport
+}
+
+// Fill in the defaults and check the transport
+func (t *Transport) validate() error {
+	if t.SlaveId == 0 {
+		t.SlaveId = defaultSlaveId
+	}
+	if t.BaudRate == 0 {
+		t.BaudRate = defaultBaudRate
+	}
+	if len(t.Parity) == 0 {
+		t.Parity = defaultParity
+	}
+	if len(t.Serial) == 0 {
+		return fmt.Errorf("missing serial device")
+	}
+	if t.SlaveId < 1 || t.SlaveId > 247 {
+		return fmt.Errorf("%s: invalid slave ID %d, expecting 1-247", t.Serial, t.SlaveId)
+	}
+	if t.BaudRate < 0 {
+		return fmt.Errorf("%s: invalid baud rate %d", t.Serial, t.BaudRate)
+	}
+	if !slices.Contains([]string{"N", "E", "O"}, t.Parity) {
+		return fmt.Errorf("%s: invalid parity %q, expecting N, E or O", t.Serial, t.Parity)
+	}
+	return nil
+}
+
+// The bus of the serial device of t, created on first use. The
+// serial line settings must match the other units on the bus
+func openBus(t Transport) (*sharedBus, error) {
+	buseslock.Lock()
+	defer buseslock.Unlock()
+	bus, ok := buses[t.Serial]
+	if !ok {
+		handler := modbus.NewRTUClientHandler(t.Serial)
+		handler.BaudRate = t.BaudRate
+		handler.DataBits = 8
+		handler.Parity = t.Parity
+		handler.StopBits = 1
+		handler.SlaveId = byte(t.SlaveId)
+		handler.Timeout = 1500 * time.Millisecond
+		bus = &sharedBus{handler: handler, lock: newBusLock(), failing: map[int]bool{}}
+		buses[t.Serial] = bus
+	} else if bus.handler.BaudRate != t.BaudRate || bus.handler.Parity != t.Parity {
+		return nil, fmt.Errorf("%s is already used with baud rate %d and parity %s", t.Serial, bus.handler.BaudRate, bus.handler.Parity)
+	}
+	bus.users++
+	return bus, nil
+}
+
+// Stop using the bus of serial. Returns true for the last user,
+// who closes the serial device
+func releaseBus(serial string) bool {
+	buseslock.Lock()
+	defer buseslock.Unlock()
+	bus, ok := buses[serial]
+	if !ok {
+		return true
+	}
+	bus.users--
+	if bus.users > 0 {
+		return false
+	}
+	delete(buses, serial)
+	return true
+}
+
+// Record whether the latest update of the unit of t failed. Returns
+// true if all units on the bus are failing, or the bus isn't open
+func setBusFailing(t Transport, failing bool) bool {
+	buseslock.Lock()
+	defer buseslock.Unlock()
+	bus, ok := buses[t.Serial]
+	if !ok {
+		return true
+	}
+	bus.failing[t.SlaveId] = failing
+	n := 0
+	for _, f := range bus.failing {
+		if f {
+			n++
+		}
+	}
+	return n >= bus.users
+}
+
+// modbus.Client addressing one unit on a shared bus. The slave ID of
+// the handler is set before each request, the requests are made
+// holding the bus lock
+type slaveClient struct {
+	modbus.Client
+	handler *modbus.RTUClientHandler
+	slaveId byte
+}
+
+func newSlaveClient(handler *modbus.RTUClientHandler, slaveId int) *slaveClient {
+	return &slaveClient{Client: modbus.NewClient(handler), handler: handler, slaveId: byte(slaveId)}
+}
+
+func (c *slaveClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	c.handler.SlaveId = c.slaveId
+	return c.Client.ReadCoils(address, quantity)
+}
+
+func (c *slaveClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	c.handler.SlaveId = c.slaveId
+	return c.Client.ReadHoldingRegisters(address, quantity)
+}
+
+func (c *slaveClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	c.handler.SlaveId = c.slaveId
+	return c.Client.WriteSingleCoil(address, value)
+}
+
+func (c *slaveClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	c.handler.SlaveId = c.slaveId
+	return c.Client.WriteMultipleCoils(address, quantity, value)
+}
+
+func (c *slaveClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	c.handler.SlaveId = c.slaveId
+	return c.Client.WriteSingleRegister(address, value)
+}
+
+func (c *slaveClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	c.handler.SlaveId = c.slaveId
+	return c.Client.WriteMultipleRegisters(address, quantity, value)
+}
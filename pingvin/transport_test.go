@@ -0,0 +1,68 @@
+package pingvin
+
+import "testing"
+
+func TestTransport(t *testing.T) {
+	transport := Transport{Serial: "/dev/ttyTEST0"}
+	if err := transport.validate(); err != nil || transport.SlaveId != 1 || transport.BaudRate != 19200 || transport.Parity != "N" {
+		t.Errorf("expecting the defaults, got %+v, %v", transport, err)
+	}
+	for _, invalid := range []Transport{{}, {Serial: "/dev/ttyTEST0", SlaveId: 248}, {Serial: "/dev/ttyTEST0", Parity: "X"}} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("expecting error for %+v", invalid)
+		}
+	}
+}
+
+func TestSharedBus(t *testing.T) {
+	a, err := openBus(Transport{Serial: "/dev/ttyTEST0", SlaveId: 1, BaudRate: 19200, Parity: "N"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := openBus(Transport{Serial: "/dev/ttyTEST0", SlaveId: 2, BaudRate: 19200, Parity: "N"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Error("expecting units on the same serial device to share the bus")
+	}
+	if _, err := openBus(Transport{Serial: "/dev/ttyTEST0", SlaveId: 3, BaudRate: 9600, Parity: "N"}); err == nil {
+		t.Error("expecting error for a different baud rate on the same bus")
+	}
+	if releaseBus("/dev/ttyTEST0") {
+		t.Error("expecting the bus to be left open for the other unit")
+	}
+	if !releaseBus("/dev/ttyTEST0") {
+		t.Error("expecting the last unit to close the bus")
+	}
+	// Each unit's requests go to its own slave ID
+	client := newSlaveClient(a.handler, 2)
+	_, _ = client.ReadCoils(0, 1)
+	if a.handler.SlaveId != 2 {
+		t.Errorf("expecting slave ID 2, got %d", a.handler.SlaveId)
+	}
+}
+
+func TestBusFailing(t *testing.T) {
+	a := Transport{Serial: "/dev/ttyTEST1", SlaveId: 1, BaudRate: 19200, Parity: "N"}
+	b := Transport{Serial: "/dev/ttyTEST1", SlaveId: 2, BaudRate: 19200, Parity: "N"}
+	for _, transport := range []Transport{a, b} {
+		if _, err := openBus(transport); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer releaseBus(a.Serial)
+	defer releaseBus(b.Serial)
+	if setBusFailing(a, true) {
+		t.Error("bus down with one unit answering")
+	}
+	if !setBusFailing(b, true) {
+		t.Error("bus not down with none of the units answering")
+	}
+	if setBusFailing(a, false) {
+		t.Error("bus down after a successful update")
+	}
+	if !setBusFailing(Transport{Serial: "/dev/ttyTEST2"}, true) {
+		t.Error("expecting a bus that isn't open to be down")
+	}
+}
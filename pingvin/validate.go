@@ -0,0 +1,360 @@
+package pingvin
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Coils and registers the daemon uses by address, e.g. for the status
+// and operating modes, with the symbols of the built-in map
+var (
+	requiredCoils = map[int]string{
+		1:  "COIL_AWAY",
+		2:  "COIL_AWAYL",
+		3:  "COIL_OVERPR",
+		6:  "COIL_MAX_H",
+		7:  "COIL_MAX_C",
+		10: "COIL_M_BOOST",
+		40: "COIL_ECO_MODE",
+	}
+	requiredRegisters = map[int]string{
+		1:   "HREG_T_OP1",
+		3:   "HREG_EFFECTIVE_TF",
+		4:   "HREG_EFFECTIVE_PF",
+		6:   "HREG_T_FRS",
+		7:   "HREG_T_SPLY_LTO",
+		8:   "HREG_T_SPLY",
+		9:   "HREG_T_WST",
+		10:  "HREG_T_EXT",
+		12:  "HREG_T_WR",
+		13:  "HREG_HUM_EXT",
+		29:  "HREG_LTO_N_SPLY",
+		30:  "HREG_LTO_N_EXT",
+		35:  "HREG_RH_MEAN",
+		36:  "HREG_ABSHUM10",
+		44:  "HREG_MODE",
+		49:  "HREG_OUTPUT",
+		134: "HREG_TE01_24H_AVG",
+		135: "HREG_T_SETPOINT",
+		774: "HREG_EFFECTIVE_CIRCULATION",
+	}
+)
+
+var (
+	metricNameRegexp  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	metricLabelRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	metricGroupRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+// Language of labels, e.g. en or fi
+var languageRegexp = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// Errors and warnings found in a map or when reading the unit
+type MapReport struct {
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+func (r *MapReport) errorf(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *MapReport) warnf(format string, args ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Check the map and its profiles, returns the errors found
+func (m *Map) Validate() error {
+	if report := m.Check(); len(report.Errors) > 0 {
+		return errors.New(strings.Join(report.Errors, "; "))
+	}
+	return nil
+}
+
+// Check the map and its profiles. All the problems found are reported,
+// problems of the map are not repeated for each profile
+func (m *Map) Check() MapReport {
+	report := MapReport{Errors: []string{}, Warnings: []string{}}
+	if m.Version != mapVersion {
+		report.errorf("unsupported map version %d, expecting %d", m.Version, mapVersion)
+	}
+	base := MapReport{}
+	m.check(&base, nil)
+	report.Errors = append(report.Errors, base.Errors...)
+	report.Warnings = append(report.Warnings, base.Warnings...)
+	names := []string{}
+	for i := range m.Profiles {
+		profile := &m.Profiles[i]
+		if len(profile.Name) == 0 {
+			report.errorf("profile %d: missing name", i+1)
+			continue
+		}
+		if slices.Contains(names, profile.Name) {
+			report.errorf("profile %s: duplicate name", profile.Name)
+			continue
+		}
+		names = append(names, profile.Name)
+		r := MapReport{}
+		m.check(&r, profile)
+		for _, e := range r.Errors {
+			if !slices.Contains(base.Errors, e) {
+				report.errorf("profile %s: %s", profile.Name, e)
+			}
+		}
+		for _, w := range r.Warnings {
+			if !slices.Contains(base.Warnings, w) {
+				report.warnf("profile %s: %s", profile.Name, w)
+			}
+		}
+	}
+	return report
+}
+
+// Check the map with the changes of profile, which may be nil
+func (m *Map) check(report *MapReport, profile *MapProfile) {
+	coils, registers, _, err := buildMap(m, profile)
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			for _, line := range strings.Split(e.Error(), "\n") {
+				report.errorf("%s", line)
+			}
+		}
+	}
+	// Addresses in order make the map easier to follow
+	mapcoils, mapregisters := m.Coils, m.Registers
+	if profile != nil {
+		mapcoils, mapregisters = profile.Coils, profile.Registers
+	}
+	for i := 1; i < len(mapcoils); i++ {
+		if mapcoils[i].Address < mapcoils[i-1].Address {
+			report.warnf("coil %d: listed after coil %d", mapcoils[i].Address, mapcoils[i-1].Address)
+		}
+	}
+	for i := 1; i < len(mapregisters); i++ {
+		if mapregisters[i].Address < mapregisters[i-1].Address {
+			report.warnf("register %d: listed after register %d", mapregisters[i].Address, mapregisters[i-1].Address)
+		}
+	}
+	for _, addr := range sortedKeys(requiredCoils) {
+		symbol := requiredCoils[addr]
+		if addr >= len(coils) || coils[addr].Reserved {
+			report.errorf("coil %d: missing, the daemon uses it as %s", addr, symbol)
+		} else if coils[addr].Symbol != symbol {
+			report.warnf("coil %d: %s, the daemon uses it as %s", addr, coils[addr].Symbol, symbol)
+		}
+	}
+	for _, addr := range sortedKeys(requiredRegisters) {
+		symbol := requiredRegisters[addr]
+		if addr >= len(registers) || registers[addr].Reserved {
+			report.errorf("register %d: missing, the daemon uses it as %s", addr, symbol)
+		} else if registers[addr].Symbol != symbol {
+			report.warnf("register %d: %s, the daemon uses it as %s", addr, registers[addr].Symbol, symbol)
+		}
+	}
+}
+
+func sortedKeys(m map[int]string) []int {
+	keys := []int{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Check that symbol is given and not seen before, and access is valid
+func checkSymbol(symbol, access string, seen map[string]bool) error {
+	if len(symbol) == 0 {
+		return errors.New("missing symbol")
+	}
+	if seen[symbol] {
+		return fmt.Errorf("duplicate symbol %s", symbol)
+	}
+	seen[symbol] = true
+	if len(access) > 0 && !slices.Contains([]string{AccessRead, AccessWrite, AccessConfirm}, access) {
+		return fmt.Errorf("%s: invalid access %q, expecting read, write or confirm", symbol, access)
+	}
+	return nil
+}
+
+func checkRegister(r MapRegister, seen map[string]bool) error {
+	if err := checkSymbol(r.Symbol, r.Access, seen); err != nil {
+		return err
+	}
+	if !slices.Contains(registerTypes, r.Type) {
+		return fmt.Errorf("%s: invalid type %q, expecting %s", r.Symbol, r.Type, strings.Join(registerTypes, ", "))
+	}
+	if r.Multiplier <= 0 {
+		return fmt.Errorf("%s: multiplier must be positive", r.Symbol)
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return fmt.Errorf("%s: min is greater than max", r.Symbol)
+	}
+	if len(r.Bits) > 16 {
+		return fmt.Errorf("%s: expecting at most 16 bits, got %d", r.Symbol, len(r.Bits))
+	}
+	if err := checkRegisterMetric(r.Metric); err != nil {
+		return fmt.Errorf("%s: %w", r.Symbol, err)
+	}
+	return checkLabels(r.Symbol, r.Labels, true)
+}
+
+// Check the metric of a register in the labelled layout, m may be nil
+func checkRegisterMetric(m *MapMetric) error {
+	if m == nil {
+		return nil
+	}
+	name := prometheus.BuildFQName("", "pingvin", m.Name)
+	if len(m.Name) == 0 || !metricNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid metric name %q", m.Name)
+	}
+	if slices.Contains(builtinFamilies, name) || strings.HasPrefix(name, "pingvin_modbus_") {
+		return fmt.Errorf("metric name %s is used by the daemon", m.Name)
+	}
+	if !metricGroupRegexp.MatchString(m.Group) {
+		return fmt.Errorf("metric %s: invalid group %q, expecting lowercase letters, digits and _", m.Name, m.Group)
+	}
+	if slices.Contains(builtinGroups, m.Group) {
+		return fmt.Errorf("metric %s: group %s is used by the daemon", m.Name, m.Group)
+	}
+	if len(m.Type) > 0 && m.Type != "gauge" && m.Type != "counter" {
+		return fmt.Errorf("metric %s: invalid type %q, expecting gauge or counter", m.Name, m.Type)
+	}
+	for label := range m.Labels {
+		// The device label is added to the metrics of each device
+		if !metricLabelRegexp.MatchString(label) || strings.HasPrefix(label, "__") || label == "device" {
+			return fmt.Errorf("metric %s: invalid label name %q", m.Name, label)
+		}
+	}
+	return nil
+}
+
+// Check that the registers of each metric family share the type, group,
+// help and label names, and have different label values
+func checkMetricFamilies(registers []*pingvinRegister) []error {
+	errs := []error{}
+	first := map[string]*pingvinRegister{}
+	help := map[string]string{}
+	series := map[string]string{}
+	for _, reg := range registers {
+		m := reg.Metric
+		if reg.Reserved || m == nil {
+			continue
+		}
+		other, ok := first[m.Name]
+		if !ok {
+			first[m.Name] = reg
+		} else if (m.Type == "counter") != (other.Metric.Type == "counter") || m.Group != other.Metric.Group {
+			errs = append(errs, fmt.Errorf("register %d: metric %s: type and group differ from register %d", reg.Address, m.Name, other.Address))
+			continue
+		} else if !slices.Equal(sortedLabels(m.Labels), sortedLabels(other.Metric.Labels)) {
+			errs = append(errs, fmt.Errorf("register %d: metric %s: label names differ from register %d", reg.Address, m.Name, other.Address))
+			continue
+		}
+		if len(m.Help) > 0 && len(help[m.Name]) > 0 && m.Help != help[m.Name] {
+			errs = append(errs, fmt.Errorf("register %d: metric %s: help differs from another register", reg.Address, m.Name))
+			continue
+		} else if len(m.Help) > 0 {
+			help[m.Name] = m.Help
+		}
+		id := m.Name + fmt.Sprint(labelValues(m.Labels))
+		if symbol, ok := series[id]; ok {
+			errs = append(errs, fmt.Errorf("register %d: metric %s: same labels as %s", reg.Address, m.Name, symbol))
+			continue
+		}
+		series[id] = reg.Symbol
+	}
+	return errs
+}
+
+// Check the languages of labels. Coil labels have no name
+func checkLabels(symbol string, labels map[string]MapLabel, named bool) error {
+	for lang, label := range labels {
+		if !languageRegexp.MatchString(lang) {
+			return fmt.Errorf("%s: invalid label language %q, expecting a language code, e.g. fi", symbol, lang)
+		}
+		if !named && len(label.Name) > 0 {
+			return fmt.Errorf("%s: %s label has a name, coils only have a description", symbol, lang)
+		}
+	}
+	return nil
+}
+
+// Check that the Prometheus metric name is valid and not used by
+// another coil or register
+func checkMetric(name, user string, seen map[string]string) error {
+	if !metricNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid Prometheus metric name %s", name)
+	}
+	if other, ok := seen[name]; ok {
+		return fmt.Errorf("Prometheus metric %s collides with %s", name, other)
+	}
+	seen[name] = user
+	return nil
+}
+
+// Read all coils and registers of the map from the unit. Addresses that
+// can't be read are reported as errors, values outside the limits or
+// the enumerated values of the map as warnings
+func (p *Pingvin) CheckUnit() MapReport {
+	report := MapReport{Errors: []string{}, Warnings: []string{}}
+	if _, err := p.readCoilRange(0, uint16(len(p.Coils))); err != nil {
+		// Find the coils that can't be read
+		for _, coil := range p.Coils {
+			if coil.Reserved {
+				continue
+			}
+			if _, err := p.readCoilRange(uint16(coil.Address), 1); err != nil {
+				report.errorf("coil %d (%s): %v", coil.Address, coil.Symbol, err)
+			}
+		}
+	}
+	addrs := p.pollAddresses([]string{TierFast, TierSlow, TierOnce})
+	for _, block := range planBlocks(addrs) {
+		if _, err := p.readRegisterRange(uint16(block.start), uint16(block.quantity)); err == nil {
+			continue
+		}
+		failed := len(report.Errors)
+		for _, reg := range p.Registers[block.start : block.start+block.quantity] {
+			if reg.Reserved {
+				continue
+			}
+			if _, err := p.readRegisterRange(uint16(reg.Address), 1); err != nil {
+				report.errorf("register %d (%s): %v", reg.Address, reg.Symbol, err)
+			}
+		}
+		// The reserved registers in between can't be read
+		if len(report.Errors) == failed {
+			report.warnf("registers %d-%d: can't be read with one request, the reserved registers in between may be unreadable", block.start, block.start+block.quantity-1)
+		}
+	}
+	for _, reg := range p.Registers {
+		if reg.Reserved || reg.LastUpdated == nil {
+			continue
+		}
+		if (reg.Min != nil && reg.Value < *reg.Min) || (reg.Max != nil && reg.Value > *reg.Max) {
+			report.warnf("register %d (%s): value %d outside the limits %s", reg.Address, reg.Symbol, reg.Value, formatLimits(reg.Min, reg.Max))
+		}
+		if _, ok := reg.Enum[reg.Value]; len(reg.Enum) > 0 && !ok {
+			report.warnf("register %d (%s): value %d not in the enumerated values", reg.Address, reg.Symbol, reg.Value)
+		}
+	}
+	return report
+}
+
+// Limits as "min - max", either may be missing
+func formatLimits(min, max *int) string {
+	limits := []string{"", ""}
+	if min != nil {
+		limits[0] = fmt.Sprint(*min)
+	}
+	if max != nil {
+		limits[1] = fmt.Sprint(*max)
+	}
+	return strings.TrimSpace(strings.Join(limits, " - "))
+}
@@ -0,0 +1,75 @@
+package pingvin
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckMap(t *testing.T) {
+	m, err := ReadMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := m.Check(); len(report.Errors) > 0 || len(report.Warnings) > 0 {
+		t.Fatalf("expecting no problems in the built-in map, got %v", report)
+	}
+	// Drop coil 2 and add problems at the end of the registers
+	m.Coils = slices.DeleteFunc(m.Coils, func(c MapCoil) bool { return c.Address == 2 })
+	m.Registers = append(m.Registers,
+		MapRegister{Address: 900, Symbol: "HREGX", Type: "uint16", Multiplier: 1},
+		MapRegister{Address: 901, Symbol: "hregx", Type: "uint16", Multiplier: 1},
+		MapRegister{Address: 902, Symbol: "HREG_Y", Type: "uint32", Multiplier: 1},
+		MapRegister{Address: 850, Symbol: "HREG_Z", Type: "uint16", Multiplier: 1},
+	)
+	report := m.Check()
+	expected := []string{
+		"coil 2: missing, the daemon uses it as COIL_AWAYL",
+		"Prometheus metric pingvin_hregx collides with register 900",
+		"HREG_Y: invalid type",
+	}
+	for _, e := range expected {
+		if !slices.ContainsFunc(report.Errors, func(s string) bool { return strings.Contains(s, e) }) {
+			t.Errorf("expecting error %q, got %v", e, report.Errors)
+		}
+	}
+	if len(report.Errors) != len(expected) {
+		t.Errorf("expecting %d errors, got %v", len(expected), report.Errors)
+	}
+	if !slices.Contains(report.Warnings, "register 850: listed after register 902") {
+		t.Errorf("expecting an order warning, got %v", report.Warnings)
+	}
+	// Problems of the base map are not repeated for the profile
+	m.Profiles[0].Registers = append(m.Profiles[0].Registers, MapRegister{Address: 135, Reserved: true})
+	report = m.Check()
+	if len(report.Errors) != len(expected)+1 || !strings.HasPrefix(report.Errors[len(report.Errors)-1], "profile pingvin-sw-before-1.18: register 135: missing") {
+		t.Errorf("expecting one profile error, got %v", report.Errors)
+	}
+}
+
+func TestCheckUnit(t *testing.T) {
+	p, client := newTestPingvin(t)
+	// Values within the limits of the map
+	client.registers[100], client.registers[102], client.registers[640] = 50, 50, 1
+	client.registers[733], client.registers[734] = 6, 1
+	if report := p.CheckUnit(); len(report.Errors) > 0 || len(report.Warnings) > 0 {
+		t.Fatalf("expecting no problems, got %v", report)
+	}
+	// The last register can't be read and the setpoint is out of range
+	client.registers = client.registers[:len(client.registers)-1]
+	client.registers[135] = 600
+	client.registers[215] = 8
+	report := p.CheckUnit()
+	if len(report.Errors) != 1 || !strings.HasPrefix(report.Errors[0], "register 798 (HREG_DO_BITMAP)") {
+		t.Errorf("expecting an error for register 798, got %v", report.Errors)
+	}
+	expected := []string{
+		"register 135 (HREG_T_SETPOINT): value 600 outside the limits 0 - 500",
+		"register 215 (HREG_WC1): value 8 not in the enumerated values",
+	}
+	for _, w := range expected {
+		if !slices.Contains(report.Warnings, w) {
+			t.Errorf("expecting warning %q, got %v", w, report.Warnings)
+		}
+	}
+}
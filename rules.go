@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0ranki/enervent-ctrl/pingvin"
+)
+
+// Number of evaluation log entries kept per rule
+const ruleLogSize = 50
+
+// Rule configuration
+type ruleConf struct {
+	Name       string          `yaml:"name" json:"name"`
+	DryRun     bool            `yaml:"dry_run" json:"dry_run"`       // Log the actions instead of running them
+	For        time.Duration   `yaml:"for" json:"-"`                 // How long the conditions must hold before the actions run
+	Conditions []ruleCondition `yaml:"conditions" json:"conditions"` // All conditions must be true
+	Actions    []ruleAction    `yaml:"actions" json:"actions"`       // Run once each time the conditions become true
+	Disabled   bool            `yaml:"disabled,omitempty" json:"-"`  // Don't evaluate the rule
+}
+
+// Compare a value to a threshold. value and compare_to are either
+// status fields (e.g. temp_setting, measurements.supply_intake, temp_delta)
+// or coil/register symbols (e.g. HREG_T_FRS, COIL_HEATING_EN).
+// Registers are scaled by the multiplier. Both values are read from
+// device, the default device if empty.
+// Once true, the condition stays true until the value crosses
+// the threshold by more than hysteresis
+type ruleCondition struct {
+	Value      string  `yaml:"value" json:"value"`
+	Op         string  `yaml:"op" json:"op"` // <, <=, >, >=, ==, !=
+	Threshold  float64 `yaml:"threshold" json:"threshold"`
+	CompareTo  string  `yaml:"compare_to,omitempty" json:"compare_to,omitempty"` // Threshold is added to this value
+	Hysteresis float64 `yaml:"hysteresis,omitempty" json:"hysteresis,omitempty"`
+	Device     string  `yaml:"device,omitempty" json:"device,omitempty"`
+}
+
+// Write a coil or a scaled register value by symbol, or switch the operating mode
+// of device, the default device if empty
+type ruleAction struct {
+	Write  string  `yaml:"write,omitempty" json:"write,omitempty"`
+	Value  float64 `yaml:"value" json:"value"`
+	Mode   string  `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Device string  `yaml:"device,omitempty" json:"device,omitempty"`
+}
+
+// Rule evaluation state
+type ruleState struct {
+	Conf      ruleConf           `json:"config"`
+	For       string             `json:"for"`        // Conf.For as text
+	Active    bool               `json:"active"`     // All conditions currently true
+	Since     *time.Time         `json:"since"`      // Conditions true since
+	Fired     bool               `json:"fired"`      // All actions run for the current activation
+	LastFired *time.Time         `json:"last_fired"` // Last time the actions were run
+	LastError string             `json:"last_error,omitempty"`
+	Values    map[string]float64 `json:"values"` // Values from the latest evaluation, DEVICE/VALUE for other than the default device
+	Log       []ruleLogEntry     `json:"log"`
+	latched   []bool             // Per condition results, for hysteresis
+	ran       int                // Actions run successfully for the current activation
+}
+
+type ruleLogEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+var (
+	rules     []*ruleState
+	ruleslock = &sync.Mutex{}
+	ruleOps   = []string{"<", "<=", ">", ">=", "==", "!="}
+)
+
+// Validate the rules in the configuration and set up their state
+func initRules() error {
+	names := map[string]bool{}
+	for i, conf := range config.Rules {
+		if len(conf.Name) == 0 {
+			return fmt.Errorf("rule #%d: name is required", i+1)
+		}
+		if names[conf.Name] {
+			return fmt.Errorf("rule %s: duplicate name", conf.Name)
+		}
+		names[conf.Name] = true
+		if len(conf.Conditions) == 0 || len(conf.Actions) == 0 {
+			return fmt.Errorf("rule %s: at least one condition and action is required", conf.Name)
+		}
+		for _, cond := range conf.Conditions {
+			if !slices.Contains(ruleOps, cond.Op) {
+				return fmt.Errorf("rule %s: invalid op %q, expecting one of %s", conf.Name, cond.Op, strings.Join(ruleOps, " "))
+			}
+			if len(cond.Value) == 0 {
+				return fmt.Errorf("rule %s: condition value is required", conf.Name)
+			}
+			if ruleDevice(cond.Device) == nil {
+				return fmt.Errorf("rule %s: unknown device %s", conf.Name, cond.Device)
+			}
+		}
+		for _, action := range conf.Actions {
+			d := ruleDevice(action.Device)
+			if d == nil {
+				return fmt.Errorf("rule %s: unknown device %s", conf.Name, action.Device)
+			}
+			if (len(action.Write) == 0) == (len(action.Mode) == 0) {
+				return fmt.Errorf("rule %s: action must have either write or mode", conf.Name)
+			}
+			if len(action.Mode) > 0 && !slices.Contains(pingvin.Modes, action.Mode) {
+				return fmt.Errorf("rule %s: invalid mode %s", conf.Name, action.Mode)
+			}
+			if len(action.Write) > 0 {
+				if _, err := d.device.Value(action.Write); err != nil {
+					return fmt.Errorf("rule %s: %s", conf.Name, err)
+				}
+			}
+		}
+		if conf.Disabled {
+			log.Println("Rule", conf.Name, "disabled")
+			continue
+		}
+		rules = append(rules, &ruleState{Conf: conf, For: conf.For.String(), latched: make([]bool, len(conf.Conditions)), Log: []ruleLogEntry{}})
+		log.Printf("Loaded rule %s (%d conditions, %d actions, dry run: %t)", conf.Name, len(conf.Conditions), len(conf.Actions), conf.DryRun)
+	}
+	return nil
+}
+
+// Evaluate the rules every interval seconds
+func runRules(ctx context.Context, interval int) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
+		}
+		evaluateRules(time.Now())
+	}
+}
+
+// Evaluate all rules against the latest values, run actions
+// of rules whose conditions have held long enough
+func evaluateRules(now time.Time) {
+	ruleslock.Lock()
+	defer ruleslock.Unlock()
+	// Values by the device id of the conditions, read once per evaluation
+	values := map[string]map[string]float64{}
+	for _, rule := range rules {
+		for _, cond := range rule.Conf.Conditions {
+			if _, ok := values[cond.Device]; !ok {
+				values[cond.Device] = statusValues(ruleDevice(cond.Device).device)
+			}
+		}
+	}
+	for _, rule := range rules {
+		rule.evaluate(now, values)
+	}
+}
+
+// The device of a rule condition or action, the default device
+// if id is empty. nil if not found
+func ruleDevice(id string) *managedDevice {
+	if len(id) == 0 {
+		return devices[0]
+	}
+	return findDevice(id)
+}
+
+func (rule *ruleState) evaluate(now time.Time, values map[string]map[string]float64) {
+	rule.Values = map[string]float64{}
+	active := true
+	for i, cond := range rule.Conf.Conditions {
+		result, err := cond.evaluate(values[cond.Device], rule.latched[i], rule.Values)
+		if err != nil {
+			if err.Error() != rule.LastError {
+				rule.logf(now, "ERROR: %s", err)
+			}
+			rule.LastError = err.Error()
+			result = false
+		}
+		rule.latched[i] = result
+		active = active && result
+	}
+	if active && !rule.Active {
+		rule.Since = &now
+		rule.logf(now, "Conditions met, waiting %s", rule.Conf.For)
+	} else if !active && rule.Active {
+		rule.Since = nil
+		rule.Fired = false
+		rule.ran = 0
+		rule.logf(now, "Conditions no longer met")
+	}
+	rule.Active = active
+	if !active || rule.Fired || now.Sub(*rule.Since) < rule.Conf.For {
+		return
+	}
+	rule.LastFired = &now
+	if rule.Conf.DryRun || config.ReadOnly {
+		rule.Fired = true
+		for _, action := range rule.Conf.Actions {
+			rule.logf(now, "Dry run: would %s", action)
+		}
+		return
+	}
+	rule.LastError = ""
+	// A failed action is retried on the next evaluation, the actions
+	// before it are not run again
+	for ; rule.ran < len(rule.Conf.Actions); rule.ran++ {
+		action := rule.Conf.Actions[rule.ran]
+		if err := action.run(rule.Conf.Name); err != nil {
+			rule.LastError = err.Error()
+			rule.logf(now, "ERROR: %s failed: %s", action, err)
+			return
+		}
+		rule.logf(now, "Ran %s", action)
+	}
+	rule.Fired = true
+}
+
+// Evaluate the condition, the values used are stored in used
+func (cond ruleCondition) evaluate(values map[string]float64, latched bool, used map[string]float64) (bool, error) {
+	value, ok := values[cond.Value]
+	if !ok {
+		return false, fmt.Errorf("unknown value %s", cond.key(cond.Value))
+	}
+	used[cond.key(cond.Value)] = value
+	threshold := cond.Threshold
+	if len(cond.CompareTo) > 0 {
+		ref, ok := values[cond.CompareTo]
+		if !ok {
+			return false, fmt.Errorf("unknown value %s", cond.key(cond.CompareTo))
+		}
+		used[cond.key(cond.CompareTo)] = ref
+		threshold += ref
+	}
+	if latched {
+		// Require the value to cross the threshold by hysteresis before
+		// the condition turns false
+		if cond.Op == ">" || cond.Op == ">=" {
+			threshold -= cond.Hysteresis
+		} else if cond.Op == "<" || cond.Op == "<=" {
+			threshold += cond.Hysteresis
+		}
+	}
+	switch cond.Op {
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "==":
+		return value == threshold, nil
+	case "!=":
+		return value != threshold, nil
+	}
+	return false, fmt.Errorf("invalid op %s", cond.Op)
+}
+
+// Name of value in the evaluation results, prefixed with
+// the device id for other than the default device
+func (cond ruleCondition) key(value string) string {
+	if len(cond.Device) == 0 {
+		return value
+	}
+	return cond.Device + "/" + value
+}
+
+// Run the action and record it in the audit log
+func (action ruleAction) run(rule string) error {
+	device := ruleDevice(action.Device).device
+	entry := auditEntry{User: "rule:" + rule, Device: action.Device, Action: "mode", Target: "mode", Requested: action.Mode}
+	var err error
+	if len(action.Mode) > 0 {
+		entry.Old = device.CurrentMode()
+		_, err = device.SetMode(action.Mode)
+		entry.Value = device.CurrentMode()
+	} else {
+		entry.Action, entry.Target, entry.Requested = "value", action.Write, action.Value
+		entry.Old, _ = device.Value(action.Write)
+		err = device.WriteValue(action.Write, action.Value)
+		entry.Value, _ = device.Value(action.Write)
+	}
+	entry.setResult(err)
+	audit(entry)
+	return err
+}
+
+func (action ruleAction) String() string {
+	s := fmt.Sprintf("write %s = %v", action.Write, action.Value)
+	if len(action.Mode) > 0 {
+		s = "switch mode to " + action.Mode
+	}
+	if len(action.Device) > 0 {
+		s += " on " + action.Device
+	}
+	return s
+}
+
+// Add an entry to the evaluation log, dropping the oldest
+// entry if the log is full
+func (rule *ruleState) logf(now time.Time, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	device.Debug.Println("Rule", rule.Conf.Name+":", msg)
+	if strings.HasPrefix(msg, "ERROR") || strings.HasPrefix(msg, "Ran") || strings.HasPrefix(msg, "Dry run") {
+		log.Println("Rule", rule.Conf.Name+":", msg)
+	}
+	rule.Log = append(rule.Log, ruleLogEntry{now, msg})
+	if len(rule.Log) > ruleLogSize {
+		rule.Log = rule.Log[len(rule.Log)-ruleLogSize:]
+	}
+}
+
+// Values available for rule conditions: numeric and boolean fields
+// of the status, temp_delta (room temperature - setpoint), and all
+// coils and registers by symbol. Stale values are left out, so
+// conditions using them fail instead of acting on old data
+func statusValues(device *pingvin.Pingvin) map[string]float64 {
+	values := map[string]float64{}
+	current := device.CurrentStatus()
+	fresh := current.SnapshotAge != nil && *current.SnapshotAge <= device.StaleAfter().Seconds()
+	if device.Status != nil && fresh {
+		data, err := json.Marshal(device.Status)
+		if err == nil {
+			status := map[string]any{}
+			_ = json.Unmarshal(data, &status)
+			flattenValues("", status, values)
+		}
+		values["temp_delta"] = float64(device.Status.Measurements.Roomtemp1 - device.Status.TempSetting)
+	}
+	for _, coil := range device.Coils {
+		if v, err := device.FreshValue(coil.Symbol); err == nil {
+			values[coil.Symbol] = v
+		}
+	}
+	for _, reg := range device.Registers {
+		if v, err := device.FreshValue(reg.Symbol); err == nil {
+			values[reg.Symbol] = v
+		}
+	}
+	return values
+}
+
+// Add numeric and boolean values from a decoded JSON object to values,
+// nested objects are prefixed with the parent key, e.g. measurements.room_temp1
+func flattenValues(prefix string, obj map[string]any, values map[string]float64) {
+	for key, val := range obj {
+		switch v := val.(type) {
+		case float64:
+			values[prefix+key] = v
+		case bool:
+			values[prefix+key] = 0
+			if v {
+				values[prefix+key] = 1
+			}
+		case map[string]any:
+			flattenValues(prefix+key+".", v, values)
+		}
+	}
+}
+
+// /api/v1/rules endpoint
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ruleslock.Lock()
+	defer ruleslock.Unlock()
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/rules"), "/")
+	if len(name) == 0 {
+		_ = json.NewEncoder(w).Encode(rules)
+		return
+	}
+	for _, rule := range rules {
+		if rule.Conf.Name == name {
+			_ = json.NewEncoder(w).Encode(rule)
+			return
+		}
+	}
+	http.Error(w, "Rule "+name+" not found", http.StatusNotFound)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/0ranki/enervent-ctrl/pingvin"
+)
+
+func TestRuleConditionHysteresis(t *testing.T) {
+	cond := ruleCondition{Value: "temp_delta", Op: ">", Threshold: 0.5, Hysteresis: 0.3}
+	tests := []struct {
+		value   float64
+		latched bool
+		want    bool
+	}{
+		{0.4, false, false},
+		{0.6, false, true},
+		{0.4, true, true}, // Within hysteresis
+		{0.1, true, false},
+	}
+	for _, test := range tests {
+		got, err := cond.evaluate(map[string]float64{"temp_delta": test.value}, test.latched, map[string]float64{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%v > 0.5 (latched: %t) is %t, expecting %t", test.value, test.latched, got, test.want)
+		}
+	}
+}
+
+func TestRuleConditionCompareTo(t *testing.T) {
+	cond := ruleCondition{Value: "measurements.room_temp1", Op: ">=", Threshold: 0.5, CompareTo: "temp_setting"}
+	values := map[string]float64{"measurements.room_temp1": 21.5, "temp_setting": 21}
+	if got, _ := cond.evaluate(values, false, map[string]float64{}); !got {
+		t.Error("21.5 >= 21 + 0.5 is false, expecting true")
+	}
+	if _, err := cond.evaluate(map[string]float64{}, false, map[string]float64{}); err == nil {
+		t.Error("expecting error for unknown value")
+	}
+}
+
+func TestRuleDuration(t *testing.T) {
+	rule := &ruleState{
+		Conf: ruleConf{
+			Name:       "test",
+			DryRun:     true,
+			For:        15 * time.Minute,
+			Conditions: []ruleCondition{{Value: "measurements.supply_intake", Op: ">", Threshold: 10}},
+			Actions:    []ruleAction{{Write: "COIL_HEATING_EN", Value: 0}},
+		},
+		latched: []bool{false},
+	}
+	start := time.Now()
+	warm := map[string]map[string]float64{"": {"measurements.supply_intake": 12}}
+	rule.evaluate(start, warm)
+	if !rule.Active || rule.Fired {
+		t.Fatal("rule should be active but not fired")
+	}
+	rule.evaluate(start.Add(10*time.Minute), warm)
+	if rule.Fired {
+		t.Fatal("rule fired before the duration")
+	}
+	rule.evaluate(start.Add(15*time.Minute), warm)
+	if !rule.Fired || rule.LastFired == nil {
+		t.Fatal("rule not fired after the duration")
+	}
+	rule.evaluate(start.Add(16*time.Minute), map[string]map[string]float64{"": {"measurements.supply_intake": 8}})
+	if rule.Active || rule.Fired {
+		t.Error("rule should reset when the conditions are no longer met")
+	}
+	if len(rule.Log) != 3 {
+		t.Errorf("rule log has %d entries, expecting 3: %v", len(rule.Log), rule.Log)
+	}
+}
+
+func TestRuleDevices(t *testing.T) {
+	devices = []*managedDevice{{conf: deviceConf{Id: defaultDeviceId}, device: &pingvin.Pingvin{}}, {conf: deviceConf{Id: "upstairs"}, device: &pingvin.Pingvin{}}}
+	defer func() { rules = nil }()
+	config = Conf{Rules: []ruleConf{{
+		Name:       "test",
+		Conditions: []ruleCondition{{Value: "temp_delta", Op: ">", Threshold: 0.5, Device: "upstairs"}},
+		Actions:    []ruleAction{{Mode: "away", Device: "downstairs"}},
+	}}}
+	if err := initRules(); err == nil {
+		t.Error("expecting error for an unknown device")
+	}
+	config.Rules[0].Actions[0].Device = "upstairs"
+	if err := initRules(); err != nil {
+		t.Fatal(err)
+	}
+	if ruleDevice("") != devices[0] || ruleDevice("upstairs") != devices[1] {
+		t.Error("unexpected rule devices")
+	}
+	// The conditions are evaluated against the values of their device
+	rule := rules[0]
+	rule.Conf.DryRun = true
+	rule.evaluate(time.Now(), map[string]map[string]float64{"": {"temp_delta": 0}, "upstairs": {"temp_delta": 1}})
+	if !rule.Active || rule.Values["upstairs/temp_delta"] != 1 {
+		t.Errorf("unexpected state %t, values %v", rule.Active, rule.Values)
+	}
+	if s := rule.Conf.Actions[0].String(); s != "switch mode to away on upstairs" {
+		t.Errorf("unexpected action %q", s)
+	}
+}
+
+// A failed action is retried until it succeeds
+func TestRuleActionRetry(t *testing.T) {
+	devices = []*managedDevice{{conf: deviceConf{Id: defaultDeviceId}, device: &pingvin.Pingvin{}}}
+	config = Conf{}
+	rule := &ruleState{
+		Conf: ruleConf{
+			Name:       "test",
+			Conditions: []ruleCondition{{Value: "temp_delta", Op: ">", Threshold: 0.5}},
+			Actions:    []ruleAction{{Write: "COIL_NOT_FOUND", Value: 0}},
+		},
+		latched: []bool{false},
+	}
+	values := map[string]map[string]float64{"": {"temp_delta": 1}}
+	start := time.Now()
+	rule.evaluate(start, values)
+	if rule.Fired || rule.LastError == "" {
+		t.Fatalf("failed action marked as fired, last error %q", rule.LastError)
+	}
+	rule.evaluate(start.Add(time.Minute), values)
+	if len(rule.Log) != 3 || rule.Fired {
+		t.Errorf("action not retried, log %v", rule.Log)
+	}
+	rule.evaluate(start.Add(2*time.Minute), map[string]map[string]float64{"": {"temp_delta": 0}})
+	if rule.ran != 0 || rule.Fired {
+		t.Error("rule not reset when the conditions are no longer met")
+	}
+}
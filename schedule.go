@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0ranki/enervent-ctrl/client"
+)
+
+// Number of week timer slots of the unit
+const scheduleSlots = 20
+
+// Days of the week timer bitfield from Monday, bit 0 is Sunday
+var weekdays = []int{1, 2, 3, 4, 5, 6, 0}
+
+// Week timer slot
+type scheduleSlot struct {
+	Slot     int      `json:"slot"`
+	Days     []string `json:"days"`
+	Start    string   `json:"start"` // HH:MM
+	Stop     string   `json:"stop"`
+	Function string   `json:"function"`
+	Value    int      `json:"function_value"`
+}
+
+// Registers of a week timer slot, in the order of the fields of the unit
+func slotSymbols(slot int) []string {
+	return []string{
+		fmt.Sprintf("HREG_DAY_WC%d", slot),
+		fmt.Sprintf("HREG_STA_HOUR_WC%d", slot),
+		fmt.Sprintf("HREG_STA_MIN_WC%d", slot),
+		fmt.Sprintf("HREG_STO_HOUR_WC%d", slot),
+		fmt.Sprintf("HREG_STO_MIN_WC%d", slot),
+		fmt.Sprintf("HREG_WC%d", slot),
+	}
+}
+
+// Registers of a week timer slot, error if some of them are missing
+func slotRegisters(registers []client.Register, slot int) ([]*client.Register, error) {
+	regs := []*client.Register{}
+	for _, symbol := range slotSymbols(slot) {
+		reg, err := findRegister(registers, symbol)
+		if err != nil {
+			return nil, fmt.Errorf("week timer slot %d: %w", slot, err)
+		}
+		regs = append(regs, reg)
+	}
+	return regs, nil
+}
+
+func readSlot(registers []client.Register, slot int) (*scheduleSlot, error) {
+	regs, err := slotRegisters(registers, slot)
+	if err != nil {
+		return nil, err
+	}
+	s := &scheduleSlot{
+		Slot:     slot,
+		Days:     []string{},
+		Start:    fmt.Sprintf("%02d:%02d", regs[1].Value, regs[2].Value),
+		Stop:     fmt.Sprintf("%02d:%02d", regs[3].Value, regs[4].Value),
+		Function: registerText(regs[5]),
+		Value:    regs[5].Value,
+	}
+	for _, day := range weekdays {
+		if regs[0].Value>>day&0x1 == 1 {
+			s.Days = append(s.Days, dayName(regs[0], day))
+		}
+	}
+	if len(s.Function) == 0 {
+		s.Function = strconv.Itoa(s.Value)
+	}
+	return s, nil
+}
+
+// Name of a day of the week timer, from the bit names of the map
+func dayName(days *client.Register, bit int) string {
+	if bit < len(days.Bits) {
+		return days.Bits[bit]
+	}
+	return time.Weekday(bit).String()
+}
+
+// Short form of the days of a slot, e.g. Mon-Fri or Mon,Wed
+func formatDays(days []string) string {
+	if len(days) == 0 {
+		return "-"
+	}
+	short := []string{}
+	for _, day := range days {
+		short = append(short, day[:min(3, len(day))])
+	}
+	if len(short) == 7 {
+		return "daily"
+	}
+	// Consecutive days from Monday, e.g. Mon-Fri
+	all := []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+	for i := range all {
+		if len(short) > 2 && i+len(short) <= len(all) && strings.Join(all[i:i+len(short)], ",") == strings.Join(short, ",") {
+			return short[0] + "-" + short[len(short)-1]
+		}
+	}
+	return strings.Join(short, ",")
+}
+
+// Parse days of the week timer, e.g. mon-fri, sat,sun, daily or none.
+// Returns the value of the days bitfield
+func parseDays(s string) (int, error) {
+	s = strings.ToLower(s)
+	switch s {
+	case "daily", "all":
+		return 0x7f, nil
+	case "none", "-":
+		return 0, nil
+	}
+	day := func(name string) (int, error) {
+		for i, d := range weekdays {
+			if len(name) >= 2 && strings.HasPrefix(strings.ToLower(time.Weekday(d).String()), name) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid day %s", name)
+	}
+	value := 0
+	for _, part := range strings.Split(s, ",") {
+		first, last, isrange := strings.Cut(strings.TrimSpace(part), "-")
+		from, err := day(first)
+		if err != nil {
+			return 0, err
+		}
+		to := from
+		if isrange {
+			if to, err = day(last); err != nil {
+				return 0, err
+			}
+		}
+		// Ranges may wrap over the week, e.g. fri-mon
+		for i := from; ; i = (i + 1) % len(weekdays) {
+			value |= 1 << weekdays[i]
+			if i == to {
+				break
+			}
+		}
+	}
+	return value, nil
+}
+
+// Parse a time of day, e.g. 07:30. Returns the hour and minute
+func parseTimeOfDay(s string) (int, int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time %s, expecting HH:MM", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// Parse the function of a slot by name, e.g. away or "away long", or value
+func parseFunction(reg *client.Register, s string) (int, error) {
+	normalize := func(name string) string {
+		return strings.NewReplacer(" ", "", "_", "", "-", "").Replace(strings.ToLower(name))
+	}
+	for value, name := range reg.Enum {
+		if normalize(name) == normalize(s) {
+			return value, nil
+		}
+	}
+	if value, err := strconv.Atoi(s); err == nil {
+		return value, nil
+	}
+	names := []string{}
+	for _, name := range reg.Enum {
+		names = append(names, strings.ReplaceAll(strings.ToLower(name), " ", "-"))
+	}
+	slices.Sort(names)
+	return 0, fmt.Errorf("invalid function %s, expecting one of %s", s, strings.Join(names, ", "))
+}
+
+// List or change the week timer slots
+func scheduleCommand(ctx context.Context, args []string) error {
+	if len(args) > 0 && args[0] == "set" {
+		return scheduleSetCommand(ctx, args[1:])
+	}
+	flags, opts := cliFlagSet("schedule list", "schedule list [-json] [-all]\nschedule set [-days DAYS] [-start HH:MM] [-stop HH:MM] [-function FUNCTION] SLOT")
+	all := flags.Bool("all", false, "Also list the unused slots")
+	if len(args) == 0 || args[0] != "list" {
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+	parseCLIFlags(flags, args[1:], 0, 0)
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	registers, err := b.Registers(ctx)
+	if err != nil {
+		return err
+	}
+	slots := []*scheduleSlot{}
+	for slot := 1; slot <= scheduleSlots; slot++ {
+		s, err := readSlot(registers, slot)
+		if err != nil {
+			return err
+		}
+		if *all || s.Value != 0 || len(s.Days) > 0 {
+			slots = append(slots, s)
+		}
+	}
+	if opts.json {
+		return printJSON(slots)
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "SLOT\tDAYS\tSTART\tSTOP\tFUNCTION")
+	for _, s := range slots {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", s.Slot, formatDays(s.Days), s.Start, s.Stop, s.Function)
+	}
+	return tw.Flush()
+}
+
+// Change a week timer slot. The fields not given are kept, the
+// registers are written in one atomic batch
+func scheduleSetCommand(ctx context.Context, args []string) error {
+	flags, opts := cliFlagSet("schedule set", "schedule set [-days DAYS] [-start HH:MM] [-stop HH:MM] [-function FUNCTION] SLOT",
+		"DAYS is e.g. mon-fri, sat,sun, daily or none. FUNCTION is e.g. away, boost or off")
+	days := flags.String("days", "", "Days of the week when the slot is active")
+	start := flags.String("start", "", "Start time, e.g. 07:00")
+	stop := flags.String("stop", "", "Stop time, e.g. 16:30")
+	function := flags.String("function", "", "Function of the slot")
+	confirm := flags.Bool("confirm", false, "Confirm the writes of registers with the confirm write policy")
+	// The slot may be given before the flags
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = append(slices.Clone(args[1:]), args[0])
+	}
+	parseCLIFlags(flags, args, 1, 1)
+	slot, err := strconv.Atoi(flags.Arg(0))
+	if err != nil || slot < 1 || slot > scheduleSlots {
+		fmt.Fprintf(os.Stderr, "Invalid slot %s, expecting 1-%d\n", flags.Arg(0), scheduleSlots)
+		os.Exit(exitUsage)
+	}
+	if len(*days) == 0 && len(*start) == 0 && len(*stop) == 0 && len(*function) == 0 {
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+	b, done, err := opts.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	registers, err := b.Registers(ctx)
+	if err != nil {
+		return err
+	}
+	regs, err := slotRegisters(registers, slot)
+	if err != nil {
+		return err
+	}
+	values := map[int]int{}
+	if len(*days) > 0 {
+		if values[0], err = parseDays(*days); err != nil {
+			return err
+		}
+	}
+	if len(*start) > 0 {
+		if values[1], values[2], err = parseTimeOfDay(*start); err != nil {
+			return err
+		}
+	}
+	if len(*stop) > 0 {
+		if values[3], values[4], err = parseTimeOfDay(*stop); err != nil {
+			return err
+		}
+	}
+	if len(*function) > 0 {
+		if values[5], err = parseFunction(regs[5], *function); err != nil {
+			return err
+		}
+	}
+	req := client.BatchRequest{Atomic: true}
+	for i, reg := range regs {
+		if value, ok := values[i]; ok && value != reg.Value {
+			req.Writes = append(req.Writes, client.BatchWrite{Type: "register", Address: reg.Address, Value: value, Confirm: *confirm})
+		}
+	}
+	if len(req.Writes) > 0 {
+		resp, err := b.Batch(ctx, req)
+		if err != nil {
+			return batchError(resp, err)
+		}
+		for _, res := range resp.Results {
+			for _, reg := range regs {
+				if reg.Address == res.Address {
+					reg.Value = res.Value
+				}
+			}
+		}
+	}
+	s, err := readSlot(registers, slot)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(s)
+	}
+	fmt.Printf("Slot %d: %s %s-%s %s\n", s.Slot, formatDays(s.Days), s.Start, s.Stop, s.Function)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/0ranki/enervent-ctrl/client"
+)
+
+func TestParseDays(t *testing.T) {
+	tests := map[string]int{
+		"mon-fri": 0b0111110,
+		"sat,sun": 0b1000001,
+		"Fri-Mon": 0b1100011,
+		"tu,th":   0b0010100,
+		"daily":   0b1111111,
+		"none":    0,
+		"wed-wed": 0b0001000,
+		"sunday":  0b0000001,
+	}
+	for s, expected := range tests {
+		if value, err := parseDays(s); err != nil || value != expected {
+			t.Errorf("%s: expecting %07b, got %07b, %v", s, expected, value, err)
+		}
+	}
+	for _, s := range []string{"", "m", "mon-", "moon", "mon,,fri"} {
+		if value, err := parseDays(s); err == nil {
+			t.Errorf("%s: expecting an error, got %07b", s, value)
+		}
+	}
+}
+
+func TestFormatDays(t *testing.T) {
+	tests := map[string][]string{
+		"Mon-Fri":     {"Monday", "Tuesday", "Wednesday", "Thursday", "Friday"},
+		"Sat,Sun":     {"Saturday", "Sunday"},
+		"Mon,Wed,Fri": {"Monday", "Wednesday", "Friday"},
+		"daily":       {"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"},
+		"-":           {},
+	}
+	for expected, days := range tests {
+		if s := formatDays(days); s != expected {
+			t.Errorf("%v: expecting %s, got %s", days, expected, s)
+		}
+	}
+}
+
+func TestReadSlot(t *testing.T) {
+	days := []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+	registers := []client.Register{
+		{Symbol: "HREG_DAY_WC2", Value: 0b0111110, Bits: days},
+		{Symbol: "HREG_STA_HOUR_WC2", Value: 7},
+		{Symbol: "HREG_STA_MIN_WC2", Value: 30},
+		{Symbol: "HREG_STO_HOUR_WC2", Value: 16},
+		{Symbol: "HREG_STO_MIN_WC2", Value: 5},
+		{Symbol: "HREG_WC2", Value: 2, Enum: map[int]string{0: "Off", 1: "Away", 2: "Away long"}},
+	}
+	slot, err := readSlot(registers, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprintf("%s %s-%s %s %d", formatDays(slot.Days), slot.Start, slot.Stop, slot.Function, slot.Value); s != "Mon-Fri 07:30-16:05 Away long 2" {
+		t.Errorf("unexpected slot %s", s)
+	}
+	if _, err := readSlot(registers, 1); err == nil {
+		t.Error("expecting an error for a slot not in the map")
+	}
+	if value, err := parseFunction(&registers[5], "away_LONG"); err != nil || value != 2 {
+		t.Errorf("expecting 2, got %d, %v", value, err)
+	}
+	if _, err := parseFunction(&registers[5], "boost"); err == nil {
+		t.Error("expecting an error for an unknown function")
+	}
+}
@@ -0,0 +1,147 @@
+// Texts of the page in other languages than English
+const translations = {
+    fi: {
+        "Configuration drift, checked at ": "Asetusten poikkeamat, tarkistettu ",
+        "Revert selected": "Palauta valitut",
+        "Pin current configuration": "Lukitse nykyiset asetukset",
+        "Symbol": "Symboli",
+        "Baseline": "Perustaso",
+        "Current": "Nykyinen",
+        "Since": "Alkaen",
+        "No baseline pinned": "Perustasoa ei ole lukittu",
+        "Baseline pinned at ": "Perustaso lukittu ",
+        "No drift": "Ei poikkeamia",
+        "Write the baseline values of the selected registers to the unit?": "Kirjoitetaanko valittujen rekisterien perustason arvot laitteelle?",
+        "Replace the baseline with the current configuration?": "Korvataanko perustaso nykyisillä asetuksilla?",
+    },
+}
+
+// The lang parameter of the page or the language of the browser,
+// ?device=ID shows another device than the default one
+const params = new URLSearchParams(document.location.search)
+const lang = params.get("lang") || navigator.language.split("-")[0]
+const api = params.has("device") ? `/api/v1/devices/${encodeURIComponent(params.get("device"))}/drift` : "/api/v1/drift"
+
+function translate(text) {
+    if (translations[lang] && translations[lang][text]) {
+        return translations[lang][text]
+    }
+    return text
+}
+
+document.documentElement.lang = lang
+for (const id of ["caption", "revert", "pin", "th_symbol", "th_baseline", "th_current", "th_since"]) {
+    document.getElementById(id).innerHTML = translate(document.getElementById(id).innerHTML)
+}
+
+function formatTime(time) {
+    return time ? new Date(time).toLocaleString(lang) : ""
+}
+
+// Coils are shown as on or off
+function formatValue(entry, value) {
+    if (entry.type == "coil") {
+        return value ? "on" : "off"
+    }
+    return value
+}
+
+// Fill the table, keeping the symbols that were selected
+function showDrift(data) {
+    document.getElementById("time").innerHTML = formatTime(data.last_check)
+    if (data.pinned) {
+        document.getElementById("pinned").innerHTML = translate("Baseline pinned at ") + formatTime(data.pinned)
+    } else {
+        document.getElementById("pinned").innerHTML = translate("No baseline pinned")
+    }
+    selected = selectedSymbols()
+    drifttable = document.getElementById("drifttable")
+    drifttable.innerHTML = ""
+    if (data.pinned && data.drift.length == 0) {
+        tablerow = document.createElement("tr")
+        td = document.createElement("td")
+        td.colSpan = 5
+        td.appendChild(document.createTextNode(translate("No drift")))
+        tablerow.appendChild(td)
+        drifttable.appendChild(tablerow)
+    }
+    for (const entry of data.drift) {
+        tablerow = document.createElement("tr")
+        td = document.createElement("td")
+        checkbox = document.createElement("input")
+        checkbox.type = "checkbox"
+        checkbox.value = entry.symbol
+        checkbox.checked = selected.includes(entry.symbol)
+        // Entries that can't be reverted, e.g. unknown symbols
+        checkbox.disabled = Boolean(entry.error)
+        td.appendChild(checkbox)
+        tablerow.appendChild(td)
+        current = entry.error ? entry.error : formatValue(entry, entry.current)
+        for (const text of [entry.symbol, formatValue(entry, entry.baseline), current, formatTime(entry.since)]) {
+            td = document.createElement("td")
+            td.appendChild(document.createTextNode(text))
+            tablerow.appendChild(td)
+        }
+        tablerow.className = "highlightrow"
+        drifttable.appendChild(tablerow)
+    }
+}
+
+function selectedSymbols() {
+    return Array.from(document.querySelectorAll("#drifttable input:checked")).map((checkbox) => checkbox.value)
+}
+
+function getDrift() {
+    fetch(api)
+    .then((response) => {
+        if (!response.ok) {
+            throw new Error(`Error fetching data: ${response.status}`)
+        }
+        return response.json()
+    })
+    .then(showDrift)
+    .catch((error) => {
+        document.getElementById("result").innerHTML = error.message
+    })
+    // The unit is checked every few minutes, no need to refresh often
+    setTimeout(getDrift, 30*1000)
+}
+
+// POST to the API and show the result of the request
+function post(url, body) {
+    document.getElementById("result").innerHTML = ""
+    fetch(url, {method: "POST", body: body})
+    .then((response) => {
+        if (!response.ok) {
+            return response.text().then((text) => {
+                throw new Error(`${response.status}: ${text}`)
+            })
+        }
+        return fetch(api).then((response) => response.json()).then(showDrift)
+    })
+    .catch((error) => {
+        document.getElementById("result").innerHTML = error.message
+    })
+}
+
+// The revert is confirmed here, so registers with the confirm
+// write policy are also written
+document.getElementById("revert").addEventListener("click", () => {
+    symbols = selectedSymbols()
+    if (symbols.length == 0 || !window.confirm(translate("Write the baseline values of the selected registers to the unit?"))) {
+        return
+    }
+    post(`${api}/revert?confirm=true`, JSON.stringify({symbols: symbols}))
+})
+
+document.getElementById("pin").addEventListener("click", () => {
+    if (window.confirm(translate("Replace the baseline with the current configuration?"))) {
+        post(`${api}/baseline`, null)
+    }
+})
+
+document.getElementById("select_all").addEventListener("change", (event) => {
+    for (const checkbox of document.querySelectorAll("#drifttable input:enabled")) {
+        checkbox.checked = event.currentTarget.checked
+    }
+})
@@ -1,3 +1,37 @@
+// Texts of the page in other languages than English
+const translations = {
+    fi: {
+        "Coil values at ": "Kelojen arvot ",
+        "Holding register values at ": "Rekisterien arvot ",
+        "Include reserved": "Näytä varatut",
+        "Address": "Osoite",
+        "Value": "Arvo",
+        "Symbol": "Symboli",
+        "Description": "Kuvaus",
+        "Coils": "Kelat",
+        "Registers": "Rekisterit",
+        "Page not found": "Sivua ei löydy",
+    },
+}
+
+// The lang parameter of the page, e.g. /registers/?lang=fi, or the
+// language of the browser. The API chooses the same language for the
+// names and descriptions
+const params = new URLSearchParams(document.location.search)
+const lang = params.get("lang") || navigator.language.split("-")[0]
+
+function translate(text) {
+    if (translations[lang] && translations[lang][text]) {
+        return translations[lang][text]
+    }
+    return text
+}
+
+document.documentElement.lang = lang
+for (const id of ["incl_res_label", "th_address", "th_value", "th_symbol", "th_description"]) {
+    document.getElementById(id).innerHTML = translate(document.getElementById(id).innerHTML)
+}
+
 function zeroPad(number) {
     return ("0" + number).slice(-2)
 }
@@ -110,20 +144,27 @@ function getData() {
     // change api url based on which we're looking at
     if (document.location.pathname == "/coils/") {
         url = "/api/v1/coils"
-        document.getElementById("title").innerHTML = "Coils | Enervent Pingvin Kotilämpö"
-        document.getElementById('caption').innerHTML = "Coil values at "
+        document.getElementById("title").innerHTML = `${translate("Coils")} | Enervent Pingvin Kotilämpö`
+        document.getElementById('caption').innerHTML = translate("Coil values at ")
     }
     else if (document.location.pathname == "/registers/") {
         url = "/api/v1/registers"
-        document.getElementById("title").innerHTML = "Registers | Enervent Pingvin Kotilämpö"
+        document.getElementById("title").innerHTML = `${translate("Registers")} | Enervent Pingvin Kotilämpö`
+        document.getElementById('caption').innerHTML = translate("Holding register values at ")
     }
     else {
-        document.getElementById("data").innerHTML = 'Page not found'
+        document.getElementById("data").innerHTML = translate('Page not found')
         error = true
     }
     if (!error) {
-        // Fetch data from API
-        fetch(url)
+        // Fetch data from API, the lang parameter is passed on
+        // as the browser language may differ from the page's.
+        // ?device=ID shows another device than the default one
+        api = url
+        if (params.has("device")) {
+            api = url.replace("/api/v1/", `/api/v1/devices/${encodeURIComponent(params.get("device"))}/`)
+        }
+        fetch(params.has("lang") ? `${api}?lang=${encodeURIComponent(lang)}` : api)
         .then((response) => {
             if (!response.ok) {
                 throw new Error(`Error fetching data: ${response.status}`)
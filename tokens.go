@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token scopes and the corresponding user roles
+var tokenScopes = map[string]string{
+	"read":    roleViewer,
+	"control": roleOperator,
+	"admin":   roleAdmin,
+}
+
+// Last used timestamps are written to disk at most this often per token
+const tokenSaveInterval = time.Minute
+
+// API token. Only the SHA-256 hash of the token is stored
+type apiToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scope    string     `json:"scope"`
+	Hash     string     `json:"hash,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires"`
+	LastUsed *time.Time `json:"last_used"`
+}
+
+// Request body for creating a token
+type tokenRequest struct {
+	Name    string `json:"name"`
+	Scope   string `json:"scope"`
+	Expires string `json:"expires"` // Duration, e.g. 720h. Empty for no expiry
+}
+
+var (
+	tokens      []*apiToken
+	tokenfile   string
+	tokenmtime  time.Time
+	tokenssaved = map[string]time.Time{}
+	tokenlock   = &sync.Mutex{}
+)
+
+// Read tokens from tokenfile if it has changed since the last read,
+// e.g. after `enervent-ctrl token create`.
+// tokenlock must be held by the caller
+func loadTokens() error {
+	info, err := os.Stat(tokenfile)
+	if errors.Is(err, os.ErrNotExist) {
+		tokens = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(tokenmtime) {
+		return nil
+	}
+	data, err := os.ReadFile(tokenfile)
+	if err != nil {
+		return err
+	}
+	loaded := []*apiToken{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("%s: %w", tokenfile, err)
+	}
+	tokens = loaded
+	tokenmtime = info.ModTime()
+	return nil
+}
+
+// Write tokens to tokenfile.
+// tokenlock must be held by the caller
+func saveTokens() error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(tokenfile, data, 0600); err != nil {
+		return err
+	}
+	if info, err := os.Stat(tokenfile); err == nil {
+		tokenmtime = info.ModTime()
+	}
+	return nil
+}
+
+// Check a bearer token, returns the user it authenticates as
+// or nil if the token is unknown or expired
+func authenticateToken(token string) *userConf {
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	tokenlock.Lock()
+	defer tokenlock.Unlock()
+	if err := loadTokens(); err != nil {
+		log.Println("ERROR: Failed to load API tokens:", err)
+		return nil
+	}
+	now := time.Now()
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) != 1 {
+			continue
+		}
+		if t.Expires != nil && now.After(*t.Expires) {
+			return nil
+		}
+		t.LastUsed = &now
+		if now.Sub(tokenssaved[t.ID]) > tokenSaveInterval {
+			tokenssaved[t.ID] = now
+			if err := saveTokens(); err != nil {
+				log.Println("ERROR: Failed to save API tokens:", err)
+			}
+		}
+		return &userConf{Username: "token:" + t.Name, Role: tokenScopes[t.Scope]}
+	}
+	return nil
+}
+
+// Create a new token, returns the token and the plain text value,
+// which isn't stored anywhere
+func createToken(name, scope string, expires time.Duration) (*apiToken, string, error) {
+	if len(name) == 0 {
+		return nil, "", fmt.Errorf("token name is required")
+	}
+	if _, ok := tokenScopes[scope]; !ok {
+		return nil, "", fmt.Errorf("invalid scope %q, expecting read, control or admin", scope)
+	}
+	if expires < 0 {
+		return nil, "", fmt.Errorf("expiry must be positive")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	value := "ect_" + hex.EncodeToString(secret)
+	sum := sha256.Sum256([]byte(value))
+	token := &apiToken{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Scope:   scope,
+		Hash:    hex.EncodeToString(sum[:]),
+		Created: time.Now().Truncate(time.Second),
+	}
+	if expires > 0 {
+		t := token.Created.Add(expires)
+		token.Expires = &t
+	}
+	tokenlock.Lock()
+	defer tokenlock.Unlock()
+	if err := loadTokens(); err != nil {
+		return nil, "", err
+	}
+	tokens = append(tokens, token)
+	if err := saveTokens(); err != nil {
+		return nil, "", err
+	}
+	return token, value, nil
+}
+
+// Revoke the token with id
+func revokeToken(id string) error {
+	tokenlock.Lock()
+	defer tokenlock.Unlock()
+	if err := loadTokens(); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(tokens, func(t *apiToken) bool { return t.ID == id })
+	if i < 0 {
+		return fmt.Errorf("token %s not found", id)
+	}
+	tokens = slices.Delete(tokens, i, i+1)
+	return saveTokens()
+}
+
+// Tokens without the hashes
+func listTokens() ([]apiToken, error) {
+	tokenlock.Lock()
+	defer tokenlock.Unlock()
+	if err := loadTokens(); err != nil {
+		return nil, err
+	}
+	list := []apiToken{}
+	for _, t := range tokens {
+		token := *t
+		token.Hash = ""
+		list = append(list, token)
+	}
+	return list, nil
+}
+
+// /api/v1/tokens endpoint, admin only
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if user := requestUser(r); user != nil && user.Role != roleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens"), "/")
+	if len(id) == 0 && r.Method == "GET" {
+		list, err := listTokens()
+		if err != nil {
+			log.Println("ERROR: tokens:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	} else if len(id) == 0 && r.Method == "POST" {
+		req := tokenRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid token request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var expires time.Duration
+		if len(req.Expires) > 0 {
+			var err error
+			if expires, err = time.ParseDuration(req.Expires); err != nil {
+				http.Error(w, "Invalid expiry: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		token, value, err := createToken(req.Name, req.Scope, expires)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("Created API token", token.ID, token.Name, "with scope", token.Scope)
+		token.Hash = ""
+		_ = json.NewEncoder(w).Encode(struct {
+			*apiToken
+			Token string `json:"token"`
+		}{token, value})
+	} else if len(id) > 0 && r.Method == "DELETE" {
+		if err := revokeToken(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Println("Revoked API token", id)
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// `enervent-ctrl token` subcommand for managing API tokens
+func tokenCommand(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: enervent-ctrl token create [-scope SCOPE] [-expires DURATION] NAME")
+		fmt.Fprintln(os.Stderr, "       enervent-ctrl token revoke ID")
+		fmt.Fprintln(os.Stderr, "       enervent-ctrl token list")
+		fmt.Fprintln(os.Stderr, "Scopes: read, control, admin")
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	flags := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	scopeflag := flags.String("scope", "read", "Scope of the token: read, control or admin")
+	expiresflag := flags.Duration("expires", 0, "Expire the token after this duration, e.g. 8760h. Default is no expiry")
+	_ = flags.Parse(args[1:])
+	parseConfigFile()
+	tokenfile = confpath + "/tokens.json"
+	switch {
+	case args[0] == "create" && flags.NArg() == 1:
+		token, value, err := createToken(flags.Arg(0), *scopeflag, *expiresflag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Created token", token.ID, "with scope", token.Scope)
+		fmt.Println(value)
+	case args[0] == "revoke" && flags.NArg() == 1:
+		if err := revokeToken(flags.Arg(0)); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Revoked token", flags.Arg(0))
+	case args[0] == "list" && flags.NArg() == 0:
+		list, err := listTokens()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, t := range list {
+			expires, lastused := "never", "never"
+			if t.Expires != nil {
+				expires = t.Expires.Format(time.RFC3339)
+			}
+			if t.LastUsed != nil {
+				lastused = t.LastUsed.Format(time.RFC3339)
+			}
+			fmt.Printf("%s %s scope=%s expires=%s last_used=%s\n", t.ID, t.Name, t.Scope, expires, lastused)
+		}
+	default:
+		usage()
+	}
+}
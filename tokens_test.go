@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	config = Conf{}
+	tokenfile = filepath.Join(t.TempDir(), "tokens.json")
+	tokenmtime = time.Time{}
+	token, value, err := createToken("homeassistant", "control", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := createToken("x", "root", 0); err == nil {
+		t.Error("expecting error for invalid scope")
+	}
+	handler := authHandlerFunc(roleOperator, func(w http.ResponseWriter, r *http.Request) {})
+	request := func(method, value string) int {
+		r := httptest.NewRequest(method, "/api/v1/mode", nil)
+		r.Header.Set("Authorization", "Bearer "+value)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+	if code := request("PUT", value); code != http.StatusOK {
+		t.Errorf("control token: status %d, expecting 200", code)
+	}
+	if code := request("PUT", value+"x"); code != http.StatusUnauthorized {
+		t.Errorf("invalid token: status %d, expecting 401", code)
+	}
+	list, err := listTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].LastUsed == nil || len(list[0].Hash) != 0 {
+		t.Errorf("unexpected token list %+v", list)
+	}
+	_, readonly, _ := createToken("prometheus", "read", time.Hour)
+	if code := request("PUT", readonly); code != http.StatusForbidden {
+		t.Errorf("read token: status %d, expecting 403", code)
+	}
+	if err := revokeToken(token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if code := request("GET", value); code != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, expecting 401", code)
+	}
+	_, expired, _ := createToken("expired", "admin", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if code := request("GET", expired); code != http.StatusUnauthorized {
+		t.Errorf("expired token: status %d, expecting 401", code)
+	}
+}